@@ -7,26 +7,101 @@
 
 // @securityDefinitions.basic  BasicAuth
 
+// @securityDefinitions.apikey  ApiKeyAuth
+// @in                          header
+// @name                        X-API-Key
+// @description                 Static api key, also accepted as "Authorization: Bearer <key>"
+
+// @securityDefinitions.apikey  BearerAuth
+// @in                          header
+// @name                        Authorization
+// @description                 "Bearer <token>" with a JWT issued by the gateway, when AUTH_MODE includes jwt
+
 package main
 
 import (
 	"context"
+	"fmt"
 	"github.com/vlasashk/user-segmentation/internal/controller/api"
 	"github.com/vlasashk/user-segmentation/internal/model/logger"
+	"github.com/vlasashk/user-segmentation/internal/model/outbox"
 	"github.com/vlasashk/user-segmentation/internal/model/storage"
+	"github.com/vlasashk/user-segmentation/internal/model/webhook"
+	"log/slog"
 	"os"
 )
 
 func main() {
 	log := logger.InitLogger()
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(context.Background(), os.Args[2:]); err != nil {
+			log.Error("Failed to migrate database", logger.Err(err))
+			os.Exit(1)
+		}
+		return
+	}
 	log.Info("Starting application")
-	db, err := storage.New(context.Background())
+	db, err := newStorage(context.Background())
 	if err != nil {
 		log.Error("Failed to initialize storage", logger.Err(err))
 		os.Exit(1)
 	}
-	log.Info("Database successfully initialized")
+	log.Info("Database successfully initialized", slog.String("driver", os.Getenv("DB_DRIVER")))
 	defer db.Close()
-	server := api.NewAPIServer(os.Getenv("PORT"), db, log)
+	webhookConfig, err := webhook.ConfigFromEnv()
+	if err != nil {
+		log.Error("Failed to configure webhook delivery", logger.Err(err))
+		os.Exit(1)
+	}
+	go webhook.NewWorker(db, log, webhookConfig).Run(context.Background())
+	sink, err := outbox.SinkFromEnv()
+	if err != nil {
+		log.Error("Failed to configure outbox sink", logger.Err(err))
+		os.Exit(1)
+	}
+	outboxConfig, err := outbox.ConfigFromEnv()
+	if err != nil {
+		log.Error("Failed to configure outbox", logger.Err(err))
+		os.Exit(1)
+	}
+	// Without a relay nothing publishes events, so they are pruned once they are past the retention anyway.
+	outboxConfig.PruneUnpublished = sink == nil
+	go outbox.NewPruner(db, log, outboxConfig).Run(context.Background())
+	if sink != nil {
+		go outbox.NewRelay(db, sink, log, outboxConfig).Run(context.Background())
+		log.Info("Outbox relay enabled", slog.String("sink", os.Getenv("OUTBOX_SINK")))
+	}
+	server, err := api.NewAPIServer(os.Getenv("PORT"), db, log)
+	if err != nil {
+		log.Error("Failed to initialize api server", logger.Err(err))
+		os.Exit(1)
+	}
+	go server.RunIdempotencyPruner(context.Background())
+	if port := os.Getenv("GRPC_PORT"); port != "" {
+		go api.RunGRPC(log, api.NewGRPCServer(server), port)
+		log.Info("gRPC API enabled", slog.String("port", port))
+	}
 	api.Run(log, server)
 }
+
+// backend is implemented by every storage.
+type backend interface {
+	api.Storage
+	webhook.Store
+	outbox.Store
+	Close()
+}
+
+// newStorage opens the storage selected by DB_DRIVER: "postgres", the default, "sqlite" or "memory".
+func newStorage(ctx context.Context) (backend, error) {
+	switch driver := os.Getenv("DB_DRIVER"); driver {
+	case "", "postgres":
+		return storage.New(ctx)
+	case "sqlite":
+		return storage.NewSQLite(ctx)
+	case "memory":
+		return storage.NewMemoryDB(), nil
+	default:
+		return nil, fmt.Errorf("unknown DB_DRIVER %q", driver)
+	}
+}
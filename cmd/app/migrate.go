@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/vlasashk/user-segmentation/internal/model/storage"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+const migrateUsage = "usage: app migrate up | down [steps] | status"
+
+// migrator is implemented by every storage with a schema.
+type migrator interface {
+	MigrateUp(ctx context.Context) ([]storage.Migration, error)
+	MigrateDown(ctx context.Context, steps int) ([]storage.Migration, error)
+	MigrationStatus(ctx context.Context) ([]storage.MigrationStatus, error)
+	Close()
+}
+
+// newMigrator connects to the storage selected by DB_DRIVER without migrating it.
+func newMigrator(ctx context.Context) (migrator, error) {
+	switch driver := os.Getenv("DB_DRIVER"); driver {
+	case "", "postgres":
+		return storage.Connect(ctx)
+	case "sqlite":
+		return storage.ConnectSQLite(ctx)
+	case "memory":
+		return nil, fmt.Errorf("memory storage has no schema to migrate")
+	default:
+		return nil, fmt.Errorf("unknown DB_DRIVER %q", driver)
+	}
+}
+
+// runMigrate handles "app migrate up", "app migrate down [steps]" (one step by default) and "app migrate status".
+func runMigrate(ctx context.Context, args []string) error {
+	if len(args) == 0 || len(args) > 2 || (len(args) == 2 && args[0] != "down") {
+		return fmt.Errorf(migrateUsage)
+	}
+	steps := 1
+	if len(args) == 2 {
+		var err error
+		if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+			return fmt.Errorf("steps must be a positive number")
+		}
+	}
+	db, err := newMigrator(ctx)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	switch args[0] {
+	case "up":
+		applied, err := db.MigrateUp(ctx)
+		if err != nil {
+			return err
+		}
+		printMigrations("applied", applied)
+	case "down":
+		rolledBack, err := db.MigrateDown(ctx, steps)
+		if err != nil {
+			return err
+		}
+		printMigrations("rolled back", rolledBack)
+	case "status":
+		status, err := db.MigrationStatus(ctx)
+		if err != nil {
+			return err
+		}
+		printMigrationStatus(status)
+	default:
+		return fmt.Errorf(migrateUsage)
+	}
+	return nil
+}
+
+func printMigrations(action string, migrations []storage.Migration) {
+	if len(migrations) == 0 {
+		fmt.Println("no migrations to run")
+		return
+	}
+	for _, migration := range migrations {
+		fmt.Printf("%s %04d_%s\n", action, migration.Version, migration.Name)
+	}
+}
+
+func printMigrationStatus(status []storage.MigrationStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+	for _, migration := range status {
+		name, appliedAt := migration.Name, "pending"
+		if name == "" {
+			name = "(missing)"
+		}
+		if migration.AppliedAt != nil {
+			appliedAt = migration.AppliedAt.UTC().Format(time.RFC3339)
+		}
+		_, _ = fmt.Fprintf(w, "%04d\t%s\t%s\n", migration.Version, name, appliedAt)
+	}
+	_ = w.Flush()
+}
@@ -15,8 +15,113 @@ const docTemplate = `{
     "host": "{{.Host}}",
     "basePath": "{{.BasePath}}",
     "paths": {
+        "/events": {
+            "get": {
+                "security": [
+                    {
+                        "BasicAuth": []
+                    },
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Stream membership changes and segment deletions as Server-Sent Events, optionally only those of a user\nor a segment. Every event carries its seq as the SSE id: a reconnecting client sends it back in\nLast-Event-ID (or the last_event_id query parameter) and gets the events it missed. Without it\nthe stream starts with the next change.",
+                "produces": [
+                    "text/event-stream"
+                ],
+                "tags": [
+                    "events"
+                ],
+                "summary": "Stream membership changes",
+                "operationId": "events",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Only events of the user",
+                        "name": "user_id",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "Only events of the segment",
+                        "name": "segment",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Resume after the event with this seq",
+                        "name": "last_event_id",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Resume after the event with this seq",
+                        "name": "Last-Event-ID",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Stream of events, data of each one is the json event",
+                        "schema": {
+                            "$ref": "#/definitions/github_com_vlasashk_user-segmentation_internal_model_storage.OutboxEvent"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid input data",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Authentication required",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Insufficient role",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Query execution failure",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "503": {
+                        "description": "Database is unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "504": {
+                        "description": "Query timed out",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    }
+                }
+            }
+        },
         "/report": {
             "post": {
+                "security": [
+                    {
+                        "BasicAuth": []
+                    },
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
                 "description": "Generate a CSV report for a specific month and year",
                 "consumes": [
                     "application/json"
@@ -24,8 +129,12 @@ const docTemplate = `{
                 "produces": [
                     "application/json"
                 ],
+                "tags": [
+                    "legacy"
+                ],
                 "summary": "Generate CSV report",
                 "operationId": "generateCsvReport",
+                "deprecated": true,
                 "parameters": [
                     {
                         "description": "CSV report request",
@@ -35,6 +144,12 @@ const docTemplate = `{
                         "schema": {
                             "$ref": "#/definitions/internal_controller_api.CsvReportRequest"
                         }
+                    },
+                    {
+                        "type": "string",
+                        "description": "Key making retries of the request safe",
+                        "name": "Idempotency-Key",
+                        "in": "header"
                     }
                 ],
                 "responses": {
@@ -47,33 +162,86 @@ const docTemplate = `{
                     "400": {
                         "description": "Invalid input data",
                         "schema": {
-                            "$ref": "#/definitions/internal_controller_api.ResponseStatus"
+                            "$ref": "#/definitions/internal_controller_api.Problem"
                         }
                     },
-                    "409": {
+                    "401": {
+                        "description": "Authentication required",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Insufficient role",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "500": {
                         "description": "Query execution failure",
                         "schema": {
-                            "$ref": "#/definitions/internal_controller_api.ResponseStatus"
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "503": {
+                        "description": "Database is unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "504": {
+                        "description": "Query timed out",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
                         }
                     }
                 }
             }
         },
-        "/report/{fileName}": {
+        "/report/{reportID}": {
             "get": {
-                "description": "Download a previously generated CSV report",
+                "security": [
+                    {
+                        "BasicAuth": []
+                    },
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Download a previously generated CSV report using the signed link returned by report generation",
                 "produces": [
                     "text/csv"
                 ],
+                "tags": [
+                    "legacy"
+                ],
                 "summary": "Download CSV report",
                 "operationId": "downloadCsvReport",
+                "deprecated": true,
                 "parameters": [
                     {
                         "type": "string",
-                        "description": "CSV file name to download",
-                        "name": "fileName",
+                        "description": "Report ID to download",
+                        "name": "reportID",
                         "in": "path",
                         "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Link expiration as unix timestamp",
+                        "name": "expires",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Link signature",
+                        "name": "signature",
+                        "in": "query",
+                        "required": true
                     }
                 ],
                 "responses": {
@@ -84,9 +252,27 @@ const docTemplate = `{
                         }
                     },
                     "400": {
-                        "description": "Invalid file name",
+                        "description": "Invalid report ID",
                         "schema": {
-                            "$ref": "#/definitions/internal_controller_api.ResponseStatus"
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Authentication required",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Invalid or expired link, or insufficient role",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Report doesn't exist",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
                         }
                     }
                 }
@@ -94,15 +280,30 @@ const docTemplate = `{
         },
         "/segment/new": {
             "post": {
-                "description": "Add a new segment to the system",
+                "security": [
+                    {
+                        "BasicAuth": []
+                    },
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Add a new segment to the system. The segment is owned by the caller's team,\nonly admins may set owner_team explicitly",
                 "consumes": [
                     "application/json"
                 ],
                 "produces": [
                     "application/json"
                 ],
+                "tags": [
+                    "legacy"
+                ],
                 "summary": "Add a new segment",
                 "operationId": "addSegment",
+                "deprecated": true,
                 "parameters": [
                     {
                         "description": "Segment object to be added",
@@ -112,6 +313,12 @@ const docTemplate = `{
                         "schema": {
                             "$ref": "#/definitions/internal_controller_api.SegmentRequest"
                         }
+                    },
+                    {
+                        "type": "string",
+                        "description": "Key making retries of the request safe",
+                        "name": "Idempotency-Key",
+                        "in": "header"
                     }
                 ],
                 "responses": {
@@ -124,13 +331,43 @@ const docTemplate = `{
                     "400": {
                         "description": "Invalid input data",
                         "schema": {
-                            "$ref": "#/definitions/internal_controller_api.ResponseStatus"
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Authentication required",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Insufficient role or segment owned by another team",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
                         }
                     },
                     "409": {
+                        "description": "Segment already exists",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "500": {
                         "description": "Query execution failure",
                         "schema": {
-                            "$ref": "#/definitions/internal_controller_api.ResponseStatus"
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "503": {
+                        "description": "Database is unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "504": {
+                        "description": "Query timed out",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
                         }
                     }
                 }
@@ -138,6 +375,17 @@ const docTemplate = `{
         },
         "/segment/remove": {
             "delete": {
+                "security": [
+                    {
+                        "BasicAuth": []
+                    },
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
                 "description": "Cascade delete a segment and remove associated users",
                 "consumes": [
                     "application/json"
@@ -145,8 +393,12 @@ const docTemplate = `{
                 "produces": [
                     "application/json"
                 ],
+                "tags": [
+                    "legacy"
+                ],
                 "summary": "Cascade delete a segment",
                 "operationId": "cascadeDeleteSegment",
+                "deprecated": true,
                 "parameters": [
                     {
                         "description": "Segment object to delete",
@@ -156,6 +408,12 @@ const docTemplate = `{
                         "schema": {
                             "$ref": "#/definitions/internal_controller_api.SegmentRequest"
                         }
+                    },
+                    {
+                        "type": "string",
+                        "description": "Key making retries of the request safe",
+                        "name": "Idempotency-Key",
+                        "in": "header"
                     }
                 ],
                 "responses": {
@@ -168,13 +426,43 @@ const docTemplate = `{
                     "400": {
                         "description": "Invalid input data",
                         "schema": {
-                            "$ref": "#/definitions/internal_controller_api.ResponseStatus"
+                            "$ref": "#/definitions/internal_controller_api.Problem"
                         }
                     },
-                    "409": {
+                    "401": {
+                        "description": "Authentication required",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Insufficient role or segment owned by another team",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Segment doesn't exist",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "500": {
                         "description": "Query execution failure",
                         "schema": {
-                            "$ref": "#/definitions/internal_controller_api.ResponseStatus"
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "503": {
+                        "description": "Database is unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "504": {
+                        "description": "Query timed out",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
                         }
                     }
                 }
@@ -182,12 +470,27 @@ const docTemplate = `{
         },
         "/segment/users/{segmentName}": {
             "get": {
+                "security": [
+                    {
+                        "BasicAuth": []
+                    },
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
                 "description": "Get a list of users belonging to a specific segment",
                 "produces": [
                     "application/json"
                 ],
+                "tags": [
+                    "legacy"
+                ],
                 "summary": "Get users of a segment",
                 "operationId": "getSegmentUsersInfo",
+                "deprecated": true,
                 "parameters": [
                     {
                         "type": "string",
@@ -207,13 +510,43 @@ const docTemplate = `{
                     "400": {
                         "description": "Invalid input data",
                         "schema": {
-                            "$ref": "#/definitions/internal_controller_api.ResponseStatus"
+                            "$ref": "#/definitions/internal_controller_api.Problem"
                         }
                     },
-                    "409": {
+                    "401": {
+                        "description": "Authentication required",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Insufficient role",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Segment doesn't exist",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "500": {
                         "description": "Query execution failure",
                         "schema": {
-                            "$ref": "#/definitions/internal_controller_api.ResponseStatus"
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "503": {
+                        "description": "Database is unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "504": {
+                        "description": "Query timed out",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
                         }
                     }
                 }
@@ -221,6 +554,17 @@ const docTemplate = `{
         },
         "/user/addSegment": {
             "post": {
+                "security": [
+                    {
+                        "BasicAuth": []
+                    },
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
                 "description": "Link user to segments",
                 "consumes": [
                     "application/json"
@@ -228,8 +572,12 @@ const docTemplate = `{
                 "produces": [
                     "application/json"
                 ],
+                "tags": [
+                    "legacy"
+                ],
                 "summary": "Add user ti a segment",
                 "operationId": "addUserToSegment",
+                "deprecated": true,
                 "parameters": [
                     {
                         "description": "Segment object to be added",
@@ -239,6 +587,12 @@ const docTemplate = `{
                         "schema": {
                             "$ref": "#/definitions/internal_controller_api.UserSegmentRequest"
                         }
+                    },
+                    {
+                        "type": "string",
+                        "description": "Key making retries of the request safe",
+                        "name": "Idempotency-Key",
+                        "in": "header"
                     }
                 ],
                 "responses": {
@@ -251,13 +605,49 @@ const docTemplate = `{
                     "400": {
                         "description": "Invalid input data",
                         "schema": {
-                            "$ref": "#/definitions/internal_controller_api.ResponseStatus"
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Authentication required",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Insufficient role or segment owned by another team",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "User or segment doesn't exist",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
                         }
                     },
                     "409": {
+                        "description": "User is already part of a segment",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "500": {
                         "description": "Query execution failure",
                         "schema": {
-                            "$ref": "#/definitions/internal_controller_api.ResponseStatus"
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "503": {
+                        "description": "Database is unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "504": {
+                        "description": "Query timed out",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
                         }
                     }
                 }
@@ -265,6 +655,17 @@ const docTemplate = `{
         },
         "/user/new": {
             "post": {
+                "security": [
+                    {
+                        "BasicAuth": []
+                    },
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
                 "description": "Add a new user to the system",
                 "consumes": [
                     "application/json"
@@ -272,8 +673,12 @@ const docTemplate = `{
                 "produces": [
                     "application/json"
                 ],
+                "tags": [
+                    "legacy"
+                ],
                 "summary": "Add a new user",
                 "operationId": "addUser",
+                "deprecated": true,
                 "parameters": [
                     {
                         "description": "User object to be added",
@@ -283,6 +688,12 @@ const docTemplate = `{
                         "schema": {
                             "$ref": "#/definitions/internal_controller_api.UserRequest"
                         }
+                    },
+                    {
+                        "type": "string",
+                        "description": "Key making retries of the request safe",
+                        "name": "Idempotency-Key",
+                        "in": "header"
                     }
                 ],
                 "responses": {
@@ -295,13 +706,43 @@ const docTemplate = `{
                     "400": {
                         "description": "Invalid input data",
                         "schema": {
-                            "$ref": "#/definitions/internal_controller_api.ResponseStatus"
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Authentication required",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Insufficient role",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
                         }
                     },
                     "409": {
+                        "description": "User already exists",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "500": {
                         "description": "Query execution failure",
                         "schema": {
-                            "$ref": "#/definitions/internal_controller_api.ResponseStatus"
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "503": {
+                        "description": "Database is unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "504": {
+                        "description": "Query timed out",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
                         }
                     }
                 }
@@ -309,6 +750,17 @@ const docTemplate = `{
         },
         "/user/segments": {
             "delete": {
+                "security": [
+                    {
+                        "BasicAuth": []
+                    },
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
                 "description": "Remove a user from one or more segments",
                 "consumes": [
                     "application/json"
@@ -316,8 +768,12 @@ const docTemplate = `{
                 "produces": [
                     "application/json"
                 ],
+                "tags": [
+                    "legacy"
+                ],
                 "summary": "Remove a user from one or more segments",
                 "operationId": "deleteUserFromSegment",
+                "deprecated": true,
                 "parameters": [
                     {
                         "description": "User and segment association",
@@ -327,6 +783,12 @@ const docTemplate = `{
                         "schema": {
                             "$ref": "#/definitions/internal_controller_api.UserSegmentRequest"
                         }
+                    },
+                    {
+                        "type": "string",
+                        "description": "Key making retries of the request safe",
+                        "name": "Idempotency-Key",
+                        "in": "header"
                     }
                 ],
                 "responses": {
@@ -339,13 +801,138 @@ const docTemplate = `{
                     "400": {
                         "description": "Invalid input data",
                         "schema": {
-                            "$ref": "#/definitions/internal_controller_api.ResponseStatus"
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Authentication required",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Insufficient role or segment owned by another team",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "User or segment doesn't exist",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
                         }
                     },
                     "409": {
+                        "description": "User is not part of a segment",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "500": {
                         "description": "Query execution failure",
                         "schema": {
-                            "$ref": "#/definitions/internal_controller_api.ResponseStatus"
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "503": {
+                        "description": "Database is unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "504": {
+                        "description": "Query timed out",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/user/segments/batch": {
+            "post": {
+                "security": [
+                    {
+                        "BasicAuth": []
+                    },
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Get the segments of each of the listed users in one request. Users that don't exist are left out of the result",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "legacy"
+                ],
+                "summary": "Get segments of many users",
+                "operationId": "getUsersSegmentsInfo",
+                "deprecated": true,
+                "parameters": [
+                    {
+                        "description": "User IDs to get lists of segments for",
+                        "name": "users",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.UsersBatchRequest"
+                        }
+                    },
+                    {
+                        "type": "string",
+                        "description": "Key making retries of the request safe",
+                        "name": "Idempotency-Key",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Successfully retrieved users segments",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.GetUsersSegmentsResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid input data",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Authentication required",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Insufficient role",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Query execution failure",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "503": {
+                        "description": "Database is unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "504": {
+                        "description": "Query timed out",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
                         }
                     }
                 }
@@ -353,12 +940,27 @@ const docTemplate = `{
         },
         "/user/segments/{userID}": {
             "get": {
+                "security": [
+                    {
+                        "BasicAuth": []
+                    },
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
                 "description": "Get information about the segments a user belongs to",
                 "produces": [
                     "application/json"
                 ],
+                "tags": [
+                    "legacy"
+                ],
                 "summary": "Get user's segments information",
                 "operationId": "getUserSegmentsInfo",
+                "deprecated": true,
                 "parameters": [
                     {
                         "type": "string",
@@ -367,31 +969,1769 @@ const docTemplate = `{
                         "in": "path",
                         "required": true
                     }
-                ],
-                "responses": {
-                    "200": {
-                        "description": "Successfully retrieved user segments",
-                        "schema": {
-                            "$ref": "#/definitions/internal_controller_api.GetSegmentsResponse"
-                        }
-                    },
-                    "400": {
-                        "description": "Invalid input data",
-                        "schema": {
-                            "$ref": "#/definitions/internal_controller_api.ResponseStatus"
-                        }
-                    },
-                    "409": {
-                        "description": "Query execution failure",
-                        "schema": {
-                            "$ref": "#/definitions/internal_controller_api.ResponseStatus"
-                        }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Successfully retrieved user segments",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.GetSegmentsResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid input data",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Authentication required",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Insufficient role",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "User doesn't exist",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Query execution failure",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "503": {
+                        "description": "Database is unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "504": {
+                        "description": "Query timed out",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/user/{userID}/segments/{slug}": {
+            "get": {
+                "security": [
+                    {
+                        "BasicAuth": []
+                    },
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Check whether a user is a member of a segment and since when",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "legacy"
+                ],
+                "summary": "Check user's membership in a segment",
+                "operationId": "getMembership",
+                "deprecated": true,
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "User ID",
+                        "name": "userID",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Segment slug",
+                        "name": "slug",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Successfully checked membership",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.MembershipResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid input data",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Authentication required",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Insufficient role",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "User or segment doesn't exist",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Query execution failure",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "503": {
+                        "description": "Database is unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "504": {
+                        "description": "Query timed out",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/v1/reports": {
+            "post": {
+                "security": [
+                    {
+                        "BasicAuth": []
+                    },
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Generate a CSV report for a specific month and year and return a signed link to download it",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "v1"
+                ],
+                "summary": "Generate CSV report",
+                "operationId": "v1GenerateCsvReport",
+                "parameters": [
+                    {
+                        "description": "CSV report request",
+                        "name": "csvReport",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.CsvReportRequest"
+                        }
+                    },
+                    {
+                        "type": "string",
+                        "description": "Key making retries of the request safe",
+                        "name": "Idempotency-Key",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Successfully generated CSV report",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.CsvReportResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid input data",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Authentication required",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Insufficient role",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Query execution failure",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "503": {
+                        "description": "Database is unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "504": {
+                        "description": "Query timed out",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/v1/reports/{reportID}": {
+            "get": {
+                "security": [
+                    {
+                        "BasicAuth": []
+                    },
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Download a previously generated CSV report using the signed link returned by report generation",
+                "produces": [
+                    "text/csv"
+                ],
+                "tags": [
+                    "v1"
+                ],
+                "summary": "Download CSV report",
+                "operationId": "v1DownloadCsvReport",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Report ID to download",
+                        "name": "reportID",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Link expiration as unix timestamp",
+                        "name": "expires",
+                        "in": "query",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Link signature",
+                        "name": "signature",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "CSV file for download",
+                        "schema": {
+                            "type": "file"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid report ID",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Authentication required",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Invalid or expired link, or insufficient role",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Report doesn't exist",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/v1/segments": {
+            "post": {
+                "security": [
+                    {
+                        "BasicAuth": []
+                    },
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Add a new segment to the system. The segment is owned by the caller's team,\nonly admins may set owner_team explicitly",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "v1"
+                ],
+                "summary": "Add a new segment",
+                "operationId": "v1AddSegment",
+                "parameters": [
+                    {
+                        "description": "Segment object to be added",
+                        "name": "segment",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.SegmentRequest"
+                        }
+                    },
+                    {
+                        "type": "string",
+                        "description": "Key making retries of the request safe",
+                        "name": "Idempotency-Key",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Successfully added segment",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.SegmentResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid input data",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Authentication required",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Insufficient role or segment owned by another team",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "409": {
+                        "description": "Segment already exists",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Query execution failure",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "503": {
+                        "description": "Database is unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "504": {
+                        "description": "Query timed out",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/v1/segments/{slug}": {
+            "delete": {
+                "security": [
+                    {
+                        "BasicAuth": []
+                    },
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Cascade delete a segment and remove associated users",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "v1"
+                ],
+                "summary": "Cascade delete a segment",
+                "operationId": "v1DeleteSegment",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Segment slug",
+                        "name": "slug",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Key making retries of the request safe",
+                        "name": "Idempotency-Key",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Successfully deleted segment",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.SegmentResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid input data",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Authentication required",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Insufficient role or segment owned by another team",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Segment doesn't exist",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Query execution failure",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "503": {
+                        "description": "Database is unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "504": {
+                        "description": "Query timed out",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/v1/segments/{slug}/users": {
+            "get": {
+                "security": [
+                    {
+                        "BasicAuth": []
+                    },
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Get a list of users belonging to a specific segment",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "v1"
+                ],
+                "summary": "Get users of a segment",
+                "operationId": "v1GetSegmentUsers",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Segment slug",
+                        "name": "slug",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Successfully retrieved segment users",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.GetUsersResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid input data",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Authentication required",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Insufficient role",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Segment doesn't exist",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Query execution failure",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "503": {
+                        "description": "Database is unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "504": {
+                        "description": "Query timed out",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/v1/users": {
+            "post": {
+                "security": [
+                    {
+                        "BasicAuth": []
+                    },
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Add a new user to the system",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "v1"
+                ],
+                "summary": "Add a new user",
+                "operationId": "v1AddUser",
+                "parameters": [
+                    {
+                        "description": "User object to be added",
+                        "name": "user",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.UserRequest"
+                        }
+                    },
+                    {
+                        "type": "string",
+                        "description": "Key making retries of the request safe",
+                        "name": "Idempotency-Key",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Successfully added user",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.UserResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid input data",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Authentication required",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Insufficient role",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "409": {
+                        "description": "User already exists",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Query execution failure",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "503": {
+                        "description": "Database is unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "504": {
+                        "description": "Query timed out",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/v1/users/segments/batch": {
+            "post": {
+                "security": [
+                    {
+                        "BasicAuth": []
+                    },
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Get the segments of each of the listed users in one request. Users that don't exist are left out of the result",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "v1"
+                ],
+                "summary": "Get segments of many users",
+                "operationId": "v1GetUsersSegments",
+                "parameters": [
+                    {
+                        "description": "User IDs to get lists of segments for",
+                        "name": "users",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.UsersBatchRequest"
+                        }
+                    },
+                    {
+                        "type": "string",
+                        "description": "Key making retries of the request safe",
+                        "name": "Idempotency-Key",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Successfully retrieved users segments",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.GetUsersSegmentsResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid input data",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Authentication required",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Insufficient role",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Query execution failure",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "503": {
+                        "description": "Database is unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "504": {
+                        "description": "Query timed out",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/v1/users/{userID}/memberships": {
+            "get": {
+                "security": [
+                    {
+                        "BasicAuth": []
+                    },
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Check whether a user is a member of each of the listed segments and since when",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "v1"
+                ],
+                "summary": "Check user's membership in several segments",
+                "operationId": "v1GetUserMemberships",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "User ID",
+                        "name": "userID",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "array",
+                        "items": {
+                            "type": "string"
+                        },
+                        "collectionFormat": "multi",
+                        "description": "Segment slugs",
+                        "name": "slug",
+                        "in": "query",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Successfully checked memberships",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.MembershipsResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid input data",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Authentication required",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Insufficient role",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "User or segment doesn't exist",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Query execution failure",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "503": {
+                        "description": "Database is unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "504": {
+                        "description": "Query timed out",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/v1/users/{userID}/segments": {
+            "get": {
+                "security": [
+                    {
+                        "BasicAuth": []
+                    },
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Get information about the segments a user belongs to",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "v1"
+                ],
+                "summary": "Get user's segments information",
+                "operationId": "v1GetUserSegments",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "User ID",
+                        "name": "userID",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Successfully retrieved user segments",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.GetSegmentsResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid input data",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Authentication required",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Insufficient role",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "User doesn't exist",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Query execution failure",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "503": {
+                        "description": "Database is unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "504": {
+                        "description": "Query timed out",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    }
+                }
+            },
+            "post": {
+                "security": [
+                    {
+                        "BasicAuth": []
+                    },
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Add user to all listed segments, none of them are added if any of them fails",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "v1"
+                ],
+                "summary": "Add user to segments",
+                "operationId": "v1AddUserToSegments",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "User ID",
+                        "name": "userID",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Segments to add the user to",
+                        "name": "segments",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.SegmentListRequest"
+                        }
+                    },
+                    {
+                        "type": "string",
+                        "description": "Key making retries of the request safe",
+                        "name": "Idempotency-Key",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Successfully linked segments to a user",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.UserSegmentResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid input data",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Authentication required",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Insufficient role or segment owned by another team",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "User or segment doesn't exist",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "409": {
+                        "description": "User is already part of a segment",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Query execution failure",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "503": {
+                        "description": "Database is unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "504": {
+                        "description": "Query timed out",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/v1/users/{userID}/segments/{slug}": {
+            "get": {
+                "security": [
+                    {
+                        "BasicAuth": []
+                    },
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Check whether a user is a member of a segment and since when",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "v1"
+                ],
+                "summary": "Check user's membership in a segment",
+                "operationId": "v1GetUserSegment",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "User ID",
+                        "name": "userID",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Segment slug",
+                        "name": "slug",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Successfully checked membership",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.MembershipResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid input data",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Authentication required",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Insufficient role",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "User or segment doesn't exist",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Query execution failure",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "503": {
+                        "description": "Database is unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "504": {
+                        "description": "Query timed out",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    }
+                }
+            },
+            "put": {
+                "security": [
+                    {
+                        "BasicAuth": []
+                    },
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Make user a member of the segment. Repeating the request for a member succeeds without changes",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "v1"
+                ],
+                "summary": "Add user to a segment",
+                "operationId": "v1PutUserSegment",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "User ID",
+                        "name": "userID",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Segment slug",
+                        "name": "slug",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Key making retries of the request safe",
+                        "name": "Idempotency-Key",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "User is a member of the segment",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.UserSegmentResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid input data",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Authentication required",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Insufficient role or segment owned by another team",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "User or segment doesn't exist",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Query execution failure",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "503": {
+                        "description": "Database is unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "504": {
+                        "description": "Query timed out",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    }
+                }
+            },
+            "delete": {
+                "security": [
+                    {
+                        "BasicAuth": []
+                    },
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Remove user from the segment by marking deleted_at field",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "v1"
+                ],
+                "summary": "Remove user from a segment",
+                "operationId": "v1DeleteUserSegment",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "User ID",
+                        "name": "userID",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Segment slug",
+                        "name": "slug",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Key making retries of the request safe",
+                        "name": "Idempotency-Key",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Successfully removed user from segment",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.UserSegmentResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid input data",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Authentication required",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Insufficient role or segment owned by another team",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "User or segment doesn't exist",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "409": {
+                        "description": "User is not part of the segment",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Query execution failure",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "503": {
+                        "description": "Database is unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "504": {
+                        "description": "Query timed out",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/v1/webhooks": {
+            "get": {
+                "security": [
+                    {
+                        "BasicAuth": []
+                    },
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "List all webhook subscriptions, secrets are not returned",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "webhooks"
+                ],
+                "summary": "List webhook subscriptions",
+                "operationId": "v1GetWebhooks",
+                "responses": {
+                    "200": {
+                        "description": "Successfully retrieved subscriptions",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.WebhookSubscriptionsResponse"
+                        }
+                    },
+                    "401": {
+                        "description": "Authentication required",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Insufficient role",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Query execution failure",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "503": {
+                        "description": "Database is unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "504": {
+                        "description": "Query timed out",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    }
+                }
+            },
+            "post": {
+                "security": [
+                    {
+                        "BasicAuth": []
+                    },
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Register a URL receiving HMAC-signed membership events. Empty events or segments match everything",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "webhooks"
+                ],
+                "summary": "Subscribe to membership events",
+                "operationId": "v1AddWebhook",
+                "parameters": [
+                    {
+                        "description": "Subscription to add",
+                        "name": "subscription",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.WebhookSubscriptionRequest"
+                        }
+                    },
+                    {
+                        "type": "string",
+                        "description": "Key making retries of the request safe",
+                        "name": "Idempotency-Key",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Successfully added subscription",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.WebhookSubscriptionResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid input data",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Authentication required",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Insufficient role",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Query execution failure",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "503": {
+                        "description": "Database is unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "504": {
+                        "description": "Query timed out",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/v1/webhooks/{subscriptionID}": {
+            "delete": {
+                "security": [
+                    {
+                        "BasicAuth": []
+                    },
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "Delete a webhook subscription together with its pending deliveries and dead letters",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "webhooks"
+                ],
+                "summary": "Delete a webhook subscription",
+                "operationId": "v1DeleteWebhook",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Subscription ID",
+                        "name": "subscriptionID",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "Key making retries of the request safe",
+                        "name": "Idempotency-Key",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Successfully deleted subscription",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.ResponseStatus"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid input data",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Authentication required",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Insufficient role",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Subscription doesn't exist",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Query execution failure",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "503": {
+                        "description": "Database is unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "504": {
+                        "description": "Query timed out",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    }
+                }
+            }
+        },
+        "/v1/webhooks/{subscriptionID}/dead-letters": {
+            "get": {
+                "security": [
+                    {
+                        "BasicAuth": []
+                    },
+                    {
+                        "ApiKeyAuth": []
+                    },
+                    {
+                        "BearerAuth": []
+                    }
+                ],
+                "description": "List the latest deliveries to a subscription that were given up after running out of attempts",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "webhooks"
+                ],
+                "summary": "List failed webhook deliveries",
+                "operationId": "v1GetWebhookDeadLetters",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Subscription ID",
+                        "name": "subscriptionID",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Successfully retrieved dead letters",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.WebhookDeadLettersResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid input data",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "401": {
+                        "description": "Authentication required",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "403": {
+                        "description": "Insufficient role",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "404": {
+                        "description": "Subscription doesn't exist",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "500": {
+                        "description": "Query execution failure",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "503": {
+                        "description": "Database is unavailable",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    },
+                    "504": {
+                        "description": "Query timed out",
+                        "schema": {
+                            "$ref": "#/definitions/internal_controller_api.Problem"
+                        }
+                    }
+                }
+            }
+        }
+    },
+    "definitions": {
+        "github_com_vlasashk_user-segmentation_internal_model_storage.Membership": {
+            "type": "object",
+            "properties": {
+                "added_at": {
+                    "type": "string"
+                },
+                "member": {
+                    "type": "boolean"
+                },
+                "removed_at": {
+                    "type": "string"
+                },
+                "slug": {
+                    "type": "string"
+                }
+            }
+        },
+        "github_com_vlasashk_user-segmentation_internal_model_storage.OutboxEvent": {
+            "type": "object",
+            "properties": {
+                "id": {
+                    "type": "string"
+                },
+                "occurred_at": {
+                    "type": "string"
+                },
+                "segment": {
+                    "type": "string"
+                },
+                "seq": {
+                    "type": "integer"
+                },
+                "type": {
+                    "type": "string"
+                },
+                "user_id": {
+                    "type": "integer"
+                }
+            }
+        },
+        "github_com_vlasashk_user-segmentation_internal_model_storage.SegmentOutcome": {
+            "type": "object",
+            "properties": {
+                "outcome": {
+                    "type": "string"
+                },
+                "slug": {
+                    "type": "string"
+                }
+            }
+        },
+        "github_com_vlasashk_user-segmentation_internal_model_storage.WebhookDeadLetter": {
+            "type": "object",
+            "properties": {
+                "attempts": {
+                    "type": "integer"
+                },
+                "event_id": {
+                    "type": "string"
+                },
+                "failed_at": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "last_error": {
+                    "type": "string"
+                },
+                "payload": {
+                    "type": "object"
+                },
+                "subscription_id": {
+                    "type": "integer"
+                }
+            }
+        },
+        "github_com_vlasashk_user-segmentation_internal_model_storage.WebhookSubscription": {
+            "type": "object",
+            "required": [
+                "secret",
+                "url"
+            ],
+            "properties": {
+                "created_at": {
+                    "type": "string"
+                },
+                "events": {
+                    "type": "array",
+                    "uniqueItems": true,
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "secret": {
+                    "type": "string",
+                    "maxLength": 255,
+                    "minLength": 16
+                },
+                "segments": {
+                    "type": "array",
+                    "maxItems": 100,
+                    "uniqueItems": true,
+                    "items": {
+                        "type": "string"
                     }
+                },
+                "url": {
+                    "type": "string",
+                    "maxLength": 2048
                 }
             }
-        }
-    },
-    "definitions": {
+        },
         "internal_controller_api.CsvReportRequest": {
             "type": "object",
             "required": [
@@ -400,23 +2740,36 @@ const docTemplate = `{
             ],
             "properties": {
                 "month": {
-                    "$ref": "#/definitions/time.Month"
+                    "maximum": 12,
+                    "minimum": 1,
+                    "allOf": [
+                        {
+                            "$ref": "#/definitions/time.Month"
+                        }
+                    ]
                 },
                 "year": {
-                    "type": "integer"
+                    "type": "integer",
+                    "maximum": 9999,
+                    "minimum": 2000
                 }
             }
         },
         "internal_controller_api.CsvReportResponse": {
             "type": "object",
             "required": [
-                "csv_url"
+                "csv_url",
+                "expires_at",
+                "report_id"
             ],
             "properties": {
                 "csv_url": {
                     "type": "string"
                 },
-                "error": {
+                "expires_at": {
+                    "type": "string"
+                },
+                "report_id": {
                     "type": "string"
                 },
                 "status": {
@@ -424,6 +2777,20 @@ const docTemplate = `{
                 }
             }
         },
+        "internal_controller_api.FieldError": {
+            "type": "object",
+            "properties": {
+                "field": {
+                    "type": "string"
+                },
+                "message": {
+                    "type": "string"
+                },
+                "rule": {
+                    "type": "string"
+                }
+            }
+        },
         "internal_controller_api.GetSegmentsResponse": {
             "type": "object",
             "required": [
@@ -431,9 +2798,6 @@ const docTemplate = `{
                 "user_segments"
             ],
             "properties": {
-                "error": {
-                    "type": "string"
-                },
                 "status": {
                     "type": "string"
                 },
@@ -455,9 +2819,6 @@ const docTemplate = `{
                 "user_segment"
             ],
             "properties": {
-                "error": {
-                    "type": "string"
-                },
                 "status": {
                     "type": "string"
                 },
@@ -472,43 +2833,152 @@ const docTemplate = `{
                 }
             }
         },
-        "internal_controller_api.ResponseStatus": {
+        "internal_controller_api.GetUsersSegmentsResponse": {
+            "type": "object",
+            "required": [
+                "users_segments"
+            ],
+            "properties": {
+                "status": {
+                    "type": "string"
+                },
+                "users_segments": {
+                    "type": "object",
+                    "additionalProperties": {
+                        "type": "array",
+                        "items": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "internal_controller_api.MembershipResponse": {
             "type": "object",
+            "required": [
+                "user_id"
+            ],
             "properties": {
-                "error": {
+                "added_at": {
+                    "type": "string"
+                },
+                "member": {
+                    "type": "boolean"
+                },
+                "removed_at": {
+                    "type": "string"
+                },
+                "slug": {
                     "type": "string"
                 },
                 "status": {
                     "type": "string"
+                },
+                "user_id": {
+                    "type": "integer"
                 }
             }
         },
-        "internal_controller_api.SegmentRequest": {
+        "internal_controller_api.MembershipsResponse": {
             "type": "object",
             "required": [
-                "slug"
+                "memberships",
+                "user_id"
             ],
             "properties": {
-                "id": {
+                "memberships": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/github_com_vlasashk_user-segmentation_internal_model_storage.Membership"
+                    }
+                },
+                "status": {
+                    "type": "string"
+                },
+                "user_id": {
                     "type": "integer"
+                }
+            }
+        },
+        "internal_controller_api.Problem": {
+            "type": "object",
+            "properties": {
+                "code": {
+                    "type": "string"
                 },
-                "slug": {
+                "detail": {
+                    "type": "string"
+                },
+                "errors": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/internal_controller_api.FieldError"
+                    }
+                },
+                "instance": {
+                    "type": "string"
+                },
+                "status": {
+                    "type": "integer"
+                },
+                "title": {
+                    "type": "string"
+                },
+                "type": {
                     "type": "string"
                 }
             }
         },
-        "internal_controller_api.SegmentResponse": {
+        "internal_controller_api.ResponseStatus": {
+            "type": "object",
+            "properties": {
+                "status": {
+                    "type": "string"
+                }
+            }
+        },
+        "internal_controller_api.SegmentListRequest": {
             "type": "object",
             "required": [
-                "slug"
+                "segment_slug"
             ],
             "properties": {
-                "error": {
-                    "type": "string"
+                "segment_slug": {
+                    "type": "array",
+                    "maxItems": 100,
+                    "minItems": 1,
+                    "uniqueItems": true,
+                    "items": {
+                        "type": "string"
+                    }
+                }
+            }
+        },
+        "internal_controller_api.SegmentRequest": {
+            "type": "object",
+            "properties": {
+                "id": {
+                    "type": "integer"
+                },
+                "owner_team": {
+                    "type": "string",
+                    "maxLength": 255
                 },
+                "slug": {
+                    "type": "string"
+                }
+            }
+        },
+        "internal_controller_api.SegmentResponse": {
+            "type": "object",
+            "properties": {
                 "id": {
                     "type": "integer"
                 },
+                "owner_team": {
+                    "type": "string",
+                    "maxLength": 255
+                },
                 "slug": {
                     "type": "string"
                 },
@@ -519,9 +2989,6 @@ const docTemplate = `{
         },
         "internal_controller_api.UserRequest": {
             "type": "object",
-            "required": [
-                "user_id"
-            ],
             "properties": {
                 "id": {
                     "type": "integer"
@@ -533,13 +3000,7 @@ const docTemplate = `{
         },
         "internal_controller_api.UserResponse": {
             "type": "object",
-            "required": [
-                "user_id"
-            ],
             "properties": {
-                "error": {
-                    "type": "string"
-                },
                 "id": {
                     "type": "integer"
                 },
@@ -554,12 +3015,14 @@ const docTemplate = `{
         "internal_controller_api.UserSegmentRequest": {
             "type": "object",
             "required": [
-                "segment_slug",
-                "user_id"
+                "segment_slug"
             ],
             "properties": {
                 "segment_slug": {
                     "type": "array",
+                    "maxItems": 100,
+                    "minItems": 1,
+                    "uniqueItems": true,
                     "items": {
                         "type": "string"
                     }
@@ -572,15 +3035,20 @@ const docTemplate = `{
         "internal_controller_api.UserSegmentResponse": {
             "type": "object",
             "required": [
-                "segment_slug",
-                "user_id"
+                "segment_slug"
             ],
             "properties": {
-                "error": {
-                    "type": "string"
+                "outcomes": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/github_com_vlasashk_user-segmentation_internal_model_storage.SegmentOutcome"
+                    }
                 },
                 "segment_slug": {
                     "type": "array",
+                    "maxItems": 100,
+                    "minItems": 1,
+                    "uniqueItems": true,
                     "items": {
                         "type": "string"
                     }
@@ -593,6 +3061,138 @@ const docTemplate = `{
                 }
             }
         },
+        "internal_controller_api.UsersBatchRequest": {
+            "type": "object",
+            "required": [
+                "user_ids"
+            ],
+            "properties": {
+                "user_ids": {
+                    "type": "array",
+                    "maxItems": 100,
+                    "minItems": 1,
+                    "uniqueItems": true,
+                    "items": {
+                        "type": "integer"
+                    }
+                }
+            }
+        },
+        "internal_controller_api.WebhookDeadLettersResponse": {
+            "type": "object",
+            "required": [
+                "dead_letters"
+            ],
+            "properties": {
+                "dead_letters": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/github_com_vlasashk_user-segmentation_internal_model_storage.WebhookDeadLetter"
+                    }
+                },
+                "status": {
+                    "type": "string"
+                }
+            }
+        },
+        "internal_controller_api.WebhookSubscriptionRequest": {
+            "type": "object",
+            "required": [
+                "secret",
+                "url"
+            ],
+            "properties": {
+                "created_at": {
+                    "type": "string"
+                },
+                "events": {
+                    "type": "array",
+                    "uniqueItems": true,
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "secret": {
+                    "type": "string",
+                    "maxLength": 255,
+                    "minLength": 16
+                },
+                "segments": {
+                    "type": "array",
+                    "maxItems": 100,
+                    "uniqueItems": true,
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "url": {
+                    "type": "string",
+                    "maxLength": 2048
+                }
+            }
+        },
+        "internal_controller_api.WebhookSubscriptionResponse": {
+            "type": "object",
+            "required": [
+                "secret",
+                "url"
+            ],
+            "properties": {
+                "created_at": {
+                    "type": "string"
+                },
+                "events": {
+                    "type": "array",
+                    "uniqueItems": true,
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "secret": {
+                    "type": "string",
+                    "maxLength": 255,
+                    "minLength": 16
+                },
+                "segments": {
+                    "type": "array",
+                    "maxItems": 100,
+                    "uniqueItems": true,
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "status": {
+                    "type": "string"
+                },
+                "url": {
+                    "type": "string",
+                    "maxLength": 2048
+                }
+            }
+        },
+        "internal_controller_api.WebhookSubscriptionsResponse": {
+            "type": "object",
+            "required": [
+                "subscriptions"
+            ],
+            "properties": {
+                "status": {
+                    "type": "string"
+                },
+                "subscriptions": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/github_com_vlasashk_user-segmentation_internal_model_storage.WebhookSubscription"
+                    }
+                }
+            }
+        },
         "time.Month": {
             "type": "integer",
             "enum": [
@@ -626,8 +3226,20 @@ const docTemplate = `{
         }
     },
     "securityDefinitions": {
+        "ApiKeyAuth": {
+            "description": "Static api key, also accepted as \"Authorization: Bearer \u003ckey\u003e\"",
+            "type": "apiKey",
+            "name": "X-API-Key",
+            "in": "header"
+        },
         "BasicAuth": {
             "type": "basic"
+        },
+        "BearerAuth": {
+            "description": "\"Bearer \u003ctoken\u003e\" with a JWT issued by the gateway, when AUTH_MODE includes jwt",
+            "type": "apiKey",
+            "name": "Authorization",
+            "in": "header"
         }
     }
 }`
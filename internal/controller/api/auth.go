@@ -0,0 +1,287 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/go-chi/chi/v5/middleware"
+	"golang.org/x/crypto/bcrypt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	AuthMethodBasic  = "basic"
+	AuthMethodAPIKey = "api_key"
+	AuthMethodJWT    = "jwt"
+)
+
+const (
+	AuthModeStatic = "static"
+	AuthModeJWT    = "jwt"
+)
+
+// dummyHash is compared against when the username is unknown, so the response time doesn't reveal
+// which usernames exist.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("user-segmentation"), bcrypt.DefaultCost)
+
+type ctxKey int
+
+const identityKey ctxKey = iota
+
+// Identity describes the authenticated caller of a request.
+type Identity struct {
+	Name   string `json:"name"`
+	Method string `json:"method"`
+	Role   Role   `json:"role"`
+	Team   string `json:"team,omitempty"`
+}
+
+// BasicCredential is a username with a bcrypt hash of its password.
+type BasicCredential struct {
+	Username     string `json:"username"`
+	PasswordHash string `json:"password_hash"`
+	Role         Role   `json:"role"`
+	Team         string `json:"team,omitempty"`
+}
+
+// APIKeyCredential is a named static api key stored as a hex encoded sha256 digest.
+type APIKeyCredential struct {
+	Name    string `json:"name"`
+	KeyHash string `json:"key_hash"`
+	Role    Role   `json:"role"`
+	Team    string `json:"team,omitempty"`
+}
+
+// AuthConfig is the on-disk format of the credentials file pointed to by AUTH_PATH.
+type AuthConfig struct {
+	Users   []BasicCredential  `json:"users"`
+	APIKeys []APIKeyCredential `json:"api_keys"`
+}
+
+// Authenticator resolves the identity of the caller from request credentials.
+// It returns false if the request carries no credentials it can verify.
+type Authenticator interface {
+	Authenticate(r *http.Request) (Identity, bool)
+}
+
+// AuthChain tries each authenticator in order and accepts the first identity found.
+type AuthChain []Authenticator
+
+func (c AuthChain) Authenticate(r *http.Request) (Identity, bool) {
+	for _, auth := range c {
+		if identity, ok := auth.Authenticate(r); ok {
+			return identity, true
+		}
+	}
+	return Identity{}, false
+}
+
+// NewAuthenticator builds the authenticator chain for a comma separated list of modes
+// such as "static" or "static,jwt". An empty mode means "static".
+func NewAuthenticator(mode string) (Authenticator, error) {
+	if mode == "" {
+		mode = AuthModeStatic
+	}
+	var chain AuthChain
+	for _, m := range strings.Split(mode, ",") {
+		switch strings.TrimSpace(m) {
+		case AuthModeStatic:
+			auth, err := LoadStaticAuthenticator(os.Getenv("AUTH_PATH"))
+			if err != nil {
+				return nil, err
+			}
+			if auth.Empty() {
+				if err = allowEmptyCredentials(); err != nil {
+					return nil, err
+				}
+			}
+			chain = append(chain, auth)
+		case AuthModeJWT:
+			auth, err := NewJWTAuthenticatorFromEnv()
+			if err != nil {
+				return nil, err
+			}
+			chain = append(chain, auth)
+		default:
+			return nil, fmt.Errorf("unknown auth mode '%s'", m)
+		}
+	}
+	return chain, nil
+}
+
+// allowEmptyCredentials fails unless AUTH_ALLOW_EMPTY explicitly allows starting without static credentials,
+// so a missing or truncated credentials file doesn't silently lock everyone out.
+func allowEmptyCredentials() error {
+	allow := false
+	if v := os.Getenv("AUTH_ALLOW_EMPTY"); v != "" {
+		var err error
+		if allow, err = strconv.ParseBool(v); err != nil {
+			return fmt.Errorf("invalid AUTH_ALLOW_EMPTY '%s': %v", v, err)
+		}
+	}
+	if !allow {
+		return fmt.Errorf("credentials file has no users or api keys, set AUTH_ALLOW_EMPTY=true to start anyway")
+	}
+	return nil
+}
+
+// StaticAuthenticator checks request credentials against the configured users and api keys.
+type StaticAuthenticator struct {
+	users   map[string]BasicCredential
+	apiKeys map[[sha256.Size]byte]APIKeyCredential
+}
+
+// LoadStaticAuthenticator reads credentials from the json file at path.
+func LoadStaticAuthenticator(path string) (*StaticAuthenticator, error) {
+	if path == "" {
+		return nil, fmt.Errorf("credentials file path is empty")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credentials file: %v", err)
+	}
+	var cfg AuthConfig
+	if err = json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse credentials file: %v", err)
+	}
+	return NewStaticAuthenticator(cfg)
+}
+
+// NewStaticAuthenticator validates cfg and indexes its credentials for lookup.
+func NewStaticAuthenticator(cfg AuthConfig) (*StaticAuthenticator, error) {
+	auth := &StaticAuthenticator{
+		users:   make(map[string]BasicCredential, len(cfg.Users)),
+		apiKeys: make(map[[sha256.Size]byte]APIKeyCredential, len(cfg.APIKeys)),
+	}
+	for _, user := range cfg.Users {
+		if user.Username == "" {
+			return nil, fmt.Errorf("user with empty username")
+		}
+		if _, err := bcrypt.Cost([]byte(user.PasswordHash)); err != nil {
+			return nil, fmt.Errorf("user '%s' has invalid password hash: %v", user.Username, err)
+		}
+		if _, err := ParseRole(string(user.Role)); err != nil {
+			return nil, fmt.Errorf("user '%s': %v", user.Username, err)
+		}
+		if _, ok := auth.users[user.Username]; ok {
+			return nil, fmt.Errorf("duplicate user '%s'", user.Username)
+		}
+		auth.users[user.Username] = user
+	}
+	for _, key := range cfg.APIKeys {
+		if key.Name == "" {
+			return nil, fmt.Errorf("api key with empty name")
+		}
+		if _, err := ParseRole(string(key.Role)); err != nil {
+			return nil, fmt.Errorf("api key '%s': %v", key.Name, err)
+		}
+		raw, err := hex.DecodeString(key.KeyHash)
+		if err != nil || len(raw) != sha256.Size {
+			return nil, fmt.Errorf("api key '%s' has invalid sha256 hash", key.Name)
+		}
+		var digest [sha256.Size]byte
+		copy(digest[:], raw)
+		if _, ok := auth.apiKeys[digest]; ok {
+			return nil, fmt.Errorf("duplicate api key '%s'", key.Name)
+		}
+		auth.apiKeys[digest] = key
+	}
+	return auth, nil
+}
+
+// Empty reports whether no credential would be accepted.
+func (a *StaticAuthenticator) Empty() bool {
+	return len(a.users) == 0 && len(a.apiKeys) == 0
+}
+
+// Authenticate returns the identity of the caller, or false if the request carries no valid credentials.
+func (a *StaticAuthenticator) Authenticate(r *http.Request) (Identity, bool) {
+	if key := apiKeyFromRequest(r); key != "" {
+		return a.authenticateAPIKey(key)
+	}
+	if username, password, ok := r.BasicAuth(); ok {
+		return a.authenticateBasic(username, password)
+	}
+	return Identity{}, false
+}
+
+func (a *StaticAuthenticator) authenticateAPIKey(key string) (Identity, bool) {
+	cred, ok := a.apiKeys[sha256.Sum256([]byte(key))]
+	if !ok {
+		return Identity{}, false
+	}
+	return Identity{Name: cred.Name, Method: AuthMethodAPIKey, Role: cred.Role, Team: cred.Team}, true
+}
+
+func (a *StaticAuthenticator) authenticateBasic(username, password string) (Identity, bool) {
+	user, ok := a.users[username]
+	if !ok {
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return Identity{}, false
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		return Identity{}, false
+	}
+	return Identity{Name: user.Username, Method: AuthMethodBasic, Role: user.Role, Team: user.Team}, true
+}
+
+// apiKeyFromRequest extracts a static key from the X-API-Key header or a bearer Authorization header.
+func apiKeyFromRequest(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	return bearerToken(r)
+}
+
+func bearerToken(r *http.Request) string {
+	if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+// IdentityFromContext returns the caller identity attached by the authentication middleware.
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(identityKey).(Identity)
+	return identity, ok
+}
+
+// authenticate rejects requests without valid credentials and attaches the caller identity to the context.
+func (s *ServerAPI) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, ok := s.Auth.Authenticate(r)
+		if !ok {
+			s.Log.Warn("unauthenticated request",
+				slog.String("request_id", middleware.GetReqID(r.Context())),
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+			)
+			w.Header().Set("WWW-Authenticate", `Basic realm="user-segmentation"`)
+			renderProblem(w, r, http.StatusUnauthorized, CodeUnauthorized, "authentication required")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey, identity)))
+	})
+}
+
+// requestLog returns a logger annotated with the request id and the authenticated caller.
+func (s *ServerAPI) requestLog(r *http.Request) *slog.Logger {
+	log := s.Log.With(
+		slog.String("request_id", middleware.GetReqID(r.Context())),
+	)
+	if identity, ok := IdentityFromContext(r.Context()); ok {
+		log = log.With(
+			slog.String("caller", identity.Name),
+			slog.String("auth_method", identity.Method),
+			slog.String("role", string(identity.Role)),
+			slog.String("team", identity.Team),
+		)
+	}
+	return log
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestStaticAuthenticator(t *testing.T) *StaticAuthenticator {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte("admin-password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("GenerateFromPassword() failed: %v", err)
+	}
+	digest := sha256.Sum256([]byte("manager-key"))
+	auth, err := NewStaticAuthenticator(AuthConfig{
+		Users: []BasicCredential{{Username: "admin", PasswordHash: string(hash), Role: RoleAdmin}},
+		APIKeys: []APIKeyCredential{
+			{Name: "manager", KeyHash: hex.EncodeToString(digest[:]), Role: RoleManager, Team: "growth"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewStaticAuthenticator() failed: %v", err)
+	}
+	return auth
+}
+
+func TestStaticAuthenticator(t *testing.T) {
+	admin := Identity{Name: "admin", Method: AuthMethodBasic, Role: RoleAdmin}
+	manager := Identity{Name: "manager", Method: AuthMethodAPIKey, Role: RoleManager, Team: "growth"}
+	tests := []struct {
+		name   string
+		header func(r *http.Request)
+		want   Identity
+		wantOk bool
+	}{
+		{"basic", func(r *http.Request) { r.SetBasicAuth("admin", "admin-password") }, admin, true},
+		{"basic wrong password", func(r *http.Request) { r.SetBasicAuth("admin", "manager-key") }, Identity{}, false},
+		{"basic unknown user", func(r *http.Request) { r.SetBasicAuth("root", "admin-password") }, Identity{}, false},
+		{"api key", func(r *http.Request) { r.Header.Set("X-API-Key", "manager-key") }, manager, true},
+		{"bearer", func(r *http.Request) { r.Header.Set("Authorization", "Bearer manager-key") }, manager, true},
+		{"bearer lowercase", func(r *http.Request) { r.Header.Set("Authorization", "bearer manager-key") }, manager, true},
+		{"unknown api key", func(r *http.Request) { r.Header.Set("X-API-Key", "admin-password") }, Identity{}, false},
+		{"unknown bearer", func(r *http.Request) { r.Header.Set("Authorization", "Bearer reader-key") }, Identity{}, false},
+		{"no credentials", func(r *http.Request) {}, Identity{}, false},
+	}
+	auth := newTestStaticAuthenticator(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/segments", nil)
+			tt.header(r)
+			got, ok := auth.Authenticate(r)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("Authenticate() = %+v, %v, want %+v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	s := &ServerAPI{Auth: newTestStaticAuthenticator(t), Log: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	var identity Identity
+	h := s.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, _ = IdentityFromContext(r.Context())
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/segments", nil)
+	r.Header.Set("X-API-Key", "manager-key")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent || identity.Name != "manager" {
+		t.Errorf("authenticated request = %d with identity %+v, want %d with the manager", w.Code, identity, http.StatusNoContent)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/segments", nil)
+	r.SetBasicAuth("admin", "wrong-password")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("request with a wrong password = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if got := w.Header().Get("Content-Type"); got != problemContentType {
+		t.Errorf("Content-Type = %q, want %q", got, problemContentType)
+	}
+	if got := w.Header().Get("WWW-Authenticate"); got != `Basic realm="user-segmentation"` {
+		t.Errorf("WWW-Authenticate = %q, want the basic realm", got)
+	}
+	var problem Problem
+	if err := json.NewDecoder(w.Body).Decode(&problem); err != nil {
+		t.Fatalf("failed to decode problem: %v", err)
+	}
+	if problem.Status != http.StatusUnauthorized || problem.Code != CodeUnauthorized || problem.Detail != "authentication required" {
+		t.Errorf("problem = %+v, want status %d and code %s", problem, http.StatusUnauthorized, CodeUnauthorized)
+	}
+}
+
+func TestNewAuthenticatorEmptyCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.json")
+	if err := os.WriteFile(path, []byte(`{"users": [], "api_keys": []}`), 0600); err != nil {
+		t.Fatalf("failed to write credentials: %v", err)
+	}
+	t.Setenv("AUTH_PATH", path)
+	tests := []struct {
+		allowEmpty string
+		wantErr    bool
+	}{
+		{"", true},
+		{"false", true},
+		{"yes please", true},
+		{"true", false},
+	}
+	for _, tt := range tests {
+		t.Setenv("AUTH_ALLOW_EMPTY", tt.allowEmpty)
+		if _, err := NewAuthenticator(AuthModeStatic); (err != nil) != tt.wantErr {
+			t.Errorf("NewAuthenticator() with AUTH_ALLOW_EMPTY=%q error = %v, want error %v", tt.allowEmpty, err, tt.wantErr)
+		}
+	}
+}
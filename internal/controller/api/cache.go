@@ -0,0 +1,162 @@
+package api
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"github.com/vlasashk/user-segmentation/internal/model/cache"
+	"github.com/vlasashk/user-segmentation/internal/model/storage"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultCacheSize = 10000
+	defaultCacheTTL  = 30 * time.Second
+)
+
+// cacheMetrics is published at /debug/vars as "user_segments_cache".
+var cacheMetrics = expvar.NewMap("user_segments_cache")
+
+// ChangeListener is implemented by storages publishing their changes to other instances.
+type ChangeListener interface {
+	ListenChanges(ctx context.Context, log *slog.Logger, handle func(storage.Change))
+}
+
+// CachedStorage is a read-through cache of user segment lookups in front of a Storage.
+// Entries of a user are dropped when the user's memberships change, entries containing
+// a segment are dropped when the segment is deleted.
+type CachedStorage struct {
+	Storage
+	users *cache.LRU[uint64, []string]
+	// epoch changes on every invalidation, so lookups racing with a mutation don't cache stale results.
+	epoch atomic.Uint64
+}
+
+// NewCachedStorage wraps store with a cache of at most size users kept for at most ttl.
+func NewCachedStorage(store Storage, size int, ttl time.Duration) *CachedStorage {
+	return &CachedStorage{
+		Storage: store,
+		users:   cache.New[uint64, []string](size, ttl),
+	}
+}
+
+// newCachedStorageFromEnv wraps store with a cache configured by CACHE_SIZE and CACHE_TTL.
+func newCachedStorageFromEnv(store Storage) (*CachedStorage, error) {
+	size, ttl := defaultCacheSize, defaultCacheTTL
+	var err error
+	if v := os.Getenv("CACHE_SIZE"); v != "" {
+		if size, err = strconv.Atoi(v); err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid CACHE_SIZE %q", v)
+		}
+	}
+	if v := os.Getenv("CACHE_TTL"); v != "" {
+		if ttl, err = time.ParseDuration(v); err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid CACHE_TTL %q", v)
+		}
+	}
+	return NewCachedStorage(store, size, ttl), nil
+}
+
+func (c *CachedStorage) GetUserSegmentsInfo(ctx context.Context, user storage.User, log *slog.Logger) ([]string, error) {
+	if segments, ok := c.users.Get(user.UID); ok {
+		cacheMetrics.Add("hits", 1)
+		return slices.Clone(segments), nil
+	}
+	cacheMetrics.Add("misses", 1)
+	epoch := c.epoch.Load()
+	segments, err := c.Storage.GetUserSegmentsInfo(ctx, user, log)
+	if err != nil {
+		return segments, err
+	}
+	c.store(epoch, user.UID, segments)
+	return segments, nil
+}
+
+// GetUsersSegmentsInfo serves cached users from the cache and looks up the rest in one query.
+func (c *CachedStorage) GetUsersSegmentsInfo(ctx context.Context, users storage.UsersBatch, log *slog.Logger) (map[uint64][]string, error) {
+	res := make(map[uint64][]string, len(users.UserIDs))
+	var missing storage.UsersBatch
+	for _, uid := range users.UserIDs {
+		if segments, ok := c.users.Get(uid); ok {
+			res[uid] = slices.Clone(segments)
+		} else {
+			missing.UserIDs = append(missing.UserIDs, uid)
+		}
+	}
+	cacheMetrics.Add("hits", int64(len(res)))
+	cacheMetrics.Add("misses", int64(len(missing.UserIDs)))
+	if len(missing.UserIDs) == 0 {
+		return res, nil
+	}
+	epoch := c.epoch.Load()
+	fetched, err := c.Storage.GetUsersSegmentsInfo(ctx, missing, log)
+	if err != nil {
+		return fetched, err
+	}
+	for uid, segments := range fetched {
+		c.store(epoch, uid, segments)
+		res[uid] = segments
+	}
+	return res, nil
+}
+
+func (c *CachedStorage) AddUser(ctx context.Context, user storage.User, log *slog.Logger) (uint64, error) {
+	defer c.invalidateUser(user.UID)
+	return c.Storage.AddUser(ctx, user, log)
+}
+
+func (c *CachedStorage) AddUserToSegments(ctx context.Context, userSegments storage.UserSegments, log *slog.Logger) ([]storage.SegmentOutcome, error) {
+	defer c.invalidateUser(userSegments.UserID)
+	return c.Storage.AddUserToSegments(ctx, userSegments, log)
+}
+
+func (c *CachedStorage) DeleteUserFromSegments(ctx context.Context, userSegments storage.UserSegments, log *slog.Logger) error {
+	defer c.invalidateUser(userSegments.UserID)
+	return c.Storage.DeleteUserFromSegments(ctx, userSegments, log)
+}
+
+func (c *CachedStorage) CascadeDeleteSegment(ctx context.Context, segment storage.Segment, log *slog.Logger) error {
+	defer c.invalidateSegment(segment.Slug)
+	return c.Storage.CascadeDeleteSegment(ctx, segment, log)
+}
+
+// Invalidate drops the entries affected by a change made by this or another instance.
+func (c *CachedStorage) Invalidate(change storage.Change) {
+	switch change.Kind {
+	case storage.ChangeUser:
+		c.invalidateUser(change.UserID)
+	case storage.ChangeSegment:
+		c.invalidateSegment(change.Slug)
+	case storage.ChangeReset:
+		c.epoch.Add(1)
+		c.users.Purge()
+		cacheMetrics.Add("resets", 1)
+	}
+}
+
+// store caches the segments looked up at epoch unless an invalidation started since. Invalidations bump
+// the epoch before removing entries, so one racing with store either stops it or removes what it added.
+func (c *CachedStorage) store(epoch, uid uint64, segments []string) {
+	c.users.AddIf(uid, slices.Clone(segments), func() bool {
+		return c.epoch.Load() == epoch
+	})
+}
+
+func (c *CachedStorage) invalidateUser(uid uint64) {
+	c.epoch.Add(1)
+	c.users.Remove(uid)
+	cacheMetrics.Add("invalidations", 1)
+}
+
+func (c *CachedStorage) invalidateSegment(slug string) {
+	c.epoch.Add(1)
+	removed := c.users.RemoveFunc(func(_ uint64, segments []string) bool {
+		return slices.Contains(segments, slug)
+	})
+	cacheMetrics.Add("invalidations", int64(removed))
+}
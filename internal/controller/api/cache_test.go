@@ -0,0 +1,186 @@
+package api
+
+import (
+	"context"
+	"expvar"
+	"github.com/vlasashk/user-segmentation/internal/model/storage"
+	"io"
+	"log/slog"
+	"slices"
+	"testing"
+	"time"
+)
+
+var cacheTestLog = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// countingStore counts the lookups reaching the memory storage and calls during, if set, before returning one.
+type countingStore struct {
+	Storage
+	lookups int
+	during  func()
+}
+
+func (s *countingStore) GetUserSegmentsInfo(ctx context.Context, user storage.User, log *slog.Logger) ([]string, error) {
+	s.lookups++
+	segments, err := s.Storage.GetUserSegmentsInfo(ctx, user, log)
+	if s.during != nil {
+		s.during()
+	}
+	return segments, err
+}
+
+func (s *countingStore) GetUsersSegmentsInfo(ctx context.Context, users storage.UsersBatch, log *slog.Logger) (map[uint64][]string, error) {
+	s.lookups += len(users.UserIDs)
+	segments, err := s.Storage.GetUsersSegmentsInfo(ctx, users, log)
+	if s.during != nil {
+		s.during()
+	}
+	return segments, err
+}
+
+// newTestCache returns a cache in front of the memory storage where user 1 is in segments a and b,
+// user 2 in segment b and user 3 in none.
+func newTestCache(t *testing.T) (*CachedStorage, *countingStore) {
+	t.Helper()
+	ctx := context.Background()
+	store := &countingStore{Storage: storage.NewMemoryDB()}
+	for _, uid := range []uint64{1, 2, 3} {
+		if _, err := store.AddUser(ctx, storage.User{UID: uid}, cacheTestLog); err != nil {
+			t.Fatalf("AddUser() failed: %v", err)
+		}
+	}
+	for _, slug := range []string{"a", "b", "c"} {
+		if _, err := store.AddSegment(ctx, storage.Segment{Slug: slug}, cacheTestLog); err != nil {
+			t.Fatalf("AddSegment() failed: %v", err)
+		}
+	}
+	for uid, slugs := range map[uint64][]string{1: {"a", "b"}, 2: {"b"}} {
+		if _, err := store.AddUserToSegments(ctx, storage.UserSegments{UserID: uid, SegmentSlug: slugs}, cacheTestLog); err != nil {
+			t.Fatalf("AddUserToSegments() failed: %v", err)
+		}
+	}
+	return NewCachedStorage(store, 10, time.Minute), store
+}
+
+// wantCached checks the segments of uid and whether they were served by the cache.
+func wantCached(t *testing.T, c *CachedStorage, store *countingStore, uid uint64, cached bool, want ...string) {
+	t.Helper()
+	lookups := store.lookups
+	got, err := c.GetUserSegmentsInfo(context.Background(), storage.User{UID: uid}, cacheTestLog)
+	if err != nil {
+		t.Fatalf("GetUserSegmentsInfo(%d) failed: %v", uid, err)
+	}
+	slices.Sort(got)
+	if !slices.Equal(got, want) {
+		t.Errorf("GetUserSegmentsInfo(%d) = %v, want %v", uid, got, want)
+	}
+	if hit := store.lookups == lookups; hit != cached {
+		t.Errorf("GetUserSegmentsInfo(%d) served from the cache = %v, want %v", uid, hit, cached)
+	}
+}
+
+func TestCachedStorageInvalidatesUser(t *testing.T) {
+	ctx := context.Background()
+	c, store := newTestCache(t)
+	wantCached(t, c, store, 1, false, "a", "b")
+	wantCached(t, c, store, 2, false, "b")
+	wantCached(t, c, store, 1, true, "a", "b")
+	wantCached(t, c, store, 2, true, "b")
+
+	if _, err := c.AddUserToSegments(ctx, storage.UserSegments{UserID: 1, SegmentSlug: []string{"c"}}, cacheTestLog); err != nil {
+		t.Fatalf("AddUserToSegments() failed: %v", err)
+	}
+	wantCached(t, c, store, 1, false, "a", "b", "c")
+	wantCached(t, c, store, 2, true, "b")
+
+	if err := c.DeleteUserFromSegments(ctx, storage.UserSegments{UserID: 1, SegmentSlug: []string{"a"}}, cacheTestLog); err != nil {
+		t.Fatalf("DeleteUserFromSegments() failed: %v", err)
+	}
+	wantCached(t, c, store, 1, false, "b", "c")
+	wantCached(t, c, store, 2, true, "b")
+
+	// Changes made by other instances are delivered through Invalidate.
+	c.Invalidate(storage.Change{Kind: storage.ChangeUser, UserID: 2})
+	wantCached(t, c, store, 1, true, "b", "c")
+	wantCached(t, c, store, 2, false, "b")
+}
+
+func TestCachedStorageSegmentDelete(t *testing.T) {
+	c, store := newTestCache(t)
+	for _, uid := range []uint64{1, 2, 3} {
+		c.GetUserSegmentsInfo(context.Background(), storage.User{UID: uid}, cacheTestLog)
+	}
+	if err := c.CascadeDeleteSegment(context.Background(), storage.Segment{Slug: "a"}, cacheTestLog); err != nil {
+		t.Fatalf("CascadeDeleteSegment() failed: %v", err)
+	}
+	wantCached(t, c, store, 1, false, "b")
+	wantCached(t, c, store, 2, true, "b")
+	wantCached(t, c, store, 3, true)
+
+	c.Invalidate(storage.Change{Kind: storage.ChangeSegment, Slug: "b"})
+	wantCached(t, c, store, 1, false, "b")
+	wantCached(t, c, store, 2, false, "b")
+	wantCached(t, c, store, 3, true)
+}
+
+func TestCachedStorageReset(t *testing.T) {
+	c, store := newTestCache(t)
+	users := storage.UsersBatch{UserIDs: []uint64{1, 2, 3}}
+	if _, err := c.GetUsersSegmentsInfo(context.Background(), users, cacheTestLog); err != nil {
+		t.Fatalf("GetUsersSegmentsInfo() failed: %v", err)
+	}
+	wantCached(t, c, store, 3, true)
+	c.Invalidate(storage.Change{Kind: storage.ChangeReset})
+	wantCached(t, c, store, 1, false, "a", "b")
+	wantCached(t, c, store, 2, false, "b")
+	wantCached(t, c, store, 3, false)
+}
+
+func TestCachedStorageStaleFill(t *testing.T) {
+	c, store := newTestCache(t)
+	// A membership of user 1 changes while its segments are looked up, the result mustn't be cached.
+	store.during = func() {
+		c.Invalidate(storage.Change{Kind: storage.ChangeUser, UserID: 1})
+	}
+	wantCached(t, c, store, 1, false, "a", "b")
+	store.during = nil
+	wantCached(t, c, store, 1, false, "a", "b")
+	wantCached(t, c, store, 1, true, "a", "b")
+
+	// Any invalidation racing with a batch lookup keeps all of its results out of the cache.
+	store.during = func() {
+		c.Invalidate(storage.Change{Kind: storage.ChangeSegment, Slug: "c"})
+	}
+	if _, err := c.GetUsersSegmentsInfo(context.Background(), storage.UsersBatch{UserIDs: []uint64{2, 3}}, cacheTestLog); err != nil {
+		t.Fatalf("GetUsersSegmentsInfo() failed: %v", err)
+	}
+	store.during = nil
+	wantCached(t, c, store, 2, false, "b")
+	wantCached(t, c, store, 3, false)
+	wantCached(t, c, store, 1, true, "a", "b")
+}
+
+func TestCachedStorageMetrics(t *testing.T) {
+	counter := func(name string) int64 {
+		if v, ok := cacheMetrics.Get(name).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	hits, misses, resets := counter("hits"), counter("misses"), counter("resets")
+	c, _ := newTestCache(t)
+	ctx := context.Background()
+	c.GetUserSegmentsInfo(ctx, storage.User{UID: 1}, cacheTestLog)
+	c.GetUserSegmentsInfo(ctx, storage.User{UID: 1}, cacheTestLog)
+	c.GetUsersSegmentsInfo(ctx, storage.UsersBatch{UserIDs: []uint64{1, 2, 3}}, cacheTestLog)
+	c.Invalidate(storage.Change{Kind: storage.ChangeReset})
+	if got := counter("hits") - hits; got != 2 {
+		t.Errorf("hits = %d, want 2", got)
+	}
+	if got := counter("misses") - misses; got != 3 {
+		t.Errorf("misses = %d, want 3", got)
+	}
+	if got := counter("resets") - resets; got != 1 {
+		t.Errorf("resets = %d, want 1", got)
+	}
+}
@@ -0,0 +1,164 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/vlasashk/user-segmentation/internal/model/logger"
+	"github.com/vlasashk/user-segmentation/internal/model/storage"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultEventsPollInterval = time.Second
+	eventsBatchSize           = 100
+	eventsHeartbeatInterval   = 15 * time.Second
+	// eventsRetry is the reconnection delay suggested to clients.
+	eventsRetry = 3 * time.Second
+)
+
+// HandleEvents godoc
+// @Summary Stream membership changes
+// @Description Stream membership changes and segment deletions as Server-Sent Events, optionally only those of a user
+// @Description or a segment. Every event carries its seq as the SSE id: a reconnecting client sends it back in
+// @Description Last-Event-ID (or the last_event_id query parameter) and gets the events it missed. Without it
+// @Description the stream starts with the next change.
+// @ID events
+// @Tags events
+// @Produce  text/event-stream
+// @Param user_id query int false "Only events of the user"
+// @Param segment query string false "Only events of the segment"
+// @Param last_event_id query int false "Resume after the event with this seq"
+// @Param Last-Event-ID header int false "Resume after the event with this seq"
+// @Success 200 {object} storage.OutboxEvent "Stream of events, data of each one is the json event"
+// @Failure 400 {object} Problem "Invalid input data"
+// @Failure 401 {object} Problem "Authentication required"
+// @Failure 403 {object} Problem "Insufficient role"
+// @Failure 500 {object} Problem "Query execution failure"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Failure 504 {object} Problem "Query timed out"
+// @Security BasicAuth
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Router /events [get]
+func (s *ServerAPI) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	log := s.requestLog(r)
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		log.Error("response writer doesn't support flushing")
+		renderProblem(w, r, http.StatusInternalServerError, CodeInternal, "streaming is not supported")
+		return
+	}
+	filter, ok := parseEventFilter(w, r, log)
+	if !ok {
+		return
+	}
+	if lastEventID := lastEventID(r); lastEventID != "" {
+		after, err := strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			log.Error("failed to parse last event ID", logger.Err(err))
+			renderProblem(w, r, http.StatusBadRequest, CodeBadRequest, "failed to parse last event ID")
+			return
+		}
+		filter.After = after
+	} else {
+		after, err := s.Store.GetLastEventSeq(r.Context(), log)
+		if err != nil {
+			renderStorageError(w, r, err)
+			return
+		}
+		filter.After = after
+	}
+	log = log.With(slog.Uint64("user_id", filter.UserID), slog.String("segment", filter.Segment))
+	log.Info("event stream started", slog.Uint64("after", filter.After))
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	_, _ = fmt.Fprintf(w, "retry: %d\n\n", eventsRetry.Milliseconds())
+	flusher.Flush()
+
+	poll := time.NewTicker(s.EventsPollInterval)
+	defer poll.Stop()
+	heartbeat := time.NewTicker(eventsHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		events, err := s.Store.GetEvents(r.Context(), filter, log)
+		if errors.Is(err, storage.ErrCanceled) {
+			log.Info("event stream closed")
+			return
+		}
+		if err != nil {
+			// The client reconnects with the last event it got.
+			log.Error("event stream interrupted", logger.Err(err))
+			return
+		}
+		for _, event := range events {
+			if err = writeEvent(w, event); err != nil {
+				log.Info("event stream closed", logger.Err(err))
+				return
+			}
+			filter.After = event.Seq
+		}
+		if len(events) > 0 {
+			flusher.Flush()
+			heartbeat.Reset(eventsHeartbeatInterval)
+		}
+		if len(events) == filter.Limit {
+			continue
+		}
+		select {
+		case <-r.Context().Done():
+			log.Info("event stream closed")
+			return
+		case <-poll.C:
+		case <-heartbeat.C:
+			// Keeps proxies from closing an idle stream.
+			if _, err = fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// parseEventFilter builds the filter of an event stream from the user_id and segment query parameters.
+func parseEventFilter(w http.ResponseWriter, r *http.Request, log *slog.Logger) (storage.EventFilter, bool) {
+	req := &EventsRequest{Segment: r.URL.Query().Get("segment")}
+	if v := r.URL.Query().Get("user_id"); v != "" {
+		uid, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			log.Error("failed to parse user ID", logger.Err(err))
+			renderProblem(w, r, http.StatusBadRequest, CodeBadRequest, "failed to parse user ID")
+			return storage.EventFilter{}, false
+		}
+		req.UserID = uid
+	}
+	if !validateRequest(w, r, log, req) {
+		return storage.EventFilter{}, false
+	}
+	return storage.EventFilter{UserID: req.UserID, Segment: req.Segment, Limit: eventsBatchSize}, true
+}
+
+// lastEventID is sent by reconnecting EventSource clients in the Last-Event-ID header.
+// The query parameter lets clients resume a stream they didn't start.
+func lastEventID(r *http.Request) string {
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		return v
+	}
+	return r.URL.Query().Get("last_event_id")
+}
+
+func writeEvent(w http.ResponseWriter, event storage.OutboxEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Seq, event.Type, data)
+	return err
+}
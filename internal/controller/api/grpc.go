@@ -0,0 +1,348 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"github.com/go-playground/validator/v10"
+	"github.com/vlasashk/user-segmentation/internal/model/logger"
+	"github.com/vlasashk/user-segmentation/internal/model/storage"
+	segmentationv1 "github.com/vlasashk/user-segmentation/pkg/proto/segmentation/v1"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// grpcMethodRoles is the role required by each gRPC method, methods missing here are rejected.
+var grpcMethodRoles = map[string]Role{
+	segmentationv1.SegmentationService_AddUser_FullMethodName:                RoleManager,
+	segmentationv1.SegmentationService_AddSegment_FullMethodName:             RoleManager,
+	segmentationv1.SegmentationService_DeleteSegment_FullMethodName:          RoleManager,
+	segmentationv1.SegmentationService_AddUserToSegments_FullMethodName:      RoleManager,
+	segmentationv1.SegmentationService_DeleteUserFromSegments_FullMethodName: RoleManager,
+	segmentationv1.SegmentationService_GetUserSegments_FullMethodName:        RoleReader,
+	segmentationv1.SegmentationService_GetUsersSegments_FullMethodName:       RoleReader,
+	segmentationv1.SegmentationService_GetMemberships_FullMethodName:         RoleReader,
+	segmentationv1.SegmentationService_GetSegmentUsers_FullMethodName:        RoleReader,
+	segmentationv1.SegmentationService_CreateReport_FullMethodName:           RoleAdmin,
+}
+
+// GRPCServer implements the segmentation gRPC service on top of the HTTP API server's storage and credentials.
+type GRPCServer struct {
+	segmentationv1.UnimplementedSegmentationServiceServer
+	api *ServerAPI
+}
+
+// NewGRPCServer builds a gRPC server sharing storage, authentication and report signing with s.
+func NewGRPCServer(s *ServerAPI) *grpc.Server {
+	server := grpc.NewServer(grpc.ChainUnaryInterceptor(s.grpcRecover, s.grpcAuthenticate))
+	segmentationv1.RegisterSegmentationServiceServer(server, &GRPCServer{api: s})
+	return server
+}
+
+// RunGRPC serves the gRPC API on port until the server is stopped.
+func RunGRPC(log *slog.Logger, server *grpc.Server, port string) {
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		log.Error("failed to listen for grpc", logger.Err(err))
+		return
+	}
+	if err := server.Serve(listener); err != nil {
+		log.Error("failed to start grpc server", logger.Err(err))
+	}
+}
+
+// grpcRecover turns a panic in a handler into an internal error, like middleware.Recoverer does for HTTP.
+func (s *ServerAPI) grpcRecover(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			s.Log.Error("grpc handler panic", slog.String("grpc_method", info.FullMethod), slog.Any("panic", p))
+			err = status.Error(codes.Internal, "internal error")
+		}
+	}()
+	return handler(ctx, req)
+}
+
+// grpcAuthenticate checks the credentials passed in call metadata and the role required by the method,
+// then attaches the caller identity to the context.
+func (s *ServerAPI) grpcAuthenticate(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	required, ok := grpcMethodRoles[info.FullMethod]
+	if !ok {
+		return nil, status.Errorf(codes.Unimplemented, "method %s is not supported", info.FullMethod)
+	}
+	identity, ok := s.Auth.Authenticate(requestFromMetadata(ctx, info.FullMethod))
+	if !ok {
+		s.Log.Warn("unauthenticated grpc call", slog.String("grpc_method", info.FullMethod))
+		return nil, status.Error(codes.Unauthenticated, "authentication required")
+	}
+	if !identity.Role.Allows(required) {
+		s.Log.Warn("insufficient role",
+			slog.String("grpc_method", info.FullMethod),
+			slog.String("caller", identity.Name),
+			slog.String("role", string(identity.Role)),
+			slog.String("required_role", string(required)),
+		)
+		return nil, status.Errorf(codes.PermissionDenied, "role '%s' is required", required)
+	}
+	return handler(context.WithValue(ctx, identityKey, identity), req)
+}
+
+// requestFromMetadata wraps the credentials of a gRPC call into an HTTP request,
+// so the HTTP authenticators can verify them.
+func requestFromMetadata(ctx context.Context, method string) *http.Request {
+	r, _ := http.NewRequestWithContext(ctx, http.MethodPost, method, nil)
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, header := range []string{"Authorization", "X-API-Key"} {
+		if values := md.Get(header); len(values) > 0 {
+			r.Header.Set(header, values[0])
+		}
+	}
+	return r
+}
+
+// grpcLog returns a logger annotated with the gRPC method and the authenticated caller.
+func (s *ServerAPI) grpcLog(ctx context.Context, method string) *slog.Logger {
+	log := s.Log.With(slog.String("grpc_method", method))
+	if identity, ok := IdentityFromContext(ctx); ok {
+		log = log.With(
+			slog.String("caller", identity.Name),
+			slog.String("auth_method", identity.Method),
+			slog.String("role", string(identity.Role)),
+			slog.String("team", identity.Team),
+		)
+	}
+	return log
+}
+
+// grpcValidate validates req, reporting field violations as an InvalidArgument status.
+func grpcValidate(log *slog.Logger, req interface{}) error {
+	err := validate.Struct(req)
+	if err == nil {
+		return nil
+	}
+	log.Error("wrong request structure", logger.Err(err))
+	var validationErrs validator.ValidationErrors
+	if !errors.As(err, &validationErrs) {
+		return status.Error(codes.InvalidArgument, "invalid request")
+	}
+	badRequest := &errdetails.BadRequest{}
+	for _, fe := range validationErrs {
+		badRequest.FieldViolations = append(badRequest.FieldViolations, &errdetails.BadRequest_FieldViolation{
+			Field:       fe.Field(),
+			Description: fieldErrorMessage(fe),
+		})
+	}
+	st, detailsErr := status.New(codes.InvalidArgument, "request validation failed").WithDetails(badRequest)
+	if detailsErr != nil {
+		return status.Error(codes.InvalidArgument, "request validation failed")
+	}
+	return st.Err()
+}
+
+// grpcStorageError maps a storage error onto a gRPC status, the same way renderStorageError does for HTTP.
+func grpcStorageError(err error) error {
+	switch {
+	case errors.Is(err, storage.ErrForbidden):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, storage.ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, storage.ErrAlreadyExists):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, storage.ErrNotMember):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, storage.ErrUnavailable):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, storage.ErrCanceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, storage.ErrTimeout):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+func (g *GRPCServer) AddUser(ctx context.Context, req *segmentationv1.AddUserRequest) (*segmentationv1.AddUserResponse, error) {
+	log := g.api.grpcLog(ctx, segmentationv1.SegmentationService_AddUser_FullMethodName)
+	user := &UserRequest{storage.User{UID: req.GetUserId()}}
+	if err := grpcValidate(log, user); err != nil {
+		return nil, err
+	}
+	if _, err := g.api.Store.AddUser(ctx, user.User, log); err != nil {
+		return nil, grpcStorageError(err)
+	}
+	log.Info("query successfully executed", slog.Any("request", user))
+	return &segmentationv1.AddUserResponse{UserId: user.UID}, nil
+}
+
+func (g *GRPCServer) AddSegment(ctx context.Context, req *segmentationv1.AddSegmentRequest) (*segmentationv1.AddSegmentResponse, error) {
+	log := g.api.grpcLog(ctx, segmentationv1.SegmentationService_AddSegment_FullMethodName)
+	segment := &SegmentRequest{storage.Segment{Slug: req.GetSlug(), OwnerTeam: req.GetOwnerTeam()}}
+	if err := grpcValidate(log, segment); err != nil {
+		return nil, err
+	}
+	identity, _ := IdentityFromContext(ctx)
+	owner, err := segmentOwnerTeam(identity, segment.OwnerTeam)
+	if err != nil {
+		log.Error("segment owner rejected", logger.Err(err))
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+	segment.OwnerTeam = owner
+	if _, err := g.api.Store.AddSegment(ctx, segment.Segment, log); err != nil {
+		return nil, grpcStorageError(err)
+	}
+	log.Info("query successfully executed", slog.Any("request", segment))
+	return &segmentationv1.AddSegmentResponse{Slug: segment.Slug, OwnerTeam: segment.OwnerTeam}, nil
+}
+
+func (g *GRPCServer) DeleteSegment(ctx context.Context, req *segmentationv1.DeleteSegmentRequest) (*segmentationv1.DeleteSegmentResponse, error) {
+	log := g.api.grpcLog(ctx, segmentationv1.SegmentationService_DeleteSegment_FullMethodName)
+	segment := &SegmentRequest{storage.Segment{Slug: req.GetSlug()}}
+	if err := grpcValidate(log, segment); err != nil {
+		return nil, err
+	}
+	identity, _ := IdentityFromContext(ctx)
+	team, err := ownerRestriction(identity)
+	if err != nil {
+		return nil, grpcStorageError(err)
+	}
+	segment.OwnerTeam = team
+	if err := g.api.Store.CascadeDeleteSegment(ctx, segment.Segment, log); err != nil {
+		return nil, grpcStorageError(err)
+	}
+	log.Info("query successfully executed", slog.Any("request", segment))
+	return &segmentationv1.DeleteSegmentResponse{}, nil
+}
+
+func (g *GRPCServer) AddUserToSegments(ctx context.Context, req *segmentationv1.AddUserToSegmentsRequest) (*segmentationv1.AddUserToSegmentsResponse, error) {
+	log := g.api.grpcLog(ctx, segmentationv1.SegmentationService_AddUserToSegments_FullMethodName)
+	userSegments := &UserSegmentRequest{storage.UserSegments{UserID: req.GetUserId(), SegmentSlug: req.GetSegmentSlugs()}}
+	if err := grpcValidate(log, userSegments); err != nil {
+		return nil, err
+	}
+	identity, _ := IdentityFromContext(ctx)
+	team, err := ownerRestriction(identity)
+	if err != nil {
+		return nil, grpcStorageError(err)
+	}
+	userSegments.OwnerTeam = team
+	if _, err := g.api.Store.AddUserToSegments(ctx, userSegments.UserSegments, log); err != nil {
+		return nil, grpcStorageError(err)
+	}
+	log.Info("query successfully executed", slog.Any("request", userSegments))
+	return &segmentationv1.AddUserToSegmentsResponse{}, nil
+}
+
+func (g *GRPCServer) DeleteUserFromSegments(ctx context.Context, req *segmentationv1.DeleteUserFromSegmentsRequest) (*segmentationv1.DeleteUserFromSegmentsResponse, error) {
+	log := g.api.grpcLog(ctx, segmentationv1.SegmentationService_DeleteUserFromSegments_FullMethodName)
+	userSegments := &UserSegmentRequest{storage.UserSegments{UserID: req.GetUserId(), SegmentSlug: req.GetSegmentSlugs()}}
+	if err := grpcValidate(log, userSegments); err != nil {
+		return nil, err
+	}
+	identity, _ := IdentityFromContext(ctx)
+	team, err := ownerRestriction(identity)
+	if err != nil {
+		return nil, grpcStorageError(err)
+	}
+	userSegments.OwnerTeam = team
+	if err := g.api.Store.DeleteUserFromSegments(ctx, userSegments.UserSegments, log); err != nil {
+		return nil, grpcStorageError(err)
+	}
+	log.Info("query successfully executed", slog.Any("request", userSegments))
+	return &segmentationv1.DeleteUserFromSegmentsResponse{}, nil
+}
+
+func (g *GRPCServer) GetUserSegments(ctx context.Context, req *segmentationv1.GetUserSegmentsRequest) (*segmentationv1.GetUserSegmentsResponse, error) {
+	log := g.api.grpcLog(ctx, segmentationv1.SegmentationService_GetUserSegments_FullMethodName)
+	user := &UserRequest{storage.User{UID: req.GetUserId()}}
+	if err := grpcValidate(log, user); err != nil {
+		return nil, err
+	}
+	segments, err := g.api.Store.GetUserSegmentsInfo(ctx, user.User, log)
+	if err != nil {
+		return nil, grpcStorageError(err)
+	}
+	log.Info("query successfully executed", slog.Int("segments", len(segments)))
+	return &segmentationv1.GetUserSegmentsResponse{SegmentSlugs: segments}, nil
+}
+
+func (g *GRPCServer) GetUsersSegments(ctx context.Context, req *segmentationv1.GetUsersSegmentsRequest) (*segmentationv1.GetUsersSegmentsResponse, error) {
+	log := g.api.grpcLog(ctx, segmentationv1.SegmentationService_GetUsersSegments_FullMethodName)
+	users := &UsersBatchRequest{storage.UsersBatch{UserIDs: req.GetUserIds()}}
+	if err := grpcValidate(log, users); err != nil {
+		return nil, err
+	}
+	segments, err := g.api.Store.GetUsersSegmentsInfo(ctx, users.UsersBatch, log)
+	if err != nil {
+		return nil, grpcStorageError(err)
+	}
+	response := &segmentationv1.GetUsersSegmentsResponse{UsersSegments: make(map[uint64]*segmentationv1.SegmentList, len(segments))}
+	for uid, slugs := range segments {
+		response.UsersSegments[uid] = &segmentationv1.SegmentList{SegmentSlugs: slugs}
+	}
+	log.Info("query successfully executed", slog.Int("users", len(segments)))
+	return response, nil
+}
+
+func (g *GRPCServer) GetMemberships(ctx context.Context, req *segmentationv1.GetMembershipsRequest) (*segmentationv1.GetMembershipsResponse, error) {
+	log := g.api.grpcLog(ctx, segmentationv1.SegmentationService_GetMemberships_FullMethodName)
+	userSegments := &UserSegmentRequest{storage.UserSegments{UserID: req.GetUserId(), SegmentSlug: req.GetSegmentSlugs()}}
+	if err := grpcValidate(log, userSegments); err != nil {
+		return nil, err
+	}
+	memberships, err := g.api.Store.GetMemberships(ctx, userSegments.UserSegments, log)
+	if err != nil {
+		return nil, grpcStorageError(err)
+	}
+	response := &segmentationv1.GetMembershipsResponse{}
+	for _, membership := range memberships {
+		m := &segmentationv1.Membership{Slug: membership.Slug, Member: membership.Member}
+		if membership.AddedAt != nil {
+			m.AddedAt = timestamppb.New(*membership.AddedAt)
+		}
+		if membership.RemovedAt != nil {
+			m.RemovedAt = timestamppb.New(*membership.RemovedAt)
+		}
+		response.Memberships = append(response.Memberships, m)
+	}
+	log.Info("query successfully executed", slog.Int("memberships", len(memberships)))
+	return response, nil
+}
+
+func (g *GRPCServer) GetSegmentUsers(ctx context.Context, req *segmentationv1.GetSegmentUsersRequest) (*segmentationv1.GetSegmentUsersResponse, error) {
+	log := g.api.grpcLog(ctx, segmentationv1.SegmentationService_GetSegmentUsers_FullMethodName)
+	segment := &SegmentRequest{storage.Segment{Slug: req.GetSlug()}}
+	if err := grpcValidate(log, segment); err != nil {
+		return nil, err
+	}
+	users, err := g.api.Store.GetSegmentUsersInfo(ctx, segment.Segment, log)
+	if err != nil {
+		return nil, grpcStorageError(err)
+	}
+	log.Info("query successfully executed", slog.Int("users", len(users)))
+	return &segmentationv1.GetSegmentUsersResponse{UserIds: users}, nil
+}
+
+func (g *GRPCServer) CreateReport(ctx context.Context, req *segmentationv1.CreateReportRequest) (*segmentationv1.CreateReportResponse, error) {
+	log := g.api.grpcLog(ctx, segmentationv1.SegmentationService_CreateReport_FullMethodName)
+	dates := &CsvReportRequest{storage.CsvReport{Year: uint(req.GetYear()), Month: time.Month(req.GetMonth())}}
+	if err := grpcValidate(log, dates); err != nil {
+		return nil, err
+	}
+	reportID, err := g.api.Store.CsvHistoryReport(ctx, dates.CsvReport, log)
+	if err != nil {
+		return nil, grpcStorageError(err)
+	}
+	link, expires := g.api.reportLink(reportID, "/v1/reports/")
+	log.Info("query successfully executed", slog.String("report_id", reportID))
+	return &segmentationv1.CreateReportResponse{
+		ReportId:  reportID,
+		CsvUrl:    link,
+		ExpiresAt: timestamppb.New(expires),
+	}, nil
+}
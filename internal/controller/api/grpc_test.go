@@ -0,0 +1,369 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/vlasashk/user-segmentation/internal/model/storage"
+	segmentationv1 "github.com/vlasashk/user-segmentation/pkg/proto/segmentation/v1"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"io"
+	"log/slog"
+	"net"
+	"sort"
+	"testing"
+)
+
+// testAPIKeys are the credentials accepted by the test gRPC server, keyed by the raw key.
+var testAPIKeys = map[string]APIKeyCredential{
+	"reader-key":        {Name: "reader", Role: RoleReader, Team: "growth"},
+	"manager-key":       {Name: "manager", Role: RoleManager, Team: "growth"},
+	"other-manager-key": {Name: "other-manager", Role: RoleManager, Team: "search"},
+	"teamless-key":      {Name: "teamless", Role: RoleManager},
+	"admin-key":         {Name: "admin", Role: RoleAdmin},
+}
+
+// roleKeys is a key with each role, used to check the role required by every method.
+var roleKeys = []struct {
+	role Role
+	key  string
+}{
+	{RoleReader, "reader-key"},
+	{RoleManager, "manager-key"},
+	{RoleAdmin, "admin-key"},
+}
+
+// newTestGRPC serves the gRPC API over an in-memory listener, backed by the memory storage
+// with user 1 and the segment "growth-seg" owned by team growth.
+func newTestGRPC(t *testing.T) segmentationv1.SegmentationServiceClient {
+	t.Helper()
+	t.Setenv("CSV_PATH", t.TempDir())
+	cfg := AuthConfig{}
+	for key, cred := range testAPIKeys {
+		digest := sha256.Sum256([]byte(key))
+		cred.KeyHash = hex.EncodeToString(digest[:])
+		cfg.APIKeys = append(cfg.APIKeys, cred)
+	}
+	auth, err := NewStaticAuthenticator(cfg)
+	if err != nil {
+		t.Fatalf("NewStaticAuthenticator() failed: %v", err)
+	}
+	reports, err := NewReportSigner("secret", "")
+	if err != nil {
+		t.Fatalf("NewReportSigner() failed: %v", err)
+	}
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store := storage.NewMemoryDB()
+	ctx := context.Background()
+	if _, err = store.AddUser(ctx, storage.User{UID: 1}, log); err != nil {
+		t.Fatalf("AddUser() failed: %v", err)
+	}
+	if _, err = store.AddSegment(ctx, storage.Segment{Slug: "growth-seg", OwnerTeam: "growth"}, log); err != nil {
+		t.Fatalf("AddSegment() failed: %v", err)
+	}
+
+	lis := bufconn.Listen(1 << 20)
+	server := NewGRPCServer(&ServerAPI{Store: store, Log: log, Reports: reports, Auth: auth})
+	go func() {
+		_ = server.Serve(lis)
+	}()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.DialContext(ctx, "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("failed to dial bufconn: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return segmentationv1.NewSegmentationServiceClient(conn)
+}
+
+// withKey attaches an API key to the outgoing call metadata.
+func withKey(key string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "x-api-key", key)
+}
+
+// grpcCall makes a call with a valid request.
+type grpcCall func(ctx context.Context, client segmentationv1.SegmentationServiceClient) error
+
+var grpcCalls = map[string]grpcCall{
+	segmentationv1.SegmentationService_AddUser_FullMethodName: func(ctx context.Context, client segmentationv1.SegmentationServiceClient) error {
+		_, err := client.AddUser(ctx, &segmentationv1.AddUserRequest{UserId: 2})
+		return err
+	},
+	segmentationv1.SegmentationService_AddSegment_FullMethodName: func(ctx context.Context, client segmentationv1.SegmentationServiceClient) error {
+		_, err := client.AddSegment(ctx, &segmentationv1.AddSegmentRequest{Slug: "new-seg"})
+		return err
+	},
+	segmentationv1.SegmentationService_DeleteSegment_FullMethodName: func(ctx context.Context, client segmentationv1.SegmentationServiceClient) error {
+		_, err := client.DeleteSegment(ctx, &segmentationv1.DeleteSegmentRequest{Slug: "growth-seg"})
+		return err
+	},
+	segmentationv1.SegmentationService_AddUserToSegments_FullMethodName: func(ctx context.Context, client segmentationv1.SegmentationServiceClient) error {
+		_, err := client.AddUserToSegments(ctx, &segmentationv1.AddUserToSegmentsRequest{UserId: 1, SegmentSlugs: []string{"growth-seg"}})
+		return err
+	},
+	segmentationv1.SegmentationService_DeleteUserFromSegments_FullMethodName: func(ctx context.Context, client segmentationv1.SegmentationServiceClient) error {
+		_, err := client.DeleteUserFromSegments(ctx, &segmentationv1.DeleteUserFromSegmentsRequest{UserId: 1, SegmentSlugs: []string{"growth-seg"}})
+		return err
+	},
+	segmentationv1.SegmentationService_GetUserSegments_FullMethodName: func(ctx context.Context, client segmentationv1.SegmentationServiceClient) error {
+		_, err := client.GetUserSegments(ctx, &segmentationv1.GetUserSegmentsRequest{UserId: 1})
+		return err
+	},
+	segmentationv1.SegmentationService_GetUsersSegments_FullMethodName: func(ctx context.Context, client segmentationv1.SegmentationServiceClient) error {
+		_, err := client.GetUsersSegments(ctx, &segmentationv1.GetUsersSegmentsRequest{UserIds: []uint64{1}})
+		return err
+	},
+	segmentationv1.SegmentationService_GetMemberships_FullMethodName: func(ctx context.Context, client segmentationv1.SegmentationServiceClient) error {
+		_, err := client.GetMemberships(ctx, &segmentationv1.GetMembershipsRequest{UserId: 1, SegmentSlugs: []string{"growth-seg"}})
+		return err
+	},
+	segmentationv1.SegmentationService_GetSegmentUsers_FullMethodName: func(ctx context.Context, client segmentationv1.SegmentationServiceClient) error {
+		_, err := client.GetSegmentUsers(ctx, &segmentationv1.GetSegmentUsersRequest{Slug: "growth-seg"})
+		return err
+	},
+	segmentationv1.SegmentationService_CreateReport_FullMethodName: func(ctx context.Context, client segmentationv1.SegmentationServiceClient) error {
+		_, err := client.CreateReport(ctx, &segmentationv1.CreateReportRequest{Year: 2023, Month: 8})
+		return err
+	},
+}
+
+func TestGRPCAuth(t *testing.T) {
+	if len(grpcCalls) != len(grpcMethodRoles) {
+		t.Fatalf("grpcCalls covers %d methods, want %d", len(grpcCalls), len(grpcMethodRoles))
+	}
+	for method, required := range grpcMethodRoles {
+		call, ok := grpcCalls[method]
+		if !ok {
+			t.Fatalf("no call for method %s", method)
+		}
+		t.Run(method, func(t *testing.T) {
+			client := newTestGRPC(t)
+			if code := status.Code(call(context.Background(), client)); code != codes.Unauthenticated {
+				t.Errorf("call without credentials = %v, want %v", code, codes.Unauthenticated)
+			}
+			if code := status.Code(call(withKey("unknown-key"), client)); code != codes.Unauthenticated {
+				t.Errorf("call with unknown key = %v, want %v", code, codes.Unauthenticated)
+			}
+			for _, rk := range roleKeys {
+				code := status.Code(call(withKey(rk.key), client))
+				if !rk.role.Allows(required) {
+					if code != codes.PermissionDenied {
+						t.Errorf("call as %s = %v, want %v", rk.role, code, codes.PermissionDenied)
+					}
+					continue
+				}
+				if code == codes.Unauthenticated || code == codes.PermissionDenied {
+					t.Errorf("call as %s = %v, want it to pass authorization", rk.role, code)
+				}
+			}
+		})
+	}
+}
+
+func TestGRPCValidationDetails(t *testing.T) {
+	client := newTestGRPC(t)
+	ctx := withKey("admin-key")
+	tests := []struct {
+		name       string
+		call       func() error
+		wantFields []string
+	}{
+		{
+			name: "add user",
+			call: func() error {
+				_, err := client.AddUser(ctx, &segmentationv1.AddUserRequest{})
+				return err
+			},
+			wantFields: []string{"user_id"},
+		},
+		{
+			name: "add segment",
+			call: func() error {
+				_, err := client.AddSegment(ctx, &segmentationv1.AddSegmentRequest{Slug: "not a slug"})
+				return err
+			},
+			wantFields: []string{"slug"},
+		},
+		{
+			name: "add user to segments",
+			call: func() error {
+				_, err := client.AddUserToSegments(ctx, &segmentationv1.AddUserToSegmentsRequest{UserId: 1})
+				return err
+			},
+			wantFields: []string{"segment_slug"},
+		},
+		{
+			name: "get users segments",
+			call: func() error {
+				_, err := client.GetUsersSegments(ctx, &segmentationv1.GetUsersSegmentsRequest{UserIds: []uint64{1, 1}})
+				return err
+			},
+			wantFields: []string{"user_ids"},
+		},
+		{
+			name: "create report",
+			call: func() error {
+				_, err := client.CreateReport(ctx, &segmentationv1.CreateReportRequest{Year: 1999, Month: 13})
+				return err
+			},
+			wantFields: []string{"month", "year"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := status.Convert(tt.call())
+			if st.Code() != codes.InvalidArgument {
+				t.Fatalf("call = %v, want %v", st.Code(), codes.InvalidArgument)
+			}
+			var fields []string
+			for _, detail := range st.Details() {
+				badRequest, ok := detail.(*errdetails.BadRequest)
+				if !ok {
+					continue
+				}
+				for _, violation := range badRequest.GetFieldViolations() {
+					if violation.GetDescription() == "" {
+						t.Errorf("violation of %s has no description", violation.GetField())
+					}
+					fields = append(fields, violation.GetField())
+				}
+			}
+			sort.Strings(fields)
+			if len(fields) != len(tt.wantFields) {
+				t.Fatalf("violated fields = %v, want %v", fields, tt.wantFields)
+			}
+			for i := range fields {
+				if fields[i] != tt.wantFields[i] {
+					t.Errorf("violated fields = %v, want %v", fields, tt.wantFields)
+				}
+			}
+		})
+	}
+}
+
+func TestGRPCStorageErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		call grpcCall
+		key  string
+		want codes.Code
+	}{
+		{
+			name: "user exists",
+			call: func(ctx context.Context, client segmentationv1.SegmentationServiceClient) error {
+				_, err := client.AddUser(ctx, &segmentationv1.AddUserRequest{UserId: 1})
+				return err
+			},
+			key:  "manager-key",
+			want: codes.AlreadyExists,
+		},
+		{
+			name: "segment exists",
+			call: func(ctx context.Context, client segmentationv1.SegmentationServiceClient) error {
+				_, err := client.AddSegment(ctx, &segmentationv1.AddSegmentRequest{Slug: "growth-seg"})
+				return err
+			},
+			key:  "manager-key",
+			want: codes.AlreadyExists,
+		},
+		{
+			name: "unknown segment",
+			call: func(ctx context.Context, client segmentationv1.SegmentationServiceClient) error {
+				_, err := client.GetSegmentUsers(ctx, &segmentationv1.GetSegmentUsersRequest{Slug: "missing-seg"})
+				return err
+			},
+			key:  "reader-key",
+			want: codes.NotFound,
+		},
+		{
+			name: "unknown user",
+			call: func(ctx context.Context, client segmentationv1.SegmentationServiceClient) error {
+				_, err := client.AddUserToSegments(ctx, &segmentationv1.AddUserToSegmentsRequest{UserId: 42, SegmentSlugs: []string{"growth-seg"}})
+				return err
+			},
+			key:  "manager-key",
+			want: codes.NotFound,
+		},
+		{
+			name: "not a member",
+			call: func(ctx context.Context, client segmentationv1.SegmentationServiceClient) error {
+				_, err := client.DeleteUserFromSegments(ctx, &segmentationv1.DeleteUserFromSegmentsRequest{UserId: 1, SegmentSlugs: []string{"growth-seg"}})
+				return err
+			},
+			key:  "manager-key",
+			want: codes.FailedPrecondition,
+		},
+		{
+			name: "segment of another team",
+			call: func(ctx context.Context, client segmentationv1.SegmentationServiceClient) error {
+				_, err := client.DeleteSegment(ctx, &segmentationv1.DeleteSegmentRequest{Slug: "growth-seg"})
+				return err
+			},
+			key:  "other-manager-key",
+			want: codes.PermissionDenied,
+		},
+		{
+			name: "caller without a team",
+			call: func(ctx context.Context, client segmentationv1.SegmentationServiceClient) error {
+				_, err := client.AddUserToSegments(ctx, &segmentationv1.AddUserToSegmentsRequest{UserId: 1, SegmentSlugs: []string{"growth-seg"}})
+				return err
+			},
+			key:  "teamless-key",
+			want: codes.PermissionDenied,
+		},
+		{
+			name: "segment owned by another team",
+			call: func(ctx context.Context, client segmentationv1.SegmentationServiceClient) error {
+				_, err := client.AddSegment(ctx, &segmentationv1.AddSegmentRequest{Slug: "search-seg", OwnerTeam: "search"})
+				return err
+			},
+			key:  "manager-key",
+			want: codes.PermissionDenied,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newTestGRPC(t)
+			if code := status.Code(tt.call(withKey(tt.key), client)); code != tt.want {
+				t.Errorf("call = %v, want %v", code, tt.want)
+			}
+		})
+	}
+}
+
+func TestGRPCStorageError(t *testing.T) {
+	tests := []struct {
+		kind error
+		want codes.Code
+	}{
+		{storage.ErrForbidden, codes.PermissionDenied},
+		{storage.ErrNotFound, codes.NotFound},
+		{storage.ErrAlreadyExists, codes.AlreadyExists},
+		{storage.ErrNotMember, codes.FailedPrecondition},
+		{storage.ErrUnavailable, codes.Unavailable},
+		{storage.ErrCanceled, codes.Canceled},
+		{storage.ErrTimeout, codes.DeadlineExceeded},
+		{errors.New("boom"), codes.Internal},
+	}
+	for _, tt := range tests {
+		err := grpcStorageError(&storage.Error{Kind: tt.kind, Msg: "failed"})
+		if code := status.Code(err); code != tt.want {
+			t.Errorf("grpcStorageError(%v) = %v, want %v", tt.kind, code, tt.want)
+		}
+	}
+}
@@ -1,58 +1,69 @@
 package api
 
 import (
-	"context"
 	"errors"
 	"fmt"
 	"github.com/go-chi/chi/v5"
-	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/render"
-	"github.com/go-playground/validator/v10"
 	"github.com/vlasashk/user-segmentation/internal/model/logger"
+	"github.com/vlasashk/user-segmentation/internal/model/storage"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
+	"time"
 )
 
 // HandleAddUser godoc
 // @Summary Add a new user
 // @Description Add a new user to the system
 // @ID addUser
+// @Tags legacy
+// @Deprecated
 // @Accept  json
 // @Produce  json
 // @Param user body UserRequest true "User object to be added"
+// @Param Idempotency-Key header string false "Key making retries of the request safe"
 // @Success 201 {object} UserResponse "Successfully added user"
-// @Failure 400 {object} ResponseStatus "Invalid input data"
-// @Failure 409 {object} ResponseStatus "Query execution failure"
+// @Failure 400 {object} Problem "Invalid input data"
+// @Failure 401 {object} Problem "Authentication required"
+// @Failure 403 {object} Problem "Insufficient role"
+// @Failure 409 {object} Problem "User already exists"
+// @Failure 500 {object} Problem "Query execution failure"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Failure 504 {object} Problem "Query timed out"
+// @Security BasicAuth
+// @Security ApiKeyAuth
+// @Security BearerAuth
 // @Router /user/new [post]
 func (s *ServerAPI) HandleAddUser(w http.ResponseWriter, r *http.Request) {
 	newUser := &UserRequest{}
-	log := s.Log.With(
-		slog.String("request_id", middleware.GetReqID(r.Context())),
-	)
+	log := s.requestLog(r)
 	if err := render.DecodeJSON(r.Body, &newUser); err != nil {
 		log.Error("failed to decode request body", logger.Err(err))
-		render.Status(r, http.StatusBadRequest)
-		render.JSON(w, r, Error("failed to decode request body"))
+		renderProblem(w, r, http.StatusBadRequest, CodeBadRequest, "failed to decode request body")
 		return
 	}
 	log.Info("request body decoded", slog.Any("request", *newUser))
-	if err := validator.New().Struct(newUser); err != nil {
+	if err := validate.Struct(newUser); err != nil {
 		log.Error("wrong body structure", logger.Err(err))
-		render.Status(r, http.StatusBadRequest)
-		render.JSON(w, r, Error("wrong body structure"))
+		renderValidationProblem(w, r, err)
 		return
 	}
-	id, err := s.Store.AddUser(context.Background(), newUser.User, log)
+	s.addUser(w, r, log, newUser.User)
+}
+
+// addUser adds user and writes the response. Helpers like this one are shared by legacy and v1 routes.
+func (s *ServerAPI) addUser(w http.ResponseWriter, r *http.Request, log *slog.Logger, user storage.User) {
+	id, err := s.Store.AddUser(r.Context(), user, log)
 	if err != nil {
-		render.Status(r, http.StatusConflict)
-		render.JSON(w, r, Error(err.Error()))
+		renderStorageError(w, r, err)
 		return
 	}
 	response := UserResponse{
 		ResponseStatus: OK(),
-		User:           newUser.User,
+		User:           user,
 	}
 	response.User.Id = id
 	log.Info("query successfully executed", slog.Any("request", response))
@@ -63,42 +74,62 @@ func (s *ServerAPI) HandleAddUser(w http.ResponseWriter, r *http.Request) {
 
 // HandleAddSegment godoc
 // @Summary Add a new segment
-// @Description Add a new segment to the system
+// @Description Add a new segment to the system. The segment is owned by the caller's team,
+// @Description only admins may set owner_team explicitly
 // @ID addSegment
+// @Tags legacy
+// @Deprecated
 // @Accept  json
 // @Produce  json
 // @Param segment body SegmentRequest true "Segment object to be added"
+// @Param Idempotency-Key header string false "Key making retries of the request safe"
 // @Success 201 {object} SegmentResponse "Successfully added segment"
-// @Failure 400 {object} ResponseStatus "Invalid input data"
-// @Failure 409 {object} ResponseStatus "Query execution failure"
+// @Failure 400 {object} Problem "Invalid input data"
+// @Failure 401 {object} Problem "Authentication required"
+// @Failure 403 {object} Problem "Insufficient role or segment owned by another team"
+// @Failure 409 {object} Problem "Segment already exists"
+// @Failure 500 {object} Problem "Query execution failure"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Failure 504 {object} Problem "Query timed out"
+// @Security BasicAuth
+// @Security ApiKeyAuth
+// @Security BearerAuth
 // @Router /segment/new [post]
 func (s *ServerAPI) HandleAddSegment(w http.ResponseWriter, r *http.Request) {
 	newSegment := &SegmentRequest{}
-	log := s.Log.With(
-		slog.String("request_id", middleware.GetReqID(r.Context())),
-	)
+	log := s.requestLog(r)
 	if err := render.DecodeJSON(r.Body, &newSegment); err != nil {
 		log.Error("failed to decode request body", logger.Err(err))
-		render.Status(r, http.StatusBadRequest)
-		render.JSON(w, r, Error("failed to decode request body"))
+		renderProblem(w, r, http.StatusBadRequest, CodeBadRequest, "failed to decode request body")
 		return
 	}
 	log.Info("request body decoded", slog.Any("request", *newSegment))
-	if err := validator.New().Struct(newSegment); err != nil {
+	if err := validate.Struct(newSegment); err != nil {
 		log.Error("wrong body structure", logger.Err(err))
-		render.Status(r, http.StatusBadRequest)
-		render.JSON(w, r, Error("wrong body structure"))
+		renderValidationProblem(w, r, err)
+		return
+	}
+	s.addSegment(w, r, log, newSegment.Segment)
+}
+
+// addSegment assigns the owner team, adds segment and writes the response.
+func (s *ServerAPI) addSegment(w http.ResponseWriter, r *http.Request, log *slog.Logger, segment storage.Segment) {
+	identity, _ := IdentityFromContext(r.Context())
+	if owner, err := segmentOwnerTeam(identity, segment.OwnerTeam); err != nil {
+		log.Error("segment owner rejected", logger.Err(err))
+		renderProblem(w, r, http.StatusForbidden, CodeForbidden, err.Error())
 		return
+	} else {
+		segment.OwnerTeam = owner
 	}
-	id, err := s.Store.AddSegment(context.Background(), newSegment.Segment, log)
+	id, err := s.Store.AddSegment(r.Context(), segment, log)
 	if err != nil {
-		render.Status(r, http.StatusConflict)
-		render.JSON(w, r, Error(err.Error()))
+		renderStorageError(w, r, err)
 		return
 	}
 	response := SegmentResponse{
 		ResponseStatus: OK(),
-		Segment:        newSegment.Segment,
+		Segment:        segment,
 	}
 	response.Segment.Id = id
 	log.Info("query successfully executed", slog.Any("request", response))
@@ -111,46 +142,59 @@ func (s *ServerAPI) HandleAddSegment(w http.ResponseWriter, r *http.Request) {
 // @Summary Add user ti a segment
 // @Description Link user to segments
 // @ID addUserToSegment
+// @Tags legacy
+// @Deprecated
 // @Accept  json
 // @Produce  json
 // @Param segment body UserSegmentRequest true "Segment object to be added"
+// @Param Idempotency-Key header string false "Key making retries of the request safe"
 // @Success 201 {object} UserSegmentRequest "Successfully linked segment to a user"
-// @Failure 400 {object} ResponseStatus "Invalid input data"
-// @Failure 409 {object} ResponseStatus "Query execution failure"
+// @Failure 400 {object} Problem "Invalid input data"
+// @Failure 401 {object} Problem "Authentication required"
+// @Failure 403 {object} Problem "Insufficient role or segment owned by another team"
+// @Failure 404 {object} Problem "User or segment doesn't exist"
+// @Failure 409 {object} Problem "User is already part of a segment"
+// @Failure 500 {object} Problem "Query execution failure"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Failure 504 {object} Problem "Query timed out"
+// @Security BasicAuth
+// @Security ApiKeyAuth
+// @Security BearerAuth
 // @Router /user/addSegment [post]
 func (s *ServerAPI) HandleAddUserToSegment(w http.ResponseWriter, r *http.Request) {
 	newUserSegment := &UserSegmentRequest{}
-	log := s.Log.With(
-		slog.String("request_id", middleware.GetReqID(r.Context())),
-	)
+	log := s.requestLog(r)
 	if err := render.DecodeJSON(r.Body, &newUserSegment); err != nil {
 		log.Error("failed to decode request body", logger.Err(err))
-		render.Status(r, http.StatusBadRequest)
-		render.JSON(w, r, Error("failed to decode request body"))
+		renderProblem(w, r, http.StatusBadRequest, CodeBadRequest, "failed to decode request body")
 		return
 	}
 	log.Info("request body decoded", slog.Any("request", *newUserSegment))
-	if err := validator.New().Struct(newUserSegment); err != nil {
+	if err := validate.Struct(newUserSegment); err != nil {
 		log.Error("wrong body structure", logger.Err(err))
-		render.Status(r, http.StatusBadRequest)
-		render.JSON(w, r, Error("wrong body structure"))
+		renderValidationProblem(w, r, err)
 		return
 	}
-	if len(newUserSegment.UserSegments.SegmentSlug) == 0 {
-		log.Error("empty segment array")
-		render.Status(r, http.StatusBadRequest)
-		render.JSON(w, r, Error("empty segment array"))
+	setSuccessorLink(w, fmt.Sprintf("/v1/users/%d/segments", newUserSegment.UserID))
+	s.addUserToSegments(w, r, log, newUserSegment.UserSegments)
+}
+
+// addUserToSegments adds user to segments owned by the caller's team and writes the response.
+func (s *ServerAPI) addUserToSegments(w http.ResponseWriter, r *http.Request, log *slog.Logger, userSegments storage.UserSegments) {
+	team, ok := authorizeSegments(w, r, log)
+	if !ok {
 		return
 	}
-	err := s.Store.AddUserToSegments(context.Background(), newUserSegment.UserSegments, log)
+	userSegments.OwnerTeam = team
+	outcomes, err := s.Store.AddUserToSegments(r.Context(), userSegments, log)
 	if err != nil {
-		render.Status(r, http.StatusConflict)
-		render.JSON(w, r, Error(err.Error()))
+		renderOutcomesProblem(w, r, err, outcomes)
 		return
 	}
 	response := UserSegmentResponse{
 		ResponseStatus: OK(),
-		UserSegments:   newUserSegment.UserSegments,
+		UserSegments:   userSegments,
+		Outcomes:       outcomes,
 	}
 	log.Info("query successfully executed", slog.Any("request", response))
 	render.Status(r, http.StatusOK)
@@ -162,36 +206,46 @@ func (s *ServerAPI) HandleAddUserToSegment(w http.ResponseWriter, r *http.Reques
 // @Summary Get user's segments information
 // @Description Get information about the segments a user belongs to
 // @ID getUserSegmentsInfo
+// @Tags legacy
+// @Deprecated
 // @Produce  json
 // @Param userID path string true "user ID to get list of segments for"
 // @Success 200 {object} GetSegmentsResponse "Successfully retrieved user segments"
-// @Failure 400 {object} ResponseStatus "Invalid input data"
-// @Failure 409 {object} ResponseStatus "Query execution failure"
+// @Failure 400 {object} Problem "Invalid input data"
+// @Failure 401 {object} Problem "Authentication required"
+// @Failure 403 {object} Problem "Insufficient role"
+// @Failure 404 {object} Problem "User doesn't exist"
+// @Failure 500 {object} Problem "Query execution failure"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Failure 504 {object} Problem "Query timed out"
+// @Security BasicAuth
+// @Security ApiKeyAuth
+// @Security BearerAuth
 // @Router /user/segments/{userID} [get]
 func (s *ServerAPI) HandleGetUserSegmentsInfo(w http.ResponseWriter, r *http.Request) {
 	user := &UserRequest{}
-	log := s.Log.With(
-		slog.String("request_id", middleware.GetReqID(r.Context())),
-	)
+	log := s.requestLog(r)
 	if uid, err := strconv.ParseUint(chi.URLParam(r, "userID"), 10, 64); err != nil {
 		log.Error("failed to parse user ID", logger.Err(err))
-		render.Status(r, http.StatusBadRequest)
-		render.JSON(w, r, Error("failed to parse user ID"))
+		renderProblem(w, r, http.StatusBadRequest, CodeBadRequest, "failed to parse user ID")
 		return
 	} else {
 		user.UID = uid
 	}
 	log.Info("user ID parsed successfully", slog.Any("request", *user))
-	if err := validator.New().Struct(user); err != nil {
+	if err := validate.Struct(user); err != nil {
 		log.Error("wrong body structure", logger.Err(err))
-		render.Status(r, http.StatusBadRequest)
-		render.JSON(w, r, Error("wrong body structure"))
+		renderValidationProblem(w, r, err)
 		return
 	}
-	segments, err := s.Store.GetUserSegmentsInfo(context.Background(), user.User, log)
+	s.getUserSegmentsInfo(w, r, log, user.User)
+}
+
+// getUserSegmentsInfo writes the list of segments the user is a member of.
+func (s *ServerAPI) getUserSegmentsInfo(w http.ResponseWriter, r *http.Request, log *slog.Logger, user storage.User) {
+	segments, err := s.Store.GetUserSegmentsInfo(r.Context(), user, log)
 	if err != nil {
-		render.Status(r, http.StatusConflict)
-		render.JSON(w, r, Error(err.Error()))
+		renderStorageError(w, r, err)
 		return
 	}
 	response := GetSegmentsResponse{
@@ -205,50 +259,189 @@ func (s *ServerAPI) HandleGetUserSegmentsInfo(w http.ResponseWriter, r *http.Req
 	return
 }
 
+// HandleGetUsersSegmentsInfo godoc
+// @Summary Get segments of many users
+// @Description Get the segments of each of the listed users in one request. Users that don't exist are left out of the result
+// @ID getUsersSegmentsInfo
+// @Tags legacy
+// @Deprecated
+// @Accept  json
+// @Produce  json
+// @Param users body UsersBatchRequest true "User IDs to get lists of segments for"
+// @Param Idempotency-Key header string false "Key making retries of the request safe"
+// @Success 200 {object} GetUsersSegmentsResponse "Successfully retrieved users segments"
+// @Failure 400 {object} Problem "Invalid input data"
+// @Failure 401 {object} Problem "Authentication required"
+// @Failure 403 {object} Problem "Insufficient role"
+// @Failure 500 {object} Problem "Query execution failure"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Failure 504 {object} Problem "Query timed out"
+// @Security BasicAuth
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Router /user/segments/batch [post]
+func (s *ServerAPI) HandleGetUsersSegmentsInfo(w http.ResponseWriter, r *http.Request) {
+	users := &UsersBatchRequest{}
+	log := s.requestLog(r)
+	if err := render.DecodeJSON(r.Body, &users); err != nil {
+		log.Error("failed to decode request body", logger.Err(err))
+		renderProblem(w, r, http.StatusBadRequest, CodeBadRequest, "failed to decode request body")
+		return
+	}
+	log.Info("request body decoded", slog.Any("request", *users))
+	if err := validate.Struct(users); err != nil {
+		log.Error("wrong body structure", logger.Err(err))
+		renderValidationProblem(w, r, err)
+		return
+	}
+	s.getUsersSegmentsInfo(w, r, log, users.UsersBatch)
+}
+
+// getUsersSegmentsInfo writes the lists of segments the users are members of.
+func (s *ServerAPI) getUsersSegmentsInfo(w http.ResponseWriter, r *http.Request, log *slog.Logger, users storage.UsersBatch) {
+	segments, err := s.Store.GetUsersSegmentsInfo(r.Context(), users, log)
+	if err != nil {
+		renderStorageError(w, r, err)
+		return
+	}
+	response := GetUsersSegmentsResponse{
+		ResponseStatus: OK(),
+		UsersSegments:  segments,
+	}
+	log.Info("query successfully executed", slog.Int("users", len(segments)))
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, response)
+	return
+}
+
+// HandleGetMembership godoc
+// @Summary Check user's membership in a segment
+// @Description Check whether a user is a member of a segment and since when
+// @ID getMembership
+// @Tags legacy
+// @Deprecated
+// @Produce  json
+// @Param userID path int true "User ID"
+// @Param slug path string true "Segment slug"
+// @Success 200 {object} MembershipResponse "Successfully checked membership"
+// @Failure 400 {object} Problem "Invalid input data"
+// @Failure 401 {object} Problem "Authentication required"
+// @Failure 403 {object} Problem "Insufficient role"
+// @Failure 404 {object} Problem "User or segment doesn't exist"
+// @Failure 500 {object} Problem "Query execution failure"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Failure 504 {object} Problem "Query timed out"
+// @Security BasicAuth
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Router /user/{userID}/segments/{slug} [get]
+func (s *ServerAPI) HandleGetMembership(w http.ResponseWriter, r *http.Request) {
+	log := s.requestLog(r)
+	userSegments, ok := parseUserSegment(w, r, log)
+	if !ok {
+		return
+	}
+	s.getMembership(w, r, log, userSegments)
+}
+
+// getMembership writes the user's membership in the only segment of userSegments.
+func (s *ServerAPI) getMembership(w http.ResponseWriter, r *http.Request, log *slog.Logger, userSegments storage.UserSegments) {
+	memberships, err := s.Store.GetMemberships(r.Context(), userSegments, log)
+	if err != nil {
+		renderStorageError(w, r, err)
+		return
+	}
+	if len(memberships) == 0 {
+		log.Error("no membership returned", slog.Uint64("user_id", userSegments.UserID), slog.Any("segments", userSegments.SegmentSlug))
+		renderProblem(w, r, http.StatusNotFound, CodeNotFound, "membership doesn't exist")
+		return
+	}
+	response := MembershipResponse{
+		ResponseStatus: OK(),
+		UserID:         userSegments.UserID,
+		Membership:     memberships[0],
+	}
+	log.Info("query successfully executed", slog.Any("request", response))
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, response)
+	return
+}
+
+// getMemberships writes the user's membership in each segment of userSegments.
+func (s *ServerAPI) getMemberships(w http.ResponseWriter, r *http.Request, log *slog.Logger, userSegments storage.UserSegments) {
+	memberships, err := s.Store.GetMemberships(r.Context(), userSegments, log)
+	if err != nil {
+		renderStorageError(w, r, err)
+		return
+	}
+	response := MembershipsResponse{
+		ResponseStatus: OK(),
+		UserID:         userSegments.UserID,
+		Memberships:    memberships,
+	}
+	log.Info("query successfully executed", slog.Any("request", response))
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, response)
+	return
+}
+
 // HandleDeleteUserFromSegment godoc
 // @Summary Remove a user from one or more segments
 // @Description Remove a user from one or more segments
 // @ID deleteUserFromSegment
+// @Tags legacy
+// @Deprecated
 // @Accept  json
 // @Produce  json
 // @Param userSegments body UserSegmentRequest true "User and segment association"
+// @Param Idempotency-Key header string false "Key making retries of the request safe"
 // @Success 200 {object} UserSegmentResponse "Successfully removed user from segment"
-// @Failure 400 {object} ResponseStatus "Invalid input data"
-// @Failure 409 {object} ResponseStatus "Query execution failure"
+// @Failure 400 {object} Problem "Invalid input data"
+// @Failure 401 {object} Problem "Authentication required"
+// @Failure 403 {object} Problem "Insufficient role or segment owned by another team"
+// @Failure 404 {object} Problem "User or segment doesn't exist"
+// @Failure 409 {object} Problem "User is not part of a segment"
+// @Failure 500 {object} Problem "Query execution failure"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Failure 504 {object} Problem "Query timed out"
+// @Security BasicAuth
+// @Security ApiKeyAuth
+// @Security BearerAuth
 // @Router /user/segments [delete]
 func (s *ServerAPI) HandleDeleteUserFromSegment(w http.ResponseWriter, r *http.Request) {
 	newUserSegment := &UserSegmentRequest{}
-	log := s.Log.With(
-		slog.String("request_id", middleware.GetReqID(r.Context())),
-	)
+	log := s.requestLog(r)
 	if err := render.DecodeJSON(r.Body, &newUserSegment); err != nil {
 		log.Error("failed to decode request body", logger.Err(err))
-		render.Status(r, http.StatusBadRequest)
-		render.JSON(w, r, Error("failed to decode request body"))
+		renderProblem(w, r, http.StatusBadRequest, CodeBadRequest, "failed to decode request body")
 		return
 	}
 	log.Info("request body decoded", slog.Any("request", *newUserSegment))
-	if err := validator.New().Struct(newUserSegment); err != nil {
+	if err := validate.Struct(newUserSegment); err != nil {
 		log.Error("wrong body structure", logger.Err(err))
-		render.Status(r, http.StatusBadRequest)
-		render.JSON(w, r, Error("wrong body structure"))
+		renderValidationProblem(w, r, err)
 		return
 	}
-	if len(newUserSegment.UserSegments.SegmentSlug) == 0 {
-		log.Error("empty segment array")
-		render.Status(r, http.StatusBadRequest)
-		render.JSON(w, r, Error("empty segment array"))
+	// Every segment is removed by its own /v1 request, the link points to the segments of the user.
+	setSuccessorLink(w, fmt.Sprintf("/v1/users/%d/segments", newUserSegment.UserID))
+	s.deleteUserFromSegments(w, r, log, newUserSegment.UserSegments)
+}
+
+// deleteUserFromSegments removes user from segments owned by the caller's team and writes the response.
+func (s *ServerAPI) deleteUserFromSegments(w http.ResponseWriter, r *http.Request, log *slog.Logger, userSegments storage.UserSegments) {
+	team, ok := authorizeSegments(w, r, log)
+	if !ok {
 		return
 	}
-	err := s.Store.DeleteUserFromSegments(context.Background(), newUserSegment.UserSegments, log)
+	userSegments.OwnerTeam = team
+	err := s.Store.DeleteUserFromSegments(r.Context(), userSegments, log)
 	if err != nil {
-		render.Status(r, http.StatusConflict)
-		render.JSON(w, r, Error(err.Error()))
+		renderStorageError(w, r, err)
 		return
 	}
 	response := UserSegmentResponse{
 		ResponseStatus: OK(),
-		UserSegments:   newUserSegment.UserSegments,
+		UserSegments:   userSegments,
 	}
 	log.Info("query successfully executed", slog.Any("request", response))
 	render.Status(r, http.StatusOK)
@@ -260,40 +453,57 @@ func (s *ServerAPI) HandleDeleteUserFromSegment(w http.ResponseWriter, r *http.R
 // @Summary Cascade delete a segment
 // @Description Cascade delete a segment and remove associated users
 // @ID cascadeDeleteSegment
+// @Tags legacy
+// @Deprecated
 // @Accept  json
 // @Produce  json
 // @Param segment body SegmentRequest true "Segment object to delete"
+// @Param Idempotency-Key header string false "Key making retries of the request safe"
 // @Success 200 {object} SegmentResponse "Successfully deleted segment"
-// @Failure 400 {object} ResponseStatus "Invalid input data"
-// @Failure 409 {object} ResponseStatus "Query execution failure"
+// @Failure 400 {object} Problem "Invalid input data"
+// @Failure 401 {object} Problem "Authentication required"
+// @Failure 403 {object} Problem "Insufficient role or segment owned by another team"
+// @Failure 404 {object} Problem "Segment doesn't exist"
+// @Failure 500 {object} Problem "Query execution failure"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Failure 504 {object} Problem "Query timed out"
+// @Security BasicAuth
+// @Security ApiKeyAuth
+// @Security BearerAuth
 // @Router /segment/remove [delete]
 func (s *ServerAPI) HandleCascadeDeleteSegment(w http.ResponseWriter, r *http.Request) {
 	newSegment := &SegmentRequest{}
-	log := s.Log.With(
-		slog.String("request_id", middleware.GetReqID(r.Context())),
-	)
+	log := s.requestLog(r)
 	if err := render.DecodeJSON(r.Body, &newSegment); err != nil {
 		log.Error("failed to decode request body", logger.Err(err))
-		render.Status(r, http.StatusBadRequest)
-		render.JSON(w, r, Error("failed to decode request body"))
+		renderProblem(w, r, http.StatusBadRequest, CodeBadRequest, "failed to decode request body")
 		return
 	}
 	log.Info("request body decoded", slog.Any("request", *newSegment))
-	if err := validator.New().Struct(newSegment); err != nil {
+	if err := validate.Struct(newSegment); err != nil {
 		log.Error("wrong body structure", logger.Err(err))
-		render.Status(r, http.StatusBadRequest)
-		render.JSON(w, r, Error("wrong body structure"))
+		renderValidationProblem(w, r, err)
+		return
+	}
+	setSuccessorLink(w, "/v1/segments/"+url.PathEscape(newSegment.Slug))
+	s.cascadeDeleteSegment(w, r, log, newSegment.Segment)
+}
+
+// cascadeDeleteSegment deletes segment if it's owned by the caller's team and writes the response.
+func (s *ServerAPI) cascadeDeleteSegment(w http.ResponseWriter, r *http.Request, log *slog.Logger, segment storage.Segment) {
+	team, ok := authorizeSegments(w, r, log)
+	if !ok {
 		return
 	}
-	err := s.Store.CascadeDeleteSegment(context.Background(), newSegment.Segment, log)
+	segment.OwnerTeam = team
+	err := s.Store.CascadeDeleteSegment(r.Context(), segment, log)
 	if err != nil {
-		render.Status(r, http.StatusConflict)
-		render.JSON(w, r, Error(err.Error()))
+		renderStorageError(w, r, err)
 		return
 	}
 	response := SegmentResponse{
 		ResponseStatus: OK(),
-		Segment:        newSegment.Segment,
+		Segment:        segment,
 	}
 	log.Info("query successfully executed", slog.Any("request", response))
 	render.Status(r, http.StatusOK)
@@ -305,29 +515,40 @@ func (s *ServerAPI) HandleCascadeDeleteSegment(w http.ResponseWriter, r *http.Re
 // @Summary Get users of a segment
 // @Description Get a list of users belonging to a specific segment
 // @ID getSegmentUsersInfo
+// @Tags legacy
+// @Deprecated
 // @Produce  json
 // @Param segmentName path string true "segment Name to get list of its users"
 // @Success 200 {object} GetUsersResponse "Successfully retrieved segment users"
-// @Failure 400 {object} ResponseStatus "Invalid input data"
-// @Failure 409 {object} ResponseStatus "Query execution failure"
+// @Failure 400 {object} Problem "Invalid input data"
+// @Failure 401 {object} Problem "Authentication required"
+// @Failure 403 {object} Problem "Insufficient role"
+// @Failure 404 {object} Problem "Segment doesn't exist"
+// @Failure 500 {object} Problem "Query execution failure"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Failure 504 {object} Problem "Query timed out"
+// @Security BasicAuth
+// @Security ApiKeyAuth
+// @Security BearerAuth
 // @Router /segment/users/{segmentName} [get]
 func (s *ServerAPI) HandleGetSegmentUsersInfo(w http.ResponseWriter, r *http.Request) {
 	segment := &SegmentRequest{}
-	log := s.Log.With(
-		slog.String("request_id", middleware.GetReqID(r.Context())),
-	)
+	log := s.requestLog(r)
 	segment.Slug = chi.URLParam(r, "segmentName")
 	log.Info("segment name received", slog.Any("request", *segment))
-	if err := validator.New().Struct(segment); err != nil {
+	if err := validate.Struct(segment); err != nil {
 		log.Error("wrong body structure", logger.Err(err))
-		render.Status(r, http.StatusBadRequest)
-		render.JSON(w, r, Error("wrong body structure"))
+		renderValidationProblem(w, r, err)
 		return
 	}
-	users, err := s.Store.GetSegmentUsersInfo(context.Background(), segment.Segment, log)
+	s.getSegmentUsersInfo(w, r, log, segment.Segment)
+}
+
+// getSegmentUsersInfo writes the list of users the segment has.
+func (s *ServerAPI) getSegmentUsersInfo(w http.ResponseWriter, r *http.Request, log *slog.Logger, segment storage.Segment) {
+	users, err := s.Store.GetSegmentUsersInfo(r.Context(), segment, log)
 	if err != nil {
-		render.Status(r, http.StatusConflict)
-		render.JSON(w, r, Error(err.Error()))
+		renderStorageError(w, r, err)
 		return
 	}
 	response := GetUsersResponse{
@@ -345,46 +566,53 @@ func (s *ServerAPI) HandleGetSegmentUsersInfo(w http.ResponseWriter, r *http.Req
 // @Summary Generate CSV report
 // @Description Generate a CSV report for a specific month and year
 // @ID generateCsvReport
+// @Tags legacy
+// @Deprecated
 // @Accept  json
 // @Produce  json
 // @Param csvReport body CsvReportRequest true "CSV report request"
+// @Param Idempotency-Key header string false "Key making retries of the request safe"
 // @Success 200 {object} CsvReportResponse "Successfully generated CSV report"
-// @Failure 400 {object} ResponseStatus "Invalid input data"
-// @Failure 409 {object} ResponseStatus "Query execution failure"
+// @Failure 400 {object} Problem "Invalid input data"
+// @Failure 401 {object} Problem "Authentication required"
+// @Failure 403 {object} Problem "Insufficient role"
+// @Failure 500 {object} Problem "Query execution failure"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Failure 504 {object} Problem "Query timed out"
+// @Security BasicAuth
+// @Security ApiKeyAuth
+// @Security BearerAuth
 // @Router /report [post]
 func (s *ServerAPI) HandleCsvReport(w http.ResponseWriter, r *http.Request) {
 	dates := &CsvReportRequest{}
-	log := s.Log.With(
-		slog.String("request_id", middleware.GetReqID(r.Context())),
-	)
+	log := s.requestLog(r)
 	if err := render.DecodeJSON(r.Body, &dates); err != nil {
 		log.Error("failed to decode request body", logger.Err(err))
-		render.Status(r, http.StatusBadRequest)
-		render.JSON(w, r, Error("failed to decode request body"))
+		renderProblem(w, r, http.StatusBadRequest, CodeBadRequest, "failed to decode request body")
 		return
 	}
 	log.Info("request body decoded", slog.Any("request", *dates))
-	if err := validator.New().Struct(dates); err != nil {
+	if err := validate.Struct(dates); err != nil {
 		log.Error("wrong body structure", logger.Err(err))
-		render.Status(r, http.StatusBadRequest)
-		render.JSON(w, r, Error("wrong body structure"))
-		return
-	}
-	if !(dates.Month > 0 && dates.Month < 13) {
-		log.Error("wrong body structure", logger.Err(fmt.Errorf("wrong month format")))
-		render.Status(r, http.StatusConflict)
-		render.JSON(w, r, Error("wrong month format"))
+		renderValidationProblem(w, r, err)
 		return
 	}
-	if err := s.Store.CsvHistoryReport(context.Background(), dates.CsvReport, log); err != nil {
-		render.Status(r, http.StatusConflict)
-		render.JSON(w, r, Error(err.Error()))
+	s.csvReport(w, r, log, dates.CsvReport, "/report/")
+}
+
+// csvReport generates the report and writes a signed download link under linkPrefix.
+func (s *ServerAPI) csvReport(w http.ResponseWriter, r *http.Request, log *slog.Logger, dates storage.CsvReport, linkPrefix string) {
+	reportID, err := s.Store.CsvHistoryReport(r.Context(), dates, log)
+	if err != nil {
+		renderStorageError(w, r, err)
 		return
 	}
-	url := fmt.Sprintf("http://localhost:%s/report/%s_%d_%d.csv", os.Getenv("PORT"), "report", dates.Year, dates.Month)
+	link, expires := s.reportLink(reportID, linkPrefix)
 	response := CsvReportResponse{
 		ResponseStatus: OK(),
-		CsvUrl:         url,
+		ReportID:       reportID,
+		CsvUrl:         link,
+		ExpiresAt:      expires,
 	}
 	log.Info("query successfully executed", slog.Any("request", response))
 	render.Status(r, http.StatusOK)
@@ -392,35 +620,58 @@ func (s *ServerAPI) HandleCsvReport(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// reportLink signs a download link for the report served under linkPrefix.
+func (s *ServerAPI) reportLink(reportID, linkPrefix string) (string, time.Time) {
+	expires, signature := s.Reports.Sign(reportID, time.Now())
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("signature", signature)
+	return s.PublicURL + linkPrefix + reportID + "?" + query.Encode(), expires
+}
+
 // HandleDownloadCsv godoc
 // @Summary Download CSV report
-// @Description Download a previously generated CSV report
+// @Description Download a previously generated CSV report using the signed link returned by report generation
 // @ID downloadCsvReport
+// @Tags legacy
+// @Deprecated
 // @Produce  text/csv
-// @Param fileName path string true "CSV file name to download"
+// @Param reportID path string true "Report ID to download"
+// @Param expires query int true "Link expiration as unix timestamp"
+// @Param signature query string true "Link signature"
 // @Success 200 {file} file "CSV file for download"
-// @Failure 400 {object} ResponseStatus "Invalid file name"
-// @Router /report/{fileName} [get]
+// @Failure 400 {object} Problem "Invalid report ID"
+// @Failure 401 {object} Problem "Authentication required"
+// @Failure 403 {object} Problem "Invalid or expired link, or insufficient role"
+// @Failure 404 {object} Problem "Report doesn't exist"
+// @Security BasicAuth
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Router /report/{reportID} [get]
 func (s *ServerAPI) HandleDownloadCsv(w http.ResponseWriter, r *http.Request) {
-	log := s.Log.With(
-		slog.String("request_id", middleware.GetReqID(r.Context())),
-	)
-	fileName := fmt.Sprintf("%s%s.csv", os.Getenv("CSV_PATH"), chi.URLParam(r, "fileName"))
-	if len(fileName) < 1 {
-		log.Error("file name is empty", logger.Err(fmt.Errorf("file name is empty")))
-		render.Status(r, http.StatusBadRequest)
-		render.JSON(w, r, Error("file name is empty"))
-		return
-	}
-	log.Info("file name acquired", slog.Any("request", fileName))
-	if _, err := os.Stat(fileName); errors.Is(err, os.ErrNotExist) {
+	log := s.requestLog(r)
+	reportID := chi.URLParam(r, "reportID")
+	fileName, err := storage.ResolveReportPath(os.Getenv("CSV_PATH"), reportID)
+	if err != nil {
+		log.Error("invalid report id", logger.Err(err))
+		renderProblem(w, r, http.StatusBadRequest, CodeBadRequest, "invalid report id")
+		return
+	}
+	query := r.URL.Query()
+	if err = s.Reports.Verify(reportID, query.Get("expires"), query.Get("signature"), time.Now()); err != nil {
+		log.Error("download link rejected", logger.Err(err))
+		renderProblem(w, r, http.StatusForbidden, CodeForbidden, err.Error())
+		return
+	}
+	log.Info("report id acquired", slog.String("report_id", reportID))
+	if _, err = os.Stat(fileName); errors.Is(err, os.ErrNotExist) {
 		log.Error("file doesn't exist", logger.Err(err))
-		render.Status(r, http.StatusBadRequest)
-		render.JSON(w, r, Error("file doesn't exist"))
+		renderProblem(w, r, http.StatusNotFound, CodeNotFound, "file doesn't exist")
 		return
 	}
-	log.Info("file successfully found", slog.Any("request", fileName))
-	w.Header().Set("Content-Disposition", "attachment; filename="+fileName)
+	log.Info("file successfully found", slog.String("report_id", reportID))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"report_%s.csv\"", reportID))
+	w.Header().Set("Cache-Control", "no-store")
 	http.ServeFile(w, r, fileName)
 	return
 }
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/vlasashk/user-segmentation/internal/model/storage"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// noMembershipsStore answers membership checks without any membership.
+type noMembershipsStore struct {
+	Storage
+}
+
+func (noMembershipsStore) GetMemberships(context.Context, storage.UserSegments, *slog.Logger) ([]storage.Membership, error) {
+	return nil, nil
+}
+
+func TestGetMembership(t *testing.T) {
+	s, router := newTestRouter(t)
+	for _, path := range []string{"/v1/users/1/segments/growth-seg", "/user/1/segments/growth-seg"} {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("X-API-Key", "reader-key")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		var response MembershipResponse
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		if w.Code != http.StatusOK || response.UserID != 1 || response.Slug != "growth-seg" || response.Member {
+			t.Errorf("GET %s = %d %+v, want user 1 not in growth-seg", path, w.Code, response)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/user/1/segments/growth-seg", nil)
+	r.Header.Set("X-API-Key", "reader-key")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if got, want := w.Header().Get("Link"), `</v1/users/1/segments/growth-seg>; rel="successor-version"`; got != want {
+		t.Errorf("Link = %q, want %q", got, want)
+	}
+
+	s.Store = noMembershipsStore{s.Store}
+	router = s.routes()
+	for _, path := range []string{"/v1/users/1/segments/growth-seg", "/user/1/segments/growth-seg"} {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("X-API-Key", "reader-key")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		var problem Problem
+		_ = json.NewDecoder(w.Body).Decode(&problem)
+		if w.Code != http.StatusNotFound || problem.Code != CodeNotFound {
+			t.Errorf("GET %s without memberships = %d %+v, want %d", path, w.Code, problem, http.StatusNotFound)
+		}
+	}
+}
+
+func TestGetUsersSegmentsInfo(t *testing.T) {
+	s, router := newTestRouter(t)
+	member := storage.UserSegments{UserID: 1, SegmentSlug: []string{"growth-seg"}, OwnerTeam: "growth"}
+	if _, err := s.Store.AddUserToSegments(context.Background(), member, s.Log); err != nil {
+		t.Fatalf("AddUserToSegments() failed: %v", err)
+	}
+	for _, path := range []string{"/v1/users/segments/batch", "/user/segments/batch"} {
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"user_ids":[1,2]}`))
+		r.Header.Set("X-API-Key", "reader-key")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		var response GetUsersSegmentsResponse
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		want := map[uint64][]string{1: {"growth-seg"}}
+		if w.Code != http.StatusOK || !maps.EqualFunc(response.UsersSegments, want, slices.Equal[[]string]) {
+			t.Errorf("POST %s = %d %v, want %v", path, w.Code, response.UsersSegments, want)
+		}
+		wantLink := ""
+		if path == "/user/segments/batch" {
+			wantLink = `</v1/users/segments/batch>; rel="successor-version"`
+		}
+		if got := w.Header().Get("Link"); got != wantLink {
+			t.Errorf("POST %s Link = %q, want %q", path, got, wantLink)
+		}
+	}
+}
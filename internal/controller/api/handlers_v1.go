@@ -0,0 +1,475 @@
+package api
+
+import (
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/vlasashk/user-segmentation/internal/model/logger"
+	"github.com/vlasashk/user-segmentation/internal/model/storage"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// HandleV1AddUser godoc
+// @Summary Add a new user
+// @Description Add a new user to the system
+// @ID v1AddUser
+// @Tags v1
+// @Accept  json
+// @Produce  json
+// @Param user body UserRequest true "User object to be added"
+// @Param Idempotency-Key header string false "Key making retries of the request safe"
+// @Success 200 {object} UserResponse "Successfully added user"
+// @Failure 400 {object} Problem "Invalid input data"
+// @Failure 401 {object} Problem "Authentication required"
+// @Failure 403 {object} Problem "Insufficient role"
+// @Failure 409 {object} Problem "User already exists"
+// @Failure 500 {object} Problem "Query execution failure"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Failure 504 {object} Problem "Query timed out"
+// @Security BasicAuth
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Router /v1/users [post]
+func (s *ServerAPI) HandleV1AddUser(w http.ResponseWriter, r *http.Request) {
+	user := &UserRequest{}
+	log := s.requestLog(r)
+	if !decodeRequest(w, r, log, user) {
+		return
+	}
+	s.addUser(w, r, log, user.User)
+}
+
+// HandleV1GetUserSegments godoc
+// @Summary Get user's segments information
+// @Description Get information about the segments a user belongs to
+// @ID v1GetUserSegments
+// @Tags v1
+// @Produce  json
+// @Param userID path int true "User ID"
+// @Success 200 {object} GetSegmentsResponse "Successfully retrieved user segments"
+// @Failure 400 {object} Problem "Invalid input data"
+// @Failure 401 {object} Problem "Authentication required"
+// @Failure 403 {object} Problem "Insufficient role"
+// @Failure 404 {object} Problem "User doesn't exist"
+// @Failure 500 {object} Problem "Query execution failure"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Failure 504 {object} Problem "Query timed out"
+// @Security BasicAuth
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Router /v1/users/{userID}/segments [get]
+func (s *ServerAPI) HandleV1GetUserSegments(w http.ResponseWriter, r *http.Request) {
+	log := s.requestLog(r)
+	uid, ok := parseUserID(w, r, log)
+	if !ok {
+		return
+	}
+	user := &UserRequest{storage.User{UID: uid}}
+	if !validateRequest(w, r, log, user) {
+		return
+	}
+	s.getUserSegmentsInfo(w, r, log, user.User)
+}
+
+// HandleV1GetUsersSegments godoc
+// @Summary Get segments of many users
+// @Description Get the segments of each of the listed users in one request. Users that don't exist are left out of the result
+// @ID v1GetUsersSegments
+// @Tags v1
+// @Accept  json
+// @Produce  json
+// @Param users body UsersBatchRequest true "User IDs to get lists of segments for"
+// @Param Idempotency-Key header string false "Key making retries of the request safe"
+// @Success 200 {object} GetUsersSegmentsResponse "Successfully retrieved users segments"
+// @Failure 400 {object} Problem "Invalid input data"
+// @Failure 401 {object} Problem "Authentication required"
+// @Failure 403 {object} Problem "Insufficient role"
+// @Failure 500 {object} Problem "Query execution failure"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Failure 504 {object} Problem "Query timed out"
+// @Security BasicAuth
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Router /v1/users/segments/batch [post]
+func (s *ServerAPI) HandleV1GetUsersSegments(w http.ResponseWriter, r *http.Request) {
+	users := &UsersBatchRequest{}
+	log := s.requestLog(r)
+	if !decodeRequest(w, r, log, users) {
+		return
+	}
+	s.getUsersSegmentsInfo(w, r, log, users.UsersBatch)
+}
+
+// HandleV1AddUserToSegments godoc
+// @Summary Add user to segments
+// @Description Add user to all listed segments, none of them are added if any of them fails
+// @ID v1AddUserToSegments
+// @Tags v1
+// @Accept  json
+// @Produce  json
+// @Param userID path int true "User ID"
+// @Param segments body SegmentListRequest true "Segments to add the user to"
+// @Param Idempotency-Key header string false "Key making retries of the request safe"
+// @Success 200 {object} UserSegmentResponse "Successfully linked segments to a user"
+// @Failure 400 {object} Problem "Invalid input data"
+// @Failure 401 {object} Problem "Authentication required"
+// @Failure 403 {object} Problem "Insufficient role or segment owned by another team"
+// @Failure 404 {object} Problem "User or segment doesn't exist"
+// @Failure 409 {object} Problem "User is already part of a segment"
+// @Failure 500 {object} Problem "Query execution failure"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Failure 504 {object} Problem "Query timed out"
+// @Security BasicAuth
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Router /v1/users/{userID}/segments [post]
+func (s *ServerAPI) HandleV1AddUserToSegments(w http.ResponseWriter, r *http.Request) {
+	log := s.requestLog(r)
+	uid, ok := parseUserID(w, r, log)
+	if !ok {
+		return
+	}
+	segments := &SegmentListRequest{}
+	if !decodeRequest(w, r, log, segments) {
+		return
+	}
+	userSegments := &UserSegmentRequest{storage.UserSegments{UserID: uid, SegmentSlug: segments.SegmentSlug}}
+	if !validateRequest(w, r, log, userSegments) {
+		return
+	}
+	s.addUserToSegments(w, r, log, userSegments.UserSegments)
+}
+
+// HandleV1PutUserSegment godoc
+// @Summary Add user to a segment
+// @Description Make user a member of the segment. Repeating the request for a member succeeds without changes
+// @ID v1PutUserSegment
+// @Tags v1
+// @Produce  json
+// @Param userID path int true "User ID"
+// @Param slug path string true "Segment slug"
+// @Param Idempotency-Key header string false "Key making retries of the request safe"
+// @Success 200 {object} UserSegmentResponse "User is a member of the segment"
+// @Failure 400 {object} Problem "Invalid input data"
+// @Failure 401 {object} Problem "Authentication required"
+// @Failure 403 {object} Problem "Insufficient role or segment owned by another team"
+// @Failure 404 {object} Problem "User or segment doesn't exist"
+// @Failure 500 {object} Problem "Query execution failure"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Failure 504 {object} Problem "Query timed out"
+// @Security BasicAuth
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Router /v1/users/{userID}/segments/{slug} [put]
+func (s *ServerAPI) HandleV1PutUserSegment(w http.ResponseWriter, r *http.Request) {
+	log := s.requestLog(r)
+	userSegments, ok := parseUserSegment(w, r, log)
+	if !ok {
+		return
+	}
+	team, ok := authorizeSegments(w, r, log)
+	if !ok {
+		return
+	}
+	userSegments.OwnerTeam = team
+	_, err := s.Store.AddUserToSegments(r.Context(), userSegments, log)
+	if err != nil && !errors.Is(err, storage.ErrAlreadyExists) {
+		renderStorageError(w, r, err)
+		return
+	}
+	response := UserSegmentResponse{
+		ResponseStatus: OK(),
+		UserSegments:   userSegments,
+	}
+	log.Info("query successfully executed", slog.Any("request", response))
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, response)
+}
+
+// HandleV1GetUserSegment godoc
+// @Summary Check user's membership in a segment
+// @Description Check whether a user is a member of a segment and since when
+// @ID v1GetUserSegment
+// @Tags v1
+// @Produce  json
+// @Param userID path int true "User ID"
+// @Param slug path string true "Segment slug"
+// @Success 200 {object} MembershipResponse "Successfully checked membership"
+// @Failure 400 {object} Problem "Invalid input data"
+// @Failure 401 {object} Problem "Authentication required"
+// @Failure 403 {object} Problem "Insufficient role"
+// @Failure 404 {object} Problem "User or segment doesn't exist"
+// @Failure 500 {object} Problem "Query execution failure"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Failure 504 {object} Problem "Query timed out"
+// @Security BasicAuth
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Router /v1/users/{userID}/segments/{slug} [get]
+func (s *ServerAPI) HandleV1GetUserSegment(w http.ResponseWriter, r *http.Request) {
+	log := s.requestLog(r)
+	userSegments, ok := parseUserSegment(w, r, log)
+	if !ok {
+		return
+	}
+	s.getMembership(w, r, log, userSegments)
+}
+
+// HandleV1GetUserMemberships godoc
+// @Summary Check user's membership in several segments
+// @Description Check whether a user is a member of each of the listed segments and since when
+// @ID v1GetUserMemberships
+// @Tags v1
+// @Produce  json
+// @Param userID path int true "User ID"
+// @Param slug query []string true "Segment slugs" collectionFormat(multi)
+// @Success 200 {object} MembershipsResponse "Successfully checked memberships"
+// @Failure 400 {object} Problem "Invalid input data"
+// @Failure 401 {object} Problem "Authentication required"
+// @Failure 403 {object} Problem "Insufficient role"
+// @Failure 404 {object} Problem "User or segment doesn't exist"
+// @Failure 500 {object} Problem "Query execution failure"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Failure 504 {object} Problem "Query timed out"
+// @Security BasicAuth
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Router /v1/users/{userID}/memberships [get]
+func (s *ServerAPI) HandleV1GetUserMemberships(w http.ResponseWriter, r *http.Request) {
+	log := s.requestLog(r)
+	userSegments, ok := parseUserMemberships(w, r, log)
+	if !ok {
+		return
+	}
+	s.getMemberships(w, r, log, userSegments)
+}
+
+// HandleV1DeleteUserSegment godoc
+// @Summary Remove user from a segment
+// @Description Remove user from the segment by marking deleted_at field
+// @ID v1DeleteUserSegment
+// @Tags v1
+// @Produce  json
+// @Param userID path int true "User ID"
+// @Param slug path string true "Segment slug"
+// @Param Idempotency-Key header string false "Key making retries of the request safe"
+// @Success 200 {object} UserSegmentResponse "Successfully removed user from segment"
+// @Failure 400 {object} Problem "Invalid input data"
+// @Failure 401 {object} Problem "Authentication required"
+// @Failure 403 {object} Problem "Insufficient role or segment owned by another team"
+// @Failure 404 {object} Problem "User or segment doesn't exist"
+// @Failure 409 {object} Problem "User is not part of the segment"
+// @Failure 500 {object} Problem "Query execution failure"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Failure 504 {object} Problem "Query timed out"
+// @Security BasicAuth
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Router /v1/users/{userID}/segments/{slug} [delete]
+func (s *ServerAPI) HandleV1DeleteUserSegment(w http.ResponseWriter, r *http.Request) {
+	log := s.requestLog(r)
+	userSegments, ok := parseUserSegment(w, r, log)
+	if !ok {
+		return
+	}
+	s.deleteUserFromSegments(w, r, log, userSegments)
+}
+
+// HandleV1AddSegment godoc
+// @Summary Add a new segment
+// @Description Add a new segment to the system. The segment is owned by the caller's team,
+// @Description only admins may set owner_team explicitly
+// @ID v1AddSegment
+// @Tags v1
+// @Accept  json
+// @Produce  json
+// @Param segment body SegmentRequest true "Segment object to be added"
+// @Param Idempotency-Key header string false "Key making retries of the request safe"
+// @Success 200 {object} SegmentResponse "Successfully added segment"
+// @Failure 400 {object} Problem "Invalid input data"
+// @Failure 401 {object} Problem "Authentication required"
+// @Failure 403 {object} Problem "Insufficient role or segment owned by another team"
+// @Failure 409 {object} Problem "Segment already exists"
+// @Failure 500 {object} Problem "Query execution failure"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Failure 504 {object} Problem "Query timed out"
+// @Security BasicAuth
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Router /v1/segments [post]
+func (s *ServerAPI) HandleV1AddSegment(w http.ResponseWriter, r *http.Request) {
+	segment := &SegmentRequest{}
+	log := s.requestLog(r)
+	if !decodeRequest(w, r, log, segment) {
+		return
+	}
+	s.addSegment(w, r, log, segment.Segment)
+}
+
+// HandleV1DeleteSegment godoc
+// @Summary Cascade delete a segment
+// @Description Cascade delete a segment and remove associated users
+// @ID v1DeleteSegment
+// @Tags v1
+// @Produce  json
+// @Param slug path string true "Segment slug"
+// @Param Idempotency-Key header string false "Key making retries of the request safe"
+// @Success 200 {object} SegmentResponse "Successfully deleted segment"
+// @Failure 400 {object} Problem "Invalid input data"
+// @Failure 401 {object} Problem "Authentication required"
+// @Failure 403 {object} Problem "Insufficient role or segment owned by another team"
+// @Failure 404 {object} Problem "Segment doesn't exist"
+// @Failure 500 {object} Problem "Query execution failure"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Failure 504 {object} Problem "Query timed out"
+// @Security BasicAuth
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Router /v1/segments/{slug} [delete]
+func (s *ServerAPI) HandleV1DeleteSegment(w http.ResponseWriter, r *http.Request) {
+	log := s.requestLog(r)
+	segment := &SegmentRequest{storage.Segment{Slug: chi.URLParam(r, "slug")}}
+	if !validateRequest(w, r, log, segment) {
+		return
+	}
+	s.cascadeDeleteSegment(w, r, log, segment.Segment)
+}
+
+// HandleV1GetSegmentUsers godoc
+// @Summary Get users of a segment
+// @Description Get a list of users belonging to a specific segment
+// @ID v1GetSegmentUsers
+// @Tags v1
+// @Produce  json
+// @Param slug path string true "Segment slug"
+// @Success 200 {object} GetUsersResponse "Successfully retrieved segment users"
+// @Failure 400 {object} Problem "Invalid input data"
+// @Failure 401 {object} Problem "Authentication required"
+// @Failure 403 {object} Problem "Insufficient role"
+// @Failure 404 {object} Problem "Segment doesn't exist"
+// @Failure 500 {object} Problem "Query execution failure"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Failure 504 {object} Problem "Query timed out"
+// @Security BasicAuth
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Router /v1/segments/{slug}/users [get]
+func (s *ServerAPI) HandleV1GetSegmentUsers(w http.ResponseWriter, r *http.Request) {
+	log := s.requestLog(r)
+	segment := &SegmentRequest{storage.Segment{Slug: chi.URLParam(r, "slug")}}
+	if !validateRequest(w, r, log, segment) {
+		return
+	}
+	s.getSegmentUsersInfo(w, r, log, segment.Segment)
+}
+
+// HandleV1CsvReport godoc
+// @Summary Generate CSV report
+// @Description Generate a CSV report for a specific month and year and return a signed link to download it
+// @ID v1GenerateCsvReport
+// @Tags v1
+// @Accept  json
+// @Produce  json
+// @Param csvReport body CsvReportRequest true "CSV report request"
+// @Param Idempotency-Key header string false "Key making retries of the request safe"
+// @Success 200 {object} CsvReportResponse "Successfully generated CSV report"
+// @Failure 400 {object} Problem "Invalid input data"
+// @Failure 401 {object} Problem "Authentication required"
+// @Failure 403 {object} Problem "Insufficient role"
+// @Failure 500 {object} Problem "Query execution failure"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Failure 504 {object} Problem "Query timed out"
+// @Security BasicAuth
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Router /v1/reports [post]
+func (s *ServerAPI) HandleV1CsvReport(w http.ResponseWriter, r *http.Request) {
+	dates := &CsvReportRequest{}
+	log := s.requestLog(r)
+	if !decodeRequest(w, r, log, dates) {
+		return
+	}
+	s.csvReport(w, r, log, dates.CsvReport, "/v1/reports/")
+}
+
+// HandleV1DownloadCsv godoc
+// @Summary Download CSV report
+// @Description Download a previously generated CSV report using the signed link returned by report generation
+// @ID v1DownloadCsvReport
+// @Tags v1
+// @Produce  text/csv
+// @Param reportID path string true "Report ID to download"
+// @Param expires query int true "Link expiration as unix timestamp"
+// @Param signature query string true "Link signature"
+// @Success 200 {file} file "CSV file for download"
+// @Failure 400 {object} Problem "Invalid report ID"
+// @Failure 401 {object} Problem "Authentication required"
+// @Failure 403 {object} Problem "Invalid or expired link, or insufficient role"
+// @Failure 404 {object} Problem "Report doesn't exist"
+// @Security BasicAuth
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Router /v1/reports/{reportID} [get]
+func (s *ServerAPI) HandleV1DownloadCsv(w http.ResponseWriter, r *http.Request) {
+	s.HandleDownloadCsv(w, r)
+}
+
+// decodeRequest decodes the json body into dst and validates it, writing the error response on failure.
+func decodeRequest(w http.ResponseWriter, r *http.Request, log *slog.Logger, dst interface{}) bool {
+	if err := render.DecodeJSON(r.Body, dst); err != nil {
+		log.Error("failed to decode request body", logger.Err(err))
+		renderProblem(w, r, http.StatusBadRequest, CodeBadRequest, "failed to decode request body")
+		return false
+	}
+	log.Info("request body decoded", slog.Any("request", dst))
+	return validateRequest(w, r, log, dst)
+}
+
+// validateRequest validates req, writing the error response on failure.
+func validateRequest(w http.ResponseWriter, r *http.Request, log *slog.Logger, req interface{}) bool {
+	if err := validate.Struct(req); err != nil {
+		log.Error("wrong body structure", logger.Err(err))
+		renderValidationProblem(w, r, err)
+		return false
+	}
+	return true
+}
+
+// parseUserID parses the userID path parameter, writing the error response on failure.
+func parseUserID(w http.ResponseWriter, r *http.Request, log *slog.Logger) (uint64, bool) {
+	uid, err := strconv.ParseUint(chi.URLParam(r, "userID"), 10, 64)
+	if err != nil {
+		log.Error("failed to parse user ID", logger.Err(err))
+		renderProblem(w, r, http.StatusBadRequest, CodeBadRequest, "failed to parse user ID")
+		return 0, false
+	}
+	return uid, true
+}
+
+// parseUserSegment builds a single segment membership from the userID and slug path parameters.
+func parseUserSegment(w http.ResponseWriter, r *http.Request, log *slog.Logger) (storage.UserSegments, bool) {
+	uid, ok := parseUserID(w, r, log)
+	if !ok {
+		return storage.UserSegments{}, false
+	}
+	userSegments := &UserSegmentRequest{storage.UserSegments{UserID: uid, SegmentSlug: []string{chi.URLParam(r, "slug")}}}
+	if !validateRequest(w, r, log, userSegments) {
+		return storage.UserSegments{}, false
+	}
+	return userSegments.UserSegments, true
+}
+
+// parseUserMemberships builds the memberships to check from the userID path parameter and the slug query parameters.
+func parseUserMemberships(w http.ResponseWriter, r *http.Request, log *slog.Logger) (storage.UserSegments, bool) {
+	uid, ok := parseUserID(w, r, log)
+	if !ok {
+		return storage.UserSegments{}, false
+	}
+	userSegments := &UserSegmentRequest{storage.UserSegments{UserID: uid, SegmentSlug: r.URL.Query()["slug"]}}
+	if !validateRequest(w, r, log, userSegments) {
+		return storage.UserSegments{}, false
+	}
+	return userSegments.UserSegments, true
+}
@@ -0,0 +1,183 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/vlasashk/user-segmentation/internal/model/logger"
+	"github.com/vlasashk/user-segmentation/internal/model/storage"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	IdempotencyKeyHeader     = "Idempotency-Key"
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+	defaultIdempotencyTTL    = 24 * time.Hour
+	// defaultIdempotencyLease outlasts the request timeout, so a key isn't taken over while its request still runs.
+	defaultIdempotencyLease   = 2 * time.Minute
+	maxIdempotencyKeyLength   = 255
+	maxIdempotentRequestBytes = 1 << 20
+	idempotencyPruneInterval  = time.Minute
+)
+
+// replayedHeaders are the response headers stored with an idempotent response besides Content-Type.
+var replayedHeaders = []string{"Deprecation", "Link"}
+
+// idempotent makes mutating requests carrying an Idempotency-Key header safe to retry: the first
+// response is stored and replayed to retries with the same key and body until the key expires.
+// Server errors, rejected credentials and requests abandoned by the client aren't stored, so such requests
+// can be retried with the same key. A key whose response is never stored, e.g. because the process crashed,
+// is released when its lease runs out.
+func (s *ServerAPI) idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keyValue := r.Header.Get(IdempotencyKeyHeader)
+		if keyValue == "" || !isMutatingMethod(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		log := s.requestLog(r).With(slog.String("idempotency_key", keyValue))
+		if len(keyValue) > maxIdempotencyKeyLength {
+			renderProblem(w, r, http.StatusBadRequest, CodeBadRequest, "idempotency key is too long")
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxIdempotentRequestBytes+1))
+		if err != nil {
+			log.Error("failed to read request body", logger.Err(err))
+			renderProblem(w, r, http.StatusBadRequest, CodeBadRequest, "failed to read request body")
+			return
+		}
+		if len(body) > maxIdempotentRequestBytes {
+			renderProblem(w, r, http.StatusRequestEntityTooLarge, CodeBadRequest, "request body is too large")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		identity, _ := IdentityFromContext(r.Context())
+		key := storage.IdempotencyKey{
+			Caller:      identity.Method + ":" + identity.Name,
+			Key:         keyValue,
+			RequestHash: requestHash(r, body),
+		}
+		record, reserved, err := s.Store.ReserveIdempotencyKey(r.Context(), key, s.IdempotencyTTL, s.IdempotencyLease, log)
+		if err != nil {
+			renderStorageError(w, r, err)
+			return
+		}
+		if !reserved {
+			replayIdempotentResponse(w, r, log, key, record)
+			return
+		}
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		recorded := &bytes.Buffer{}
+		ww.Tee(recorded)
+		completed := false
+		defer func() {
+			// The outcome is stored even if the client went away, otherwise the key stays reserved until it expires.
+			storeCtx := context.WithoutCancel(r.Context())
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			if completed && storeIdempotentStatus(status) {
+				response := storage.IdempotentResponse{
+					StatusCode:  status,
+					ContentType: ww.Header().Get("Content-Type"),
+					Header:      make(map[string]string),
+					Body:        recorded.Bytes(),
+				}
+				for _, header := range replayedHeaders {
+					if value := ww.Header().Get(header); value != "" {
+						response.Header[header] = value
+					}
+				}
+				err := s.Store.SaveIdempotentResponse(storeCtx, key, record.Token, response, log)
+				if err == nil {
+					return
+				}
+				// Retries can't be answered without the response, let them through instead of
+				// rejecting them as in progress until the lease runs out.
+				log.Error("failed to store idempotent response, releasing the key", logger.Err(err))
+			}
+			if err := s.Store.ReleaseIdempotencyKey(storeCtx, key, record.Token, log); err != nil {
+				log.Error("failed to release idempotency key, it stays reserved until its lease runs out", logger.Err(err))
+			}
+		}()
+		next.ServeHTTP(ww, r)
+		completed = true
+	})
+}
+
+func replayIdempotentResponse(w http.ResponseWriter, r *http.Request, log *slog.Logger, key storage.IdempotencyKey, record storage.IdempotencyRecord) {
+	switch {
+	case record.RequestHash != key.RequestHash:
+		log.Warn("idempotency key reused with a different request")
+		renderProblem(w, r, http.StatusUnprocessableEntity, CodeIdempotencyKeyReused,
+			"idempotency key was already used for a different request")
+	case record.Response == nil:
+		log.Warn("idempotency key is in use by a request in progress")
+		renderProblem(w, r, http.StatusConflict, CodeIdempotencyKeyInProgress,
+			"request with this idempotency key is still being processed")
+	default:
+		log.Info("replaying stored response", slog.Int("status", record.Response.StatusCode))
+		for header, value := range record.Response.Header {
+			w.Header().Set(header, value)
+		}
+		if record.Response.ContentType != "" {
+			w.Header().Set("Content-Type", record.Response.ContentType)
+		}
+		w.Header().Set(IdempotentReplayedHeader, "true")
+		w.WriteHeader(record.Response.StatusCode)
+		_, _ = w.Write(record.Response.Body)
+	}
+}
+
+// RunIdempotencyPruner deletes expired idempotency keys until ctx is done.
+func (s *ServerAPI) RunIdempotencyPruner(ctx context.Context) {
+	log := s.Log.With(slog.String("component", "idempotency_pruner"))
+	ticker := time.NewTicker(idempotencyPruneInterval)
+	defer ticker.Stop()
+	for {
+		pruned, err := s.Store.PruneIdempotencyKeys(ctx, s.IdempotencyTTL, s.IdempotencyLease, log)
+		if err != nil {
+			log.Warn("failed to prune idempotency keys", logger.Err(err))
+		} else if pruned > 0 {
+			log.Info("idempotency keys pruned", slog.Int64("count", pruned))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func isMutatingMethod(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+func storeIdempotentStatus(status int) bool {
+	return status < http.StatusInternalServerError &&
+		status != http.StatusUnauthorized &&
+		status != http.StatusForbidden &&
+		status != StatusClientClosedRequest
+}
+
+func requestHash(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method))
+	h.Write([]byte{'\n'})
+	h.Write([]byte(r.URL.RequestURI()))
+	h.Write([]byte{'\n'})
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
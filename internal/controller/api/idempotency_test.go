@@ -0,0 +1,161 @@
+package api
+
+import (
+	"github.com/vlasashk/user-segmentation/internal/model/storage"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newIdempotentHandler wraps handler into the idempotent middleware backed by the memory storage,
+// and counts the requests reaching handler.
+func newIdempotentHandler(handler http.HandlerFunc) (http.Handler, *atomic.Int32) {
+	s := &ServerAPI{
+		Store:            storage.NewMemoryDB(),
+		Log:              slog.New(slog.NewTextHandler(io.Discard, nil)),
+		IdempotencyTTL:   time.Hour,
+		IdempotencyLease: time.Hour,
+	}
+	calls := &atomic.Int32{}
+	return s.idempotent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		handler(w, r)
+	})), calls
+}
+
+func sendIdempotent(h http.Handler, key, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/user", strings.NewReader(body))
+	r.Header.Set(IdempotencyKeyHeader, key)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	h, calls := newIdempotentHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		setSuccessorLink(w, "/v1/users")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"user_id":1}`))
+	})
+	first := sendIdempotent(h, "key-1", `{"user_id":1}`)
+	retry := sendIdempotent(h, "key-1", `{"user_id":1}`)
+	if got := calls.Load(); got != 1 {
+		t.Fatalf("handler called %d times, want 1", got)
+	}
+	if retry.Code != first.Code || retry.Body.String() != first.Body.String() {
+		t.Errorf("replay = %d %q, want %d %q", retry.Code, retry.Body, first.Code, first.Body)
+	}
+	for _, header := range []string{"Content-Type", "Deprecation", "Link"} {
+		if got, want := retry.Header().Get(header), first.Header().Get(header); got != want {
+			t.Errorf("replayed %s = %q, want %q", header, got, want)
+		}
+	}
+	if got := retry.Header().Get(IdempotentReplayedHeader); got != "true" {
+		t.Errorf("replayed %s = %q, want true", IdempotentReplayedHeader, got)
+	}
+	if first.Header().Get(IdempotentReplayedHeader) != "" {
+		t.Errorf("first response has %s header", IdempotentReplayedHeader)
+	}
+
+	// Another key runs the request again.
+	sendIdempotent(h, "key-2", `{"user_id":1}`)
+	if got := calls.Load(); got != 2 {
+		t.Errorf("handler called %d times for two keys, want 2", got)
+	}
+}
+
+func TestIdempotentKeyReused(t *testing.T) {
+	h, calls := newIdempotentHandler(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	})
+	sendIdempotent(h, "key-1", `{"user_id":1}`)
+	w := sendIdempotent(h, "key-1", `{"user_id":2}`)
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), CodeIdempotencyKeyReused) {
+		t.Errorf("request with a reused key = %d %s, want %d with %s", w.Code, w.Body, http.StatusUnprocessableEntity, CodeIdempotencyKeyReused)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("handler called %d times, want 1", got)
+	}
+}
+
+func TestIdempotentInProgress(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	h, calls := newIdempotentHandler(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusCreated)
+	})
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- sendIdempotent(h, "key-1", `{"user_id":1}`)
+	}()
+	<-started
+	w := sendIdempotent(h, "key-1", `{"user_id":1}`)
+	close(release)
+	if first := <-done; first.Code != http.StatusCreated {
+		t.Errorf("original request = %d, want %d", first.Code, http.StatusCreated)
+	}
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), CodeIdempotencyKeyInProgress) {
+		t.Errorf("retry in progress = %d %s, want %d with %s", w.Code, w.Body, http.StatusConflict, CodeIdempotencyKeyInProgress)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("handler called %d times, want 1", got)
+	}
+}
+
+func TestIdempotentServerErrorNotStored(t *testing.T) {
+	var fail atomic.Bool
+	fail.Store(true)
+	h, calls := newIdempotentHandler(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	if w := sendIdempotent(h, "key-1", `{"user_id":1}`); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("failing request = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	fail.Store(false)
+	w := sendIdempotent(h, "key-1", `{"user_id":1}`)
+	if w.Code != http.StatusCreated || w.Header().Get(IdempotentReplayedHeader) != "" {
+		t.Errorf("retry after a server error = %d, replayed %q, want %d", w.Code, w.Header().Get(IdempotentReplayedHeader), http.StatusCreated)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("handler called %d times, want 2", got)
+	}
+}
+
+func TestIdempotentReleasedOnPanic(t *testing.T) {
+	var panics atomic.Bool
+	panics.Store(true)
+	h, calls := newIdempotentHandler(func(w http.ResponseWriter, r *http.Request) {
+		if panics.Load() {
+			panic("handler failed")
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	func() {
+		defer func() {
+			if p := recover(); p == nil {
+				t.Errorf("panic of the handler wasn't propagated")
+			}
+		}()
+		sendIdempotent(h, "key-1", `{"user_id":1}`)
+	}()
+	panics.Store(false)
+	if w := sendIdempotent(h, "key-1", `{"user_id":1}`); w.Code != http.StatusCreated {
+		t.Errorf("retry after a panic = %d, want %d", w.Code, http.StatusCreated)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("handler called %d times, want 2", got)
+	}
+}
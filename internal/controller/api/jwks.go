@@ -0,0 +1,220 @@
+package api
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultJWKSRefresh = 10 * time.Minute
+	// minJWKSRefetch limits how often an unknown key id can trigger a refetch of the key set.
+	minJWKSRefetch = 30 * time.Second
+)
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+// JWKS holds the public keys used to verify tokens, loaded from a file or a remote url.
+type JWKS struct {
+	mu   sync.RWMutex
+	keys map[string]crypto.PublicKey
+	// fetchedAt is when the keys were last loaded, checkedAt when loading them was last attempted.
+	fetchedAt time.Time
+	checkedAt time.Time
+	// loading lets a single call refetch the keys at a time, the others wait for its result.
+	loading    sync.Mutex
+	refresh    time.Duration
+	minRefetch time.Duration
+	fetch      func(ctx context.Context) ([]byte, error)
+}
+
+// NewFileJWKS loads a key set from a json file. The file is read once.
+func NewFileJWKS(path string) (*JWKS, error) {
+	ks := &JWKS{
+		fetch: func(context.Context) ([]byte, error) {
+			return os.ReadFile(path)
+		},
+	}
+	if err := ks.load(context.Background()); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// NewRemoteJWKS loads a key set from url and refetches it every refresh interval,
+// or earlier when a token is signed with an unknown key id.
+func NewRemoteJWKS(url string, client *http.Client, refresh time.Duration) (*JWKS, error) {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if refresh <= 0 {
+		refresh = defaultJWKSRefresh
+	}
+	ks := &JWKS{
+		refresh:    refresh,
+		minRefetch: minJWKSRefetch,
+		fetch: func(ctx context.Context) ([]byte, error) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+			if err != nil {
+				return nil, err
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				return nil, err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+			}
+			return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		},
+	}
+	if err := ks.load(context.Background()); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// Key returns the public key with the given key id, refetching a remote key set when it is stale
+// or doesn't know the key id yet.
+func (ks *JWKS) Key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	ks.mu.RLock()
+	key, ok := ks.keys[kid]
+	fetchedAt, checkedAt := ks.fetchedAt, ks.checkedAt
+	ks.mu.RUnlock()
+	remote := ks.refresh > 0
+	if remote && (time.Since(fetchedAt) > ks.refresh || (!ok && time.Since(checkedAt) > ks.minRefetch)) {
+		if err := ks.refetch(ctx, checkedAt); err != nil && !ok {
+			return nil, err
+		}
+		ks.mu.RLock()
+		key, ok = ks.keys[kid]
+		ks.mu.RUnlock()
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key id '%s'", kid)
+	}
+	return key, nil
+}
+
+// refetch loads the keys unless they were loaded or failed to load since checkedAt,
+// so concurrent requests with an unknown key id trigger a single fetch.
+func (ks *JWKS) refetch(ctx context.Context, checkedAt time.Time) error {
+	ks.loading.Lock()
+	defer ks.loading.Unlock()
+	ks.mu.RLock()
+	checked := ks.checkedAt.After(checkedAt)
+	ks.mu.RUnlock()
+	if checked {
+		return nil
+	}
+	return ks.load(ctx)
+}
+
+func (ks *JWKS) load(ctx context.Context) error {
+	data, err := ks.fetch(ctx)
+	ks.mu.Lock()
+	ks.checkedAt = time.Now()
+	ks.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to fetch jwks: %v", err)
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return err
+	}
+	ks.mu.Lock()
+	ks.keys = keys
+	ks.fetchedAt = time.Now()
+	ks.mu.Unlock()
+	return nil
+}
+
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set jwkSet
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("failed to parse jwks: %v", err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwk '%s': %v", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("jwks doesn't contain signing keys")
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus: %v", err)
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil || !e.IsInt64() {
+			return nil, fmt.Errorf("invalid exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve '%s'", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x coordinate: %v", err)
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid y coordinate: %v", err)
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		if !key.Curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point is not on curve")
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type '%s'", k.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(raw), nil
+}
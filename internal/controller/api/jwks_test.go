@@ -0,0 +1,302 @@
+package api
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/golang-jwt/jwt/v5"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testJWKSServer is a local stand-in for the gateway's key set endpoint.
+type testJWKSServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	set     jwkSet
+	fetches atomic.Int32
+	// delay slows down responses, so concurrent fetches overlap.
+	delay time.Duration
+}
+
+func newTestJWKSServer(t *testing.T, keys ...jwk) *testJWKSServer {
+	t.Helper()
+	srv := &testJWKSServer{set: jwkSet{Keys: keys}}
+	srv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.fetches.Add(1)
+		time.Sleep(srv.delay)
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		_ = json.NewEncoder(w).Encode(srv.set)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func (srv *testJWKSServer) setKeys(keys ...jwk) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.set = jwkSet{Keys: keys}
+}
+
+func encodeBigInt(n *big.Int, size int) string {
+	return base64.RawURLEncoding.EncodeToString(n.FillBytes(make([]byte, size)))
+}
+
+func newRSAKey(t *testing.T, kid string) (*rsa.PrivateKey, jwk) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate rsa key: %v", err)
+	}
+	return key, jwk{
+		Kty: "RSA",
+		Kid: kid,
+		Use: "sig",
+		Alg: "RS256",
+		N:   encodeBigInt(key.N, key.Size()),
+		E:   encodeBigInt(big.NewInt(int64(key.E)), 3),
+	}
+}
+
+func newECKey(t *testing.T, kid string) (*ecdsa.PrivateKey, jwk) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate ec key: %v", err)
+	}
+	return key, jwk{
+		Kty: "EC",
+		Kid: kid,
+		Use: "sig",
+		Alg: "ES256",
+		Crv: "P-256",
+		X:   encodeBigInt(key.X, 32),
+		Y:   encodeBigInt(key.Y, 32),
+	}
+}
+
+func signToken(t *testing.T, method jwt.SigningMethod, kid string, key crypto.Signer, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = kid
+	raw, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	return raw
+}
+
+func bearerRequest(token string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/v1/users/1/segments", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func validClaims(role interface{}) jwt.MapClaims {
+	return jwt.MapClaims{
+		"sub":  "frontend",
+		"role": role,
+		"team": "growth",
+		"exp":  time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	rsaKey, rsaJWK := newRSAKey(t, "rsa-1")
+	ecKey, ecJWK := newECKey(t, "ec-1")
+	srv := newTestJWKSServer(t, rsaJWK, ecJWK)
+	keys, err := NewRemoteJWKS(srv.URL, srv.Client(), time.Hour)
+	if err != nil {
+		t.Fatalf("failed to load jwks: %v", err)
+	}
+	auth := NewJWTAuthenticator(keys, JWTConfig{
+		RoleMap: map[string]Role{"segments.write": RoleManager},
+	})
+	expired := validClaims("reader")
+	expired["exp"] = time.Now().Add(-time.Hour).Unix()
+	noExpiry := validClaims("reader")
+	delete(noExpiry, "exp")
+
+	tests := []struct {
+		name     string
+		token    string
+		wantOK   bool
+		wantRole Role
+	}{
+		{
+			name:     "rs256",
+			token:    signToken(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, validClaims("reader")),
+			wantOK:   true,
+			wantRole: RoleReader,
+		},
+		{
+			name:     "es256",
+			token:    signToken(t, jwt.SigningMethodES256, "ec-1", ecKey, validClaims("admin")),
+			wantOK:   true,
+			wantRole: RoleAdmin,
+		},
+		{
+			name:     "mapped role claim",
+			token:    signToken(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, validClaims("segments.write")),
+			wantOK:   true,
+			wantRole: RoleManager,
+		},
+		{
+			name:     "highest of several roles",
+			token:    signToken(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, validClaims([]interface{}{"reader", "segments.write", "unknown"})),
+			wantOK:   true,
+			wantRole: RoleManager,
+		},
+		{
+			name:  "unknown role",
+			token: signToken(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, validClaims("superuser")),
+		},
+		{
+			name:  "expired",
+			token: signToken(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, expired),
+		},
+		{
+			name:  "without expiry",
+			token: signToken(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, noExpiry),
+		},
+		{
+			name:  "signed by another key",
+			token: signToken(t, jwt.SigningMethodES256, "rsa-1", ecKey, validClaims("reader")),
+		},
+		{
+			name:  "malformed",
+			token: "not-a-token",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, ok := auth.Authenticate(bearerRequest(tt.token))
+			if ok != tt.wantOK {
+				t.Fatalf("Authenticate() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			want := Identity{Name: "frontend", Method: AuthMethodJWT, Role: tt.wantRole, Team: "growth"}
+			if identity != want {
+				t.Errorf("Authenticate() = %+v, want %+v", identity, want)
+			}
+		})
+	}
+}
+
+func TestJWKSKeyRotation(t *testing.T) {
+	oldKey, oldJWK := newRSAKey(t, "old")
+	newKey, newJWK := newRSAKey(t, "new")
+	srv := newTestJWKSServer(t, oldJWK)
+	keys, err := NewRemoteJWKS(srv.URL, srv.Client(), time.Hour)
+	if err != nil {
+		t.Fatalf("failed to load jwks: %v", err)
+	}
+	keys.minRefetch = 0
+	auth := NewJWTAuthenticator(keys, JWTConfig{})
+
+	if _, ok := auth.Authenticate(bearerRequest(signToken(t, jwt.SigningMethodRS256, "old", oldKey, validClaims("reader")))); !ok {
+		t.Fatalf("token signed by the current key was rejected")
+	}
+	srv.setKeys(newJWK)
+	if _, ok := auth.Authenticate(bearerRequest(signToken(t, jwt.SigningMethodRS256, "new", newKey, validClaims("reader")))); !ok {
+		t.Fatalf("token signed by the rotated key was rejected")
+	}
+	if got := srv.fetches.Load(); got != 2 {
+		t.Errorf("key set fetched %d times, want 2", got)
+	}
+	if _, ok := auth.Authenticate(bearerRequest(signToken(t, jwt.SigningMethodRS256, "old", oldKey, validClaims("reader")))); ok {
+		t.Errorf("token signed by the retired key was accepted")
+	}
+}
+
+func TestJWKSRefetchRateLimit(t *testing.T) {
+	_, rsaJWK := newRSAKey(t, "rsa-1")
+	srv := newTestJWKSServer(t, rsaJWK)
+	keys, err := NewRemoteJWKS(srv.URL, srv.Client(), time.Hour)
+	if err != nil {
+		t.Fatalf("failed to load jwks: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err = keys.Key(context.Background(), "unknown"); err == nil {
+			t.Fatalf("Key() of an unknown key id succeeded")
+		}
+	}
+	if got := srv.fetches.Load(); got != 1 {
+		t.Errorf("key set fetched %d times, want 1", got)
+	}
+}
+
+func TestJWKSConcurrentRefetch(t *testing.T) {
+	_, oldJWK := newRSAKey(t, "old")
+	_, newJWK := newRSAKey(t, "new")
+	srv := newTestJWKSServer(t, oldJWK)
+	keys, err := NewRemoteJWKS(srv.URL, srv.Client(), time.Hour)
+	if err != nil {
+		t.Fatalf("failed to load jwks: %v", err)
+	}
+	keys.minRefetch = 0
+	srv.setKeys(oldJWK, newJWK)
+	srv.delay = 50 * time.Millisecond
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := keys.Key(context.Background(), "new")
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Key() failed: %v", err)
+		}
+	}
+	if got := srv.fetches.Load(); got != 2 {
+		t.Errorf("key set fetched %d times, want 2", got)
+	}
+}
+
+func TestFileJWKS(t *testing.T) {
+	ecKey, ecJWK := newECKey(t, "ec-1")
+	data, err := json.Marshal(jwkSet{Keys: []jwk{ecJWK, {Kty: "RSA", Kid: "enc", Use: "enc"}}})
+	if err != nil {
+		t.Fatalf("failed to encode jwks: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err = os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("failed to write jwks: %v", err)
+	}
+	keys, err := NewFileJWKS(path)
+	if err != nil {
+		t.Fatalf("NewFileJWKS() failed: %v", err)
+	}
+	auth := NewJWTAuthenticator(keys, JWTConfig{})
+	if _, ok := auth.Authenticate(bearerRequest(signToken(t, jwt.SigningMethodES256, "ec-1", ecKey, validClaims("reader")))); !ok {
+		t.Errorf("token signed by the file key was rejected")
+	}
+	if _, err = keys.Key(context.Background(), "enc"); err == nil {
+		t.Errorf("encryption key was loaded as a signing key")
+	}
+	if _, err = parseJWKS([]byte(`{"keys":[{"kty":"EC","kid":"bad","crv":"P-384","x":"AA","y":"AA"}]}`)); err == nil {
+		t.Errorf("parseJWKS() accepted an unsupported curve")
+	}
+}
@@ -0,0 +1,163 @@
+package api
+
+import (
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// JWTConfig describes how gateway tokens are verified and mapped onto identities.
+type JWTConfig struct {
+	Issuer   string
+	Audience string
+	// RoleClaim names the claim holding a role or a list of roles, "role" by default.
+	RoleClaim string
+	// TeamClaim names the claim holding the caller's team, "team" by default.
+	TeamClaim string
+	// RoleMap translates claim values into roles. Values equal to a role name map onto that role.
+	RoleMap map[string]Role
+}
+
+// JWTAuthenticator accepts RS256 and ES256 bearer tokens signed by a key from the JWKS.
+type JWTAuthenticator struct {
+	keys   *JWKS
+	cfg    JWTConfig
+	parser *jwt.Parser
+}
+
+// NewJWTAuthenticator creates an authenticator verifying tokens with keys.
+func NewJWTAuthenticator(keys *JWKS, cfg JWTConfig) *JWTAuthenticator {
+	if cfg.RoleClaim == "" {
+		cfg.RoleClaim = "role"
+	}
+	if cfg.TeamClaim == "" {
+		cfg.TeamClaim = "team"
+	}
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodES256.Alg()}),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30 * time.Second),
+	}
+	if cfg.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(cfg.Issuer))
+	}
+	if cfg.Audience != "" {
+		opts = append(opts, jwt.WithAudience(cfg.Audience))
+	}
+	return &JWTAuthenticator{
+		keys:   keys,
+		cfg:    cfg,
+		parser: jwt.NewParser(opts...),
+	}
+}
+
+// NewJWTAuthenticatorFromEnv configures a JWTAuthenticator from JWKS_PATH or JWKS_URL,
+// JWKS_REFRESH, JWT_ISSUER, JWT_AUDIENCE, JWT_ROLE_CLAIM, JWT_TEAM_CLAIM and JWT_ROLE_MAP.
+func NewJWTAuthenticatorFromEnv() (*JWTAuthenticator, error) {
+	var keys *JWKS
+	var err error
+	switch {
+	case os.Getenv("JWKS_PATH") != "":
+		keys, err = NewFileJWKS(os.Getenv("JWKS_PATH"))
+	case os.Getenv("JWKS_URL") != "":
+		var refresh time.Duration
+		if v := os.Getenv("JWKS_REFRESH"); v != "" {
+			if refresh, err = time.ParseDuration(v); err != nil {
+				return nil, fmt.Errorf("invalid JWKS_REFRESH: %v", err)
+			}
+		}
+		keys, err = NewRemoteJWKS(os.Getenv("JWKS_URL"), nil, refresh)
+	default:
+		return nil, fmt.Errorf("jwt auth requires JWKS_PATH or JWKS_URL")
+	}
+	if err != nil {
+		return nil, err
+	}
+	roleMap, err := ParseRoleMap(os.Getenv("JWT_ROLE_MAP"))
+	if err != nil {
+		return nil, err
+	}
+	return NewJWTAuthenticator(keys, JWTConfig{
+		Issuer:    os.Getenv("JWT_ISSUER"),
+		Audience:  os.Getenv("JWT_AUDIENCE"),
+		RoleClaim: os.Getenv("JWT_ROLE_CLAIM"),
+		TeamClaim: os.Getenv("JWT_TEAM_CLAIM"),
+		RoleMap:   roleMap,
+	}), nil
+}
+
+// ParseRoleMap parses a mapping like "segments.read=reader,segments.admin=admin".
+func ParseRoleMap(s string) (map[string]Role, error) {
+	res := make(map[string]Role)
+	if s == "" {
+		return res, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		claim, name, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || claim == "" {
+			return nil, fmt.Errorf("invalid role mapping '%s'", pair)
+		}
+		role, err := ParseRole(name)
+		if err != nil {
+			return nil, err
+		}
+		res[claim] = role
+	}
+	return res, nil
+}
+
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (Identity, bool) {
+	raw := bearerToken(r)
+	if raw == "" {
+		return Identity{}, false
+	}
+	claims := jwt.MapClaims{}
+	_, err := a.parser.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return a.keys.Key(r.Context(), kid)
+	})
+	if err != nil {
+		return Identity{}, false
+	}
+	subject, err := claims.GetSubject()
+	if err != nil || subject == "" {
+		return Identity{}, false
+	}
+	role, ok := a.role(claims[a.cfg.RoleClaim])
+	if !ok {
+		return Identity{}, false
+	}
+	team, _ := claims[a.cfg.TeamClaim].(string)
+	return Identity{Name: subject, Method: AuthMethodJWT, Role: role, Team: team}, true
+}
+
+// role picks the highest role granted by the role claim, which may be a string or a list of strings.
+func (a *JWTAuthenticator) role(claim interface{}) (Role, bool) {
+	var values []string
+	switch v := claim.(type) {
+	case string:
+		values = strings.Fields(v)
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	var best Role
+	for _, value := range values {
+		role, ok := a.cfg.RoleMap[value]
+		if !ok {
+			if parsed, err := ParseRole(value); err == nil {
+				role, ok = parsed, true
+			}
+		}
+		if ok && roleRank[role] > roleRank[best] {
+			best = role
+		}
+	}
+	return best, best != ""
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"fmt"
+	"github.com/vlasashk/user-segmentation/internal/model/logger"
+	"github.com/vlasashk/user-segmentation/internal/model/storage"
+	"log/slog"
+	"net/http"
+)
+
+// segmentOwnerTeam returns the team a new segment is assigned to. Admins may choose any team,
+// everyone else can only create segments owned by their own team.
+func segmentOwnerTeam(identity Identity, requested string) (string, error) {
+	if identity.Role.Allows(RoleAdmin) {
+		if requested != "" {
+			return requested, nil
+		}
+		return identity.Team, nil
+	}
+	if identity.Team == "" {
+		return "", fmt.Errorf("caller '%s' doesn't belong to a team", identity.Name)
+	}
+	if requested != "" && requested != identity.Team {
+		return "", fmt.Errorf("caller '%s' can't create segments owned by team '%s'", identity.Name, requested)
+	}
+	return identity.Team, nil
+}
+
+// ownerRestriction returns the team whose segments the caller may modify, or an empty string for admins,
+// who may modify any segment. Segments without an owner are admin only. Storage checks the owner in the
+// transaction making the change, so a segment recreated by another team in the meantime isn't modified.
+func ownerRestriction(identity Identity) (string, error) {
+	if identity.Role.Allows(RoleAdmin) {
+		return "", nil
+	}
+	if identity.Team == "" {
+		return "", &storage.Error{
+			Kind: storage.ErrForbidden,
+			Msg:  fmt.Sprintf("caller '%s' doesn't belong to a team", identity.Name),
+		}
+	}
+	return identity.Team, nil
+}
+
+// authorizeSegments returns the team whose segments the caller of an HTTP request may modify.
+// If the caller can't modify any segment the error response is written and false is returned.
+func authorizeSegments(w http.ResponseWriter, r *http.Request, log *slog.Logger) (string, bool) {
+	identity, _ := IdentityFromContext(r.Context())
+	team, err := ownerRestriction(identity)
+	if err != nil {
+		log.Warn("caller can't modify segments", logger.Err(err))
+		renderStorageError(w, r, err)
+		return "", false
+	}
+	return team, true
+}
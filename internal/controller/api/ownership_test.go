@@ -0,0 +1,80 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/vlasashk/user-segmentation/internal/model/storage"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestOwnershipHTTP(t *testing.T) {
+	changes := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{http.MethodDelete, "/segment/remove", `{"slug":"growth-seg"}`},
+		{http.MethodDelete, "/v1/segments/growth-seg", ``},
+		{http.MethodPost, "/user/addSegment", `{"user_id":2,"segment_slug":["growth-seg"]}`},
+		{http.MethodPost, "/v1/users/2/segments", `{"segment_slug":["growth-seg"]}`},
+		{http.MethodPut, "/v1/users/2/segments/growth-seg", `{}`},
+		{http.MethodDelete, "/user/segments", `{"user_id":1,"segment_slug":["growth-seg"]}`},
+		{http.MethodDelete, "/v1/users/1/segments/growth-seg", ``},
+	}
+	for _, key := range []string{"other-manager-key", "teamless-key"} {
+		for _, change := range changes {
+			t.Run(change.method+" "+change.path+" with "+key, func(t *testing.T) {
+				s, router := newTestRouter(t)
+				ctx := context.Background()
+				if _, err := s.Store.AddUser(ctx, storage.User{UID: 2}, s.Log); err != nil {
+					t.Fatalf("AddUser() failed: %v", err)
+				}
+				member := storage.UserSegments{UserID: 1, SegmentSlug: []string{"growth-seg"}, OwnerTeam: "growth"}
+				if _, err := s.Store.AddUserToSegments(ctx, member, s.Log); err != nil {
+					t.Fatalf("AddUserToSegments() failed: %v", err)
+				}
+
+				r := httptest.NewRequest(change.method, change.path, strings.NewReader(change.body))
+				r.Header.Set("Content-Type", "application/json")
+				r.Header.Set("X-API-Key", key)
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, r)
+				var problem Problem
+				_ = json.NewDecoder(w.Body).Decode(&problem)
+				if w.Code != http.StatusForbidden || problem.Code != CodeForbidden {
+					t.Errorf("response = %d %+v, want %d", w.Code, problem, http.StatusForbidden)
+				}
+
+				users, err := s.Store.GetSegmentUsersInfo(ctx, storage.Segment{Slug: "growth-seg"}, s.Log)
+				if err != nil {
+					t.Fatalf("GetSegmentUsersInfo() after a refused change failed: %v", err)
+				}
+				if !slices.Equal(users, []uint64{1}) {
+					t.Errorf("members after a refused change = %v, want [1]", users)
+				}
+			})
+		}
+	}
+}
+
+func TestOwnershipHTTPOwner(t *testing.T) {
+	for _, key := range []string{"manager-key", "admin-key"} {
+		s, router := newTestRouter(t)
+		r := httptest.NewRequest(http.MethodDelete, "/v1/segments/growth-seg", nil)
+		r.Header.Set("X-API-Key", key)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("delete with %s = %d %s, want %d", key, w.Code, w.Body, http.StatusOK)
+		}
+		_, err := s.Store.GetSegmentUsersInfo(context.Background(), storage.Segment{Slug: "growth-seg"}, s.Log)
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Errorf("GetSegmentUsersInfo() after delete with %s error = %v, want %v", key, err, storage.ErrNotFound)
+		}
+	}
+}
@@ -1,24 +1,176 @@
 package api
 
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-playground/validator/v10"
+	"github.com/vlasashk/user-segmentation/internal/model/storage"
+	"net/http"
+)
+
 type ResponseStatus struct {
 	Status string `json:"status"`
-	Error  string `json:"error,omitempty"`
 }
 
+const StatusOK = "OK"
+
+// StatusClientClosedRequest is returned when the client went away before the request was completed.
+// Nobody reads the response, but the status shows up in the logs.
+const StatusClientClosedRequest = 499
+
+// Machine-readable error codes returned in Problem.Code.
 const (
-	StatusOK    = "OK"
-	StatusError = "Error"
+	CodeBadRequest       = "bad_request"
+	CodeValidationFailed = "validation_failed"
+	CodeUnauthorized     = "unauthorized"
+	CodeForbidden        = "forbidden"
+	CodeNotFound         = "not_found"
+	CodeAlreadyExists    = "already_exists"
+	CodeNotMember        = "not_member"
+	CodeUnavailable      = "unavailable"
+	CodeCanceled         = "canceled"
+	CodeTimeout          = "timeout"
+	CodeInternal         = "internal"
+
+	CodeIdempotencyKeyReused     = "idempotency_key_reused"
+	CodeIdempotencyKeyInProgress = "idempotency_key_in_progress"
 )
 
+const (
+	problemContentType = "application/problem+json"
+	problemTypePrefix  = "urn:user-segmentation:problem:"
+)
+
+var problemTitles = map[string]string{
+	CodeBadRequest:       "Malformed request",
+	CodeValidationFailed: "Validation failed",
+	CodeUnauthorized:     "Authentication required",
+	CodeForbidden:        "Access denied",
+	CodeNotFound:         "Resource not found",
+	CodeAlreadyExists:    "Resource already exists",
+	CodeNotMember:        "User is not a member of the segment",
+	CodeUnavailable:      "Service unavailable",
+	CodeCanceled:         "Request canceled",
+	CodeTimeout:          "Request timed out",
+	CodeInternal:         "Internal error",
+
+	CodeIdempotencyKeyReused:     "Idempotency key reused",
+	CodeIdempotencyKeyInProgress: "Request with this idempotency key is in progress",
+}
+
+// Problem is an RFC 7807 error response body.
+type Problem struct {
+	Type     string       `json:"type"`
+	Title    string       `json:"title"`
+	Status   int          `json:"status"`
+	Detail   string       `json:"detail,omitempty"`
+	Instance string       `json:"instance,omitempty"`
+	Code     string       `json:"code"`
+	Errors   []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError describes a single invalid field of the request.
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
 func OK() ResponseStatus {
 	return ResponseStatus{
 		Status: StatusOK,
 	}
 }
 
-func Error(msg string) ResponseStatus {
-	return ResponseStatus{
-		Status: StatusError,
-		Error:  msg,
+// NewProblem builds a problem for the request, using the request id as its instance.
+func NewProblem(r *http.Request, status int, code, detail string) Problem {
+	return Problem{
+		Type:     problemTypePrefix + code,
+		Title:    problemTitles[code],
+		Status:   status,
+		Detail:   detail,
+		Instance: middleware.GetReqID(r.Context()),
+		Code:     code,
+	}
+}
+
+func writeProblem(w http.ResponseWriter, problem Problem) {
+	w.Header().Set("Content-Type", problemContentType)
+	w.WriteHeader(problem.Status)
+	_ = json.NewEncoder(w).Encode(problem)
+}
+
+func renderProblem(w http.ResponseWriter, r *http.Request, status int, code, detail string) {
+	writeProblem(w, NewProblem(r, status, code, detail))
+}
+
+// renderValidationProblem reports every field rejected by the validator.
+func renderValidationProblem(w http.ResponseWriter, r *http.Request, err error) {
+	problem := NewProblem(r, http.StatusBadRequest, CodeValidationFailed, "request has invalid fields")
+	var validationErrors validator.ValidationErrors
+	if errors.As(err, &validationErrors) {
+		for _, fe := range validationErrors {
+			problem.Errors = append(problem.Errors, FieldError{
+				Field:   fe.Field(),
+				Rule:    fe.Tag(),
+				Message: fieldErrorMessage(fe),
+			})
+		}
+	} else {
+		problem.Detail = err.Error()
+	}
+	writeProblem(w, problem)
+}
+
+// storageErrorStatus maps a storage error onto an http status and error code.
+func storageErrorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return http.StatusNotFound, CodeNotFound
+	case errors.Is(err, storage.ErrAlreadyExists):
+		return http.StatusConflict, CodeAlreadyExists
+	case errors.Is(err, storage.ErrNotMember):
+		return http.StatusConflict, CodeNotMember
+	case errors.Is(err, storage.ErrForbidden):
+		return http.StatusForbidden, CodeForbidden
+	case errors.Is(err, storage.ErrUnavailable):
+		return http.StatusServiceUnavailable, CodeUnavailable
+	case errors.Is(err, storage.ErrCanceled):
+		return StatusClientClosedRequest, CodeCanceled
+	case errors.Is(err, storage.ErrTimeout):
+		return http.StatusGatewayTimeout, CodeTimeout
+	default:
+		return http.StatusInternalServerError, CodeInternal
+	}
+}
+
+func renderStorageError(w http.ResponseWriter, r *http.Request, err error) {
+	status, code := storageErrorStatus(err)
+	renderProblem(w, r, status, code, err.Error())
+}
+
+// outcomeMessages explains why a segment wasn't added.
+var outcomeMessages = map[string]string{
+	storage.OutcomeNotFound:      "segment doesn't exist",
+	storage.OutcomeAlreadyMember: "user is already part of the segment",
+	storage.OutcomeAborted:       "not added because another segment failed",
+}
+
+// renderOutcomesProblem reports a storage error along with every segment that wasn't added.
+func renderOutcomesProblem(w http.ResponseWriter, r *http.Request, err error, outcomes []storage.SegmentOutcome) {
+	status, code := storageErrorStatus(err)
+	problem := NewProblem(r, status, code, err.Error())
+	for i, outcome := range outcomes {
+		if outcome.Outcome == storage.OutcomeAdded {
+			continue
+		}
+		problem.Errors = append(problem.Errors, FieldError{
+			Field:   fmt.Sprintf("segment_slug[%d]", i),
+			Rule:    outcome.Outcome,
+			Message: outcomeMessages[outcome.Outcome],
+		})
 	}
+	writeProblem(w, problem)
 }
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// Role grants access to a group of endpoints. Every role includes the permissions of the roles below it.
+type Role string
+
+const (
+	// RoleReader can only query users and segments.
+	RoleReader Role = "reader"
+	// RoleManager can additionally create and delete users, segments and memberships.
+	RoleManager Role = "manager"
+	// RoleAdmin can additionally generate and download reports.
+	RoleAdmin Role = "admin"
+)
+
+var roleRank = map[Role]int{
+	RoleReader:  1,
+	RoleManager: 2,
+	RoleAdmin:   3,
+}
+
+// ParseRole validates a role name from the credentials config.
+func ParseRole(name string) (Role, error) {
+	role := Role(name)
+	if _, ok := roleRank[role]; !ok {
+		return "", fmt.Errorf("unknown role '%s'", name)
+	}
+	return role, nil
+}
+
+// Allows reports whether a caller with role r may access endpoints requiring role required.
+func (r Role) Allows(required Role) bool {
+	return roleRank[r] >= roleRank[required]
+}
+
+// requireRole rejects callers whose role doesn't include the required one.
+func (s *ServerAPI) requireRole(required Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			identity, ok := IdentityFromContext(r.Context())
+			if !ok || !identity.Role.Allows(required) {
+				s.requestLog(r).Warn("insufficient role",
+					slog.String("role", string(identity.Role)),
+					slog.String("required_role", string(required)),
+				)
+				renderProblem(w, r, http.StatusForbidden, CodeForbidden, fmt.Sprintf("role '%s' is required", required))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
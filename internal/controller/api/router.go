@@ -1,64 +1,217 @@
 package api
 
 import (
+	"context"
+	"expvar"
+	"fmt"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	httpSwagger "github.com/swaggo/http-swagger"
 	_ "github.com/vlasashk/user-segmentation/docs"
 	"log/slog"
 	"net/http"
+	"net/url"
+	"os"
+	"strings"
 	"time"
 )
 
-func NewAPIServer(listenAddr string, store Storage, log *slog.Logger) *ServerAPI {
-	return &ServerAPI{
-		ListenAddr: listenAddr,
-		Store:      store,
-		Log:        log,
+func NewAPIServer(listenAddr string, store Storage, log *slog.Logger) (*ServerAPI, error) {
+	reports, err := NewReportSigner(os.Getenv("REPORT_SECRET"), os.Getenv("REPORT_URL_TTL"))
+	if err != nil {
+		return nil, err
+	}
+	auth, err := NewAuthenticator(os.Getenv("AUTH_MODE"))
+	if err != nil {
+		return nil, err
+	}
+	idempotencyTTL := defaultIdempotencyTTL
+	if v := os.Getenv("IDEMPOTENCY_TTL"); v != "" {
+		if idempotencyTTL, err = time.ParseDuration(v); err != nil || idempotencyTTL <= 0 {
+			return nil, fmt.Errorf("invalid IDEMPOTENCY_TTL %q", v)
+		}
+	}
+	idempotencyLease := defaultIdempotencyLease
+	if v := os.Getenv("IDEMPOTENCY_LEASE"); v != "" {
+		if idempotencyLease, err = time.ParseDuration(v); err != nil || idempotencyLease <= 0 {
+			return nil, fmt.Errorf("invalid IDEMPOTENCY_LEASE %q", v)
+		}
+	}
+	eventsPollInterval := defaultEventsPollInterval
+	if v := os.Getenv("EVENTS_POLL_INTERVAL"); v != "" {
+		if eventsPollInterval, err = time.ParseDuration(v); err != nil || eventsPollInterval <= 0 {
+			return nil, fmt.Errorf("invalid EVENTS_POLL_INTERVAL %q", v)
+		}
 	}
+	publicURL := strings.TrimSuffix(os.Getenv("PUBLIC_URL"), "/")
+	if publicURL != "" {
+		if u, err := url.Parse(publicURL); err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid PUBLIC_URL %q", publicURL)
+		}
+	}
+	if os.Getenv("CACHE_ENABLED") == "true" {
+		cached, err := newCachedStorageFromEnv(store)
+		if err != nil {
+			return nil, err
+		}
+		if listener, ok := store.(ChangeListener); ok {
+			go listener.ListenChanges(context.Background(), log, cached.Invalidate)
+		}
+		store = cached
+		log.Info("user segments cache enabled")
+	}
+	if os.Getenv("REPORT_SECRET") == "" {
+		log.Warn("REPORT_SECRET is not set, report download links won't survive a restart")
+	}
+	return &ServerAPI{
+		ListenAddr:         listenAddr,
+		Store:              store,
+		Log:                log,
+		Reports:            reports,
+		PublicURL:          publicURL,
+		Auth:               auth,
+		IdempotencyTTL:     idempotencyTTL,
+		IdempotencyLease:   idempotencyLease,
+		EventsPollInterval: eventsPollInterval,
+	}, nil
 }
 
 func Run(log *slog.Logger, server *ServerAPI) {
+	if err := http.ListenAndServe(":"+server.ListenAddr, server.routes()); err != nil {
+		log.Error("failed to start server")
+	}
+}
+
+// routes builds the router serving every endpoint of the http API.
+func (s *ServerAPI) routes() http.Handler {
 	router := chi.NewRouter()
 	router.Use(middleware.RequestID)
 	router.Use(middleware.Logger)
 	router.Use(middleware.Recoverer)
 	router.Use(middleware.URLFormat)
-	router.Use(middleware.Timeout(60 * time.Second))
 
 	router.Get("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/plain")
 		_, _ = w.Write([]byte("Welcome to API for dynamic user segmentation for testing new functionality"))
 	})
-	router.Mount("/user", server.userRouter())
-	router.Mount("/segment", server.segmentRouter())
-	router.Mount("/report", server.csvReportRouter())
 	router.Mount("/swagger", httpSwagger.WrapHandler)
-	if err := http.ListenAndServe(":"+server.ListenAddr, router); err != nil {
-		log.Error("failed to start server")
+	router.Group(func(router chi.Router) {
+		router.Use(s.authenticate)
+		router.Use(s.idempotent)
+		// Event streams stay open for as long as the client listens.
+		router.With(s.requireRole(RoleReader)).Get("/events", s.HandleEvents)
+		router.Group(func(router chi.Router) {
+			router.Use(middleware.Timeout(60 * time.Second))
+			router.With(s.requireRole(RoleAdmin)).Handle("/debug/vars", expvar.Handler())
+			router.Mount("/v1", s.v1Router())
+			router.Mount("/user", s.userRouter())
+			router.Mount("/segment", s.segmentRouter())
+			router.Mount("/report", s.csvReportRouter())
+		})
+	})
+	return router
+}
+
+func (s *ServerAPI) v1Router() http.Handler {
+	router := chi.NewRouter()
+	router.Route("/users", func(router chi.Router) {
+		router.With(s.requireRole(RoleManager)).Post("/", s.HandleV1AddUser)
+		router.With(s.requireRole(RoleReader)).Post("/segments/batch", s.HandleV1GetUsersSegments)
+		router.With(s.requireRole(RoleReader)).Get("/{userID}/memberships", s.HandleV1GetUserMemberships)
+		router.Route("/{userID}/segments", func(router chi.Router) {
+			router.With(s.requireRole(RoleReader)).Get("/", s.HandleV1GetUserSegments)
+			router.With(s.requireRole(RoleReader)).Get("/{slug}", s.HandleV1GetUserSegment)
+			router.With(s.requireRole(RoleManager)).Post("/", s.HandleV1AddUserToSegments)
+			router.With(s.requireRole(RoleManager)).Put("/{slug}", s.HandleV1PutUserSegment)
+			router.With(s.requireRole(RoleManager)).Delete("/{slug}", s.HandleV1DeleteUserSegment)
+		})
+	})
+	router.Route("/segments", func(router chi.Router) {
+		router.With(s.requireRole(RoleManager)).Post("/", s.HandleV1AddSegment)
+		router.With(s.requireRole(RoleManager)).Delete("/{slug}", s.HandleV1DeleteSegment)
+		router.With(s.requireRole(RoleReader)).Get("/{slug}/users", s.HandleV1GetSegmentUsers)
+	})
+	router.Route("/webhooks", func(router chi.Router) {
+		router.Use(s.requireRole(RoleAdmin))
+		router.Post("/", s.HandleV1AddWebhook)
+		router.Get("/", s.HandleV1GetWebhooks)
+		router.Delete("/{subscriptionID}", s.HandleV1DeleteWebhook)
+		router.Get("/{subscriptionID}/dead-letters", s.HandleV1GetWebhookDeadLetters)
+	})
+	router.Route("/reports", func(router chi.Router) {
+		router.Use(s.requireRole(RoleAdmin))
+		router.Post("/", s.HandleV1CsvReport)
+		router.Get("/{reportID}", s.HandleV1DownloadCsv)
+	})
+	return router
+}
+
+// deprecated marks responses of a legacy route and points clients to its /v1 replacement.
+// successor builds the replacement's URI from the request; routes taking the values it needs from the body
+// pass nil and call setSuccessorLink once the body is decoded.
+func deprecated(successor func(r *http.Request) string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Deprecation", "true")
+			if successor != nil {
+				setSuccessorLink(w, successor(r))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// setSuccessorLink points clients of a deprecated route to its /v1 replacement.
+func setSuccessorLink(w http.ResponseWriter, successor string) {
+	w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+}
+
+// successorPath returns a successor that is the same for every request.
+func successorPath(path string) func(r *http.Request) string {
+	return func(*http.Request) string {
+		return path
+	}
+}
+
+// successorParams returns a successor formatting path with the escaped values of the named url params.
+// The query is kept, so e.g. signed report links stay valid.
+func successorParams(format string, params ...string) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		args := make([]any, 0, len(params))
+		for _, param := range params {
+			args = append(args, url.PathEscape(chi.URLParam(r, param)))
+		}
+		successor := fmt.Sprintf(format, args...)
+		if r.URL.RawQuery != "" {
+			successor += "?" + r.URL.RawQuery
+		}
+		return successor
 	}
 }
 
 func (s *ServerAPI) csvReportRouter() http.Handler {
 	router := chi.NewRouter()
-	router.Post("/", s.HandleCsvReport)
-	router.Get("/{fileName}", s.HandleDownloadCsv)
+	router.Use(s.requireRole(RoleAdmin))
+	router.With(deprecated(successorPath("/v1/reports"))).Post("/", s.HandleCsvReport)
+	router.With(deprecated(successorParams("/v1/reports/%s", "reportID"))).Get("/{reportID}", s.HandleDownloadCsv)
 	return router
 }
 
 func (s *ServerAPI) userRouter() http.Handler {
 	router := chi.NewRouter()
-	router.Post("/new", s.HandleAddUser)
-	router.Post("/addSegment", s.HandleAddUserToSegment)
-	router.Get("/segments/{userID}", s.HandleGetUserSegmentsInfo)
-	router.Delete("/segments", s.HandleDeleteUserFromSegment)
+	router.With(deprecated(successorPath("/v1/users")), s.requireRole(RoleManager)).Post("/new", s.HandleAddUser)
+	router.With(deprecated(nil), s.requireRole(RoleManager)).Post("/addSegment", s.HandleAddUserToSegment)
+	router.With(deprecated(successorParams("/v1/users/%s/segments", "userID")), s.requireRole(RoleReader)).Get("/segments/{userID}", s.HandleGetUserSegmentsInfo)
+	router.With(deprecated(successorPath("/v1/users/segments/batch")), s.requireRole(RoleReader)).Post("/segments/batch", s.HandleGetUsersSegmentsInfo)
+	router.With(deprecated(successorParams("/v1/users/%s/segments/%s", "userID", "slug")), s.requireRole(RoleReader)).Get("/{userID}/segments/{slug}", s.HandleGetMembership)
+	router.With(deprecated(nil), s.requireRole(RoleManager)).Delete("/segments", s.HandleDeleteUserFromSegment)
 	return router
 }
 
 func (s *ServerAPI) segmentRouter() http.Handler {
 	router := chi.NewRouter()
-	router.Post("/new", s.HandleAddSegment)
-	router.Delete("/remove", s.HandleCascadeDeleteSegment)
-	router.Get("/users/{segmentName}", s.HandleGetSegmentUsersInfo)
+	router.With(deprecated(successorPath("/v1/segments")), s.requireRole(RoleManager)).Post("/new", s.HandleAddSegment)
+	router.With(deprecated(nil), s.requireRole(RoleManager)).Delete("/remove", s.HandleCascadeDeleteSegment)
+	router.With(deprecated(successorParams("/v1/segments/%s/users", "segmentName")), s.requireRole(RoleReader)).Get("/users/{segmentName}", s.HandleGetSegmentUsersInfo)
 	return router
 }
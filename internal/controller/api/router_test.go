@@ -0,0 +1,156 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/vlasashk/user-segmentation/internal/model/storage"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestRouter serves the http API backed by the memory storage with user 1 and the segment "growth-seg"
+// owned by team growth, accepting the keys of testAPIKeys.
+func newTestRouter(t *testing.T) (*ServerAPI, http.Handler) {
+	t.Helper()
+	t.Setenv("CSV_PATH", t.TempDir())
+	cfg := AuthConfig{}
+	for key, cred := range testAPIKeys {
+		digest := sha256.Sum256([]byte(key))
+		cred.KeyHash = hex.EncodeToString(digest[:])
+		cfg.APIKeys = append(cfg.APIKeys, cred)
+	}
+	auth, err := NewStaticAuthenticator(cfg)
+	if err != nil {
+		t.Fatalf("NewStaticAuthenticator() failed: %v", err)
+	}
+	reports, err := NewReportSigner("secret", "")
+	if err != nil {
+		t.Fatalf("NewReportSigner() failed: %v", err)
+	}
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store := storage.NewMemoryDB()
+	ctx := context.Background()
+	if _, err = store.AddUser(ctx, storage.User{UID: 1}, log); err != nil {
+		t.Fatalf("AddUser() failed: %v", err)
+	}
+	if _, err = store.AddSegment(ctx, storage.Segment{Slug: "growth-seg", OwnerTeam: "growth"}, log); err != nil {
+		t.Fatalf("AddSegment() failed: %v", err)
+	}
+	s := &ServerAPI{
+		Store:              store,
+		Log:                log,
+		Reports:            reports,
+		Auth:               auth,
+		IdempotencyTTL:     time.Hour,
+		IdempotencyLease:   time.Hour,
+		EventsPollInterval: time.Second,
+	}
+	return s, s.routes()
+}
+
+// signedReportQuery returns the id and query of a valid download link for a report that doesn't exist.
+func signedReportQuery(t *testing.T, s *ServerAPI) string {
+	t.Helper()
+	reportID, err := storage.NewReportID()
+	if err != nil {
+		t.Fatalf("NewReportID() failed: %v", err)
+	}
+	expires, signature := s.Reports.Sign(reportID, time.Now())
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("signature", signature)
+	return reportID + "?" + query.Encode()
+}
+
+func TestRouterRoles(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		role   Role
+		legacy bool
+	}{
+		{http.MethodPost, "/user/new", `{"user_id":2}`, RoleManager, true},
+		{http.MethodPost, "/user/addSegment", `{"user_id":1,"segment_slug":["growth-seg"]}`, RoleManager, true},
+		{http.MethodGet, "/user/segments/1", ``, RoleReader, true},
+		{http.MethodPost, "/user/segments/batch", `{"user_ids":[1]}`, RoleReader, true},
+		{http.MethodGet, "/user/1/segments/growth-seg", ``, RoleReader, true},
+		{http.MethodDelete, "/user/segments", `{"user_id":1,"segment_slug":["growth-seg"]}`, RoleManager, true},
+		{http.MethodPost, "/segment/new", `{"slug":"new-seg"}`, RoleManager, true},
+		{http.MethodDelete, "/segment/remove", `{"slug":"growth-seg"}`, RoleManager, true},
+		{http.MethodGet, "/segment/users/growth-seg", ``, RoleReader, true},
+		{http.MethodPost, "/report", `{"year":2023,"month":8}`, RoleAdmin, true},
+		{http.MethodGet, "/report/{signed}", ``, RoleAdmin, true},
+		{http.MethodPost, "/v1/users", `{"user_id":2}`, RoleManager, false},
+		{http.MethodPost, "/v1/users/segments/batch", `{"user_ids":[1]}`, RoleReader, false},
+		{http.MethodGet, "/v1/users/1/memberships?slug=growth-seg", ``, RoleReader, false},
+		{http.MethodGet, "/v1/users/1/segments", ``, RoleReader, false},
+		{http.MethodGet, "/v1/users/1/segments/growth-seg", ``, RoleReader, false},
+		{http.MethodPost, "/v1/users/1/segments", `{"segment_slug":["growth-seg"]}`, RoleManager, false},
+		{http.MethodPut, "/v1/users/1/segments/growth-seg", `{}`, RoleManager, false},
+		{http.MethodDelete, "/v1/users/1/segments/growth-seg", ``, RoleManager, false},
+		{http.MethodPost, "/v1/segments", `{"slug":"new-seg"}`, RoleManager, false},
+		{http.MethodDelete, "/v1/segments/growth-seg", ``, RoleManager, false},
+		{http.MethodGet, "/v1/segments/growth-seg/users", ``, RoleReader, false},
+		{http.MethodPost, "/v1/webhooks", `{"url":"https://example.com/hook","secret":"0123456789abcdef"}`, RoleAdmin, false},
+		{http.MethodGet, "/v1/webhooks", ``, RoleAdmin, false},
+		{http.MethodDelete, "/v1/webhooks/1", ``, RoleAdmin, false},
+		{http.MethodGet, "/v1/webhooks/1/dead-letters", ``, RoleAdmin, false},
+		{http.MethodPost, "/v1/reports", `{"year":2023,"month":8}`, RoleAdmin, false},
+		{http.MethodGet, "/v1/reports/{signed}", ``, RoleAdmin, false},
+		{http.MethodGet, "/debug/vars", ``, RoleAdmin, false},
+	}
+	for _, tt := range tests {
+		for _, rk := range roleKeys {
+			t.Run(tt.method+" "+tt.path+" as "+string(rk.role), func(t *testing.T) {
+				s, router := newTestRouter(t)
+				path := strings.Replace(tt.path, "{signed}", signedReportQuery(t, s), 1)
+				r := httptest.NewRequest(tt.method, path, strings.NewReader(tt.body))
+				r.Header.Set("Content-Type", "application/json")
+				r.Header.Set("X-API-Key", rk.key)
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, r)
+
+				if !rk.role.Allows(tt.role) {
+					var problem Problem
+					_ = json.NewDecoder(w.Body).Decode(&problem)
+					if w.Code != http.StatusForbidden || problem.Code != CodeForbidden || !strings.Contains(problem.Detail, string(tt.role)) {
+						t.Errorf("response = %d %+v, want %d requiring role %s", w.Code, problem, http.StatusForbidden, tt.role)
+					}
+					return
+				}
+				if w.Code == http.StatusUnauthorized || w.Code == http.StatusForbidden || w.Code >= http.StatusInternalServerError {
+					t.Errorf("response = %d %s, want a 2xx or a 4xx other than 401 and 403", w.Code, w.Body)
+				}
+				if got := w.Header().Get("Deprecation") == "true"; got != tt.legacy {
+					t.Errorf("deprecated = %v, want %v", got, tt.legacy)
+				}
+			})
+		}
+	}
+}
+
+func TestRouterUnauthenticated(t *testing.T) {
+	_, router := newTestRouter(t)
+	for _, path := range []string{"/user/segments/1", "/v1/users/1/segments", "/events", "/debug/vars"} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("GET %s without credentials = %d, want %d", path, w.Code, http.StatusUnauthorized)
+		}
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("GET / without credentials = %d, want %d", w.Code, http.StatusOK)
+	}
+}
@@ -4,23 +4,77 @@ import (
 	"context"
 	"github.com/vlasashk/user-segmentation/internal/model/storage"
 	"log/slog"
+	"time"
 )
 
-type Storage interface {
-	CascadeDeleteSegment(context.Context, storage.Segment, *slog.Logger) error
+// UserStore manages users and their segment memberships.
+type UserStore interface {
+	AddUser(context.Context, storage.User, *slog.Logger) (uint64, error)
+	AddUserToSegments(context.Context, storage.UserSegments, *slog.Logger) ([]storage.SegmentOutcome, error)
 	DeleteUserFromSegments(context.Context, storage.UserSegments, *slog.Logger) error
 	GetUserSegmentsInfo(context.Context, storage.User, *slog.Logger) ([]string, error)
-	GetSegmentUsersInfo(context.Context, storage.Segment, *slog.Logger) ([]uint64, error)
-	AddUserToSegments(context.Context, storage.UserSegments, *slog.Logger) error
-	AddUser(context.Context, storage.User, *slog.Logger) (uint64, error)
+	GetUsersSegmentsInfo(context.Context, storage.UsersBatch, *slog.Logger) (map[uint64][]string, error)
+	GetMemberships(context.Context, storage.UserSegments, *slog.Logger) ([]storage.Membership, error)
+}
+
+// SegmentStore manages segments.
+type SegmentStore interface {
 	AddSegment(context.Context, storage.Segment, *slog.Logger) (uint64, error)
-	CsvHistoryReport(context.Context, storage.CsvReport, *slog.Logger) error
+	CascadeDeleteSegment(context.Context, storage.Segment, *slog.Logger) error
+	GetSegmentUsersInfo(context.Context, storage.Segment, *slog.Logger) ([]uint64, error)
+}
+
+// ReportStore builds membership history reports.
+type ReportStore interface {
+	CsvHistoryReport(context.Context, storage.CsvReport, *slog.Logger) (string, error)
+}
+
+// WebhookStore manages webhook subscriptions.
+type WebhookStore interface {
+	AddWebhookSubscription(context.Context, storage.WebhookSubscription, *slog.Logger) (storage.WebhookSubscription, error)
+	GetWebhookSubscriptions(context.Context, *slog.Logger) ([]storage.WebhookSubscription, error)
+	DeleteWebhookSubscription(context.Context, uint64, *slog.Logger) error
+	GetWebhookDeadLetters(context.Context, uint64, *slog.Logger) ([]storage.WebhookDeadLetter, error)
+}
+
+// EventStore reads the log of recorded change events.
+type EventStore interface {
+	GetEvents(context.Context, storage.EventFilter, *slog.Logger) ([]storage.OutboxEvent, error)
+	GetLastEventSeq(context.Context, *slog.Logger) (uint64, error)
+}
+
+// IdempotencyStore keeps the responses of requests sent with an idempotency key.
+type IdempotencyStore interface {
+	ReserveIdempotencyKey(context.Context, storage.IdempotencyKey, time.Duration, time.Duration, *slog.Logger) (storage.IdempotencyRecord, bool, error)
+	SaveIdempotentResponse(context.Context, storage.IdempotencyKey, string, storage.IdempotentResponse, *slog.Logger) error
+	ReleaseIdempotencyKey(context.Context, storage.IdempotencyKey, string, *slog.Logger) error
+	PruneIdempotencyKeys(context.Context, time.Duration, time.Duration, *slog.Logger) (int64, error)
+}
+
+// Storage is everything the api needs from a storage backend.
+type Storage interface {
+	UserStore
+	SegmentStore
+	ReportStore
+	WebhookStore
+	EventStore
+	IdempotencyStore
 }
 
 type ServerAPI struct {
 	ListenAddr string
 	Store      Storage
 	Log        *slog.Logger
+	Reports    *ReportSigner
+	// PublicURL is the externally visible base url of the API prefixed to report links,
+	// which are relative if it's empty.
+	PublicURL      string
+	Auth           Authenticator
+	IdempotencyTTL time.Duration
+	// IdempotencyLease is how long a key stays reserved by a request that hasn't stored its response.
+	IdempotencyLease time.Duration
+	// EventsPollInterval is how often event streams look up new events.
+	EventsPollInterval time.Duration
 }
 
 type UserRequest struct {
@@ -48,6 +102,7 @@ type SegmentResponse struct {
 type UserSegmentResponse struct {
 	ResponseStatus
 	storage.UserSegments
+	Outcomes []storage.SegmentOutcome `json:"outcomes,omitempty"`
 }
 
 type GetSegmentsResponse struct {
@@ -56,6 +111,27 @@ type GetSegmentsResponse struct {
 	SegmentSlug []string `json:"user_segments" validate:"required"`
 }
 
+type UsersBatchRequest struct {
+	storage.UsersBatch
+}
+
+type GetUsersSegmentsResponse struct {
+	ResponseStatus
+	UsersSegments map[uint64][]string `json:"users_segments" validate:"required"`
+}
+
+type MembershipResponse struct {
+	ResponseStatus
+	UserID uint64 `json:"user_id" validate:"required"`
+	storage.Membership
+}
+
+type MembershipsResponse struct {
+	ResponseStatus
+	UserID      uint64               `json:"user_id" validate:"required"`
+	Memberships []storage.Membership `json:"memberships" validate:"required"`
+}
+
 type GetUsersResponse struct {
 	ResponseStatus
 	SegmentSlug string   `json:"user_segment" validate:"required"`
@@ -68,5 +144,36 @@ type CsvReportRequest struct {
 
 type CsvReportResponse struct {
 	ResponseStatus
-	CsvUrl string `json:"csv_url" validate:"required"`
+	ReportID  string    `json:"report_id" validate:"required"`
+	CsvUrl    string    `json:"csv_url" validate:"required"`
+	ExpiresAt time.Time `json:"expires_at" validate:"required"`
+}
+
+type SegmentListRequest struct {
+	SegmentSlug []string `json:"segment_slug" validate:"required,min=1,max=100,unique,dive,slug"`
+}
+
+type WebhookSubscriptionRequest struct {
+	storage.WebhookSubscription
+}
+
+type WebhookSubscriptionResponse struct {
+	ResponseStatus
+	storage.WebhookSubscription
+}
+
+type WebhookSubscriptionsResponse struct {
+	ResponseStatus
+	Subscriptions []storage.WebhookSubscription `json:"subscriptions" validate:"required"`
+}
+
+type WebhookDeadLettersResponse struct {
+	ResponseStatus
+	DeadLetters []storage.WebhookDeadLetter `json:"dead_letters" validate:"required"`
+}
+
+// EventsRequest filters an event stream.
+type EventsRequest struct {
+	UserID  uint64 `json:"user_id" validate:"omitempty,user_id"`
+	Segment string `json:"segment" validate:"omitempty,slug"`
 }
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const defaultReportURLTTL = 15 * time.Minute
+
+var (
+	errLinkExpired      = fmt.Errorf("download link has expired")
+	errInvalidSignature = fmt.Errorf("invalid download link signature")
+)
+
+// ReportSigner issues and verifies time-limited download links for csv reports.
+type ReportSigner struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+// NewReportSigner creates a signer from a secret and a link lifetime such as "15m".
+// An empty secret is replaced by a random one, so links only stay valid until restart.
+func NewReportSigner(secret, ttl string) (*ReportSigner, error) {
+	signer := &ReportSigner{
+		secret: []byte(secret),
+		ttl:    defaultReportURLTTL,
+	}
+	if ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid report url ttl %q", ttl)
+		}
+		signer.ttl = d
+	}
+	if len(signer.secret) == 0 {
+		signer.secret = make([]byte, 32)
+		if _, err := rand.Read(signer.secret); err != nil {
+			return nil, fmt.Errorf("failed to generate report secret: %v", err)
+		}
+	}
+	return signer, nil
+}
+
+// Sign returns the expiry timestamp and signature authorizing a download of reportID.
+func (rs *ReportSigner) Sign(reportID string, now time.Time) (time.Time, string) {
+	expires := now.Add(rs.ttl).Truncate(time.Second)
+	return expires, rs.signature(reportID, expires.Unix())
+}
+
+// Verify checks that signature authorizes a download of reportID and that the link hasn't expired.
+func (rs *ReportSigner) Verify(reportID, expires, signature string, now time.Time) error {
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return errInvalidSignature
+	}
+	expected := rs.signature(reportID, unix)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return errInvalidSignature
+	}
+	if now.After(time.Unix(unix, 0)) {
+		return errLinkExpired
+	}
+	return nil
+}
+
+func (rs *ReportSigner) signature(reportID string, expires int64) string {
+	mac := hmac.New(sha256.New, rs.secret)
+	mac.Write([]byte(reportID))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,116 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testReportID = "0123456789abcdef0123456789abcdef"
+
+func TestReportSigner(t *testing.T) {
+	signer, err := NewReportSigner("secret", "15m")
+	if err != nil {
+		t.Fatalf("NewReportSigner() failed: %v", err)
+	}
+	now := time.Unix(1693562400, 0)
+	expires, signature := signer.Sign(testReportID, now)
+	if want := now.Add(15 * time.Minute); !expires.Equal(want) {
+		t.Errorf("Sign() expires = %v, want %v", expires, want)
+	}
+	unix := strconv.FormatInt(expires.Unix(), 10)
+	other, err := NewReportSigner("another secret", "15m")
+	if err != nil {
+		t.Fatalf("NewReportSigner() failed: %v", err)
+	}
+	_, otherSignature := other.Sign(testReportID, now)
+	tampered := []byte(signature)
+	tampered[0] ^= 1
+
+	tests := []struct {
+		name      string
+		reportID  string
+		expires   string
+		signature string
+		now       time.Time
+		want      error
+	}{
+		{"valid", testReportID, unix, signature, now, nil},
+		{"valid until expiry", testReportID, unix, signature, expires, nil},
+		{"expired", testReportID, unix, signature, expires.Add(time.Second), errLinkExpired},
+		{"another report", strings.Repeat("f", 32), unix, signature, now, errInvalidSignature},
+		{"extended expiry", testReportID, strconv.FormatInt(expires.Unix()+3600, 10), signature, now, errInvalidSignature},
+		{"malformed expiry", testReportID, unix + "0x", signature, now, errInvalidSignature},
+		{"tampered signature", testReportID, unix, string(tampered), now, errInvalidSignature},
+		{"another secret", testReportID, unix, otherSignature, now, errInvalidSignature},
+		{"no signature", testReportID, unix, "", now, errInvalidSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := signer.Verify(tt.reportID, tt.expires, tt.signature, tt.now); !errors.Is(err, tt.want) {
+				t.Errorf("Verify() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewReportSigner(t *testing.T) {
+	for _, ttl := range []string{"soon", "0s", "-1m"} {
+		if _, err := NewReportSigner("secret", ttl); err == nil {
+			t.Errorf("NewReportSigner() with ttl %q succeeded, want error", ttl)
+		}
+	}
+	// Without a secret every signer makes up its own.
+	first, _ := NewReportSigner("", "")
+	second, _ := NewReportSigner("", "")
+	now := time.Now()
+	expires, signature := first.Sign(testReportID, now)
+	if err := second.Verify(testReportID, strconv.FormatInt(expires.Unix(), 10), signature, now); err == nil {
+		t.Errorf("Verify() of a link signed with another random secret succeeded")
+	}
+}
+
+func TestReportLink(t *testing.T) {
+	s, _ := newTestRouter(t)
+	link, expires := s.reportLink(testReportID, "/v1/reports/")
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatalf("reportLink() = %q, not an url: %v", link, err)
+	}
+	if u.IsAbs() || u.Path != "/v1/reports/"+testReportID {
+		t.Errorf("reportLink() without a public url = %q, want a relative link", link)
+	}
+	if err = s.Reports.Verify(testReportID, u.Query().Get("expires"), u.Query().Get("signature"), expires); err != nil {
+		t.Errorf("Verify() of reportLink() = %v", err)
+	}
+
+	s.PublicURL = "https://segments.example.com"
+	if link, _ = s.reportLink(testReportID, "/report/"); !strings.HasPrefix(link, "https://segments.example.com/report/"+testReportID+"?") {
+		t.Errorf("reportLink() = %q, want it under the public url", link)
+	}
+}
+
+func TestDownloadReportTraversal(t *testing.T) {
+	s, router := newTestRouter(t)
+	for _, reportID := range []string{"..%2F..%2Fetc%2Fpasswd", "..", testReportID + "%2F..%2F" + testReportID, strings.ToUpper(testReportID)} {
+		id, _ := url.PathUnescape(reportID)
+		expires, signature := s.Reports.Sign(id, time.Now())
+		query := url.Values{}
+		query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+		query.Set("signature", signature)
+		for _, prefix := range []string{"/report/", "/v1/reports/"} {
+			r := httptest.NewRequest(http.MethodGet, prefix+reportID+"?"+query.Encode(), nil)
+			r.Header.Set("X-API-Key", "admin-key")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			if w.Code != http.StatusBadRequest && w.Code != http.StatusNotFound {
+				t.Errorf("GET %s%s with a signed link = %d, want it rejected", prefix, reportID, w.Code)
+			}
+		}
+	}
+}
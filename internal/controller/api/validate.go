@@ -0,0 +1,73 @@
+package api
+
+import (
+	"fmt"
+	"github.com/go-playground/validator/v10"
+	"github.com/vlasashk/user-segmentation/internal/model/storage"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// slugPattern is the segment slug grammar: a latin letter followed by latin letters, digits, '_' or '-'.
+// Slugs are case-preserving, but two slugs differing only in case can't coexist.
+var slugPattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]*$`)
+
+// validate is shared by all handlers, validator instances cache struct metadata and are safe for concurrent use.
+var validate = newValidator()
+
+func newValidator() *validator.Validate {
+	v := validator.New()
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			return ""
+		}
+		if name == "" {
+			return field.Name
+		}
+		return name
+	})
+	_ = v.RegisterValidation("slug", func(fl validator.FieldLevel) bool {
+		slug := fl.Field().String()
+		return len(slug) <= storage.MaxSlugLength && slugPattern.MatchString(slug)
+	})
+	_ = v.RegisterValidation("user_id", func(fl validator.FieldLevel) bool {
+		uid := fl.Field().Uint()
+		return uid >= storage.MinUserID && uid <= storage.MaxUserID
+	})
+	return v
+}
+
+// fieldErrorMessage explains a validation failure in terms of the rule that was broken.
+func fieldErrorMessage(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return "field is required"
+	case "slug":
+		return fmt.Sprintf("must start with a latin letter, contain only latin letters, digits, '_' or '-' and be at most %d characters long", storage.MaxSlugLength)
+	case "user_id":
+		return fmt.Sprintf("must be between %d and %d", storage.MinUserID, uint64(storage.MaxUserID))
+	case "min":
+		if fe.Kind() == reflect.Slice {
+			return fmt.Sprintf("must contain at least %s items", fe.Param())
+		}
+		return fmt.Sprintf("must be at least %s", fe.Param())
+	case "max":
+		if fe.Kind() == reflect.Slice {
+			return fmt.Sprintf("must contain at most %s items", fe.Param())
+		}
+		if fe.Kind() == reflect.String {
+			return fmt.Sprintf("must be at most %s characters long", fe.Param())
+		}
+		return fmt.Sprintf("must be at most %s", fe.Param())
+	case "unique":
+		return "must not contain duplicates"
+	case "http_url":
+		return "must be an absolute http or https URL"
+	case "oneof":
+		return fmt.Sprintf("must be one of: %s", strings.Join(strings.Fields(fe.Param()), ", "))
+	default:
+		return fmt.Sprintf("failed on the '%s' rule", fe.Tag())
+	}
+}
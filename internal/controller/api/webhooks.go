@@ -0,0 +1,175 @@
+package api
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/vlasashk/user-segmentation/internal/model/logger"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// HandleV1AddWebhook godoc
+// @Summary Subscribe to membership events
+// @Description Register a URL receiving HMAC-signed membership events. Empty events or segments match everything
+// @ID v1AddWebhook
+// @Tags webhooks
+// @Accept  json
+// @Produce  json
+// @Param subscription body WebhookSubscriptionRequest true "Subscription to add"
+// @Param Idempotency-Key header string false "Key making retries of the request safe"
+// @Success 200 {object} WebhookSubscriptionResponse "Successfully added subscription"
+// @Failure 400 {object} Problem "Invalid input data"
+// @Failure 401 {object} Problem "Authentication required"
+// @Failure 403 {object} Problem "Insufficient role"
+// @Failure 500 {object} Problem "Query execution failure"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Failure 504 {object} Problem "Query timed out"
+// @Security BasicAuth
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Router /v1/webhooks [post]
+func (s *ServerAPI) HandleV1AddWebhook(w http.ResponseWriter, r *http.Request) {
+	subscription := &WebhookSubscriptionRequest{}
+	log := s.requestLog(r)
+	if err := render.DecodeJSON(r.Body, subscription); err != nil {
+		log.Error("failed to decode request body", logger.Err(err))
+		renderProblem(w, r, http.StatusBadRequest, CodeBadRequest, "failed to decode request body")
+		return
+	}
+	// The secret must not end up in the logs.
+	log.Info("request body decoded", slog.String("url", subscription.URL))
+	if !validateRequest(w, r, log, subscription) {
+		return
+	}
+	added, err := s.Store.AddWebhookSubscription(r.Context(), subscription.WebhookSubscription, log)
+	if err != nil {
+		renderStorageError(w, r, err)
+		return
+	}
+	added.Secret = ""
+	response := WebhookSubscriptionResponse{
+		ResponseStatus:      OK(),
+		WebhookSubscription: added,
+	}
+	log.Info("query successfully executed", slog.Any("request", response))
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, response)
+}
+
+// HandleV1GetWebhooks godoc
+// @Summary List webhook subscriptions
+// @Description List all webhook subscriptions, secrets are not returned
+// @ID v1GetWebhooks
+// @Tags webhooks
+// @Produce  json
+// @Success 200 {object} WebhookSubscriptionsResponse "Successfully retrieved subscriptions"
+// @Failure 401 {object} Problem "Authentication required"
+// @Failure 403 {object} Problem "Insufficient role"
+// @Failure 500 {object} Problem "Query execution failure"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Failure 504 {object} Problem "Query timed out"
+// @Security BasicAuth
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Router /v1/webhooks [get]
+func (s *ServerAPI) HandleV1GetWebhooks(w http.ResponseWriter, r *http.Request) {
+	log := s.requestLog(r)
+	subscriptions, err := s.Store.GetWebhookSubscriptions(r.Context(), log)
+	if err != nil {
+		renderStorageError(w, r, err)
+		return
+	}
+	response := WebhookSubscriptionsResponse{
+		ResponseStatus: OK(),
+		Subscriptions:  subscriptions,
+	}
+	log.Info("query successfully executed", slog.Int("subscriptions", len(subscriptions)))
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, response)
+}
+
+// HandleV1DeleteWebhook godoc
+// @Summary Delete a webhook subscription
+// @Description Delete a webhook subscription together with its pending deliveries and dead letters
+// @ID v1DeleteWebhook
+// @Tags webhooks
+// @Produce  json
+// @Param subscriptionID path int true "Subscription ID"
+// @Param Idempotency-Key header string false "Key making retries of the request safe"
+// @Success 200 {object} ResponseStatus "Successfully deleted subscription"
+// @Failure 400 {object} Problem "Invalid input data"
+// @Failure 401 {object} Problem "Authentication required"
+// @Failure 403 {object} Problem "Insufficient role"
+// @Failure 404 {object} Problem "Subscription doesn't exist"
+// @Failure 500 {object} Problem "Query execution failure"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Failure 504 {object} Problem "Query timed out"
+// @Security BasicAuth
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Router /v1/webhooks/{subscriptionID} [delete]
+func (s *ServerAPI) HandleV1DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	log := s.requestLog(r)
+	id, ok := parseSubscriptionID(w, r, log)
+	if !ok {
+		return
+	}
+	if err := s.Store.DeleteWebhookSubscription(r.Context(), id, log); err != nil {
+		renderStorageError(w, r, err)
+		return
+	}
+	log.Info("query successfully executed", slog.Uint64("subscription_id", id))
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, OK())
+}
+
+// HandleV1GetWebhookDeadLetters godoc
+// @Summary List failed webhook deliveries
+// @Description List the latest deliveries to a subscription that were given up after running out of attempts
+// @ID v1GetWebhookDeadLetters
+// @Tags webhooks
+// @Produce  json
+// @Param subscriptionID path int true "Subscription ID"
+// @Success 200 {object} WebhookDeadLettersResponse "Successfully retrieved dead letters"
+// @Failure 400 {object} Problem "Invalid input data"
+// @Failure 401 {object} Problem "Authentication required"
+// @Failure 403 {object} Problem "Insufficient role"
+// @Failure 404 {object} Problem "Subscription doesn't exist"
+// @Failure 500 {object} Problem "Query execution failure"
+// @Failure 503 {object} Problem "Database is unavailable"
+// @Failure 504 {object} Problem "Query timed out"
+// @Security BasicAuth
+// @Security ApiKeyAuth
+// @Security BearerAuth
+// @Router /v1/webhooks/{subscriptionID}/dead-letters [get]
+func (s *ServerAPI) HandleV1GetWebhookDeadLetters(w http.ResponseWriter, r *http.Request) {
+	log := s.requestLog(r)
+	id, ok := parseSubscriptionID(w, r, log)
+	if !ok {
+		return
+	}
+	deadLetters, err := s.Store.GetWebhookDeadLetters(r.Context(), id, log)
+	if err != nil {
+		renderStorageError(w, r, err)
+		return
+	}
+	response := WebhookDeadLettersResponse{
+		ResponseStatus: OK(),
+		DeadLetters:    deadLetters,
+	}
+	log.Info("query successfully executed", slog.Int("dead_letters", len(deadLetters)))
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, response)
+}
+
+// parseSubscriptionID parses the subscriptionID path parameter, writing the error response on failure.
+func parseSubscriptionID(w http.ResponseWriter, r *http.Request, log *slog.Logger) (uint64, bool) {
+	id, err := strconv.ParseUint(chi.URLParam(r, "subscriptionID"), 10, 64)
+	if err != nil {
+		log.Error("failed to parse subscription ID", logger.Err(err))
+		renderProblem(w, r, http.StatusBadRequest, CodeBadRequest, "failed to parse subscription ID")
+		return 0, false
+	}
+	return id, true
+}
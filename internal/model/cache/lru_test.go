@@ -0,0 +1,42 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRUAddIf(t *testing.T) {
+	c := New[int, string](2, time.Minute)
+	if c.AddIf(1, "stale", func() bool { return false }) {
+		t.Fatalf("AddIf() added a value that isn't valid")
+	}
+	if _, ok := c.Get(1); ok {
+		t.Fatalf("Get() returned a value rejected by AddIf()")
+	}
+	if !c.AddIf(1, "fresh", func() bool { return true }) {
+		t.Fatalf("AddIf() rejected a valid value")
+	}
+	if v, ok := c.Get(1); !ok || v != "fresh" {
+		t.Fatalf("Get() = %q, %v, want \"fresh\", true", v, ok)
+	}
+}
+
+func TestLRUEviction(t *testing.T) {
+	now := time.Now()
+	c := New[int, string](2, time.Minute)
+	c.now = func() time.Time { return now }
+	c.Add(1, "a")
+	c.Add(2, "b")
+	c.Get(1)
+	c.Add(3, "c")
+	if _, ok := c.Get(2); ok {
+		t.Errorf("least recently used entry wasn't evicted")
+	}
+	if _, ok := c.Get(1); !ok {
+		t.Errorf("recently used entry was evicted")
+	}
+	now = now.Add(time.Minute)
+	if _, ok := c.Get(3); ok {
+		t.Errorf("expired entry was returned")
+	}
+}
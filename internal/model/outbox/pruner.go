@@ -0,0 +1,50 @@
+package outbox
+
+import (
+	"context"
+	"github.com/vlasashk/user-segmentation/internal/model/logger"
+	"log/slog"
+	"time"
+)
+
+// Pruner deletes published events older than the retention. Unpublished events are kept until the relay
+// published them, unless Config.PruneUnpublished is set. It runs whether or not a relay does,
+// since the outbox also backs the event stream.
+type Pruner struct {
+	store Store
+	log   *slog.Logger
+	cfg   Config
+}
+
+func NewPruner(store Store, log *slog.Logger, cfg Config) *Pruner {
+	return &Pruner{
+		store: store,
+		log:   log.With(slog.String("component", "outbox_pruner")),
+		cfg:   cfg,
+	}
+}
+
+// Run prunes the outbox until ctx is done.
+func (p *Pruner) Run(ctx context.Context) {
+	ticker := time.NewTicker(defaultPruneInterval)
+	defer ticker.Stop()
+	for {
+		p.prune(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Pruner) prune(ctx context.Context) {
+	pruned, err := p.store.PruneOutbox(ctx, time.Now().Add(-p.cfg.Retention), p.cfg.PruneUnpublished, p.log)
+	if err != nil {
+		p.log.Warn("failed to prune outbox", logger.Err(err))
+		return
+	}
+	if pruned > 0 {
+		p.log.Info("outbox pruned", slog.Int64("count", pruned))
+	}
+}
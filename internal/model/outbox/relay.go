@@ -0,0 +1,102 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"github.com/vlasashk/user-segmentation/internal/model/storage"
+	"log/slog"
+	"os"
+	"time"
+)
+
+const (
+	defaultPollInterval  = time.Second
+	defaultRetention     = 7 * 24 * time.Hour
+	defaultBatchSize     = 100
+	defaultPruneInterval = 10 * time.Minute
+)
+
+// Store is the storage the relay takes recorded events from and the pruner deletes them from.
+type Store interface {
+	PublishOutbox(context.Context, int, func(context.Context, []storage.OutboxEvent) error, *slog.Logger) (int, error)
+	PruneOutbox(context.Context, time.Time, bool, *slog.Logger) (int64, error)
+}
+
+// Config tunes the relay and the pruner.
+type Config struct {
+	// PollInterval is how often unpublished events are looked up.
+	PollInterval time.Duration
+	// Retention is how long published events are kept before they are pruned.
+	Retention time.Duration
+	// PruneUnpublished prunes events older than the retention even if they weren't published.
+	// It is meant for instances without a relay, where nothing ever publishes them.
+	PruneUnpublished bool
+}
+
+// ConfigFromEnv reads OUTBOX_POLL_INTERVAL and OUTBOX_RETENTION.
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{
+		PollInterval: defaultPollInterval,
+		Retention:    defaultRetention,
+	}
+	var err error
+	if v := os.Getenv("OUTBOX_POLL_INTERVAL"); v != "" {
+		if cfg.PollInterval, err = time.ParseDuration(v); err != nil || cfg.PollInterval <= 0 {
+			return cfg, fmt.Errorf("invalid OUTBOX_POLL_INTERVAL %q", v)
+		}
+	}
+	if v := os.Getenv("OUTBOX_RETENTION"); v != "" {
+		if cfg.Retention, err = time.ParseDuration(v); err != nil || cfg.Retention <= 0 {
+			return cfg, fmt.Errorf("invalid OUTBOX_RETENTION %q", v)
+		}
+	}
+	return cfg, nil
+}
+
+// Relay publishes recorded events to a sink in the order they were recorded. An event is marked published
+// only after the sink accepted it, so every event is published at least once: consumers should drop
+// duplicates by event id.
+type Relay struct {
+	store Store
+	sink  Sink
+	log   *slog.Logger
+	cfg   Config
+}
+
+func NewRelay(store Store, sink Sink, log *slog.Logger, cfg Config) *Relay {
+	return &Relay{
+		store: store,
+		sink:  sink,
+		log:   log.With(slog.String("component", "outbox_relay")),
+		cfg:   cfg,
+	}
+}
+
+// Run publishes events until ctx is done.
+func (r *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.cfg.PollInterval)
+	defer ticker.Stop()
+	for {
+		// Keep going without waiting while there is a backlog.
+		if r.publishBatch(ctx) == defaultBatchSize && ctx.Err() == nil {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// publishBatch publishes the oldest unpublished events and returns how many were published.
+func (r *Relay) publishBatch(ctx context.Context) int {
+	n, err := r.store.PublishOutbox(ctx, defaultBatchSize, r.sink.Publish, r.log)
+	if err != nil {
+		return 0
+	}
+	if n > 0 {
+		r.log.Debug("outbox events published", slog.Int("count", n))
+	}
+	return n
+}
@@ -0,0 +1,155 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"github.com/vlasashk/user-segmentation/internal/model/storage"
+	"github.com/vlasashk/user-segmentation/internal/model/webhook"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+var discardLog = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+// recordingSink keeps the ids of published events and fails while down is set.
+type recordingSink struct {
+	mu        sync.Mutex
+	down      bool
+	published []string
+}
+
+func (s *recordingSink) Publish(_ context.Context, events []storage.OutboxEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.down {
+		return errors.New("sink is down")
+	}
+	for _, event := range events {
+		s.published = append(s.published, event.ID)
+	}
+	return nil
+}
+
+// newOutbox returns a memory storage that recorded an event for each of the segments user 1 was added to.
+func newOutbox(t *testing.T, slugs ...string) *storage.MemoryDB {
+	t.Helper()
+	ctx := context.Background()
+	store := storage.NewMemoryDB()
+	if _, err := store.AddUser(ctx, storage.User{UID: 1}, discardLog); err != nil {
+		t.Fatalf("AddUser() failed: %v", err)
+	}
+	for _, slug := range slugs {
+		if _, err := store.AddSegment(ctx, storage.Segment{Slug: slug}, discardLog); err != nil {
+			t.Fatalf("AddSegment() failed: %v", err)
+		}
+	}
+	if _, err := store.AddUserToSegments(ctx, storage.UserSegments{UserID: 1, SegmentSlug: slugs}, discardLog); err != nil {
+		t.Fatalf("AddUserToSegments() failed: %v", err)
+	}
+	return store
+}
+
+func eventIDs(t *testing.T, store *storage.MemoryDB) []string {
+	t.Helper()
+	events, err := store.GetEvents(context.Background(), storage.EventFilter{Limit: 100}, discardLog)
+	if err != nil {
+		t.Fatalf("GetEvents() failed: %v", err)
+	}
+	ids := make([]string, 0, len(events))
+	for _, event := range events {
+		ids = append(ids, event.ID)
+	}
+	return ids
+}
+
+func TestRelayRedeliversAfterSinkFailure(t *testing.T) {
+	ctx := context.Background()
+	store := newOutbox(t, "a", "b", "c")
+	want := eventIDs(t, store)
+	sink := &recordingSink{down: true}
+	cfg := Config{PollInterval: time.Second, Retention: time.Nanosecond}
+	relay := NewRelay(store, sink, discardLog, cfg)
+	pruner := NewPruner(store, discardLog, cfg)
+
+	if n := relay.publishBatch(ctx); n != 0 {
+		t.Fatalf("publishBatch() to a failing sink = %d, want 0", n)
+	}
+	// Unpublished events outlive the retention.
+	time.Sleep(time.Millisecond)
+	pruner.prune(ctx)
+	if got := eventIDs(t, store); !slices.Equal(got, want) {
+		t.Fatalf("events after pruning = %v, want the unpublished %v", got, want)
+	}
+
+	sink.down = false
+	if n := relay.publishBatch(ctx); n != len(want) {
+		t.Fatalf("publishBatch() after the sink recovered = %d, want %d", n, len(want))
+	}
+	if !slices.Equal(sink.published, want) {
+		t.Errorf("published %v, want %v", sink.published, want)
+	}
+	if n := relay.publishBatch(ctx); n != 0 {
+		t.Errorf("publishBatch() of a published outbox = %d, want 0", n)
+	}
+	pruner.prune(ctx)
+	if got := eventIDs(t, store); len(got) != 0 {
+		t.Errorf("events after pruning published events = %v, want none", got)
+	}
+}
+
+func TestPrunerWithoutRelay(t *testing.T) {
+	store := newOutbox(t, "a")
+	pruner := NewPruner(store, discardLog, Config{Retention: time.Nanosecond, PruneUnpublished: true})
+	time.Sleep(time.Millisecond)
+	pruner.prune(context.Background())
+	if got := eventIDs(t, store); len(got) != 0 {
+		t.Errorf("events after pruning = %v, want none", got)
+	}
+}
+
+func TestWebhookSinkRepublishesFailedBatch(t *testing.T) {
+	const secret = "0123456789abcdef"
+	var mu sync.Mutex
+	received := make(map[string]int)
+	failed := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		timestamp, _ := strconv.ParseInt(r.Header.Get(webhook.TimestampHeader), 10, 64)
+		if got, want := r.Header.Get(webhook.SignatureHeader), "sha256="+webhook.Sign(secret, timestamp, body); got != want {
+			t.Errorf("%s = %q, want %q", webhook.SignatureHeader, got, want)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		id := r.Header.Get(webhook.EventIDHeader)
+		// The second event fails once.
+		if len(received) == 1 && !failed {
+			failed = true
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		received[id]++
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	store := newOutbox(t, "a", "b")
+	want := eventIDs(t, store)
+	relay := NewRelay(store, NewWebhookSink(srv.URL, secret, time.Second), discardLog, Config{PollInterval: time.Second})
+	if n := relay.publishBatch(ctx); n != 0 {
+		t.Fatalf("publishBatch() with a failing request = %d, want 0", n)
+	}
+	if n := relay.publishBatch(ctx); n != len(want) {
+		t.Fatalf("publishBatch() = %d, want %d", n, len(want))
+	}
+	// The whole batch is published again, so the first event is delivered twice.
+	if received[want[0]] != 2 || received[want[1]] != 1 {
+		t.Errorf("deliveries per event = %v, want 2 of %s and 1 of %s", received, want[0], want[1])
+	}
+}
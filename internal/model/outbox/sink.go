@@ -0,0 +1,170 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/segmentio/kafka-go"
+	"github.com/vlasashk/user-segmentation/internal/model/storage"
+	"github.com/vlasashk/user-segmentation/internal/model/webhook"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultSinkTimeout = 10 * time.Second
+
+// Sink publishes events. Publish must return an error unless every event was accepted,
+// the whole batch is then published again.
+type Sink interface {
+	Publish(ctx context.Context, events []storage.OutboxEvent) error
+}
+
+// SinkFromEnv creates the sink named by OUTBOX_SINK: "stdout", "webhook" or "kafka".
+// It returns nil if OUTBOX_SINK is empty.
+func SinkFromEnv() (Sink, error) {
+	switch kind := os.Getenv("OUTBOX_SINK"); kind {
+	case "":
+		return nil, nil
+	case "stdout":
+		return NewStdoutSink(os.Stdout), nil
+	case "webhook":
+		url := os.Getenv("OUTBOX_WEBHOOK_URL")
+		if url == "" {
+			return nil, fmt.Errorf("OUTBOX_WEBHOOK_URL is required by the webhook outbox sink")
+		}
+		return NewWebhookSink(url, os.Getenv("OUTBOX_WEBHOOK_SECRET"), defaultSinkTimeout), nil
+	case "kafka":
+		brokers, topic := os.Getenv("KAFKA_BROKERS"), os.Getenv("KAFKA_TOPIC")
+		if brokers == "" || topic == "" {
+			return nil, fmt.Errorf("KAFKA_BROKERS and KAFKA_TOPIC are required by the kafka outbox sink")
+		}
+		return NewKafkaSink(strings.Split(brokers, ","), topic), nil
+	default:
+		return nil, fmt.Errorf("unknown OUTBOX_SINK %q", kind)
+	}
+}
+
+// StdoutSink writes events as json lines.
+type StdoutSink struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func NewStdoutSink(w io.Writer) *StdoutSink {
+	return &StdoutSink{enc: json.NewEncoder(w)}
+}
+
+func (s *StdoutSink) Publish(_ context.Context, events []storage.OutboxEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, event := range events {
+		if err := s.enc.Encode(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WebhookSink posts every event to a single url. Requests carry the same headers as webhook deliveries,
+// they are signed if secret isn't empty.
+type WebhookSink struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+func NewWebhookSink(url, secret string, timeout time.Duration) *WebhookSink {
+	return &WebhookSink{
+		url:    url,
+		secret: secret,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+func (s *WebhookSink) Publish(ctx context.Context, events []storage.OutboxEvent) error {
+	for _, event := range events {
+		if err := s.post(ctx, event); err != nil {
+			return fmt.Errorf("event %d: %w", event.Seq, err)
+		}
+	}
+	return nil
+}
+
+func (s *WebhookSink) post(ctx context.Context, event storage.OutboxEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	timestamp := time.Now().Unix()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhook.EventIDHeader, event.ID)
+	req.Header.Set(webhook.TimestampHeader, strconv.FormatInt(timestamp, 10))
+	if s.secret != "" {
+		req.Header.Set(webhook.SignatureHeader, "sha256="+webhook.Sign(s.secret, timestamp, body))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("sink responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// KafkaSink produces events to a topic of a Kafka compatible broker. Events are keyed by user id,
+// or by segment for segment events, so the changes of a user keep their order within a partition.
+type KafkaSink struct {
+	writer *kafka.Writer
+}
+
+func NewKafkaSink(brokers []string, topic string) *KafkaSink {
+	return &KafkaSink{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(brokers...),
+			Topic:        topic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+		},
+	}
+}
+
+func (s *KafkaSink) Publish(ctx context.Context, events []storage.OutboxEvent) error {
+	messages := make([]kafka.Message, 0, len(events))
+	for _, event := range events {
+		value, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		key := event.Segment
+		if event.UserID != 0 {
+			key = strconv.FormatUint(event.UserID, 10)
+		}
+		messages = append(messages, kafka.Message{
+			Key:   []byte(key),
+			Value: value,
+			Headers: []kafka.Header{
+				{Key: "event_id", Value: []byte(event.ID)},
+				{Key: "type", Value: []byte(event.Type)},
+			},
+		})
+	}
+	return s.writer.WriteMessages(ctx, messages...)
+}
+
+// Close flushes and closes the producer.
+func (s *KafkaSink) Close() error {
+	return s.writer.Close()
+}
@@ -0,0 +1,199 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var discardLog = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func TestSegmentOutcomes(t *testing.T) {
+	tests := []struct {
+		name     string
+		failed   map[string]string
+		want     []string
+		wantKind error
+	}{
+		{
+			name: "added",
+			want: []string{OutcomeAdded, OutcomeAdded, OutcomeAdded},
+		},
+		{
+			name:     "not found",
+			failed:   map[string]string{"b": OutcomeNotFound},
+			want:     []string{OutcomeAborted, OutcomeNotFound, OutcomeAborted},
+			wantKind: ErrNotFound,
+		},
+		{
+			name:     "already member",
+			failed:   map[string]string{"c": OutcomeAlreadyMember},
+			want:     []string{OutcomeAborted, OutcomeAborted, OutcomeAlreadyMember},
+			wantKind: ErrAlreadyExists,
+		},
+		{
+			name:     "first failure is the error",
+			failed:   map[string]string{"a": OutcomeAlreadyMember, "c": OutcomeNotFound},
+			want:     []string{OutcomeAlreadyMember, OutcomeAborted, OutcomeNotFound},
+			wantKind: ErrAlreadyExists,
+		},
+	}
+	userSegment := UserSegments{UserID: 1, SegmentSlug: []string{"a", "b", "c"}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outcomes, err := segmentOutcomes(userSegment, tt.failed, discardLog)
+			if tt.wantKind == nil && err != nil || tt.wantKind != nil && !errors.Is(err, tt.wantKind) {
+				t.Fatalf("segmentOutcomes() error = %v, want %v", err, tt.wantKind)
+			}
+			if len(outcomes) != len(tt.want) {
+				t.Fatalf("segmentOutcomes() = %+v, want %v", outcomes, tt.want)
+			}
+			for i, outcome := range outcomes {
+				if outcome.Slug != userSegment.SegmentSlug[i] || outcome.Outcome != tt.want[i] {
+					t.Errorf("segmentOutcomes() outcome %d = %+v, want {%s %s}", i, outcome, userSegment.SegmentSlug[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+// addPerSlug is how users were added to segments before the set-based queries: a lookup, an insert
+// and an event for every slug. It is kept for the benchmarks only.
+type addPerSlug func(ctx context.Context, userSegment UserSegments) error
+
+// benchmarkAdd adds a new user to n segments per iteration, once with the set-based AddUserToSegments
+// and once with perSlug.
+func benchmarkAdd(b *testing.B, store interface {
+	AddUser(context.Context, User, *slog.Logger) (uint64, error)
+	AddSegment(context.Context, Segment, *slog.Logger) (uint64, error)
+	AddUserToSegments(context.Context, UserSegments, *slog.Logger) ([]SegmentOutcome, error)
+}, perSlug addPerSlug) {
+	ctx := context.Background()
+	slugs := make([]string, MaxSegmentsPerRequest)
+	for i := range slugs {
+		slugs[i] = fmt.Sprintf("segment-%d", i)
+		if _, err := store.AddSegment(ctx, Segment{Slug: slugs[i]}, discardLog); err != nil {
+			b.Fatalf("AddSegment() failed: %v", err)
+		}
+	}
+	var uid uint64
+	for _, n := range []int{1, 10, MaxSegmentsPerRequest} {
+		for _, variant := range []struct {
+			name string
+			add  func(UserSegments) error
+		}{
+			{"per_slug", func(userSegment UserSegments) error {
+				return perSlug(ctx, userSegment)
+			}},
+			{"set_based", func(userSegment UserSegments) error {
+				_, err := store.AddUserToSegments(ctx, userSegment, discardLog)
+				return err
+			}},
+		} {
+			b.Run(fmt.Sprintf("%s/%d", variant.name, n), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					uid++
+					if _, err := store.AddUser(ctx, User{UID: uid}, discardLog); err != nil {
+						b.Fatalf("AddUser() failed: %v", err)
+					}
+					b.StartTimer()
+					if err := variant.add(UserSegments{UserID: uid, SegmentSlug: slugs[:n]}); err != nil {
+						b.Fatalf("adding to %d segments failed: %v", n, err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkSQLiteAddUserToSegments(b *testing.B) {
+	b.Setenv("SQLITE_PATH", filepath.Join(b.TempDir(), "bench.db"))
+	db, err := NewSQLite(context.Background())
+	if err != nil {
+		b.Fatalf("failed to open sqlite: %v", err)
+	}
+	defer db.Close()
+	benchmarkAdd(b, db, func(ctx context.Context, userSegment UserSegments) error {
+		return db.withTx(ctx, discardLog, func(tx *sql.Tx) error {
+			userID, segmentIDs, err := resolveSegments(ctx, tx, userSegment, discardLog)
+			if err != nil {
+				return err
+			}
+			queryInsert := `insert into user_segments (user_id, segment_id, created_at)
+							values (?1, ?2, ?3)
+							on conflict (user_id, segment_id) do update set deleted_at = NULL, created_at = ?3
+							where user_segments.deleted_at is not null`
+			now := sqliteNow()
+			for i, segmentID := range segmentIDs {
+				res, err := tx.ExecContext(ctx, queryInsert, userID, segmentID, now)
+				if err != nil {
+					return err
+				}
+				if n, _ := res.RowsAffected(); n < 1 {
+					return newError(ErrAlreadyExists, "user '%d' is already part of '%s' segment", userSegment.UserID, userSegment.SegmentSlug[i])
+				}
+				if err = sqliteRecordEvent(ctx, tx, EventMembershipAdded, userSegment.UserID, userSegment.SegmentSlug[i], discardLog); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// BenchmarkPostgresAddUserToSegments drops every table of the configured database like TestPostgresDB.
+func BenchmarkPostgresAddUserToSegments(b *testing.B) {
+	if os.Getenv("TEST_POSTGRES") == "" {
+		b.Skip("TEST_POSTGRES is not set")
+	}
+	ctx := context.Background()
+	db, err := Connect(ctx)
+	if err != nil {
+		b.Fatalf("failed to connect: %v", err)
+	}
+	defer db.Close()
+	if err = db.DropDB(ctx); err != nil {
+		b.Fatalf("failed to drop schema: %v", err)
+	}
+	if _, err = db.MigrateUp(ctx); err != nil {
+		b.Fatalf("failed to migrate: %v", err)
+	}
+	benchmarkAdd(b, db, func(ctx context.Context, userSegment UserSegments) error {
+		return db.inTx(ctx, pgx.ReadCommitted, discardLog, func(ctx context.Context, tx pgx.Tx) error {
+			id, err := lockUser(ctx, tx, userSegment.UserID, discardLog)
+			if err != nil {
+				return err
+			}
+			querySegment := `select id from segments where slug = $1 for share`
+			queryInsert := `insert into user_segments (user_id, segment_id)
+							values ($1, $2)
+							on conflict (user_id, segment_id) do update set deleted_at = NULL, created_at = NOW()
+							where user_segments.deleted_at is not null`
+			for _, slug := range userSegment.SegmentSlug {
+				var segmentID uint64
+				if err = tx.QueryRow(ctx, querySegment, slug).Scan(&segmentID); err != nil {
+					return err
+				}
+				res, err := tx.Exec(ctx, queryInsert, id, segmentID)
+				if err != nil {
+					return err
+				}
+				if res.RowsAffected() < 1 {
+					return newError(ErrAlreadyExists, "user '%d' is already part of '%s' segment", userSegment.UserID, slug)
+				}
+				if err = recordEvents(ctx, tx, EventMembershipAdded, userSegment.UserID, []string{slug}, discardLog); err != nil {
+					return err
+				}
+			}
+			return notifyChange(ctx, tx, Change{Kind: ChangeUser, UserID: userSegment.UserID}, discardLog)
+		})
+	})
+}
@@ -0,0 +1,67 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgconn"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Kinds of storage failures. Use errors.Is to classify an error returned by storage methods.
+var (
+	ErrNotFound      = errors.New("not found")
+	ErrAlreadyExists = errors.New("already exists")
+	ErrNotMember     = errors.New("not a member")
+	ErrForbidden     = errors.New("forbidden")
+	ErrUnavailable   = errors.New("storage unavailable")
+	ErrCanceled      = errors.New("canceled")
+	ErrTimeout       = errors.New("timed out")
+)
+
+// uniqueViolation is the postgres error code for unique constraint violations.
+const uniqueViolation = "23505"
+
+// Error is a storage failure of a particular kind with a message safe to show to clients.
+type Error struct {
+	Kind error
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Kind
+}
+
+func newError(kind error, format string, args ...any) error {
+	return &Error{
+		Kind: kind,
+		Msg:  fmt.Sprintf(format, args...),
+	}
+}
+
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	var sqliteErr *sqlite.Error
+	return errors.As(err, &pgErr) && pgErr.Code == uniqueViolation ||
+		errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+}
+
+// contextError reports a failure of a call whose context is done as ErrCanceled or ErrTimeout,
+// since whatever the query returned was caused by the cancellation.
+func contextError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	switch {
+	case errors.Is(ctx.Err(), context.Canceled):
+		return newError(ErrCanceled, "request canceled")
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return newError(ErrTimeout, "query timed out")
+	}
+	return err
+}
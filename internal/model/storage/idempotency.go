@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/vlasashk/user-segmentation/internal/model/logger"
+	"log/slog"
+	"time"
+)
+
+// IdempotencyKey identifies a mutating request retried by the same caller.
+type IdempotencyKey struct {
+	Caller      string
+	Key         string
+	RequestHash string
+}
+
+// IdempotentResponse is the stored response replayed to retries of a request.
+type IdempotentResponse struct {
+	StatusCode  int
+	ContentType string
+	// Header holds the other response headers replayed with the body, e.g. the deprecation headers of legacy routes.
+	Header map[string]string
+	Body   []byte
+}
+
+// IdempotencyRecord is the state of a previously reserved key.
+type IdempotencyRecord struct {
+	RequestHash string
+	// Token identifies the reservation made by ReserveIdempotencyKey. It is only set when the call reserved the key,
+	// and only the request holding it may save the response or release the key.
+	Token string
+	// Response is nil while the original request is still being processed.
+	Response *IdempotentResponse
+}
+
+// newIdempotencyToken returns a token identifying a new reservation of a key.
+func newIdempotencyToken(log *slog.Logger) (string, error) {
+	token, err := NewReportID()
+	if err != nil {
+		log.Error("failed to generate idempotency token", logger.Err(err))
+		return "", fmt.Errorf("failed to generate idempotency token")
+	}
+	return token, nil
+}
+
+// encodeResponseHeader returns header as stored with an idempotent response, nil if it is empty.
+func encodeResponseHeader(header map[string]string) ([]byte, error) {
+	if len(header) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(header)
+}
+
+// decodeResponseHeader parses a header stored by encodeResponseHeader.
+func decodeResponseHeader(raw []byte) (map[string]string, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var header map[string]string
+	if err := json.Unmarshal(raw, &header); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// ReserveIdempotencyKey claims key for a new request. If the key was already claimed within ttl
+// it returns the existing record and false instead. A key older than ttl, or without a response and older
+// than lease, is taken over, so a request that never saved its response can be retried.
+func (pg *PostgresDB) ReserveIdempotencyKey(ctx context.Context, key IdempotencyKey, ttl, lease time.Duration, log *slog.Logger) (IdempotencyRecord, bool, error) {
+	var record IdempotencyRecord
+	var reserved bool
+	token, err := newIdempotencyToken(log)
+	if err != nil {
+		return record, reserved, err
+	}
+	err = pg.acquire(ctx, func(ctx context.Context, conn *pgxpool.Conn) error {
+		if err := pg.Ping(ctx); err != nil {
+			log.Error("failed to ping db", logger.Err(err))
+			return newError(ErrUnavailable, "failed to ping db")
+		}
+		queryReserve := `insert into idempotency_keys (caller, key, request_hash, token)
+						 values ($1, $2, $3, $4)
+						 on conflict (caller, key) do update
+						 set request_hash = excluded.request_hash, token = excluded.token, created_at = NOW(),
+							 status_code = NULL, content_type = NULL, response_header = NULL, response_body = NULL
+						 where idempotency_keys.created_at < NOW() - make_interval(secs => $5)
+							or (idempotency_keys.status_code is null and idempotency_keys.created_at < NOW() - make_interval(secs => $6))`
+		queryGet := `select request_hash, status_code, content_type, response_header, response_body
+					 from idempotency_keys
+					 where caller = $1 and key = $2`
+		if res, err := conn.Exec(ctx, queryReserve, key.Caller, key.Key, key.RequestHash, token, ttl.Seconds(), lease.Seconds()); err != nil {
+			log.Error("failed to reserve idempotency key", logger.Err(err))
+			return fmt.Errorf("failed to reserve idempotency key")
+		} else if res.RowsAffected() == 1 {
+			reserved = true
+			record.Token = token
+			return nil
+		}
+		var statusCode *int
+		var contentType *string
+		var header, body []byte
+		if err := conn.QueryRow(ctx, queryGet, key.Caller, key.Key).Scan(&record.RequestHash, &statusCode, &contentType, &header, &body); err != nil {
+			log.Error("failed to get idempotency key", logger.Err(err))
+			return fmt.Errorf("failed to get idempotency key")
+		}
+		if statusCode != nil {
+			record.Response = &IdempotentResponse{
+				StatusCode: *statusCode,
+				Body:       body,
+			}
+			if contentType != nil {
+				record.Response.ContentType = *contentType
+			}
+			var err error
+			if record.Response.Header, err = decodeResponseHeader(header); err != nil {
+				log.Error("failed to decode idempotent response header", logger.Err(err))
+				return fmt.Errorf("failed to decode idempotent response header")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return record, reserved, err
+	}
+	return record, reserved, nil
+}
+
+// SaveIdempotentResponse stores the response of the request holding the reservation token of key.
+// Nothing is stored if the key was taken over by another request in the meantime.
+func (pg *PostgresDB) SaveIdempotentResponse(ctx context.Context, key IdempotencyKey, token string, response IdempotentResponse, log *slog.Logger) error {
+	header, err := encodeResponseHeader(response.Header)
+	if err != nil {
+		log.Error("failed to encode idempotent response header", logger.Err(err))
+		return fmt.Errorf("failed to encode idempotent response header")
+	}
+	err = pg.acquire(ctx, func(ctx context.Context, conn *pgxpool.Conn) error {
+		query := `update idempotency_keys
+				  set status_code = $4, content_type = $5, response_header = $6, response_body = $7
+				  where caller = $1 and key = $2 and token = $3`
+		res, err := conn.Exec(ctx, query, key.Caller, key.Key, token, response.StatusCode, response.ContentType, header, response.Body)
+		if err != nil {
+			log.Error("failed to save idempotent response", logger.Err(err))
+			return fmt.Errorf("failed to save idempotent response")
+		}
+		if res.RowsAffected() == 0 {
+			log.Warn("idempotency key was taken over by another request, response not saved")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ReleaseIdempotencyKey forgets key if it is still reserved with token, so the request can be retried with it.
+func (pg *PostgresDB) ReleaseIdempotencyKey(ctx context.Context, key IdempotencyKey, token string, log *slog.Logger) error {
+	err := pg.acquire(ctx, func(ctx context.Context, conn *pgxpool.Conn) error {
+		query := `delete from idempotency_keys where caller = $1 and key = $2 and token = $3`
+		if _, err := conn.Exec(ctx, query, key.Caller, key.Key, token); err != nil {
+			log.Error("failed to release idempotency key", logger.Err(err))
+			return fmt.Errorf("failed to release idempotency key")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// PruneIdempotencyKeys deletes keys older than ttl, and keys without a response older than lease.
+func (pg *PostgresDB) PruneIdempotencyKeys(ctx context.Context, ttl, lease time.Duration, log *slog.Logger) (int64, error) {
+	var pruned int64
+	err := pg.acquire(ctx, func(ctx context.Context, conn *pgxpool.Conn) error {
+		query := `delete from idempotency_keys
+				  where created_at < NOW() - make_interval(secs => $1)
+					 or (status_code is null and created_at < NOW() - make_interval(secs => $2))`
+		res, err := conn.Exec(ctx, query, ttl.Seconds(), lease.Seconds())
+		if err != nil {
+			log.Error("failed to prune idempotency keys", logger.Err(err))
+			return fmt.Errorf("failed to prune idempotency keys")
+		}
+		pruned = res.RowsAffected()
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return pruned, nil
+}
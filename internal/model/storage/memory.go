@@ -0,0 +1,470 @@
+package storage
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"github.com/vlasashk/user-segmentation/internal/model/logger"
+	"log/slog"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryDB keeps everything in memory. It behaves like PostgresDB, including soft deleted memberships
+// and their history, but loses its data on restart and can't be shared between instances.
+type MemoryDB struct {
+	mu sync.Mutex
+	// users maps user ids to internal ids.
+	users  map[uint64]uint64
+	lastID uint64
+	// segments is keyed by slug, segmentsLower by lowercase slug to keep slugs case-insensitively unique.
+	segments      map[string]*memorySegment
+	segmentsLower map[string]string
+	memberships   map[membershipKey]*memoryMembership
+	idempotency   map[idempotencyKey]*memoryIdempotencyRecord
+
+	subscriptions map[uint64]*WebhookSubscription
+	deliveries    map[uint64]*memoryDelivery
+	deadLetters   []WebhookDeadLetter
+	outbox        []*memoryOutboxEvent
+	// publishing serializes PublishOutbox calls, so no event is passed to two publishers at once.
+	publishing sync.Mutex
+}
+
+type memorySegment struct {
+	id        uint64
+	slug      string
+	ownerTeam string
+}
+
+type membershipKey struct {
+	userID    uint64
+	segmentID uint64
+}
+
+type memoryMembership struct {
+	createdAt time.Time
+	deletedAt *time.Time
+}
+
+type idempotencyKey struct {
+	caller string
+	key    string
+}
+
+type memoryIdempotencyRecord struct {
+	IdempotencyRecord
+	createdAt time.Time
+}
+
+// expired reports whether the key is older than ttl, or has no response and is older than lease.
+func (r *memoryIdempotencyRecord) expired(now time.Time, ttl, lease time.Duration) bool {
+	return r.createdAt.Before(now.Add(-ttl)) || r.Response == nil && r.createdAt.Before(now.Add(-lease))
+}
+
+func NewMemoryDB() *MemoryDB {
+	return &MemoryDB{
+		users:         make(map[uint64]uint64),
+		segments:      make(map[string]*memorySegment),
+		segmentsLower: make(map[string]string),
+		memberships:   make(map[membershipKey]*memoryMembership),
+		idempotency:   make(map[idempotencyKey]*memoryIdempotencyRecord),
+		subscriptions: make(map[uint64]*WebhookSubscription),
+		deliveries:    make(map[uint64]*memoryDelivery),
+	}
+}
+
+// memoryNow returns the current time with the precision of a postgres timestamp.
+func memoryNow() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
+}
+
+func (m *MemoryDB) nextID() uint64 {
+	m.lastID++
+	return m.lastID
+}
+
+func (m *MemoryDB) Ping(context.Context) error {
+	return nil
+}
+
+func (m *MemoryDB) Close() {}
+
+func (m *MemoryDB) CsvHistoryReport(_ context.Context, csvDates CsvReport, log *slog.Logger) (_ string, err error) {
+	type historyRow struct {
+		userID    uint64
+		segment   string
+		status    string
+		timestamp time.Time
+	}
+	startDate := time.Date(int(csvDates.Year), csvDates.Month, 0, 0, 0, 0, 0, time.Local)
+	endDate := startDate.AddDate(0, 1, 0)
+	inRange := func(t time.Time) bool {
+		return !t.Before(startDate) && !t.After(endDate)
+	}
+	m.mu.Lock()
+	var rows []historyRow
+	for uid, id := range m.users {
+		for _, segment := range m.segments {
+			membership, ok := m.memberships[membershipKey{id, segment.id}]
+			if !ok {
+				continue
+			}
+			if inRange(membership.createdAt) {
+				rows = append(rows, historyRow{uid, segment.slug, "added", membership.createdAt})
+			}
+			if membership.deletedAt != nil && inRange(*membership.deletedAt) {
+				rows = append(rows, historyRow{uid, segment.slug, "removed", *membership.deletedAt})
+			}
+		}
+	}
+	m.mu.Unlock()
+	slices.SortFunc(rows, func(a, b historyRow) int {
+		if c := cmp.Compare(a.userID, b.userID); c != 0 {
+			return c
+		}
+		if c := strings.Compare(a.segment, b.segment); c != 0 {
+			return c
+		}
+		return strings.Compare(a.status, b.status)
+	})
+
+	reportID, file, err := createReport(log)
+	if err != nil {
+		return reportID, err
+	}
+	defer closeReport(file, &err, log)
+	writer := newCsvWriter(file)
+	defer writer.Flush()
+	for _, row := range rows {
+		if err = writer.Write([]string{strconv.FormatUint(row.userID, 10), row.segment, row.status, row.timestamp.String()}); err != nil {
+			log.Error("failed to write into csv:", logger.Err(err))
+			return reportID, fmt.Errorf("failed to write into csv")
+		}
+	}
+	return reportID, nil
+}
+
+func (m *MemoryDB) GetSegmentUsersInfo(_ context.Context, segment Segment, log *slog.Logger) ([]uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.segments[segment.Slug]
+	if !ok {
+		log.Error(fmt.Sprintf("segment '%v' doesn't exist", segment.Slug))
+		return nil, newError(ErrNotFound, "segment '%v' doesn't exist", segment.Slug)
+	}
+	var res []uint64
+	for uid, id := range m.users {
+		if m.isMember(id, stored.id) {
+			res = append(res, uid)
+		}
+	}
+	slices.Sort(res)
+	return res, nil
+}
+
+func (m *MemoryDB) DeleteUserFromSegments(_ context.Context, userSegment UserSegments, log *slog.Logger) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id, segments, err := m.resolve(userSegment, log)
+	if err != nil {
+		return err
+	}
+	// Everything is checked before anything is changed, so the request is applied entirely or not at all.
+	for _, segment := range segments {
+		if err = checkOwner(segment.slug, segment.ownerTeam, userSegment.OwnerTeam, log); err != nil {
+			return err
+		}
+	}
+	for i, segment := range segments {
+		if !m.isMember(id, segment.id) {
+			log.Error("failed to execute query", logger.Err(fmt.Errorf("user '%d' is not part of '%s' segment", userSegment.UserID, userSegment.SegmentSlug[i])))
+			return newError(ErrNotMember, "user '%d' is not part of '%s' segment", userSegment.UserID, userSegment.SegmentSlug[i])
+		}
+	}
+	events, err := m.newEvents(EventMembershipRemoved, userSegment.UserID, userSegment.SegmentSlug, log)
+	if err != nil {
+		return err
+	}
+	now := memoryNow()
+	for _, segment := range segments {
+		m.memberships[membershipKey{id, segment.id}].deletedAt = &now
+	}
+	m.recordEvents(events)
+	return nil
+}
+
+func (m *MemoryDB) AddUserToSegments(_ context.Context, userSegment UserSegments, log *slog.Logger) ([]SegmentOutcome, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id, ok := m.users[userSegment.UserID]
+	if !ok {
+		log.Error(fmt.Sprintf("user '%v' doesn't exist", userSegment.UserID))
+		return nil, newError(ErrNotFound, "user '%v' doesn't exist", userSegment.UserID)
+	}
+	// Everything is checked before anything is changed, so the request is applied entirely or not at all.
+	failed := make(map[string]string)
+	for _, slug := range userSegment.SegmentSlug {
+		segment, ok := m.segments[slug]
+		if !ok {
+			failed[slug] = OutcomeNotFound
+			continue
+		}
+		if err := checkOwner(slug, segment.ownerTeam, userSegment.OwnerTeam, log); err != nil {
+			return nil, err
+		}
+	}
+	if len(failed) == 0 {
+		for _, slug := range userSegment.SegmentSlug {
+			if m.isMember(id, m.segments[slug].id) {
+				failed[slug] = OutcomeAlreadyMember
+			}
+		}
+	}
+	outcomes, err := segmentOutcomes(userSegment, failed, log)
+	if err != nil {
+		return outcomes, err
+	}
+	events, err := m.newEvents(EventMembershipAdded, userSegment.UserID, userSegment.SegmentSlug, log)
+	if err != nil {
+		return nil, err
+	}
+	now := memoryNow()
+	for _, slug := range userSegment.SegmentSlug {
+		// Adding a removed member again restarts the membership, like the upsert of PostgresDB.
+		m.memberships[membershipKey{id, m.segments[slug].id}] = &memoryMembership{createdAt: now}
+	}
+	m.recordEvents(events)
+	return outcomes, nil
+}
+
+// resolve returns the internal id of the user and the segments of userSegment, in the order of the slugs.
+func (m *MemoryDB) resolve(userSegment UserSegments, log *slog.Logger) (uint64, []*memorySegment, error) {
+	id, ok := m.users[userSegment.UserID]
+	if !ok {
+		log.Error(fmt.Sprintf("user '%v' doesn't exist", userSegment.UserID))
+		return 0, nil, newError(ErrNotFound, "user '%v' doesn't exist", userSegment.UserID)
+	}
+	segments := make([]*memorySegment, 0, len(userSegment.SegmentSlug))
+	for _, slug := range userSegment.SegmentSlug {
+		segment, ok := m.segments[slug]
+		if !ok {
+			log.Error(fmt.Sprintf("segment '%v' doesn't exist", slug))
+			return 0, nil, newError(ErrNotFound, "segment '%v' doesn't exist", slug)
+		}
+		segments = append(segments, segment)
+	}
+	return id, segments, nil
+}
+
+func (m *MemoryDB) isMember(userID, segmentID uint64) bool {
+	membership, ok := m.memberships[membershipKey{userID, segmentID}]
+	return ok && membership.deletedAt == nil
+}
+
+// userSegments returns the slugs of the segments the user with the given internal id is a member of.
+func (m *MemoryDB) userSegments(id uint64) []string {
+	res := make([]string, 0)
+	for _, segment := range m.segments {
+		if m.isMember(id, segment.id) {
+			res = append(res, segment.slug)
+		}
+	}
+	slices.Sort(res)
+	return res
+}
+
+func (m *MemoryDB) GetUserSegmentsInfo(_ context.Context, user User, log *slog.Logger) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id, ok := m.users[user.UID]
+	if !ok {
+		log.Error(fmt.Sprintf("user '%v' doesn't exist", user.UID))
+		return nil, newError(ErrNotFound, "user '%v' doesn't exist", user.UID)
+	}
+	res := m.userSegments(id)
+	if len(res) == 0 {
+		return nil, nil
+	}
+	return res, nil
+}
+
+// GetUsersSegmentsInfo returns the segments of each of the given users.
+// Users that don't exist are left out of the result, existing users without segments map to an empty list.
+func (m *MemoryDB) GetUsersSegmentsInfo(_ context.Context, users UsersBatch, _ *slog.Logger) (map[uint64][]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make(map[uint64][]string, len(users.UserIDs))
+	for _, uid := range users.UserIDs {
+		if id, ok := m.users[uid]; ok {
+			res[uid] = m.userSegments(id)
+		}
+	}
+	return res, nil
+}
+
+// GetMemberships reports the user's membership in each of the given segments, in the order of the slugs.
+func (m *MemoryDB) GetMemberships(_ context.Context, userSegments UserSegments, log *slog.Logger) ([]Membership, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id, segments, err := m.resolve(userSegments, log)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]Membership, 0, len(segments))
+	for _, segment := range segments {
+		membership := Membership{Slug: segment.slug}
+		if stored, ok := m.memberships[membershipKey{id, segment.id}]; ok {
+			addedAt := stored.createdAt
+			membership.AddedAt = &addedAt
+			if stored.deletedAt != nil {
+				removedAt := *stored.deletedAt
+				membership.RemovedAt = &removedAt
+			}
+		}
+		membership.Member = membership.AddedAt != nil && membership.RemovedAt == nil
+		res = append(res, membership)
+	}
+	return res, nil
+}
+
+func (m *MemoryDB) AddUser(_ context.Context, user User, log *slog.Logger) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.users[user.UID]; ok {
+		log.Error("user already exists")
+		return 0, newError(ErrAlreadyExists, "user '%v' already exists", user.UID)
+	}
+	id := m.nextID()
+	m.users[user.UID] = id
+	return id, nil
+}
+
+func (m *MemoryDB) AddSegment(_ context.Context, segment Segment, log *slog.Logger) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.segmentsLower[strings.ToLower(segment.Slug)]; ok {
+		log.Error("segment already exists")
+		return 0, newError(ErrAlreadyExists, "segment '%v' already exists", segment.Slug)
+	}
+	id := m.nextID()
+	m.segments[segment.Slug] = &memorySegment{id: id, slug: segment.Slug, ownerTeam: segment.OwnerTeam}
+	m.segmentsLower[strings.ToLower(segment.Slug)] = segment.Slug
+	return id, nil
+}
+
+// CascadeDeleteSegment deletes the segment with all its memberships and records a removal event for each member,
+// like PostgresDB.CascadeDeleteSegment.
+func (m *MemoryDB) CascadeDeleteSegment(_ context.Context, segment Segment, log *slog.Logger) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.segments[segment.Slug]
+	if !ok {
+		return segmentDeleteRefused(segment.Slug, false, "", segment.OwnerTeam, log)
+	}
+	// Refused before anything is deleted, like the owner predicate of the other backends.
+	if err := checkOwner(stored.slug, stored.ownerTeam, segment.OwnerTeam, log); err != nil {
+		return err
+	}
+	members := make([]uint64, 0)
+	for userID, id := range m.users {
+		if membership, ok := m.memberships[membershipKey{id, stored.id}]; ok && membership.deletedAt == nil {
+			members = append(members, userID)
+		}
+	}
+	slices.Sort(members)
+	events := make([]*memoryOutboxEvent, 0, len(members)+1)
+	for _, userID := range members {
+		removal, err := m.newEvents(EventMembershipRemoved, userID, []string{segment.Slug}, log)
+		if err != nil {
+			return err
+		}
+		events = append(events, removal...)
+	}
+	deletion, err := m.newEvents(EventSegmentDeleted, 0, []string{segment.Slug}, log)
+	if err != nil {
+		return err
+	}
+	m.recordEvents(append(events, deletion...))
+	delete(m.segments, stored.slug)
+	delete(m.segmentsLower, strings.ToLower(stored.slug))
+	for key := range m.memberships {
+		if key.segmentID == stored.id {
+			delete(m.memberships, key)
+		}
+	}
+	return nil
+}
+
+// ReserveIdempotencyKey claims key for a new request. If the key was already claimed within ttl
+// it returns the existing record and false instead. A key older than ttl, or without a response and older
+// than lease, is taken over, so a request that never saved its response can be retried.
+func (m *MemoryDB) ReserveIdempotencyKey(_ context.Context, key IdempotencyKey, ttl, lease time.Duration, log *slog.Logger) (IdempotencyRecord, bool, error) {
+	token, err := newIdempotencyToken(log)
+	if err != nil {
+		return IdempotencyRecord{}, false, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := memoryNow()
+	k := idempotencyKey{key.Caller, key.Key}
+	if record, ok := m.idempotency[k]; ok && !record.expired(now, ttl, lease) {
+		res := IdempotencyRecord{RequestHash: record.RequestHash}
+		if record.Response != nil {
+			response := *record.Response
+			res.Response = &response
+		}
+		return res, false, nil
+	}
+	m.idempotency[k] = &memoryIdempotencyRecord{
+		IdempotencyRecord: IdempotencyRecord{RequestHash: key.RequestHash, Token: token},
+		createdAt:         now,
+	}
+	return IdempotencyRecord{Token: token}, true, nil
+}
+
+// SaveIdempotentResponse stores the response of the request holding the reservation token of key.
+// Nothing is stored if the key was taken over by another request in the meantime.
+func (m *MemoryDB) SaveIdempotentResponse(_ context.Context, key IdempotencyKey, token string, response IdempotentResponse, log *slog.Logger) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	record, ok := m.idempotency[idempotencyKey{key.Caller, key.Key}]
+	if !ok || record.Token != token {
+		log.Warn("idempotency key was taken over by another request, response not saved")
+		return nil
+	}
+	response.Header = maps.Clone(response.Header)
+	response.Body = slices.Clone(response.Body)
+	record.Response = &response
+	return nil
+}
+
+// ReleaseIdempotencyKey forgets key if it is still reserved with token, so the request can be retried with it.
+func (m *MemoryDB) ReleaseIdempotencyKey(_ context.Context, key IdempotencyKey, token string, _ *slog.Logger) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := idempotencyKey{key.Caller, key.Key}
+	if record, ok := m.idempotency[k]; ok && record.Token == token {
+		delete(m.idempotency, k)
+	}
+	return nil
+}
+
+// PruneIdempotencyKeys deletes keys older than ttl, and keys without a response older than lease.
+func (m *MemoryDB) PruneIdempotencyKeys(_ context.Context, ttl, lease time.Duration, _ *slog.Logger) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := memoryNow()
+	var pruned int64
+	for k, record := range m.idempotency {
+		if record.expired(now, ttl, lease) {
+			delete(m.idempotency, k)
+			pruned++
+		}
+	}
+	return pruned, nil
+}
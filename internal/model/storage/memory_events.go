@@ -0,0 +1,274 @@
+package storage
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"github.com/vlasashk/user-segmentation/internal/model/logger"
+	"log/slog"
+	"slices"
+	"time"
+)
+
+type memoryOutboxEvent struct {
+	OutboxEvent
+	payload     []byte
+	publishedAt *time.Time
+}
+
+type memoryDelivery struct {
+	WebhookDelivery
+	nextAttemptAt time.Time
+	lastError     string
+}
+
+// newEvents builds an event of the given type for each of the slugs without recording them yet,
+// so a change can be checked to succeed entirely before anything is changed.
+func (m *MemoryDB) newEvents(eventType string, userID uint64, slugs []string, log *slog.Logger) ([]*memoryOutboxEvent, error) {
+	events := make([]*memoryOutboxEvent, 0, len(slugs))
+	for _, slug := range slugs {
+		event, payload, err := newEvent(eventType, userID, slug, log)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, &memoryOutboxEvent{OutboxEvent: OutboxEvent{Event: event}, payload: payload})
+	}
+	return events, nil
+}
+
+// recordEvents appends events to the outbox and queues their webhook deliveries.
+func (m *MemoryDB) recordEvents(events []*memoryOutboxEvent) {
+	now := memoryNow()
+	for _, event := range events {
+		event.Seq = m.nextID()
+		m.outbox = append(m.outbox, event)
+		if event.Type == EventSegmentDeleted {
+			continue
+		}
+		for _, subscription := range m.subscriptions {
+			if len(subscription.Events) > 0 && !slices.Contains(subscription.Events, event.Type) ||
+				len(subscription.Segments) > 0 && !slices.Contains(subscription.Segments, event.Segment) {
+				continue
+			}
+			id := m.nextID()
+			m.deliveries[id] = &memoryDelivery{
+				WebhookDelivery: WebhookDelivery{
+					Id:             id,
+					SubscriptionID: subscription.Id,
+					EventID:        event.ID,
+					Payload:        event.payload,
+				},
+				nextAttemptAt: now,
+			}
+		}
+	}
+}
+
+// PublishOutbox passes up to limit unpublished events, oldest first, to publish and marks them published
+// if it succeeds. If publish fails, the events are published again later.
+func (m *MemoryDB) PublishOutbox(ctx context.Context, limit int, publish func(context.Context, []OutboxEvent) error, log *slog.Logger) (int, error) {
+	m.publishing.Lock()
+	defer m.publishing.Unlock()
+	m.mu.Lock()
+	var pending []*memoryOutboxEvent
+	var events []OutboxEvent
+	for _, event := range m.outbox {
+		if len(events) == limit {
+			break
+		}
+		if event.publishedAt == nil {
+			pending = append(pending, event)
+			events = append(events, event.OutboxEvent)
+		}
+	}
+	m.mu.Unlock()
+	if len(events) == 0 {
+		return 0, nil
+	}
+	if err := publish(ctx, events); err != nil {
+		log.Error("failed to publish outbox events", logger.Err(err))
+		return 0, fmt.Errorf("failed to publish outbox events: %w", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := memoryNow()
+	for _, event := range pending {
+		event.publishedAt = &now
+	}
+	return len(events), nil
+}
+
+// PruneOutbox deletes published events recorded before the given time. Unpublished events are only deleted
+// if unpublished is set, otherwise they are kept until the relay published them.
+func (m *MemoryDB) PruneOutbox(_ context.Context, before time.Time, unpublished bool, _ *slog.Logger) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := len(m.outbox)
+	m.outbox = slices.DeleteFunc(m.outbox, func(event *memoryOutboxEvent) bool {
+		return event.OccurredAt.Before(before) && (unpublished || event.publishedAt != nil)
+	})
+	return int64(n - len(m.outbox)), nil
+}
+
+// GetEvents returns up to filter.Limit recorded events following the event filter.After.
+func (m *MemoryDB) GetEvents(_ context.Context, filter EventFilter, _ *slog.Logger) ([]OutboxEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make([]OutboxEvent, 0)
+	for _, event := range m.outbox {
+		if len(res) == filter.Limit {
+			break
+		}
+		if event.Seq <= filter.After ||
+			filter.UserID != 0 && event.UserID != filter.UserID ||
+			filter.Segment != "" && event.Segment != filter.Segment {
+			continue
+		}
+		res = append(res, event.OutboxEvent)
+	}
+	return res, nil
+}
+
+// GetLastEventSeq returns the Seq of the latest recorded event, 0 if there is none.
+func (m *MemoryDB) GetLastEventSeq(context.Context, *slog.Logger) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.outbox) == 0 {
+		return 0, nil
+	}
+	return m.outbox[len(m.outbox)-1].Seq, nil
+}
+
+func (m *MemoryDB) AddWebhookSubscription(_ context.Context, subscription WebhookSubscription, _ *slog.Logger) (WebhookSubscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	subscription.Events = append([]string{}, subscription.Events...)
+	subscription.Segments = append([]string{}, subscription.Segments...)
+	subscription.Id = m.nextID()
+	subscription.CreatedAt = memoryNow()
+	stored := subscription
+	m.subscriptions[subscription.Id] = &stored
+	return subscription, nil
+}
+
+// GetWebhookSubscriptions lists all subscriptions without their secrets.
+func (m *MemoryDB) GetWebhookSubscriptions(_ context.Context, _ *slog.Logger) ([]WebhookSubscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make([]WebhookSubscription, 0, len(m.subscriptions))
+	for _, subscription := range m.subscriptions {
+		listed := *subscription
+		listed.Secret = ""
+		listed.Events = slices.Clone(subscription.Events)
+		listed.Segments = slices.Clone(subscription.Segments)
+		res = append(res, listed)
+	}
+	slices.SortFunc(res, func(a, b WebhookSubscription) int {
+		return cmp.Compare(a.Id, b.Id)
+	})
+	return res, nil
+}
+
+// DeleteWebhookSubscription removes a subscription together with its pending deliveries and dead letters.
+func (m *MemoryDB) DeleteWebhookSubscription(_ context.Context, id uint64, log *slog.Logger) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.subscriptions[id]; !ok {
+		log.Error(fmt.Sprintf("webhook subscription '%d' doesn't exist", id))
+		return newError(ErrNotFound, "webhook subscription '%d' doesn't exist", id)
+	}
+	delete(m.subscriptions, id)
+	for deliveryID, delivery := range m.deliveries {
+		if delivery.SubscriptionID == id {
+			delete(m.deliveries, deliveryID)
+		}
+	}
+	m.deadLetters = slices.DeleteFunc(m.deadLetters, func(letter WebhookDeadLetter) bool {
+		return letter.SubscriptionID == id
+	})
+	return nil
+}
+
+// GetWebhookDeadLetters lists deliveries to the subscription that were given up, the most recent first.
+func (m *MemoryDB) GetWebhookDeadLetters(_ context.Context, subscriptionID uint64, log *slog.Logger) ([]WebhookDeadLetter, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.subscriptions[subscriptionID]; !ok {
+		log.Error(fmt.Sprintf("webhook subscription '%d' doesn't exist", subscriptionID))
+		return nil, newError(ErrNotFound, "webhook subscription '%d' doesn't exist", subscriptionID)
+	}
+	res := make([]WebhookDeadLetter, 0)
+	// Dead letters are appended as they fail, so walking backwards yields the most recent first.
+	for i := len(m.deadLetters) - 1; i >= 0 && len(res) < 1000; i-- {
+		if m.deadLetters[i].SubscriptionID == subscriptionID {
+			res = append(res, m.deadLetters[i])
+		}
+	}
+	return res, nil
+}
+
+// ClaimWebhookDeliveries takes up to limit deliveries that are due and hides them from other workers for lease.
+// Attempts of the returned deliveries already include the attempt being made.
+func (m *MemoryDB) ClaimWebhookDeliveries(_ context.Context, limit int, lease time.Duration, _ *slog.Logger) ([]WebhookDelivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := memoryNow()
+	var due []*memoryDelivery
+	for _, delivery := range m.deliveries {
+		if !delivery.nextAttemptAt.After(now) {
+			due = append(due, delivery)
+		}
+	}
+	slices.SortFunc(due, func(a, b *memoryDelivery) int {
+		return a.nextAttemptAt.Compare(b.nextAttemptAt)
+	})
+	var res []WebhookDelivery
+	for _, delivery := range due[:min(limit, len(due))] {
+		subscription := m.subscriptions[delivery.SubscriptionID]
+		delivery.Attempts++
+		delivery.nextAttemptAt = now.Add(lease)
+		claimed := delivery.WebhookDelivery
+		claimed.URL, claimed.Secret = subscription.URL, subscription.Secret
+		res = append(res, claimed)
+	}
+	return res, nil
+}
+
+// CompleteWebhookDelivery forgets a delivery accepted by the subscriber.
+func (m *MemoryDB) CompleteWebhookDelivery(_ context.Context, id uint64, _ *slog.Logger) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.deliveries, id)
+	return nil
+}
+
+// RetryWebhookDelivery schedules the next attempt of a failed delivery.
+func (m *MemoryDB) RetryWebhookDelivery(_ context.Context, id uint64, next time.Time, lastError string, _ *slog.Logger) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if delivery, ok := m.deliveries[id]; ok {
+		delivery.nextAttemptAt, delivery.lastError = next, lastError
+	}
+	return nil
+}
+
+// DeadLetterWebhookDelivery moves a delivery that ran out of attempts to the dead letters.
+func (m *MemoryDB) DeadLetterWebhookDelivery(_ context.Context, id uint64, lastError string, _ *slog.Logger) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delivery, ok := m.deliveries[id]
+	if !ok {
+		return nil
+	}
+	delete(m.deliveries, id)
+	m.deadLetters = append(m.deadLetters, WebhookDeadLetter{
+		Id:             m.nextID(),
+		SubscriptionID: delivery.SubscriptionID,
+		EventID:        delivery.EventID,
+		Payload:        delivery.Payload,
+		Attempts:       delivery.Attempts,
+		LastError:      lastError,
+		FailedAt:       memoryNow(),
+	})
+	return nil
+}
@@ -0,0 +1,13 @@
+package storage_test
+
+import (
+	"github.com/vlasashk/user-segmentation/internal/model/storage"
+	"github.com/vlasashk/user-segmentation/internal/model/storage/storagetest"
+	"testing"
+)
+
+func TestMemoryDB(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Store {
+		return storage.NewMemoryDB()
+	})
+}
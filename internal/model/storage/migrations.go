@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"fmt"
+	initsql "github.com/vlasashk/user-segmentation/pkg/init_sql"
+	"io/fs"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// migrationFile matches <version>_<name>.up.sql and <version>_<name>.down.sql.
+var migrationFile = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is a numbered schema change. Migrations are applied in the order of their versions
+// and rolled back in the reverse order.
+type Migration struct {
+	Version uint64
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus tells whether a migration has been applied. Migrations applied to the database
+// but missing from the migrations directory have an empty Name.
+type MigrationStatus struct {
+	Version   uint64
+	Name      string
+	AppliedAt *time.Time
+}
+
+// loadMigrations reads migrations sorted by version from the directory in env, or from the migrations
+// embedded into the binary for the backend when env isn't set. Every migration must have both up and down files.
+func loadMigrations(env, backend string) ([]Migration, error) {
+	var dir fs.FS
+	if path := os.Getenv(env); path != "" {
+		dir = os.DirFS(path)
+	} else {
+		embedded, err := fs.Sub(initsql.Migrations, backend)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open embedded migrations: %v\n", err)
+		}
+		dir = embedded
+	}
+	entries, err := fs.ReadDir(dir, ".")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations directory: %v\n", err)
+	}
+	byVersion := make(map[uint64]*Migration)
+	for _, entry := range entries {
+		match := migrationFile.FindStringSubmatch(entry.Name())
+		if entry.IsDir() || match == nil {
+			continue
+		}
+		version, err := strconv.ParseUint(match[1], 10, 64)
+		if err != nil || version == 0 {
+			return nil, fmt.Errorf("invalid migration version in %s\n", entry.Name())
+		}
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		} else if migration.Name != match[2] {
+			return nil, fmt.Errorf("migrations %d_%s and %d_%s share a version\n", version, migration.Name, version, match[2])
+		}
+		query, err := fs.ReadFile(dir, entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s file: %v\n", entry.Name(), err)
+		}
+		if match[3] == "up" {
+			migration.Up = string(query)
+		} else {
+			migration.Down = string(query)
+		}
+	}
+	res := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s must have both up and down files\n", migration.Version, migration.Name)
+		}
+		res = append(res, *migration)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Version < res[j].Version
+	})
+	return res, nil
+}
+
+// pendingMigrations returns migrations that haven't been applied yet, in the order they should be applied.
+func pendingMigrations(migrations []Migration, applied map[uint64]time.Time) []Migration {
+	var res []Migration
+	for _, migration := range migrations {
+		if _, ok := applied[migration.Version]; !ok {
+			res = append(res, migration)
+		}
+	}
+	return res
+}
+
+// rollbackMigrations returns up to steps most recently applied migrations, in the order they should be rolled back.
+func rollbackMigrations(migrations []Migration, applied map[uint64]time.Time, steps int) ([]Migration, error) {
+	known := make(map[uint64]Migration, len(migrations))
+	for _, migration := range migrations {
+		known[migration.Version] = migration
+	}
+	versions := make([]uint64, 0, len(applied))
+	for version := range applied {
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i] > versions[j]
+	})
+	var res []Migration
+	for _, version := range versions {
+		if len(res) == steps {
+			break
+		}
+		migration, ok := known[version]
+		if !ok {
+			return nil, fmt.Errorf("applied migration %d is missing from the migrations directory\n", version)
+		}
+		res = append(res, migration)
+	}
+	return res, nil
+}
+
+func migrationStatus(migrations []Migration, applied map[uint64]time.Time) []MigrationStatus {
+	res := make([]MigrationStatus, 0, len(migrations))
+	known := make(map[uint64]bool, len(migrations))
+	for _, migration := range migrations {
+		known[migration.Version] = true
+		status := MigrationStatus{Version: migration.Version, Name: migration.Name}
+		if appliedAt, ok := applied[migration.Version]; ok {
+			status.AppliedAt = &appliedAt
+		}
+		res = append(res, status)
+	}
+	for version, appliedAt := range applied {
+		if !known[version] {
+			appliedAt := appliedAt
+			res = append(res, MigrationStatus{Version: version, AppliedAt: &appliedAt})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Version < res[j].Version
+	})
+	return res
+}
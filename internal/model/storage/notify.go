@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/vlasashk/user-segmentation/internal/model/logger"
+	"log/slog"
+	"time"
+)
+
+// ChangesChannel is the notification channel every mutation of users, segments and memberships is published to.
+const ChangesChannel = "user_segmentation_changes"
+
+const (
+	minListenBackoff = time.Second
+	maxListenBackoff = 30 * time.Second
+)
+
+type ChangeKind string
+
+const (
+	// ChangeUser means the memberships of Change.UserID have changed.
+	ChangeUser ChangeKind = "user"
+	// ChangeSegment means the segment Change.Slug was added or deleted.
+	ChangeSegment ChangeKind = "segment"
+	// ChangeReset is delivered after the listener reconnects, changes made meanwhile may have been missed.
+	ChangeReset ChangeKind = "reset"
+)
+
+// Change is the payload of a notification on ChangesChannel.
+type Change struct {
+	Kind   ChangeKind `json:"kind"`
+	UserID uint64     `json:"user_id,omitempty"`
+	Slug   string     `json:"slug,omitempty"`
+}
+
+type execer interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+}
+
+// notifyChange publishes change on ChangesChannel in the transaction making the change. It is delivered on commit,
+// so listeners don't hear about changes that were rolled back. A failed notification aborts the transaction,
+// so the error has to be returned to roll back the change: listeners never miss a committed change.
+func notifyChange(ctx context.Context, tx pgx.Tx, change Change, log *slog.Logger) error {
+	payload, err := json.Marshal(change)
+	if err != nil {
+		log.Error("failed to encode change notification", logger.Err(err))
+		return fmt.Errorf("failed to encode change notification")
+	}
+	if _, err = tx.Exec(ctx, `select pg_notify($1, $2)`, ChangesChannel, string(payload)); err != nil {
+		log.Error("failed to notify about change", logger.Err(err))
+		return fmt.Errorf("failed to notify about change")
+	}
+	return nil
+}
+
+// ListenChanges calls handle for every change published on ChangesChannel until ctx is done.
+// It listens on a dedicated connection outside the pool and reconnects with a backoff when the
+// connection drops, handle receives a ChangeReset change after every reconnect.
+func (pg *PostgresDB) ListenChanges(ctx context.Context, log *slog.Logger, handle func(Change)) {
+	backoff := minListenBackoff
+	listened := false
+	onListen := func() {
+		if listened {
+			log.Info("change listener reconnected")
+			handle(Change{Kind: ChangeReset})
+		}
+		listened = true
+		backoff = minListenBackoff
+	}
+	for ctx.Err() == nil {
+		err := pg.listen(ctx, log, onListen, handle)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Error("change listener disconnected", logger.Err(err), slog.Duration("retry_in", backoff))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxListenBackoff)
+	}
+}
+
+func (pg *PostgresDB) listen(ctx context.Context, log *slog.Logger, onListen func(), handle func(Change)) error {
+	conn, err := pgx.ConnectConfig(ctx, pg.DB.Config().ConnConfig.Copy())
+	if err != nil {
+		return err
+	}
+	defer func(conn *pgx.Conn) {
+		_ = conn.Close(context.Background())
+	}(conn)
+	if _, err = conn.Exec(ctx, "listen "+pgx.Identifier{ChangesChannel}.Sanitize()); err != nil {
+		return err
+	}
+	onListen()
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+		var change Change
+		if err = json.Unmarshal([]byte(notification.Payload), &change); err != nil {
+			log.Warn("malformed change notification", logger.Err(err), slog.String("payload", notification.Payload))
+			continue
+		}
+		handle(change)
+	}
+}
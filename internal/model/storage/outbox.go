@@ -0,0 +1,292 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/vlasashk/user-segmentation/internal/model/logger"
+	"log/slog"
+	"time"
+)
+
+const (
+	// EventMembershipAdded is recorded when a user is added to a segment.
+	EventMembershipAdded = "membership.added"
+	// EventMembershipRemoved is recorded when a user is removed from a segment.
+	EventMembershipRemoved = "membership.removed"
+	// EventSegmentDeleted is recorded when a segment is deleted, following a membership.removed event
+	// for each of its members. It isn't delivered to webhooks.
+	EventSegmentDeleted = "segment.deleted"
+)
+
+// Event describes a committed change. It is published by the outbox relay and posted to webhook subscribers.
+type Event struct {
+	ID         string    `json:"id"`
+	Type       string    `json:"type"`
+	UserID     uint64    `json:"user_id,omitempty"`
+	Segment    string    `json:"segment"`
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
+// OutboxEvent is an event recorded in the outbox. Seq grows with every recorded event.
+type OutboxEvent struct {
+	Seq uint64 `json:"seq"`
+	Event
+}
+
+// EventFilter selects recorded events following the event After. Zero UserID or empty Segment match every event.
+type EventFilter struct {
+	After   uint64
+	UserID  uint64
+	Segment string
+	Limit   int
+}
+
+func newEventID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// newEvent builds an event of the given type happening now, together with its json payload.
+func newEvent(eventType string, userID uint64, slug string, log *slog.Logger) (Event, []byte, error) {
+	id, err := newEventID()
+	if err != nil {
+		log.Error("failed to generate event id", logger.Err(err))
+		return Event{}, nil, fmt.Errorf("failed to generate event id")
+	}
+	event := Event{
+		ID:         id,
+		Type:       eventType,
+		UserID:     userID,
+		Segment:    slug,
+		OccurredAt: time.Now().UTC(),
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Error("failed to encode event", logger.Err(err))
+		return Event{}, nil, fmt.Errorf("failed to encode event")
+	}
+	return event, payload, nil
+}
+
+// recordEvents writes an event for each of the slugs to the outbox and queues their webhook deliveries,
+// in two queries however many slugs there are. It runs in the transaction making the change,
+// so the events are recorded if and only if the change is committed.
+func recordEvents(ctx context.Context, conn execer, eventType string, userID uint64, slugs []string, log *slog.Logger) error {
+	userIDs := make([]uint64, len(slugs))
+	for i := range userIDs {
+		userIDs[i] = userID
+	}
+	return recordEventsOf(ctx, conn, eventType, userIDs, slugs, log)
+}
+
+// recordMemberRemovals writes a membership.removed event for each of the members of a deleted segment.
+func recordMemberRemovals(ctx context.Context, conn execer, slug string, userIDs []uint64, log *slog.Logger) error {
+	slugs := make([]string, len(userIDs))
+	for i := range slugs {
+		slugs[i] = slug
+	}
+	return recordEventsOf(ctx, conn, EventMembershipRemoved, userIDs, slugs, log)
+}
+
+// recordEventsOf writes an event for each pair of userIDs and slugs, like recordEvents.
+func recordEventsOf(ctx context.Context, conn execer, eventType string, userIDs []uint64, slugs []string, log *slog.Logger) error {
+	if len(slugs) == 0 {
+		return nil
+	}
+	eventIDs := make([]string, 0, len(slugs))
+	payloads := make([]string, 0, len(slugs))
+	for i, slug := range slugs {
+		event, payload, err := newEvent(eventType, userIDs[i], slug, log)
+		if err != nil {
+			return err
+		}
+		eventIDs = append(eventIDs, event.ID)
+		payloads = append(payloads, string(payload))
+	}
+	query := `insert into outbox (event_id, type, user_id, segment, payload)
+			  select e.event_id, $2, nullif(e.user_id, 0), e.segment, e.payload::jsonb
+			  from unnest($1::text[], $3::bigint[], $4::text[], $5::text[]) with ordinality as e(event_id, user_id, segment, payload, n)
+			  order by e.n`
+	if _, err := conn.Exec(ctx, query, eventIDs, eventType, userIDs, slugs, payloads); err != nil {
+		log.Error("failed to record event", logger.Err(err))
+		return fmt.Errorf("failed to record event")
+	}
+	if eventType == EventSegmentDeleted {
+		return nil
+	}
+	return enqueueWebhookDeliveries(ctx, conn, eventType, eventIDs, slugs, payloads, log)
+}
+
+// PublishOutbox passes up to limit unpublished events, in the order they were committed, to publish and marks them
+// published if it succeeds. It holds an advisory lock while publishing, so a single relay publishes at a time and
+// the others return without publishing anything. No transaction is open while publish runs.
+// If publish fails or the process dies before the events are marked, they are published again later.
+func (pg *PostgresDB) PublishOutbox(ctx context.Context, limit int, publish func(context.Context, []OutboxEvent) error, log *slog.Logger) (int, error) {
+	var events []OutboxEvent
+	err := pg.acquire(ctx, func(ctx context.Context, conn *pgxpool.Conn) error {
+		var locked bool
+		if err := conn.QueryRow(ctx, `select pg_try_advisory_lock($1)`, outboxLockID).Scan(&locked); err != nil {
+			log.Error("failed to acquire outbox lock", logger.Err(err))
+			return fmt.Errorf("failed to acquire outbox lock")
+		}
+		if !locked {
+			return nil
+		}
+		defer func() {
+			if _, err := conn.Exec(context.WithoutCancel(ctx), `select pg_advisory_unlock($1)`, outboxLockID); err != nil {
+				// Closing the connection ends its session, which releases the lock.
+				log.Error("failed to release outbox lock", logger.Err(err))
+				_ = conn.Conn().Close(context.WithoutCancel(ctx))
+			}
+		}()
+		// Like GetEvents, skip events of transactions that might still be followed by a commit recording
+		// an earlier event, so events are published in commit order.
+		querySelect := `select id, payload from outbox
+						where published_at is null
+						  and txid < pg_snapshot_xmin(pg_current_snapshot())
+						order by txid, id
+						limit $1`
+		queryMark := `update outbox set published_at = NOW() where id = any($1)`
+		rows, err := conn.Query(ctx, querySelect, limit)
+		if err != nil {
+			log.Error("failed to get outbox events", logger.Err(err))
+			return fmt.Errorf("failed to get outbox events")
+		}
+		ids := make([]uint64, 0, limit)
+		for rows.Next() {
+			var event OutboxEvent
+			var payload []byte
+			if err = rows.Scan(&event.Seq, &payload); err != nil {
+				rows.Close()
+				log.Error("failed to scan outbox event", logger.Err(err))
+				return fmt.Errorf("failed to scan outbox event")
+			}
+			if err = json.Unmarshal(payload, &event.Event); err != nil {
+				rows.Close()
+				log.Error("failed to decode outbox event", logger.Err(err))
+				return fmt.Errorf("failed to decode outbox event")
+			}
+			events = append(events, event)
+			ids = append(ids, event.Seq)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			log.Error("error occurred while reading", logger.Err(err))
+			return fmt.Errorf("error occurred while reading")
+		}
+		if len(events) == 0 {
+			return nil
+		}
+		if err = publish(ctx, events); err != nil {
+			log.Error("failed to publish outbox events", logger.Err(err))
+			return fmt.Errorf("failed to publish outbox events: %w", err)
+		}
+		if _, err = conn.Exec(ctx, queryMark, ids); err != nil {
+			log.Error("failed to mark outbox events published", logger.Err(err))
+			return fmt.Errorf("failed to mark outbox events published")
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(events), nil
+}
+
+// PruneOutbox deletes published events recorded before the given time. Unpublished events are only deleted
+// if unpublished is set, otherwise they are kept until the relay published them.
+func (pg *PostgresDB) PruneOutbox(ctx context.Context, before time.Time, unpublished bool, log *slog.Logger) (int64, error) {
+	var pruned int64
+	err := pg.acquire(ctx, func(ctx context.Context, conn *pgxpool.Conn) error {
+		query := `delete from outbox where created_at < $1 and ($2 or published_at is not null)`
+		res, err := conn.Exec(ctx, query, before, unpublished)
+		if err != nil {
+			log.Error("failed to prune outbox", logger.Err(err))
+			return fmt.Errorf("failed to prune outbox")
+		}
+		pruned = res.RowsAffected()
+		return nil
+	})
+	if err != nil {
+		return pruned, err
+	}
+	return pruned, nil
+}
+
+// GetEvents returns up to filter.Limit recorded events following the event filter.After. Events are ordered by
+// the transaction that recorded them and only returned once every transaction that might still record an
+// earlier event has finished, so following the returned events never skips an event committed later.
+// If filter.After is no longer in the outbox, events with a greater Seq are returned.
+func (pg *PostgresDB) GetEvents(ctx context.Context, filter EventFilter, log *slog.Logger) ([]OutboxEvent, error) {
+	res := make([]OutboxEvent, 0)
+	err := pg.acquire(ctx, func(ctx context.Context, conn *pgxpool.Conn) error {
+		query := `with cursor as (select txid, id from outbox where id = $1)
+				  select o.id, o.payload from outbox o
+				  where o.txid < pg_snapshot_xmin(pg_current_snapshot())
+					and (case when exists (select 1 from cursor)
+							  then (o.txid, o.id) > (select txid, id from cursor)
+							  else o.id > $1 end)
+					and ($2::bigint = 0 or o.user_id = $2)
+					and ($3 = '' or o.segment = $3)
+				  order by o.txid, o.id
+				  limit $4`
+		rows, err := conn.Query(ctx, query, filter.After, filter.UserID, filter.Segment, filter.Limit)
+		if err != nil {
+			log.Error("failed to get events", logger.Err(err))
+			return fmt.Errorf("failed to get events")
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var event OutboxEvent
+			var payload []byte
+			if err = rows.Scan(&event.Seq, &payload); err != nil {
+				log.Error("failed to scan event", logger.Err(err))
+				return fmt.Errorf("failed to scan event")
+			}
+			if err = json.Unmarshal(payload, &event.Event); err != nil {
+				log.Error("failed to decode event", logger.Err(err))
+				return fmt.Errorf("failed to decode event")
+			}
+			res = append(res, event)
+		}
+		if err = rows.Err(); err != nil {
+			log.Error("error occurred while reading", logger.Err(err))
+			return fmt.Errorf("error occurred while reading")
+		}
+		return nil
+	})
+	if err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+// GetLastEventSeq returns the Seq of the latest event GetEvents can return, 0 if there is none.
+// Following it with GetEvents returns only events recorded afterwards.
+func (pg *PostgresDB) GetLastEventSeq(ctx context.Context, log *slog.Logger) (uint64, error) {
+	var seq uint64
+	err := pg.acquire(ctx, func(ctx context.Context, conn *pgxpool.Conn) error {
+		if err := pg.Ping(ctx); err != nil {
+			log.Error("failed to ping db", logger.Err(err))
+			return newError(ErrUnavailable, "failed to ping db")
+		}
+		query := `select coalesce(max(id), 0) from outbox
+				  where txid = (select max(txid) from outbox where txid < pg_snapshot_xmin(pg_current_snapshot()))`
+		if err := conn.QueryRow(ctx, query).Scan(&seq); err != nil {
+			log.Error("failed to get last event", logger.Err(err))
+			return fmt.Errorf("failed to get last event")
+		}
+		return nil
+	})
+	if err != nil {
+		return seq, err
+	}
+	return seq, nil
+}
@@ -3,15 +3,44 @@ package storage
 import (
 	"context"
 	"fmt"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/vlasashk/user-segmentation/internal/model/logger"
+	"log/slog"
+	"math"
 	"os"
+	"time"
+)
+
+const (
+	// migrationLockID identifies the advisory lock held while migrating.
+	migrationLockID = 4242046
+	// outboxLockID identifies the advisory lock held by the relay publishing outbox events.
+	outboxLockID        = 4242047
+	defaultQueryTimeout = 30 * time.Second
 )
 
 type PostgresDB struct {
 	DB *pgxpool.Pool
+	// QueryTimeout bounds every storage call, on top of the deadline of the caller's context.
+	QueryTimeout time.Duration
 }
 
+// New connects to the database and applies pending migrations.
 func New(ctx context.Context) (*PostgresDB, error) {
+	pgInstance, err := Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = pgInstance.MigrateUp(ctx); err != nil {
+		pgInstance.Close()
+		return nil, err
+	}
+	return pgInstance, nil
+}
+
+// Connect connects to the database without touching its schema.
+func Connect(ctx context.Context) (*PostgresDB, error) {
 	var username, password, dbport, dbhost, dbname string
 	username = os.Getenv("POSTGRES_USER")
 	password = os.Getenv("POSTGRES_PASSWORD")
@@ -19,57 +48,219 @@ func New(ctx context.Context) (*PostgresDB, error) {
 	dbhost = os.Getenv("DB_HOST")
 	dbname = os.Getenv("POSTGRES_DB")
 	url := fmt.Sprintf("postgresql://%s:%s@%s:%s/%s", username, password, dbhost, dbport, dbname)
+	queryTimeout, err := queryTimeoutFromEnv()
+	if err != nil {
+		return nil, err
+	}
 	dbPool, err := pgxpool.New(ctx, url)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create connection pool: %v\n", err)
 	}
-	pgInstance := &PostgresDB{dbPool}
-	if err = pgInstance.Migrate(ctx); err != nil {
-		return nil, err
+	return &PostgresDB{DB: dbPool, QueryTimeout: queryTimeout}, nil
+}
+
+// inTx runs fn in a transaction at the isolation level iso and commits it if fn succeeds.
+// Checks made by fn see the same data as its writes, and if any of them fails nothing is changed.
+func (pg *PostgresDB) inTx(ctx context.Context, iso pgx.TxIsoLevel, log *slog.Logger, fn func(ctx context.Context, tx pgx.Tx) error) error {
+	return pg.acquire(ctx, func(ctx context.Context, conn *pgxpool.Conn) error {
+		if err := pg.Ping(ctx); err != nil {
+			log.Error("failed to ping db", logger.Err(err))
+			return newError(ErrUnavailable, "failed to ping db")
+		}
+		tx, err := conn.BeginTx(ctx, pgx.TxOptions{IsoLevel: iso})
+		if err != nil {
+			log.Error("failed to begin transaction", logger.Err(err))
+			return fmt.Errorf("failed to begin transaction")
+		}
+		defer func(tx pgx.Tx) {
+			_ = tx.Rollback(context.Background())
+		}(tx)
+		if err = fn(ctx, tx); err != nil {
+			return err
+		}
+		if err = tx.Commit(ctx); err != nil {
+			log.Error("failed to commit transaction", logger.Err(err))
+			return fmt.Errorf("failed to commit transaction")
+		}
+		return nil
+	})
+}
+
+// queryTimeoutFromEnv reads DB_QUERY_TIMEOUT, 30s by default.
+func queryTimeoutFromEnv() (time.Duration, error) {
+	timeout := defaultQueryTimeout
+	if v := os.Getenv("DB_QUERY_TIMEOUT"); v != "" {
+		var err error
+		if timeout, err = time.ParseDuration(v); err != nil || timeout <= 0 {
+			return 0, fmt.Errorf("invalid DB_QUERY_TIMEOUT %q", v)
+		}
 	}
-	return pgInstance, nil
+	return timeout, nil
 }
 
+// acquire runs fn on a pooled connection with ctx bounded by QueryTimeout.
+// Failures caused by ctx being done are reported as ErrCanceled or ErrTimeout.
+func (pg *PostgresDB) acquire(ctx context.Context, fn func(ctx context.Context, conn *pgxpool.Conn) error) error {
+	ctx, cancel := context.WithTimeout(ctx, pg.QueryTimeout)
+	defer cancel()
+	err := pg.DB.AcquireFunc(ctx, func(conn *pgxpool.Conn) error {
+		return fn(ctx, conn)
+	})
+	return contextError(ctx, err)
+}
+
+// DropDB rolls back every applied migration.
 func (pg *PostgresDB) DropDB(ctx context.Context) error {
-	err := pg.DB.AcquireFunc(context.Background(), func(conn *pgxpool.Conn) error {
-		if err := pg.Ping(ctx); err != nil {
-			return fmt.Errorf("failed to ping db: %v\n", err)
+	_, err := pg.MigrateDown(ctx, math.MaxInt)
+	return err
+}
+
+// MigrateUp applies pending migrations and returns them.
+func (pg *PostgresDB) MigrateUp(ctx context.Context) ([]Migration, error) {
+	migrations, err := loadMigrations("MIGRATIONS_PATH", "postgres")
+	if err != nil {
+		return nil, err
+	}
+	var res []Migration
+	err = pg.withMigrationLock(ctx, func(conn *pgxpool.Conn, applied map[uint64]time.Time) error {
+		for _, migration := range pendingMigrations(migrations, applied) {
+			query := `insert into schema_migrations (version, name) values ($1, $2)`
+			if err := pgMigrate(ctx, conn, migration.Up, query, migration); err != nil {
+				return fmt.Errorf("failed to apply migration %d_%s: %v\n", migration.Version, migration.Name, err)
+			}
+			res = append(res, migration)
 		}
-		query, err := os.ReadFile(os.Getenv("DROP_PATH"))
+		return nil
+	})
+	return res, err
+}
+
+// MigrateDown rolls back up to steps most recently applied migrations and returns them.
+func (pg *PostgresDB) MigrateDown(ctx context.Context, steps int) ([]Migration, error) {
+	migrations, err := loadMigrations("MIGRATIONS_PATH", "postgres")
+	if err != nil {
+		return nil, err
+	}
+	var res []Migration
+	err = pg.withMigrationLock(ctx, func(conn *pgxpool.Conn, applied map[uint64]time.Time) error {
+		rollback, err := rollbackMigrations(migrations, applied, steps)
 		if err != nil {
-			return fmt.Errorf("failed to read drop.sql file: %v\n", err)
+			return err
 		}
-		if _, err = conn.Exec(ctx, string(query)); err != nil {
-			return fmt.Errorf("failed to drop tables: %v\n", err)
+		for _, migration := range rollback {
+			query := `delete from schema_migrations where version = $1 and name = $2`
+			if err := pgMigrate(ctx, conn, migration.Down, query, migration); err != nil {
+				return fmt.Errorf("failed to roll back migration %d_%s: %v\n", migration.Version, migration.Name, err)
+			}
+			res = append(res, migration)
 		}
 		return nil
 	})
+	return res, err
+}
+
+// MigrationStatus lists known and applied migrations.
+func (pg *PostgresDB) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	migrations, err := loadMigrations("MIGRATIONS_PATH", "postgres")
 	if err != nil {
-		return fmt.Errorf("unable to acquire a database connection: %v\n", err)
+		return nil, err
 	}
-	return nil
+	var res []MigrationStatus
+	// Only reads the schema, so it neither waits for a running migration nor creates schema_migrations.
+	err = pg.DB.AcquireFunc(ctx, func(conn *pgxpool.Conn) error {
+		var exists bool
+		if err := conn.QueryRow(ctx, `select to_regclass('schema_migrations') is not null`).Scan(&exists); err != nil {
+			return fmt.Errorf("failed to look up schema_migrations table: %v\n", err)
+		}
+		applied := make(map[uint64]time.Time)
+		if exists {
+			if applied, err = pgAppliedMigrations(ctx, conn); err != nil {
+				return err
+			}
+		}
+		res = migrationStatus(migrations, applied)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to get migration status: %v\n", err)
+	}
+	return res, nil
 }
 
-func (pg *PostgresDB) Migrate(ctx context.Context) error {
-	err := pg.DB.AcquireFunc(context.Background(), func(conn *pgxpool.Conn) error {
+// withMigrationLock runs fn holding an advisory lock, so replicas starting at once apply migrations one after another
+// and the ones that wait see the migrations applied by the first.
+func (pg *PostgresDB) withMigrationLock(ctx context.Context, fn func(conn *pgxpool.Conn, applied map[uint64]time.Time) error) error {
+	err := pg.DB.AcquireFunc(ctx, func(conn *pgxpool.Conn) error {
 		if err := pg.Ping(ctx); err != nil {
 			return fmt.Errorf("failed to ping db: %v\n", err)
 		}
-		query, err := os.ReadFile(os.Getenv("MIGRATE_PATH"))
-		if err != nil {
-			return fmt.Errorf("failed to read up.sql file: %v\n", err)
+		if _, err := conn.Exec(ctx, `select pg_advisory_lock($1)`, migrationLockID); err != nil {
+			return fmt.Errorf("failed to acquire migration lock: %v\n", err)
 		}
-		if _, err = conn.Exec(ctx, string(query)); err != nil {
-			return fmt.Errorf("failed to init tables: %v\n", err)
+		defer func() {
+			_, _ = conn.Exec(context.Background(), `select pg_advisory_unlock($1)`, migrationLockID)
+		}()
+		query := `CREATE TABLE IF NOT EXISTS schema_migrations
+				  (
+					  version    BIGINT PRIMARY KEY,
+					  name       varchar(255) NOT NULL,
+					  applied_at TIMESTAMP    NOT NULL DEFAULT NOW()
+				  )`
+		if _, err := conn.Exec(ctx, query); err != nil {
+			return fmt.Errorf("failed to create schema_migrations table: %v\n", err)
 		}
-		return nil
+		applied, err := pgAppliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+		return fn(conn, applied)
 	})
 	if err != nil {
-		return fmt.Errorf("unable to acquire a database connection: %v\n", err)
+		return fmt.Errorf("unable to migrate: %v\n", err)
 	}
 	return nil
 }
 
+// pgAppliedMigrations returns when each recorded migration was applied by its version.
+func pgAppliedMigrations(ctx context.Context, conn *pgxpool.Conn) (map[uint64]time.Time, error) {
+	rows, err := conn.Query(ctx, `select version, applied_at from schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get applied migrations: %v\n", err)
+	}
+	defer rows.Close()
+	applied := make(map[uint64]time.Time)
+	for rows.Next() {
+		var version uint64
+		var appliedAt time.Time
+		if err = rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan applied migration: %v\n", err)
+		}
+		applied[version] = appliedAt
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get applied migrations: %v\n", err)
+	}
+	return applied, nil
+}
+
+// pgMigrate runs the migration script and records it in schema_migrations in a single transaction.
+func pgMigrate(ctx context.Context, conn *pgxpool.Conn, script, record string, migration Migration) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func(tx pgx.Tx) {
+		_ = tx.Rollback(context.Background())
+	}(tx)
+	if _, err = tx.Exec(ctx, script); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(ctx, record, migration.Version, migration.Name); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
 func (pg *PostgresDB) Ping(ctx context.Context) error {
 	return pg.DB.Ping(ctx)
 }
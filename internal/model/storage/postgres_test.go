@@ -0,0 +1,32 @@
+package storage_test
+
+import (
+	"context"
+	"github.com/vlasashk/user-segmentation/internal/model/storage"
+	"github.com/vlasashk/user-segmentation/internal/model/storage/storagetest"
+	"os"
+	"testing"
+)
+
+// TestPostgresDB runs against the database configured like the app's, e.g. with config/.env.
+// Every table of the database is dropped, so it is skipped unless TEST_POSTGRES is set.
+func TestPostgresDB(t *testing.T) {
+	if os.Getenv("TEST_POSTGRES") == "" {
+		t.Skip("TEST_POSTGRES is not set")
+	}
+	storagetest.Run(t, func(t *testing.T) storagetest.Store {
+		ctx := context.Background()
+		db, err := storage.Connect(ctx)
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		t.Cleanup(db.Close)
+		if err = db.DropDB(ctx); err != nil {
+			t.Fatalf("failed to drop schema: %v", err)
+		}
+		if _, err = db.MigrateUp(ctx); err != nil {
+			t.Fatalf("failed to migrate: %v", err)
+		}
+		return db
+	})
+}
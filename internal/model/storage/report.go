@@ -0,0 +1,51 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// reportIDPattern matches identifiers produced by NewReportID: 16 random bytes, hex encoded.
+var reportIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// NewReportID returns an opaque random identifier for a generated csv report.
+func NewReportID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// ValidReportID reports whether id has the shape of an identifier returned by NewReportID.
+func ValidReportID(id string) bool {
+	return reportIDPattern.MatchString(id)
+}
+
+// ReportPath returns the location of the report file with the given id inside dir.
+func ReportPath(dir, id string) string {
+	return filepath.Join(dir, id+".csv")
+}
+
+// ResolveReportPath validates id and returns the report location, making sure it can't escape dir.
+func ResolveReportPath(dir, id string) (string, error) {
+	if !ValidReportID(id) {
+		return "", fmt.Errorf("invalid report id")
+	}
+	base, err := filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("invalid report directory: %v", err)
+	}
+	path, err := filepath.Abs(ReportPath(dir, id))
+	if err != nil {
+		return "", fmt.Errorf("invalid report path: %v", err)
+	}
+	if rel, err := filepath.Rel(base, path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid report path")
+	}
+	return path, nil
+}
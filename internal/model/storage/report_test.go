@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveReportPath(t *testing.T) {
+	dir := t.TempDir()
+	id := strings.Repeat("ab", 16)
+	path, err := ResolveReportPath(dir, id)
+	if err != nil || path != filepath.Join(dir, id+".csv") {
+		t.Errorf("ResolveReportPath() = %q, %v, want the report in %s", path, err, dir)
+	}
+	for _, id := range []string{"", "..", "../../etc/passwd", id + "/../" + id, "/etc/passwd", strings.ToUpper(id), id[1:], id + "0"} {
+		if path, err := ResolveReportPath(dir, id); err == nil {
+			t.Errorf("ResolveReportPath(%q) = %q, want error", id, path)
+		}
+	}
+}
+
+func TestCloseReport(t *testing.T) {
+	t.Setenv("CSV_PATH", t.TempDir())
+	for _, failure := range []error{nil, errors.New("query failed")} {
+		reportID, file, err := createReport(discardLog)
+		if err != nil {
+			t.Fatalf("createReport() failed: %v", err)
+		}
+		closeReport(file, &failure, discardLog)
+		_, err = os.Stat(ReportPath(os.Getenv("CSV_PATH"), reportID))
+		if exists := err == nil; exists != (failure == nil) {
+			t.Errorf("report exists = %v after closing it with error %v", exists, failure)
+		}
+	}
+}
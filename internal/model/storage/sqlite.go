@@ -0,0 +1,854 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/vlasashk/user-segmentation/internal/model/logger"
+	"log/slog"
+	"math"
+	"os"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const (
+	defaultSQLitePath = "user-segmentation.db"
+	// sqliteTimeLayout has a fixed width, so timestamps stored as text compare like the times they represent.
+	sqliteTimeLayout = "2006-01-02 15:04:05.000000"
+)
+
+// SQLiteDB stores everything in a single SQLite file. It behaves like PostgresDB, but can only be used
+// by one instance at a time.
+type SQLiteDB struct {
+	DB *sql.DB
+	// QueryTimeout bounds every storage call, on top of the deadline of the caller's context.
+	QueryTimeout time.Duration
+}
+
+// NewSQLite opens the database file at SQLITE_PATH, creating it if needed, and applies pending migrations.
+func NewSQLite(ctx context.Context) (*SQLiteDB, error) {
+	sqliteInstance, err := ConnectSQLite(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = sqliteInstance.MigrateUp(ctx); err != nil {
+		sqliteInstance.Close()
+		return nil, err
+	}
+	return sqliteInstance, nil
+}
+
+// ConnectSQLite opens the database file at SQLITE_PATH, creating it if needed, without touching its schema.
+func ConnectSQLite(ctx context.Context) (*SQLiteDB, error) {
+	path := os.Getenv("SQLITE_PATH")
+	if path == "" {
+		path = defaultSQLitePath
+	}
+	// Write transactions take the lock when they begin, so concurrent ones wait for each other
+	// instead of failing when they try to write.
+	dsn := fmt.Sprintf("file:%s?_txlock=immediate&_pragma=foreign_keys(1)&_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)", path)
+	queryTimeout, err := queryTimeoutFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open sqlite database: %v\n", err)
+	}
+	return &SQLiteDB{DB: db, QueryTimeout: queryTimeout}, nil
+}
+
+// DropDB rolls back every applied migration.
+func (s *SQLiteDB) DropDB(ctx context.Context) error {
+	_, err := s.MigrateDown(ctx, math.MaxInt)
+	return err
+}
+
+// MigrateUp applies pending migrations and returns them.
+func (s *SQLiteDB) MigrateUp(ctx context.Context) ([]Migration, error) {
+	migrations, err := loadMigrations("SQLITE_MIGRATIONS_PATH", "sqlite")
+	if err != nil {
+		return nil, err
+	}
+	var res []Migration
+	err = s.withMigrationLock(ctx, func(tx *sql.Tx, applied map[uint64]time.Time) error {
+		for _, migration := range pendingMigrations(migrations, applied) {
+			if _, err := tx.ExecContext(ctx, migration.Up); err != nil {
+				return fmt.Errorf("failed to apply migration %d_%s: %v\n", migration.Version, migration.Name, err)
+			}
+			query := `insert into schema_migrations (version, name, applied_at) values (?, ?, ?)`
+			if _, err := tx.ExecContext(ctx, query, migration.Version, migration.Name, sqliteNow()); err != nil {
+				return fmt.Errorf("failed to record migration %d_%s: %v\n", migration.Version, migration.Name, err)
+			}
+			res = append(res, migration)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// MigrateDown rolls back up to steps most recently applied migrations and returns them.
+func (s *SQLiteDB) MigrateDown(ctx context.Context, steps int) ([]Migration, error) {
+	migrations, err := loadMigrations("SQLITE_MIGRATIONS_PATH", "sqlite")
+	if err != nil {
+		return nil, err
+	}
+	var res []Migration
+	err = s.withMigrationLock(ctx, func(tx *sql.Tx, applied map[uint64]time.Time) error {
+		rollback, err := rollbackMigrations(migrations, applied, steps)
+		if err != nil {
+			return err
+		}
+		for _, migration := range rollback {
+			if _, err := tx.ExecContext(ctx, migration.Down); err != nil {
+				return fmt.Errorf("failed to roll back migration %d_%s: %v\n", migration.Version, migration.Name, err)
+			}
+			query := `delete from schema_migrations where version = ?`
+			if _, err := tx.ExecContext(ctx, query, migration.Version); err != nil {
+				return fmt.Errorf("failed to record migration %d_%s: %v\n", migration.Version, migration.Name, err)
+			}
+			res = append(res, migration)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// MigrationStatus lists known and applied migrations.
+func (s *SQLiteDB) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	migrations, err := loadMigrations("SQLITE_MIGRATIONS_PATH", "sqlite")
+	if err != nil {
+		return nil, err
+	}
+	if err = s.Ping(ctx); err != nil {
+		return nil, fmt.Errorf("failed to ping db: %v\n", err)
+	}
+	// Only reads the schema, so it neither takes the write lock nor creates schema_migrations.
+	var exists bool
+	query := `select count(*) > 0 from sqlite_master where type = 'table' and name = 'schema_migrations'`
+	if err = s.DB.QueryRowContext(ctx, query).Scan(&exists); err != nil {
+		return nil, fmt.Errorf("failed to look up schema_migrations table: %v\n", err)
+	}
+	applied := make(map[uint64]time.Time)
+	if exists {
+		if applied, err = sqliteAppliedMigrations(ctx, s.DB); err != nil {
+			return nil, err
+		}
+	}
+	return migrationStatus(migrations, applied), nil
+}
+
+// withMigrationLock runs fn in a single transaction. Transactions take the write lock when they begin,
+// so processes migrating the same file at once wait for each other, and a failed migration leaves no changes.
+func (s *SQLiteDB) withMigrationLock(ctx context.Context, fn func(tx *sql.Tx, applied map[uint64]time.Time) error) error {
+	if err := s.Ping(ctx); err != nil {
+		return fmt.Errorf("failed to ping db: %v\n", err)
+	}
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v\n", err)
+	}
+	defer func(tx *sql.Tx) {
+		_ = tx.Rollback()
+	}(tx)
+	query := `CREATE TABLE IF NOT EXISTS schema_migrations
+			  (
+				  version    INTEGER PRIMARY KEY,
+				  name       TEXT      NOT NULL,
+				  applied_at TIMESTAMP NOT NULL
+			  )`
+	if _, err = tx.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %v\n", err)
+	}
+	applied, err := sqliteAppliedMigrations(ctx, tx)
+	if err != nil {
+		return err
+	}
+	if err = fn(tx, applied); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit migrations: %v\n", err)
+	}
+	return nil
+}
+
+// sqliteAppliedMigrations returns when each recorded migration was applied by its version.
+func sqliteAppliedMigrations(ctx context.Context, conn interface {
+	QueryContext(context.Context, string, ...any) (*sql.Rows, error)
+}) (map[uint64]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, `select version, applied_at from schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get applied migrations: %v\n", err)
+	}
+	defer func(rows *sql.Rows) {
+		_ = rows.Close()
+	}(rows)
+	applied := make(map[uint64]time.Time)
+	for rows.Next() {
+		var version uint64
+		var appliedAt time.Time
+		if err = rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan applied migration: %v\n", err)
+		}
+		applied[version] = appliedAt
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get applied migrations: %v\n", err)
+	}
+	return applied, nil
+}
+
+func (s *SQLiteDB) Ping(ctx context.Context) error {
+	return s.DB.PingContext(ctx)
+}
+
+func (s *SQLiteDB) Close() {
+	_ = s.DB.Close()
+}
+
+// queryContext bounds ctx by QueryTimeout. The returned func releases the context and reports a failure
+// caused by ctx being done as ErrCanceled or ErrTimeout, it is deferred with the method's error result.
+func (s *SQLiteDB) queryContext(ctx context.Context) (context.Context, func(err *error)) {
+	ctx, cancel := context.WithTimeout(ctx, s.QueryTimeout)
+	return ctx, func(err *error) {
+		*err = contextError(ctx, *err)
+		cancel()
+	}
+}
+
+func sqliteTime(t time.Time) string {
+	return t.UTC().Format(sqliteTimeLayout)
+}
+
+func sqliteNow() string {
+	return sqliteTime(time.Now())
+}
+
+// sqliteArray encodes values as a json array, its elements are read with json_each.
+func sqliteArray[T any](values []T) string {
+	encoded, _ := json.Marshal(values)
+	return string(encoded)
+}
+
+// withTx runs fn in a transaction that is committed if fn succeeds.
+func (s *SQLiteDB) withTx(ctx context.Context, log *slog.Logger, fn func(tx *sql.Tx) error) error {
+	if err := s.Ping(ctx); err != nil {
+		log.Error("failed to ping db", logger.Err(err))
+		return newError(ErrUnavailable, "failed to ping db")
+	}
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		log.Error("failed to begin transaction", logger.Err(err))
+		return fmt.Errorf("failed to begin transaction")
+	}
+	defer func(tx *sql.Tx) {
+		_ = tx.Rollback()
+	}(tx)
+	if err = fn(tx); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		log.Error("failed to commit transaction", logger.Err(err))
+		return fmt.Errorf("failed to commit transaction")
+	}
+	return nil
+}
+
+func (s *SQLiteDB) CsvHistoryReport(ctx context.Context, csvDates CsvReport, log *slog.Logger) (_ string, err error) {
+	ctx, done := s.queryContext(ctx)
+	defer done(&err)
+	if err := s.Ping(ctx); err != nil {
+		log.Error("failed to ping db", logger.Err(err))
+		return "", newError(ErrUnavailable, "failed to ping db")
+	}
+	startDate := time.Date(int(csvDates.Year), csvDates.Month, 0, 0, 0, 0, 0, time.Local)
+	endDate := startDate.AddDate(0, 1, 0)
+	query := `SELECT u.user_id AS user_id, s.slug AS segment, 'added' AS status, created_at AS segment_date
+				FROM user_segments us
+				JOIN segments s on s.id = us.segment_id
+				JOIN users u on u.id = us.user_id
+				WHERE (created_at BETWEEN ?1 AND ?2)
+				UNION
+				SELECT u.user_id, s.slug AS segment, 'removed' AS status, deleted_at AS segment_date
+				FROM user_segments us
+				JOIN segments s on s.id = us.segment_id
+				JOIN users u on u.id = us.user_id
+				WHERE (deleted_at BETWEEN ?1 AND ?2)
+				ORDER BY user_id, segment, status;`
+	rows, err := s.DB.QueryContext(ctx, query, sqliteTime(startDate), sqliteTime(endDate))
+	if err != nil {
+		log.Error("failed to execute query", logger.Err(err))
+		return "", fmt.Errorf("failed to execute query")
+	}
+	defer rows.Close()
+	reportID, file, err := createReport(log)
+	if err != nil {
+		return reportID, err
+	}
+	defer closeReport(file, &err, log)
+	writer := newCsvWriter(file)
+	defer writer.Flush()
+	for rows.Next() {
+		var userId, segmentId, status string
+		var segmentDate time.Time
+		if err = rows.Scan(&userId, &segmentId, &status, &segmentDate); err != nil {
+			log.Error("failed to scan data", logger.Err(err))
+			return reportID, fmt.Errorf("failed to scan data")
+		}
+		if err = writer.Write([]string{userId, segmentId, status, segmentDate.String()}); err != nil {
+			log.Error("failed to write into csv:", logger.Err(err))
+			return reportID, fmt.Errorf("failed to write into csv")
+		}
+	}
+	if err = rows.Err(); err != nil {
+		log.Error("error occurred while reading", logger.Err(err))
+		return reportID, fmt.Errorf("error occurred while reading")
+	}
+	return reportID, nil
+}
+
+func (s *SQLiteDB) GetSegmentUsersInfo(ctx context.Context, segment Segment, log *slog.Logger) (_ []uint64, err error) {
+	ctx, done := s.queryContext(ctx)
+	defer done(&err)
+	var res []uint64
+	if err := s.Ping(ctx); err != nil {
+		log.Error("failed to ping db", logger.Err(err))
+		return res, newError(ErrUnavailable, "failed to ping db")
+	}
+	var id uint64
+	queryCheckSegment := `select id from segments where slug = ?`
+	query := `select u.user_id from user_segments us join users u on u.id = us.user_id where segment_id = ? and deleted_at is null`
+	if err := s.DB.QueryRowContext(ctx, queryCheckSegment, segment.Slug).Scan(&id); err != nil {
+		log.Error(fmt.Sprintf("segment '%v' doesn't exist", segment.Slug), logger.Err(err))
+		return res, newError(ErrNotFound, "segment '%v' doesn't exist", segment.Slug)
+	}
+	rows, err := s.DB.QueryContext(ctx, query, id)
+	if err != nil {
+		log.Error("failed to get data", logger.Err(err))
+		return res, fmt.Errorf("failed to get data")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var user uint64
+		if err = rows.Scan(&user); err != nil {
+			log.Error("failed to scan user", logger.Err(err))
+			return res, fmt.Errorf("failed to scan user")
+		}
+		res = append(res, user)
+	}
+	if err = rows.Err(); err != nil {
+		log.Error("error occurred while reading", logger.Err(err))
+		return res, fmt.Errorf("error occurred while reading")
+	}
+	return res, nil
+}
+
+// resolveSegments returns the internal id of the user and of each of the segments, in the order of the slugs.
+// It fails with ErrForbidden if userSegment.OwnerTeam is set and doesn't own one of the segments.
+func resolveSegments(ctx context.Context, tx *sql.Tx, userSegment UserSegments, log *slog.Logger) (uint64, []uint64, error) {
+	var userID uint64
+	queryCheckUser := `select id from users where user_id = ?`
+	queryCheckSegment := `select id, coalesce(owner_team, '') from segments where slug = ?`
+	if err := tx.QueryRowContext(ctx, queryCheckUser, userSegment.UserID).Scan(&userID); err != nil {
+		log.Error(fmt.Sprintf("user '%v' doesn't exist", userSegment.UserID), logger.Err(err))
+		return 0, nil, newError(ErrNotFound, "user '%v' doesn't exist", userSegment.UserID)
+	}
+	segmentIDs := make([]uint64, 0, len(userSegment.SegmentSlug))
+	for _, slug := range userSegment.SegmentSlug {
+		var segmentID uint64
+		var owner string
+		if err := tx.QueryRowContext(ctx, queryCheckSegment, slug).Scan(&segmentID, &owner); err != nil {
+			log.Error(fmt.Sprintf("segment '%v' doesn't exist", slug), logger.Err(err))
+			return 0, nil, newError(ErrNotFound, "segment '%v' doesn't exist", slug)
+		}
+		if err := checkOwner(slug, owner, userSegment.OwnerTeam, log); err != nil {
+			return 0, nil, err
+		}
+		segmentIDs = append(segmentIDs, segmentID)
+	}
+	return userID, segmentIDs, nil
+}
+
+func (s *SQLiteDB) DeleteUserFromSegments(ctx context.Context, userSegment UserSegments, log *slog.Logger) (err error) {
+	ctx, done := s.queryContext(ctx)
+	defer done(&err)
+	return s.withTx(ctx, log, func(tx *sql.Tx) error {
+		userID, segmentIDs, err := resolveSegments(ctx, tx, userSegment, log)
+		if err != nil {
+			return err
+		}
+		query := `update user_segments set deleted_at = ? where segment_id = ? and user_id = ? and deleted_at is null`
+		now := sqliteNow()
+		for i, segmentID := range segmentIDs {
+			res, err := tx.ExecContext(ctx, query, now, segmentID, userID)
+			if err != nil {
+				log.Error("failed to delete data", logger.Err(err))
+				return fmt.Errorf("failed to delete data")
+			}
+			if n, _ := res.RowsAffected(); n < 1 {
+				log.Error("failed to execute query", logger.Err(fmt.Errorf("user '%d' is not part of '%s' segment", userSegment.UserID, userSegment.SegmentSlug[i])))
+				return newError(ErrNotMember, "user '%d' is not part of '%s' segment", userSegment.UserID, userSegment.SegmentSlug[i])
+			}
+			if err = sqliteRecordEvent(ctx, tx, EventMembershipRemoved, userSegment.UserID, userSegment.SegmentSlug[i], log); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// AddUserToSegments adds the user to all the segments or to none of them, like PostgresDB.AddUserToSegments.
+func (s *SQLiteDB) AddUserToSegments(ctx context.Context, userSegment UserSegments, log *slog.Logger) (_ []SegmentOutcome, err error) {
+	ctx, done := s.queryContext(ctx)
+	defer done(&err)
+	var outcomes []SegmentOutcome
+	err = s.withTx(ctx, log, func(tx *sql.Tx) error {
+		var userID uint64
+		queryCheckUser := `select id from users where user_id = ?`
+		querySegments := `select slug, id, coalesce(owner_team, '') from segments where slug in (select value from json_each(?))`
+		// Adding a removed member again restarts the membership.
+		queryInsert := `insert into user_segments (user_id, segment_id, created_at)
+						select ?1, value, ?3 from json_each(?2) where true
+						on conflict (user_id, segment_id) do update set deleted_at = NULL, created_at = ?3
+						where user_segments.deleted_at is not null
+						returning segment_id`
+		if err := tx.QueryRowContext(ctx, queryCheckUser, userSegment.UserID).Scan(&userID); err != nil {
+			log.Error(fmt.Sprintf("user '%v' doesn't exist", userSegment.UserID), logger.Err(err))
+			return newError(ErrNotFound, "user '%v' doesn't exist", userSegment.UserID)
+		}
+		segmentIDs, owners, err := sqliteSlugIDs(ctx, tx, querySegments, userSegment.SegmentSlug)
+		if err != nil {
+			log.Error("failed to get segments", logger.Err(err))
+			return fmt.Errorf("failed to get segments")
+		}
+		for _, slug := range userSegment.SegmentSlug {
+			if _, ok := segmentIDs[slug]; !ok {
+				continue
+			}
+			if err = checkOwner(slug, owners[slug], userSegment.OwnerTeam, log); err != nil {
+				return err
+			}
+		}
+		failed := make(map[string]string)
+		for _, slug := range missingSegments(userSegment.SegmentSlug, segmentIDs) {
+			failed[slug] = OutcomeNotFound
+		}
+		if len(failed) == 0 {
+			added, err := sqliteSegmentIDs(ctx, tx, queryInsert, userID, segmentIDs.ids(userSegment.SegmentSlug), sqliteNow())
+			if err != nil {
+				log.Error("failed to insert data", logger.Err(err))
+				return fmt.Errorf("failed to insert data")
+			}
+			for _, slug := range userSegment.SegmentSlug {
+				if !added[segmentIDs[slug]] {
+					failed[slug] = OutcomeAlreadyMember
+				}
+			}
+		}
+		outcomes, err = segmentOutcomes(userSegment, failed, log)
+		if err != nil {
+			return err
+		}
+		for _, slug := range userSegment.SegmentSlug {
+			if err = sqliteRecordEvent(ctx, tx, EventMembershipAdded, userSegment.UserID, slug, log); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return outcomes, err
+}
+
+// sqliteSlugIDs runs a query taking a JSON array of slugs and returning slugs with the ids and owners of their rows.
+func sqliteSlugIDs(ctx context.Context, tx *sql.Tx, query string, slugs []string) (slugIDs, map[string]string, error) {
+	rows, err := tx.QueryContext(ctx, query, sqliteArray(slugs))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	ids := make(slugIDs, len(slugs))
+	owners := make(map[string]string, len(slugs))
+	for rows.Next() {
+		var slug, owner string
+		var id uint64
+		if err = rows.Scan(&slug, &id, &owner); err != nil {
+			return nil, nil, err
+		}
+		ids[slug] = id
+		owners[slug] = owner
+	}
+	return ids, owners, rows.Err()
+}
+
+// sqliteSegmentIDs runs a membership query taking the user id, a JSON array of segment ids and the time
+// and returns the segment ids it returned.
+func sqliteSegmentIDs(ctx context.Context, tx *sql.Tx, query string, userID uint64, segmentIDs []uint64, now string) (map[uint64]bool, error) {
+	rows, err := tx.QueryContext(ctx, query, userID, sqliteArray(segmentIDs), now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make(map[uint64]bool, len(segmentIDs))
+	for rows.Next() {
+		var id uint64
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		res[id] = true
+	}
+	return res, rows.Err()
+}
+
+// sqliteUserIDs runs a query taking args and returning user ids.
+func sqliteUserIDs(ctx context.Context, tx *sql.Tx, query string, args ...any) ([]uint64, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make([]uint64, 0)
+	for rows.Next() {
+		var id uint64
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		res = append(res, id)
+	}
+	return res, rows.Err()
+}
+
+func (s *SQLiteDB) GetUserSegmentsInfo(ctx context.Context, user User, log *slog.Logger) (_ []string, err error) {
+	ctx, done := s.queryContext(ctx)
+	defer done(&err)
+	var res []string
+	if err := s.Ping(ctx); err != nil {
+		log.Error("failed to ping db", logger.Err(err))
+		return res, newError(ErrUnavailable, "failed to ping db")
+	}
+	var id uint64
+	queryCheckUser := `select id from users where user_id = ?`
+	query := `select slug from user_segments us join segments s on s.id = us.segment_id where user_id = ? and deleted_at is null`
+	if err := s.DB.QueryRowContext(ctx, queryCheckUser, user.UID).Scan(&id); err != nil {
+		log.Error(fmt.Sprintf("user '%v' doesn't exist", user.UID), logger.Err(err))
+		return res, newError(ErrNotFound, "user '%v' doesn't exist", user.UID)
+	}
+	rows, err := s.DB.QueryContext(ctx, query, id)
+	if err != nil {
+		log.Error("failed to get data", logger.Err(err))
+		return res, fmt.Errorf("failed to get data")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var segment string
+		if err = rows.Scan(&segment); err != nil {
+			log.Error("failed to scan segment", logger.Err(err))
+			return res, fmt.Errorf("failed to scan segment")
+		}
+		res = append(res, segment)
+	}
+	if err = rows.Err(); err != nil {
+		log.Error("error occurred while reading", logger.Err(err))
+		return res, fmt.Errorf("error occurred while reading")
+	}
+	return res, nil
+}
+
+// GetUsersSegmentsInfo returns the segments of each of the given users in one query.
+// Users that don't exist are left out of the result, existing users without segments map to an empty list.
+func (s *SQLiteDB) GetUsersSegmentsInfo(ctx context.Context, users UsersBatch, log *slog.Logger) (_ map[uint64][]string, err error) {
+	ctx, done := s.queryContext(ctx)
+	defer done(&err)
+	res := make(map[uint64][]string, len(users.UserIDs))
+	if err := s.Ping(ctx); err != nil {
+		log.Error("failed to ping db", logger.Err(err))
+		return res, newError(ErrUnavailable, "failed to ping db")
+	}
+	query := `select u.user_id, s.slug
+			  from users u
+			  left join user_segments us on us.user_id = u.id and us.deleted_at is null
+			  left join segments s on s.id = us.segment_id
+			  where u.user_id in (select value from json_each(?))`
+	rows, err := s.DB.QueryContext(ctx, query, sqliteArray(users.UserIDs))
+	if err != nil {
+		log.Error("failed to get data", logger.Err(err))
+		return res, fmt.Errorf("failed to get data")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var uid uint64
+		var segment *string
+		if err = rows.Scan(&uid, &segment); err != nil {
+			log.Error("failed to scan segment", logger.Err(err))
+			return res, fmt.Errorf("failed to scan segment")
+		}
+		if _, ok := res[uid]; !ok {
+			res[uid] = []string{}
+		}
+		if segment != nil {
+			res[uid] = append(res[uid], *segment)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		log.Error("error occurred while reading", logger.Err(err))
+		return res, fmt.Errorf("error occurred while reading")
+	}
+	return res, nil
+}
+
+// GetMemberships reports the user's membership in each of the given segments, in the order of the slugs.
+func (s *SQLiteDB) GetMemberships(ctx context.Context, userSegments UserSegments, log *slog.Logger) (_ []Membership, err error) {
+	ctx, done := s.queryContext(ctx)
+	defer done(&err)
+	res := make([]Membership, 0, len(userSegments.SegmentSlug))
+	if err := s.Ping(ctx); err != nil {
+		log.Error("failed to ping db", logger.Err(err))
+		return res, newError(ErrUnavailable, "failed to ping db")
+	}
+	query := `select q.value, u.id is not null, s.id is not null, us.created_at, us.deleted_at
+			  from json_each(?2) as q
+			  left join users u on u.user_id = ?1
+			  left join segments s on s.slug = q.value
+			  left join user_segments us on us.user_id = u.id and us.segment_id = s.id
+			  order by q.key`
+	rows, err := s.DB.QueryContext(ctx, query, userSegments.UserID, sqliteArray(userSegments.SegmentSlug))
+	if err != nil {
+		log.Error("failed to get data", logger.Err(err))
+		return res, fmt.Errorf("failed to get data")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var membership Membership
+		var userExists, segmentExists bool
+		if err = rows.Scan(&membership.Slug, &userExists, &segmentExists, &membership.AddedAt, &membership.RemovedAt); err != nil {
+			log.Error("failed to scan membership", logger.Err(err))
+			return res, fmt.Errorf("failed to scan membership")
+		}
+		if !userExists {
+			log.Error(fmt.Sprintf("user '%v' doesn't exist", userSegments.UserID))
+			return res, newError(ErrNotFound, "user '%v' doesn't exist", userSegments.UserID)
+		}
+		if !segmentExists {
+			log.Error(fmt.Sprintf("segment '%v' doesn't exist", membership.Slug))
+			return res, newError(ErrNotFound, "segment '%v' doesn't exist", membership.Slug)
+		}
+		membership.Member = membership.AddedAt != nil && membership.RemovedAt == nil
+		res = append(res, membership)
+	}
+	if err = rows.Err(); err != nil {
+		log.Error("error occurred while reading", logger.Err(err))
+		return res, fmt.Errorf("error occurred while reading")
+	}
+	return res, nil
+}
+
+func (s *SQLiteDB) AddUser(ctx context.Context, user User, log *slog.Logger) (_ uint64, err error) {
+	ctx, done := s.queryContext(ctx)
+	defer done(&err)
+	var id uint64
+	if err := s.Ping(ctx); err != nil {
+		log.Error("failed to ping db", logger.Err(err))
+		return id, newError(ErrUnavailable, "failed to ping db")
+	}
+	query := `insert into users (user_id) values (?) returning "id"`
+	if err := s.DB.QueryRowContext(ctx, query, user.UID).Scan(&id); err != nil {
+		if isUniqueViolation(err) {
+			log.Error("user already exists", logger.Err(err))
+			return id, newError(ErrAlreadyExists, "user '%v' already exists", user.UID)
+		}
+		log.Error("failed to insert data", logger.Err(err))
+		return id, fmt.Errorf("failed to insert data")
+	}
+	return id, nil
+}
+
+func (s *SQLiteDB) AddSegment(ctx context.Context, segment Segment, log *slog.Logger) (_ uint64, err error) {
+	ctx, done := s.queryContext(ctx)
+	defer done(&err)
+	var id uint64
+	if err := s.Ping(ctx); err != nil {
+		log.Error("failed to ping db", logger.Err(err))
+		return id, newError(ErrUnavailable, "failed to ping db")
+	}
+	query := `insert into segments (slug, owner_team) values (?, nullif(?, '')) returning "id"`
+	if err := s.DB.QueryRowContext(ctx, query, segment.Slug, segment.OwnerTeam).Scan(&id); err != nil {
+		if isUniqueViolation(err) {
+			log.Error("segment already exists", logger.Err(err))
+			return id, newError(ErrAlreadyExists, "segment '%v' already exists", segment.Slug)
+		}
+		log.Error("failed to insert data", logger.Err(err))
+		return id, fmt.Errorf("failed to insert data")
+	}
+	return id, nil
+}
+
+// CascadeDeleteSegment deletes the segment with all its memberships and records a removal event for each member,
+// like PostgresDB.CascadeDeleteSegment.
+func (s *SQLiteDB) CascadeDeleteSegment(ctx context.Context, segment Segment, log *slog.Logger) (err error) {
+	ctx, done := s.queryContext(ctx)
+	defer done(&err)
+	return s.withTx(ctx, log, func(tx *sql.Tx) error {
+		var id uint64
+		// A segment of another team is refused before anything is deleted.
+		queryGet := `select id from segments where slug = ?1 and (?2 = '' or owner_team = ?2)`
+		queryOwner := `select coalesce(owner_team, '') from segments where slug = ?`
+		queryMembers := `select u.user_id
+						 from user_segments us
+						 join users u on u.id = us.user_id
+						 where us.segment_id = ? and us.deleted_at is null
+						 order by u.user_id`
+		queryDelete := `delete from segments where id = ?`
+		if err := tx.QueryRowContext(ctx, queryGet, segment.Slug, segment.OwnerTeam).Scan(&id); err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				log.Error("failed to get segment", logger.Err(err))
+				return fmt.Errorf("failed to get segment")
+			}
+			var owner string
+			err = tx.QueryRowContext(ctx, queryOwner, segment.Slug).Scan(&owner)
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				log.Error("failed to get segment owner", logger.Err(err))
+				return fmt.Errorf("failed to get segment owner")
+			}
+			return segmentDeleteRefused(segment.Slug, err == nil, owner, segment.OwnerTeam, log)
+		}
+		members, err := sqliteUserIDs(ctx, tx, queryMembers, id)
+		if err != nil {
+			log.Error("failed to get segment members", logger.Err(err))
+			return fmt.Errorf("failed to get segment members")
+		}
+		if _, err = tx.ExecContext(ctx, queryDelete, id); err != nil {
+			log.Error("failed to delete segment", logger.Err(err))
+			return fmt.Errorf("failed to delete segment")
+		}
+		for _, userID := range members {
+			if err := sqliteRecordEvent(ctx, tx, EventMembershipRemoved, userID, segment.Slug, log); err != nil {
+				return err
+			}
+		}
+		return sqliteRecordEvent(ctx, tx, EventSegmentDeleted, 0, segment.Slug, log)
+	})
+}
+
+// ReserveIdempotencyKey claims key for a new request. If the key was already claimed within ttl
+// it returns the existing record and false instead. A key older than ttl, or without a response and older
+// than lease, is taken over, so a request that never saved its response can be retried.
+func (s *SQLiteDB) ReserveIdempotencyKey(ctx context.Context, key IdempotencyKey, ttl, lease time.Duration, log *slog.Logger) (_ IdempotencyRecord, _ bool, err error) {
+	ctx, done := s.queryContext(ctx)
+	defer done(&err)
+	var record IdempotencyRecord
+	var reserved bool
+	token, err := newIdempotencyToken(log)
+	if err != nil {
+		return record, reserved, err
+	}
+	err = s.withTx(ctx, log, func(tx *sql.Tx) error {
+		queryReserve := `insert into idempotency_keys (caller, key, request_hash, token, created_at)
+						 values (?1, ?2, ?3, ?4, ?5)
+						 on conflict (caller, key) do update
+						 set request_hash = excluded.request_hash, token = excluded.token, created_at = excluded.created_at,
+							 status_code = NULL, content_type = NULL, response_header = NULL, response_body = NULL
+						 where idempotency_keys.created_at < ?6
+							or (idempotency_keys.status_code is null and idempotency_keys.created_at < ?7)`
+		queryGet := `select request_hash, status_code, content_type, response_header, response_body
+					 from idempotency_keys
+					 where caller = ? and key = ?`
+		now := time.Now()
+		if res, err := tx.ExecContext(ctx, queryReserve, key.Caller, key.Key, key.RequestHash, token, sqliteTime(now),
+			sqliteTime(now.Add(-ttl)), sqliteTime(now.Add(-lease))); err != nil {
+			log.Error("failed to reserve idempotency key", logger.Err(err))
+			return fmt.Errorf("failed to reserve idempotency key")
+		} else if n, _ := res.RowsAffected(); n == 1 {
+			reserved = true
+			record.Token = token
+			return nil
+		}
+		var statusCode *int
+		var contentType, header *string
+		var body []byte
+		if err := tx.QueryRowContext(ctx, queryGet, key.Caller, key.Key).Scan(&record.RequestHash, &statusCode, &contentType, &header, &body); err != nil {
+			log.Error("failed to get idempotency key", logger.Err(err))
+			return fmt.Errorf("failed to get idempotency key")
+		}
+		if statusCode != nil {
+			record.Response = &IdempotentResponse{
+				StatusCode: *statusCode,
+				Body:       body,
+			}
+			if contentType != nil {
+				record.Response.ContentType = *contentType
+			}
+			if header != nil {
+				var err error
+				if record.Response.Header, err = decodeResponseHeader([]byte(*header)); err != nil {
+					log.Error("failed to decode idempotent response header", logger.Err(err))
+					return fmt.Errorf("failed to decode idempotent response header")
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return record, reserved, err
+	}
+	return record, reserved, nil
+}
+
+// SaveIdempotentResponse stores the response of the request holding the reservation token of key.
+// Nothing is stored if the key was taken over by another request in the meantime.
+func (s *SQLiteDB) SaveIdempotentResponse(ctx context.Context, key IdempotencyKey, token string, response IdempotentResponse, log *slog.Logger) (err error) {
+	ctx, done := s.queryContext(ctx)
+	defer done(&err)
+	raw, err := encodeResponseHeader(response.Header)
+	if err != nil {
+		log.Error("failed to encode idempotent response header", logger.Err(err))
+		return fmt.Errorf("failed to encode idempotent response header")
+	}
+	var header *string
+	if raw != nil {
+		encoded := string(raw)
+		header = &encoded
+	}
+	query := `update idempotency_keys
+			  set status_code = ?, content_type = ?, response_header = ?, response_body = ?
+			  where caller = ? and key = ? and token = ?`
+	res, err := s.DB.ExecContext(ctx, query, response.StatusCode, response.ContentType, header, response.Body, key.Caller, key.Key, token)
+	if err != nil {
+		log.Error("failed to save idempotent response", logger.Err(err))
+		return fmt.Errorf("failed to save idempotent response")
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		log.Warn("idempotency key was taken over by another request, response not saved")
+	}
+	return nil
+}
+
+// ReleaseIdempotencyKey forgets key if it is still reserved with token, so the request can be retried with it.
+func (s *SQLiteDB) ReleaseIdempotencyKey(ctx context.Context, key IdempotencyKey, token string, log *slog.Logger) (err error) {
+	ctx, done := s.queryContext(ctx)
+	defer done(&err)
+	query := `delete from idempotency_keys where caller = ? and key = ? and token = ?`
+	if _, err := s.DB.ExecContext(ctx, query, key.Caller, key.Key, token); err != nil {
+		log.Error("failed to release idempotency key", logger.Err(err))
+		return fmt.Errorf("failed to release idempotency key")
+	}
+	return nil
+}
+
+// PruneIdempotencyKeys deletes keys older than ttl, and keys without a response older than lease.
+func (s *SQLiteDB) PruneIdempotencyKeys(ctx context.Context, ttl, lease time.Duration, log *slog.Logger) (_ int64, err error) {
+	ctx, done := s.queryContext(ctx)
+	defer done(&err)
+	now := time.Now()
+	query := `delete from idempotency_keys where created_at < ? or (status_code is null and created_at < ?)`
+	res, err := s.DB.ExecContext(ctx, query, sqliteTime(now.Add(-ttl)), sqliteTime(now.Add(-lease)))
+	if err != nil {
+		log.Error("failed to prune idempotency keys", logger.Err(err))
+		return 0, fmt.Errorf("failed to prune idempotency keys")
+	}
+	pruned, _ := res.RowsAffected()
+	return pruned, nil
+}
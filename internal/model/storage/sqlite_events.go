@@ -0,0 +1,351 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/vlasashk/user-segmentation/internal/model/logger"
+	"log/slog"
+	"time"
+)
+
+// sqliteRecordEvent writes an event to the outbox and queues its webhook deliveries in the transaction making the change.
+func sqliteRecordEvent(ctx context.Context, tx *sql.Tx, eventType string, userID uint64, slug string, log *slog.Logger) error {
+	event, payload, err := newEvent(eventType, userID, slug, log)
+	if err != nil {
+		return err
+	}
+	now := sqliteNow()
+	query := `insert into outbox (event_id, type, user_id, segment, payload, created_at) values (?, ?, nullif(?, 0), ?, ?, ?)`
+	if _, err = tx.ExecContext(ctx, query, event.ID, event.Type, event.UserID, event.Segment, string(payload), now); err != nil {
+		log.Error("failed to record event", logger.Err(err))
+		return fmt.Errorf("failed to record event")
+	}
+	if eventType == EventSegmentDeleted {
+		return nil
+	}
+	queryEnqueue := `insert into webhook_deliveries (subscription_id, event_id, payload, next_attempt_at, created_at)
+					 select id, ?1, ?2, ?5, ?5
+					 from webhook_subscriptions
+					 where (events = '[]' or ?3 in (select value from json_each(events)))
+					   and (segments = '[]' or ?4 in (select value from json_each(segments)))`
+	if _, err = tx.ExecContext(ctx, queryEnqueue, event.ID, string(payload), event.Type, event.Segment, now); err != nil {
+		log.Error("failed to enqueue webhook deliveries", logger.Err(err))
+		return fmt.Errorf("failed to enqueue webhook deliveries")
+	}
+	return nil
+}
+
+// PublishOutbox passes up to limit unpublished events, oldest first, to publish and marks them published
+// if it succeeds. If publish fails or the process dies before the events are marked, they are published again later.
+// The events aren't locked while they are published, so only one relay may use the database.
+func (s *SQLiteDB) PublishOutbox(ctx context.Context, limit int, publish func(context.Context, []OutboxEvent) error, log *slog.Logger) (_ int, err error) {
+	ctx, done := s.queryContext(ctx)
+	defer done(&err)
+	querySelect := `select id, payload from outbox where published_at is null order by id limit ?`
+	events, err := s.queryEvents(ctx, log, querySelect, limit)
+	if err != nil || len(events) == 0 {
+		return 0, err
+	}
+	if err = publish(ctx, events); err != nil {
+		log.Error("failed to publish outbox events", logger.Err(err))
+		return 0, fmt.Errorf("failed to publish outbox events: %w", err)
+	}
+	ids := make([]uint64, 0, len(events))
+	for _, event := range events {
+		ids = append(ids, event.Seq)
+	}
+	queryMark := `update outbox set published_at = ? where id in (select value from json_each(?))`
+	if _, err = s.DB.ExecContext(ctx, queryMark, sqliteNow(), sqliteArray(ids)); err != nil {
+		log.Error("failed to mark outbox events published", logger.Err(err))
+		return 0, fmt.Errorf("failed to mark outbox events published")
+	}
+	return len(events), nil
+}
+
+// PruneOutbox deletes published events recorded before the given time. Unpublished events are only deleted
+// if unpublished is set, otherwise they are kept until the relay published them.
+func (s *SQLiteDB) PruneOutbox(ctx context.Context, before time.Time, unpublished bool, log *slog.Logger) (_ int64, err error) {
+	ctx, done := s.queryContext(ctx)
+	defer done(&err)
+	query := `delete from outbox where created_at < ? and (? or published_at is not null)`
+	res, err := s.DB.ExecContext(ctx, query, sqliteTime(before), unpublished)
+	if err != nil {
+		log.Error("failed to prune outbox", logger.Err(err))
+		return 0, fmt.Errorf("failed to prune outbox")
+	}
+	pruned, _ := res.RowsAffected()
+	return pruned, nil
+}
+
+// GetEvents returns up to filter.Limit recorded events following the event filter.After.
+func (s *SQLiteDB) GetEvents(ctx context.Context, filter EventFilter, log *slog.Logger) (_ []OutboxEvent, err error) {
+	ctx, done := s.queryContext(ctx)
+	defer done(&err)
+	query := `select id, payload from outbox
+			  where id > ?1
+				and (?2 = 0 or user_id = ?2)
+				and (?3 = '' or segment = ?3)
+			  order by id
+			  limit ?4`
+	return s.queryEvents(ctx, log, query, filter.After, filter.UserID, filter.Segment, filter.Limit)
+}
+
+// GetLastEventSeq returns the Seq of the latest recorded event, 0 if there is none.
+func (s *SQLiteDB) GetLastEventSeq(ctx context.Context, log *slog.Logger) (_ uint64, err error) {
+	ctx, done := s.queryContext(ctx)
+	defer done(&err)
+	var seq uint64
+	if err := s.Ping(ctx); err != nil {
+		log.Error("failed to ping db", logger.Err(err))
+		return seq, newError(ErrUnavailable, "failed to ping db")
+	}
+	if err := s.DB.QueryRowContext(ctx, `select coalesce(max(id), 0) from outbox`).Scan(&seq); err != nil {
+		log.Error("failed to get last event", logger.Err(err))
+		return seq, fmt.Errorf("failed to get last event")
+	}
+	return seq, nil
+}
+
+// queryEvents runs a query selecting the id and payload of outbox events.
+func (s *SQLiteDB) queryEvents(ctx context.Context, log *slog.Logger, query string, args ...any) ([]OutboxEvent, error) {
+	res := make([]OutboxEvent, 0)
+	rows, err := s.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		log.Error("failed to get events", logger.Err(err))
+		return res, fmt.Errorf("failed to get events")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var event OutboxEvent
+		var payload string
+		if err = rows.Scan(&event.Seq, &payload); err != nil {
+			log.Error("failed to scan event", logger.Err(err))
+			return res, fmt.Errorf("failed to scan event")
+		}
+		if err = json.Unmarshal([]byte(payload), &event.Event); err != nil {
+			log.Error("failed to decode event", logger.Err(err))
+			return res, fmt.Errorf("failed to decode event")
+		}
+		res = append(res, event)
+	}
+	if err = rows.Err(); err != nil {
+		log.Error("error occurred while reading", logger.Err(err))
+		return res, fmt.Errorf("error occurred while reading")
+	}
+	return res, nil
+}
+
+func (s *SQLiteDB) AddWebhookSubscription(ctx context.Context, subscription WebhookSubscription, log *slog.Logger) (_ WebhookSubscription, err error) {
+	ctx, done := s.queryContext(ctx)
+	defer done(&err)
+	if err := s.Ping(ctx); err != nil {
+		log.Error("failed to ping db", logger.Err(err))
+		return subscription, newError(ErrUnavailable, "failed to ping db")
+	}
+	if subscription.Events == nil {
+		subscription.Events = []string{}
+	}
+	if subscription.Segments == nil {
+		subscription.Segments = []string{}
+	}
+	query := `insert into webhook_subscriptions (url, secret, events, segments, created_at)
+			  values (?, ?, ?, ?, ?)
+			  returning id, created_at`
+	if err := s.DB.QueryRowContext(ctx, query, subscription.URL, subscription.Secret,
+		sqliteArray(subscription.Events), sqliteArray(subscription.Segments), sqliteNow()).
+		Scan(&subscription.Id, &subscription.CreatedAt); err != nil {
+		log.Error("failed to insert data", logger.Err(err))
+		return subscription, fmt.Errorf("failed to insert data")
+	}
+	return subscription, nil
+}
+
+// GetWebhookSubscriptions lists all subscriptions without their secrets.
+func (s *SQLiteDB) GetWebhookSubscriptions(ctx context.Context, log *slog.Logger) (_ []WebhookSubscription, err error) {
+	ctx, done := s.queryContext(ctx)
+	defer done(&err)
+	res := make([]WebhookSubscription, 0)
+	if err := s.Ping(ctx); err != nil {
+		log.Error("failed to ping db", logger.Err(err))
+		return res, newError(ErrUnavailable, "failed to ping db")
+	}
+	query := `select id, url, events, segments, created_at from webhook_subscriptions order by id`
+	rows, err := s.DB.QueryContext(ctx, query)
+	if err != nil {
+		log.Error("failed to get data", logger.Err(err))
+		return res, fmt.Errorf("failed to get data")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var subscription WebhookSubscription
+		var events, segments string
+		if err = rows.Scan(&subscription.Id, &subscription.URL, &events, &segments, &subscription.CreatedAt); err != nil {
+			log.Error("failed to scan subscription", logger.Err(err))
+			return res, fmt.Errorf("failed to scan subscription")
+		}
+		if err = json.Unmarshal([]byte(events), &subscription.Events); err == nil {
+			err = json.Unmarshal([]byte(segments), &subscription.Segments)
+		}
+		if err != nil {
+			log.Error("failed to decode subscription filters", logger.Err(err))
+			return res, fmt.Errorf("failed to decode subscription filters")
+		}
+		res = append(res, subscription)
+	}
+	if err = rows.Err(); err != nil {
+		log.Error("error occurred while reading", logger.Err(err))
+		return res, fmt.Errorf("error occurred while reading")
+	}
+	return res, nil
+}
+
+// DeleteWebhookSubscription removes a subscription together with its pending deliveries and dead letters.
+func (s *SQLiteDB) DeleteWebhookSubscription(ctx context.Context, id uint64, log *slog.Logger) (err error) {
+	ctx, done := s.queryContext(ctx)
+	defer done(&err)
+	if err := s.Ping(ctx); err != nil {
+		log.Error("failed to ping db", logger.Err(err))
+		return newError(ErrUnavailable, "failed to ping db")
+	}
+	query := `delete from webhook_subscriptions where id = ?`
+	res, err := s.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		log.Error("failed to delete subscription", logger.Err(err))
+		return fmt.Errorf("failed to delete subscription")
+	}
+	if n, _ := res.RowsAffected(); n < 1 {
+		log.Error(fmt.Sprintf("webhook subscription '%d' doesn't exist", id))
+		return newError(ErrNotFound, "webhook subscription '%d' doesn't exist", id)
+	}
+	return nil
+}
+
+// GetWebhookDeadLetters lists deliveries to the subscription that were given up, the most recent first.
+func (s *SQLiteDB) GetWebhookDeadLetters(ctx context.Context, subscriptionID uint64, log *slog.Logger) (_ []WebhookDeadLetter, err error) {
+	ctx, done := s.queryContext(ctx)
+	defer done(&err)
+	res := make([]WebhookDeadLetter, 0)
+	if err := s.Ping(ctx); err != nil {
+		log.Error("failed to ping db", logger.Err(err))
+		return res, newError(ErrUnavailable, "failed to ping db")
+	}
+	queryCheck := `select id from webhook_subscriptions where id = ?`
+	query := `select id, subscription_id, event_id, payload, attempts, coalesce(last_error, ''), failed_at
+			  from webhook_dead_letters
+			  where subscription_id = ?
+			  order by failed_at desc
+			  limit 1000`
+	if err := s.DB.QueryRowContext(ctx, queryCheck, subscriptionID).Scan(&subscriptionID); err != nil {
+		log.Error(fmt.Sprintf("webhook subscription '%d' doesn't exist", subscriptionID), logger.Err(err))
+		return res, newError(ErrNotFound, "webhook subscription '%d' doesn't exist", subscriptionID)
+	}
+	rows, err := s.DB.QueryContext(ctx, query, subscriptionID)
+	if err != nil {
+		log.Error("failed to get data", logger.Err(err))
+		return res, fmt.Errorf("failed to get data")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var letter WebhookDeadLetter
+		var payload string
+		if err = rows.Scan(&letter.Id, &letter.SubscriptionID, &letter.EventID, &payload, &letter.Attempts, &letter.LastError, &letter.FailedAt); err != nil {
+			log.Error("failed to scan dead letter", logger.Err(err))
+			return res, fmt.Errorf("failed to scan dead letter")
+		}
+		letter.Payload = json.RawMessage(payload)
+		res = append(res, letter)
+	}
+	if err = rows.Err(); err != nil {
+		log.Error("error occurred while reading", logger.Err(err))
+		return res, fmt.Errorf("error occurred while reading")
+	}
+	return res, nil
+}
+
+// ClaimWebhookDeliveries takes up to limit deliveries that are due and hides them from other workers for lease,
+// so a delivery whose worker died is retried once the lease runs out. Attempts of the returned deliveries
+// already include the attempt being made.
+func (s *SQLiteDB) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration, log *slog.Logger) (_ []WebhookDelivery, err error) {
+	ctx, done := s.queryContext(ctx)
+	defer done(&err)
+	var res []WebhookDelivery
+	now := time.Now()
+	query := `update webhook_deliveries
+			  set attempts = attempts + 1, next_attempt_at = ?1
+			  where id in (select id from webhook_deliveries
+						   where next_attempt_at <= ?2
+						   order by next_attempt_at
+						   limit ?3)
+			  returning id, subscription_id,
+				  (select url from webhook_subscriptions s where s.id = subscription_id),
+				  (select secret from webhook_subscriptions s where s.id = subscription_id),
+				  event_id, payload, attempts`
+	rows, err := s.DB.QueryContext(ctx, query, sqliteTime(now.Add(lease)), sqliteTime(now), limit)
+	if err != nil {
+		log.Error("failed to claim webhook deliveries", logger.Err(err))
+		return res, fmt.Errorf("failed to claim webhook deliveries")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var delivery WebhookDelivery
+		var payload string
+		if err = rows.Scan(&delivery.Id, &delivery.SubscriptionID, &delivery.URL, &delivery.Secret,
+			&delivery.EventID, &payload, &delivery.Attempts); err != nil {
+			log.Error("failed to scan webhook delivery", logger.Err(err))
+			return res, fmt.Errorf("failed to scan webhook delivery")
+		}
+		delivery.Payload = []byte(payload)
+		res = append(res, delivery)
+	}
+	if err = rows.Err(); err != nil {
+		log.Error("error occurred while reading", logger.Err(err))
+		return res, fmt.Errorf("error occurred while reading")
+	}
+	return res, nil
+}
+
+// CompleteWebhookDelivery forgets a delivery accepted by the subscriber.
+func (s *SQLiteDB) CompleteWebhookDelivery(ctx context.Context, id uint64, log *slog.Logger) (err error) {
+	ctx, done := s.queryContext(ctx)
+	defer done(&err)
+	query := `delete from webhook_deliveries where id = ?`
+	if _, err := s.DB.ExecContext(ctx, query, id); err != nil {
+		log.Error("failed to complete webhook delivery", logger.Err(err))
+		return fmt.Errorf("failed to complete webhook delivery")
+	}
+	return nil
+}
+
+// RetryWebhookDelivery schedules the next attempt of a failed delivery.
+func (s *SQLiteDB) RetryWebhookDelivery(ctx context.Context, id uint64, next time.Time, lastError string, log *slog.Logger) (err error) {
+	ctx, done := s.queryContext(ctx)
+	defer done(&err)
+	query := `update webhook_deliveries set next_attempt_at = ?, last_error = ? where id = ?`
+	if _, err := s.DB.ExecContext(ctx, query, sqliteTime(next), lastError, id); err != nil {
+		log.Error("failed to reschedule webhook delivery", logger.Err(err))
+		return fmt.Errorf("failed to reschedule webhook delivery")
+	}
+	return nil
+}
+
+// DeadLetterWebhookDelivery moves a delivery that ran out of attempts to the dead letter table.
+func (s *SQLiteDB) DeadLetterWebhookDelivery(ctx context.Context, id uint64, lastError string, log *slog.Logger) (err error) {
+	ctx, done := s.queryContext(ctx)
+	defer done(&err)
+	return s.withTx(ctx, log, func(tx *sql.Tx) error {
+		queryMove := `insert into webhook_dead_letters (subscription_id, event_id, payload, attempts, last_error, failed_at)
+					  select subscription_id, event_id, payload, attempts, ?, ? from webhook_deliveries where id = ?`
+		queryDelete := `delete from webhook_deliveries where id = ?`
+		if _, err := tx.ExecContext(ctx, queryMove, lastError, sqliteNow(), id); err != nil {
+			log.Error("failed to dead letter webhook delivery", logger.Err(err))
+			return fmt.Errorf("failed to dead letter webhook delivery")
+		}
+		if _, err := tx.ExecContext(ctx, queryDelete, id); err != nil {
+			log.Error("failed to dead letter webhook delivery", logger.Err(err))
+			return fmt.Errorf("failed to dead letter webhook delivery")
+		}
+		return nil
+	})
+}
@@ -0,0 +1,21 @@
+package storage_test
+
+import (
+	"context"
+	"github.com/vlasashk/user-segmentation/internal/model/storage"
+	"github.com/vlasashk/user-segmentation/internal/model/storage/storagetest"
+	"path/filepath"
+	"testing"
+)
+
+func TestSQLiteDB(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storagetest.Store {
+		t.Setenv("SQLITE_PATH", filepath.Join(t.TempDir(), "segmentation.db"))
+		db, err := storage.NewSQLite(context.Background())
+		if err != nil {
+			t.Fatalf("failed to open sqlite: %v", err)
+		}
+		t.Cleanup(db.Close)
+		return db
+	})
+}
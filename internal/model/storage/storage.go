@@ -3,41 +3,91 @@ package storage
 import (
 	"context"
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"github.com/jackc/pgx/v5"
-	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/vlasashk/user-segmentation/internal/model/logger"
 	"log/slog"
+	"math"
 	"os"
 	"time"
 )
 
+const (
+	// MinUserID and MaxUserID bound user IDs to the positive range of the BIGINT column.
+	MinUserID = 1
+	MaxUserID = math.MaxInt64
+	// MaxSlugLength is the longest allowed segment slug.
+	MaxSlugLength = 64
+	// MaxSegmentsPerRequest limits how many segments can be added or removed in one request,
+	// it has to match the max rule of UserSegments.SegmentSlug.
+	MaxSegmentsPerRequest = 100
+	// MaxUsersPerRequest limits how many users can be looked up in one batch request,
+	// it has to match the max rule of UsersBatch.UserIDs.
+	MaxUsersPerRequest = 100
+)
+
 type User struct {
 	Id  uint64 `json:"id,omitempty"`
-	UID uint64 `json:"user_id" validate:"required"`
+	UID uint64 `json:"user_id" validate:"user_id"`
 }
 
 type Segment struct {
-	Id   uint64 `json:"id,omitempty"`
-	Slug string `json:"slug" validate:"required"`
+	Id        uint64 `json:"id,omitempty"`
+	Slug      string `json:"slug" validate:"slug"`
+	OwnerTeam string `json:"owner_team,omitempty" validate:"omitempty,max=255"`
 }
 
 type UserSegments struct {
-	UserID      uint64   `json:"user_id" validate:"required"`
-	SegmentSlug []string `json:"segment_slug" validate:"required"`
+	UserID      uint64   `json:"user_id" validate:"user_id"`
+	SegmentSlug []string `json:"segment_slug" validate:"required,min=1,max=100,unique,dive,slug"`
+	// OwnerTeam restricts the change to segments owned by the team, any segment may be changed if it's empty.
+	OwnerTeam string `json:"-"`
+}
+
+type UsersBatch struct {
+	UserIDs []uint64 `json:"user_ids" validate:"required,min=1,max=100,unique,dive,user_id"`
+}
+
+// Membership tells whether a user is a member of a segment. AddedAt is set if the user was ever added
+// to the segment and RemovedAt if the user was removed from it since.
+type Membership struct {
+	Slug      string     `json:"slug"`
+	Member    bool       `json:"member"`
+	AddedAt   *time.Time `json:"added_at,omitempty"`
+	RemovedAt *time.Time `json:"removed_at,omitempty"`
+}
+
+// Outcomes of adding a user to one of the segments of a request.
+const (
+	// OutcomeAdded means the user was added to the segment.
+	OutcomeAdded = "added"
+	// OutcomeNotFound means the segment doesn't exist.
+	OutcomeNotFound = "not_found"
+	// OutcomeAlreadyMember means the user is already part of the segment.
+	OutcomeAlreadyMember = "already_member"
+	// OutcomeAborted means the user could be added to the segment, but wasn't because of the other segments.
+	OutcomeAborted = "aborted"
+)
+
+// SegmentOutcome tells what happened to one of the segments the user was added to.
+type SegmentOutcome struct {
+	Slug    string `json:"slug"`
+	Outcome string `json:"outcome"`
 }
 
 type CsvReport struct {
-	Year  uint       `json:"year" validate:"required"`
-	Month time.Month `json:"month" validate:"required"`
+	Year  uint       `json:"year" validate:"required,min=2000,max=9999"`
+	Month time.Month `json:"month" validate:"required,min=1,max=12"`
 }
 
-func (pg *PostgresDB) CsvHistoryReport(ctx context.Context, csvDates CsvReport, log *slog.Logger) error {
-	err := pg.DB.AcquireFunc(context.Background(), func(conn *pgxpool.Conn) error {
+func (pg *PostgresDB) CsvHistoryReport(ctx context.Context, csvDates CsvReport, log *slog.Logger) (string, error) {
+	var reportID string
+	err := pg.acquire(ctx, func(ctx context.Context, conn *pgxpool.Conn) (err error) {
 		if err := pg.Ping(ctx); err != nil {
 			log.Error("failed to ping db", logger.Err(err))
-			return fmt.Errorf("failed to ping db")
+			return newError(ErrUnavailable, "failed to ping db")
 		}
 		startDate := time.Date(int(csvDates.Year), csvDates.Month, 0, 0, 0, 0, 0, time.Local)
 		endDate := startDate.AddDate(0, 1, 0)
@@ -53,42 +103,65 @@ func (pg *PostgresDB) CsvHistoryReport(ctx context.Context, csvDates CsvReport,
 					JOIN users u on u.id = us.user_id
 					WHERE (deleted_at BETWEEN $1 AND $2)
 					ORDER BY user_id, segment, status;`
-		var file *os.File
-		reportPath := fmt.Sprintf("%s%s_%d_%d.csv", os.Getenv("CSV_PATH"), "report", csvDates.Year, csvDates.Month)
-		if err := os.Mkdir(os.Getenv("CSV_PATH"), 0755); err != nil && !os.IsExist(err) {
-			log.Error("failed to create directory", logger.Err(err))
-			return fmt.Errorf("failed to create directory")
-		}
-		if fileTemp, err := os.Create(reportPath); err != nil {
-			log.Error("failed to create file", logger.Err(err))
-			return fmt.Errorf("failed to create file")
-		} else {
-			file = fileTemp
-		}
-		defer func(file *os.File) {
-			_ = file.Close()
-		}(file)
-
-		if rows, err := conn.Query(ctx, query, startDate, endDate); err != nil {
+		rows, err := conn.Query(ctx, query, startDate, endDate)
+		if err != nil {
 			log.Error("failed to execute query", logger.Err(err))
 			return fmt.Errorf("failed to execute query")
-		} else {
-			defer rows.Close()
-			if err = writeCsv(file, rows, log); err != nil {
-				return err
-			}
 		}
-		return nil
+		defer rows.Close()
+		id, file, err := createReport(log)
+		if err != nil {
+			return err
+		}
+		defer closeReport(file, &err, log)
+		reportID = id
+		return writeCsv(file, rows, log)
 	})
 	if err != nil {
-		return err
+		return "", err
 	}
-	return nil
+	return reportID, nil
 }
 
-func writeCsv(file *os.File, rows pgx.Rows, log *slog.Logger) error {
+// createReport creates an empty report file with a new id in CSV_PATH.
+func createReport(log *slog.Logger) (string, *os.File, error) {
+	reportID, err := NewReportID()
+	if err != nil {
+		log.Error("failed to generate report id", logger.Err(err))
+		return "", nil, fmt.Errorf("failed to generate report id")
+	}
+	if err = os.MkdirAll(os.Getenv("CSV_PATH"), 0750); err != nil {
+		log.Error("failed to create directory", logger.Err(err))
+		return "", nil, fmt.Errorf("failed to create directory")
+	}
+	file, err := os.OpenFile(ReportPath(os.Getenv("CSV_PATH"), reportID), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		log.Error("failed to create file", logger.Err(err))
+		return "", nil, fmt.Errorf("failed to create file")
+	}
+	return reportID, file, nil
+}
+
+// closeReport closes the report file and removes it if writing the report failed with *err,
+// so no incomplete report is left behind.
+func closeReport(file *os.File, err *error, log *slog.Logger) {
+	_ = file.Close()
+	if *err == nil {
+		return
+	}
+	if removeErr := os.Remove(file.Name()); removeErr != nil {
+		log.Error("failed to remove incomplete report", logger.Err(removeErr))
+	}
+}
+
+func newCsvWriter(file *os.File) *csv.Writer {
 	writer := csv.NewWriter(file)
 	writer.Comma = ';'
+	return writer
+}
+
+func writeCsv(file *os.File, rows pgx.Rows, log *slog.Logger) error {
+	writer := newCsvWriter(file)
 	defer writer.Flush()
 	for rows.Next() {
 		var userId, segmentId, status string
@@ -112,16 +185,16 @@ func writeCsv(file *os.File, rows pgx.Rows, log *slog.Logger) error {
 func (pg *PostgresDB) GetSegmentUsersInfo(ctx context.Context, segment Segment, log *slog.Logger) ([]uint64, error) {
 	var id uint64
 	var res []uint64
-	err := pg.DB.AcquireFunc(context.Background(), func(conn *pgxpool.Conn) error {
+	err := pg.acquire(ctx, func(ctx context.Context, conn *pgxpool.Conn) error {
 		if err := pg.Ping(ctx); err != nil {
 			log.Error("failed to ping db", logger.Err(err))
-			return fmt.Errorf("failed to ping db")
+			return newError(ErrUnavailable, "failed to ping db")
 		}
 		queryCheckUser := `select id from segments where slug = $1`
 		query := `select u.user_id from user_segments us join users u on u.id = us.user_id where segment_id = $1 and deleted_at is null`
 		if err := conn.QueryRow(ctx, queryCheckUser, segment.Slug).Scan(&id); err != nil {
 			log.Error(fmt.Sprintf("segment '%v' doesn't exist", segment.Slug), logger.Err(err))
-			return fmt.Errorf("segment '%v' doesn't exist", segment.Slug)
+			return newError(ErrNotFound, "segment '%v' doesn't exist", segment.Slug)
 		}
 		if rows, err := conn.Query(ctx, query, id); err != nil {
 			log.Error("failed to get data", logger.Err(err))
@@ -149,57 +222,43 @@ func (pg *PostgresDB) GetSegmentUsersInfo(ctx context.Context, segment Segment,
 	return res, nil
 }
 
+// DeleteUserFromSegments removes the user from all the segments or, if any of them doesn't exist
+// or the user isn't part of it, from none of them.
 func (pg *PostgresDB) DeleteUserFromSegments(ctx context.Context, userSegment UserSegments, log *slog.Logger) error {
-	var id, segmentID uint64
-	err := pg.DB.AcquireFunc(context.Background(), func(conn *pgxpool.Conn) error {
-		if err := pg.Ping(ctx); err != nil {
-			log.Error("failed to ping db", logger.Err(err))
-			return fmt.Errorf("failed to ping db")
-		}
-		queryCheckUser := `select id from users where user_id = $1`
-		queryCheckSegment := `select id from segments where slug = $1`
-		query := `update user_segments us
+	err := pg.inTx(ctx, pgx.ReadCommitted, log, func(ctx context.Context, tx pgx.Tx) error {
+		query := `update user_segments
 				  set deleted_at = NOW()
-				  where segment_id in (select id from segments where slug = $1)
-  					and us.user_id = $2
-  					and deleted_at is null;`
-		if err := conn.QueryRow(ctx, queryCheckUser, userSegment.UserID).Scan(&id); err != nil {
-			log.Error(fmt.Sprintf("user '%v' doesn't exist", userSegment.UserID), logger.Err(err))
-			return fmt.Errorf("user '%v' doesn't exist", userSegment.UserID)
-		}
-		for i := 0; i < len(userSegment.SegmentSlug); i++ {
-			if err := conn.QueryRow(ctx, queryCheckSegment, userSegment.SegmentSlug[i]).Scan(&segmentID); err != nil {
-				log.Error(fmt.Sprintf("segment '%v' doesn't exist", userSegment.SegmentSlug[i]), logger.Err(err))
-				return fmt.Errorf("segment '%v' doesn't exist", userSegment.SegmentSlug[i])
-			}
+				  where user_id = $1
+					and segment_id = any($2)
+					and deleted_at is null
+				  returning segment_id`
+		id, err := lockUser(ctx, tx, userSegment.UserID, log)
+		if err != nil {
+			return err
 		}
-		if tx, err := conn.Begin(ctx); err != nil {
-			log.Error("failed to begin transaction", logger.Err(err))
-			return fmt.Errorf("failed to begin transaction")
-		} else {
-			defer func(tx pgx.Tx, ctx context.Context) {
-				_ = tx.Rollback(ctx)
-			}(tx, context.Background())
-			var res pgconn.CommandTag
-			for i := 0; i < len(userSegment.SegmentSlug); i++ {
-				if res, err = conn.Exec(ctx, query, userSegment.SegmentSlug[i], id); err != nil {
-					log.Error("failed to delete data", logger.Err(err))
-					return fmt.Errorf("failed to delete data")
-				} else {
-					n := res.RowsAffected()
-					if n < 1 {
-						log.Error("failed to execute query", logger.Err(fmt.Errorf("user '%d' is not part of '%s' segment", id, userSegment.SegmentSlug[i])))
-						return fmt.Errorf(fmt.Sprintf("user '%d' is not part of '%s' segment", id, userSegment.SegmentSlug[i]))
-					}
-				}
-			}
-			err = tx.Commit(context.Background())
-			if err != nil {
-				log.Error("failed to commit transaction", logger.Err(err))
-				return fmt.Errorf("failed to commit transaction")
+		segmentIDs, err := lockSegments(ctx, tx, userSegment.SegmentSlug, userSegment.OwnerTeam, log)
+		if err != nil {
+			return err
+		}
+		if missing := missingSegments(userSegment.SegmentSlug, segmentIDs); len(missing) > 0 {
+			log.Error(fmt.Sprintf("segment '%v' doesn't exist", missing[0]))
+			return newError(ErrNotFound, "segment '%v' doesn't exist", missing[0])
+		}
+		removed, err := collectSegmentIDs(ctx, tx, query, id, segmentIDs.ids(userSegment.SegmentSlug))
+		if err != nil {
+			log.Error("failed to delete data", logger.Err(err))
+			return fmt.Errorf("failed to delete data")
+		}
+		for _, slug := range userSegment.SegmentSlug {
+			if !removed[segmentIDs[slug]] {
+				log.Error("failed to execute query", logger.Err(fmt.Errorf("user '%d' is not part of '%s' segment", userSegment.UserID, slug)))
+				return newError(ErrNotMember, "user '%d' is not part of '%s' segment", userSegment.UserID, slug)
 			}
 		}
-		return nil
+		if err = recordEvents(ctx, tx, EventMembershipRemoved, userSegment.UserID, userSegment.SegmentSlug, log); err != nil {
+			return err
+		}
+		return notifyChange(ctx, tx, Change{Kind: ChangeUser, UserID: userSegment.UserID}, log)
 	})
 	if err != nil {
 		return err
@@ -207,80 +266,210 @@ func (pg *PostgresDB) DeleteUserFromSegments(ctx context.Context, userSegment Us
 	return nil
 }
 
-func (pg *PostgresDB) AddUserToSegments(ctx context.Context, userSegment UserSegments, log *slog.Logger) error {
-	var userID, segmentID uint64
-	segmentSlice := make([]uint64, 0, len(userSegment.SegmentSlug))
-	err := pg.DB.AcquireFunc(context.Background(), func(conn *pgxpool.Conn) error {
-		if err := pg.Ping(ctx); err != nil {
-			log.Error("failed to ping db", logger.Err(err))
-			return fmt.Errorf("failed to ping db")
+// AddUserToSegments adds the user to all the segments or, if any of them doesn't exist
+// or the user is already part of it, to none of them. The outcomes are in the order of the slugs,
+// they are returned along with the error if the user wasn't added.
+func (pg *PostgresDB) AddUserToSegments(ctx context.Context, userSegment UserSegments, log *slog.Logger) ([]SegmentOutcome, error) {
+	var outcomes []SegmentOutcome
+	err := pg.inTx(ctx, pgx.ReadCommitted, log, func(ctx context.Context, tx pgx.Tx) error {
+		// Adding a removed member again restarts the membership.
+		query := `insert into user_segments (user_id, segment_id)
+				  select $1, unnest($2::bigint[])
+				  on conflict (user_id, segment_id) do update set deleted_at = NULL, created_at = NOW()
+				  where user_segments.deleted_at is not null
+				  returning segment_id`
+		id, err := lockUser(ctx, tx, userSegment.UserID, log)
+		if err != nil {
+			return err
 		}
-		queryCheckUser := `select id from users where user_id = $1`
-		queryCheckSegment := `select id from segments where slug = $1`
-		queryInsert := `insert into user_segments (user_id, segment_id)
-						values ($1, $2)
-						on conflict (user_id, segment_id) do update set deleted_at = NULL, created_at = NOW()
-						where user_segments.segment_id in (select id from segments where slug = $3)
-						  and user_segments.user_id = $1
-						  and user_segments.deleted_at is not null;`
-		if err := conn.QueryRow(ctx, queryCheckUser, userSegment.UserID).Scan(&userID); err != nil {
-			log.Error(fmt.Sprintf("user '%v' doesn't exist", userSegment.UserID), logger.Err(err))
-			return fmt.Errorf("user '%v' doesn't exist", userSegment.UserID)
-		}
-		for i := 0; i < len(userSegment.SegmentSlug); i++ {
-			if err := conn.QueryRow(ctx, queryCheckSegment, userSegment.SegmentSlug[i]).Scan(&segmentID); err != nil {
-				log.Error(fmt.Sprintf("segment '%v' doesn't exist", userSegment.SegmentSlug[i]), logger.Err(err))
-				return fmt.Errorf("segment '%v' doesn't exist", userSegment.SegmentSlug[i])
-			}
-			segmentSlice = append(segmentSlice, segmentID)
+		segmentIDs, err := lockSegments(ctx, tx, userSegment.SegmentSlug, userSegment.OwnerTeam, log)
+		if err != nil {
+			return err
 		}
-		if tx, err := conn.Begin(ctx); err != nil {
-			log.Error("failed to begin transaction", logger.Err(err))
-			return fmt.Errorf("failed to begin transaction")
-		} else {
-			defer func(tx pgx.Tx, ctx context.Context) {
-				_ = tx.Rollback(ctx)
-			}(tx, context.Background())
-			for i := 0; i < len(segmentSlice); i++ {
-				var res pgconn.CommandTag
-				if res, err = conn.Exec(ctx, queryInsert, userID, segmentSlice[i], userSegment.SegmentSlug[i]); err != nil {
-					log.Error("failed to insert data or data already exists", logger.Err(err))
-					return fmt.Errorf("failed to insert data or data already exists")
-				} else {
-					n := res.RowsAffected()
-					if n < 1 {
-						log.Error("failed to execute query", logger.Err(fmt.Errorf("user '%d' is already part of '%s' segment", userSegment.UserID, userSegment.SegmentSlug[i])))
-						return fmt.Errorf(fmt.Sprintf("user '%d' is already part of '%s' segment", userSegment.UserID, userSegment.SegmentSlug[i]))
-					}
-				}
-			}
-			err = tx.Commit(context.Background())
+		failed := make(map[string]string)
+		for _, slug := range missingSegments(userSegment.SegmentSlug, segmentIDs) {
+			failed[slug] = OutcomeNotFound
+		}
+		if len(failed) == 0 {
+			added, err := collectSegmentIDs(ctx, tx, query, id, segmentIDs.ids(userSegment.SegmentSlug))
 			if err != nil {
-				log.Error("failed to commit transaction", logger.Err(err))
-				return fmt.Errorf("failed to commit transaction")
+				log.Error("failed to insert data", logger.Err(err))
+				return fmt.Errorf("failed to insert data")
+			}
+			for _, slug := range userSegment.SegmentSlug {
+				if !added[segmentIDs[slug]] {
+					failed[slug] = OutcomeAlreadyMember
+				}
 			}
 		}
-		return nil
+		outcomes, err = segmentOutcomes(userSegment, failed, log)
+		if err != nil {
+			return err
+		}
+		if err = recordEvents(ctx, tx, EventMembershipAdded, userSegment.UserID, userSegment.SegmentSlug, log); err != nil {
+			return err
+		}
+		return notifyChange(ctx, tx, Change{Kind: ChangeUser, UserID: userSegment.UserID}, log)
 	})
 	if err != nil {
-		return err
+		return outcomes, err
 	}
-	return nil
+	return outcomes, nil
+}
+
+// segmentOutcomes reports every segment of userSegment as added unless failed has another outcome for it.
+// If any of the segments failed, the rest are reported as aborted and the first failure is returned as the error.
+func segmentOutcomes(userSegment UserSegments, failed map[string]string, log *slog.Logger) ([]SegmentOutcome, error) {
+	outcomes := make([]SegmentOutcome, 0, len(userSegment.SegmentSlug))
+	var err error
+	for _, slug := range userSegment.SegmentSlug {
+		outcome, ok := failed[slug]
+		switch {
+		case !ok && len(failed) == 0:
+			outcome = OutcomeAdded
+		case !ok:
+			outcome = OutcomeAborted
+		case err == nil && outcome == OutcomeNotFound:
+			log.Error(fmt.Sprintf("segment '%v' doesn't exist", slug))
+			err = newError(ErrNotFound, "segment '%v' doesn't exist", slug)
+		case err == nil:
+			log.Error("failed to execute query", logger.Err(fmt.Errorf("user '%d' is already part of '%s' segment", userSegment.UserID, slug)))
+			err = newError(ErrAlreadyExists, "user '%d' is already part of '%s' segment", userSegment.UserID, slug)
+		}
+		outcomes = append(outcomes, SegmentOutcome{Slug: slug, Outcome: outcome})
+	}
+	return outcomes, err
+}
+
+// lockUser returns the id of the user's row and locks it until the end of tx,
+// so concurrent changes of the user's memberships are made one after another.
+func lockUser(ctx context.Context, tx pgx.Tx, userID uint64, log *slog.Logger) (uint64, error) {
+	var id uint64
+	query := `select id from users where user_id = $1 for update`
+	if err := tx.QueryRow(ctx, query, userID).Scan(&id); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			log.Error(fmt.Sprintf("user '%v' doesn't exist", userID), logger.Err(err))
+			return id, newError(ErrNotFound, "user '%v' doesn't exist", userID)
+		}
+		log.Error("failed to get user", logger.Err(err))
+		return id, fmt.Errorf("failed to get user")
+	}
+	return id, nil
+}
+
+// checkOwner fails with ErrForbidden if ownerTeam is set and the segment isn't owned by it.
+// Segments without an owner can only be changed by callers that aren't restricted to a team.
+func checkOwner(slug, owner, ownerTeam string, log *slog.Logger) error {
+	if ownerTeam == "" || owner == ownerTeam {
+		return nil
+	}
+	log.Warn("segment owned by another team",
+		slog.String("segment", slug),
+		slog.String("owner_team", owner),
+	)
+	return newError(ErrForbidden, "segment '%s' is not owned by caller's team", slug)
+}
+
+// segmentDeleteRefused reports why a delete restricted to the segments of ownerTeam matched nothing:
+// found and owner come from a lookup of the slug alone.
+func segmentDeleteRefused(slug string, found bool, owner, ownerTeam string, log *slog.Logger) error {
+	if found {
+		if err := checkOwner(slug, owner, ownerTeam, log); err != nil {
+			return err
+		}
+		// Otherwise the segment was created again in between, after the delete missed it.
+	}
+	log.Error("failed to execute query", logger.Err(fmt.Errorf("segment '%v' is not present in database", slug)))
+	return newError(ErrNotFound, "segment '%v' is not present in database", slug)
+}
+
+// slugIDs maps slugs of segments to the ids of their rows.
+type slugIDs map[string]uint64
+
+// ids returns the ids of the slugs present in the map, in the order of slugs.
+func (s slugIDs) ids(slugs []string) []uint64 {
+	res := make([]uint64, 0, len(slugs))
+	for _, slug := range slugs {
+		if id, ok := s[slug]; ok {
+			res = append(res, id)
+		}
+	}
+	return res
+}
+
+// missingSegments returns the slugs that aren't present in found, in the order of slugs.
+func missingSegments(slugs []string, found slugIDs) []string {
+	var res []string
+	for _, slug := range slugs {
+		if _, ok := found[slug]; !ok {
+			res = append(res, slug)
+		}
+	}
+	return res
+}
+
+// lockSegments looks up the ids of the segments in one query and keeps the segments from being deleted
+// until the end of tx. Segments that don't exist are left out of the result.
+// If ownerTeam is set, it fails with ErrForbidden unless every segment found is owned by the team.
+func lockSegments(ctx context.Context, tx pgx.Tx, slugs []string, ownerTeam string, log *slog.Logger) (slugIDs, error) {
+	res := make(slugIDs, len(slugs))
+	query := `select slug, id, coalesce(owner_team, '') from segments where slug = any($1) order by id for share`
+	rows, err := tx.Query(ctx, query, slugs)
+	if err != nil {
+		log.Error("failed to get segments", logger.Err(err))
+		return res, fmt.Errorf("failed to get segments")
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var slug, owner string
+		var id uint64
+		if err = rows.Scan(&slug, &id, &owner); err != nil {
+			log.Error("failed to scan segment", logger.Err(err))
+			return res, fmt.Errorf("failed to scan segment")
+		}
+		if err = checkOwner(slug, owner, ownerTeam, log); err != nil {
+			return res, err
+		}
+		res[slug] = id
+	}
+	if err = rows.Err(); err != nil {
+		log.Error("error occurred while reading", logger.Err(err))
+		return res, fmt.Errorf("error occurred while reading")
+	}
+	return res, nil
+}
+
+// collectSegmentIDs runs a membership query taking the user and segment ids and returns the segment ids it returned.
+func collectSegmentIDs(ctx context.Context, tx pgx.Tx, query string, userID uint64, segmentIDs []uint64) (map[uint64]bool, error) {
+	rows, err := tx.Query(ctx, query, userID, segmentIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make(map[uint64]bool, len(segmentIDs))
+	for rows.Next() {
+		var id uint64
+		if err = rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		res[id] = true
+	}
+	return res, rows.Err()
 }
 
 func (pg *PostgresDB) GetUserSegmentsInfo(ctx context.Context, user User, log *slog.Logger) ([]string, error) {
 	var id uint64
 	var res []string
-	err := pg.DB.AcquireFunc(context.Background(), func(conn *pgxpool.Conn) error {
+	err := pg.acquire(ctx, func(ctx context.Context, conn *pgxpool.Conn) error {
 		if err := pg.Ping(ctx); err != nil {
 			log.Error("failed to ping db", logger.Err(err))
-			return fmt.Errorf("failed to ping db")
+			return newError(ErrUnavailable, "failed to ping db")
 		}
 		queryCheckUser := `select id from users where user_id = $1`
 		query := `select slug from user_segments us join segments s on s.id = us.segment_id where user_id = $1 and deleted_at is null `
 		if err := conn.QueryRow(ctx, queryCheckUser, user.UID).Scan(&id); err != nil {
 			log.Error(fmt.Sprintf("user '%v' doesn't exist", user.UID), logger.Err(err))
-			return fmt.Errorf("user '%v' doesn't exist", user.UID)
+			return newError(ErrNotFound, "user '%v' doesn't exist", user.UID)
 		}
 		if rows, err := conn.Query(ctx, query, id); err != nil {
 			log.Error("failed to get data", logger.Err(err))
@@ -308,64 +497,201 @@ func (pg *PostgresDB) GetUserSegmentsInfo(ctx context.Context, user User, log *s
 	return res, nil
 }
 
-func (pg *PostgresDB) AddUser(ctx context.Context, user User, log *slog.Logger) (uint64, error) {
-	var id uint64
-	err := pg.DB.AcquireFunc(context.Background(), func(conn *pgxpool.Conn) error {
+// GetUsersSegmentsInfo returns the segments of each of the given users in one query.
+// Users that don't exist are left out of the result, existing users without segments map to an empty list.
+func (pg *PostgresDB) GetUsersSegmentsInfo(ctx context.Context, users UsersBatch, log *slog.Logger) (map[uint64][]string, error) {
+	res := make(map[uint64][]string, len(users.UserIDs))
+	err := pg.acquire(ctx, func(ctx context.Context, conn *pgxpool.Conn) error {
 		if err := pg.Ping(ctx); err != nil {
 			log.Error("failed to ping db", logger.Err(err))
-			return fmt.Errorf("failed to ping db")
+			return newError(ErrUnavailable, "failed to ping db")
 		}
-		query := `insert into users (user_id) values ($1) returning "id"`
-		if err := conn.QueryRow(ctx, query, user.UID).Scan(&id); err != nil {
-			log.Error("failed to insert data or user already exists", logger.Err(err))
-			return fmt.Errorf("failed to insert data or user already exists")
+		query := `select u.user_id, s.slug
+				  from users u
+				  left join user_segments us on us.user_id = u.id and us.deleted_at is null
+				  left join segments s on s.id = us.segment_id
+				  where u.user_id = any($1)`
+		rows, err := conn.Query(ctx, query, users.UserIDs)
+		if err != nil {
+			log.Error("failed to get data", logger.Err(err))
+			return fmt.Errorf("failed to get data")
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var uid uint64
+			var segment *string
+			if err = rows.Scan(&uid, &segment); err != nil {
+				log.Error("failed to scan segment", logger.Err(err))
+				return fmt.Errorf("failed to scan segment")
+			}
+			if _, ok := res[uid]; !ok {
+				res[uid] = []string{}
+			}
+			if segment != nil {
+				res[uid] = append(res[uid], *segment)
+			}
+		}
+		if err = rows.Err(); err != nil {
+			log.Error("error occurred while reading", logger.Err(err))
+			return fmt.Errorf("error occurred while reading")
 		}
 		return nil
 	})
 	if err != nil {
-		return id, err
+		return res, err
 	}
-	return id, nil
+	return res, nil
 }
 
-func (pg *PostgresDB) AddSegment(ctx context.Context, segment Segment, log *slog.Logger) (uint64, error) {
-	var id uint64
-	err := pg.DB.AcquireFunc(context.Background(), func(conn *pgxpool.Conn) error {
+// GetMemberships reports the user's membership in each of the given segments, in the order of the slugs.
+// Every slug is resolved by a single-row index lookup, so no segment lists are fetched.
+func (pg *PostgresDB) GetMemberships(ctx context.Context, userSegments UserSegments, log *slog.Logger) ([]Membership, error) {
+	res := make([]Membership, 0, len(userSegments.SegmentSlug))
+	err := pg.acquire(ctx, func(ctx context.Context, conn *pgxpool.Conn) error {
 		if err := pg.Ping(ctx); err != nil {
 			log.Error("failed to ping db", logger.Err(err))
-			return fmt.Errorf("failed to ping db")
+			return newError(ErrUnavailable, "failed to ping db")
+		}
+		query := `select q.slug, u.id is not null, s.id is not null, us.created_at, us.deleted_at
+				  from unnest($2::text[]) with ordinality as q(slug, ord)
+				  left join users u on u.user_id = $1
+				  left join segments s on s.slug = q.slug
+				  left join user_segments us on us.user_id = u.id and us.segment_id = s.id
+				  order by q.ord`
+		rows, err := conn.Query(ctx, query, userSegments.UserID, userSegments.SegmentSlug)
+		if err != nil {
+			log.Error("failed to get data", logger.Err(err))
+			return fmt.Errorf("failed to get data")
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var membership Membership
+			var userExists, segmentExists bool
+			if err = rows.Scan(&membership.Slug, &userExists, &segmentExists, &membership.AddedAt, &membership.RemovedAt); err != nil {
+				log.Error("failed to scan membership", logger.Err(err))
+				return fmt.Errorf("failed to scan membership")
+			}
+			if !userExists {
+				log.Error(fmt.Sprintf("user '%v' doesn't exist", userSegments.UserID))
+				return newError(ErrNotFound, "user '%v' doesn't exist", userSegments.UserID)
+			}
+			if !segmentExists {
+				log.Error(fmt.Sprintf("segment '%v' doesn't exist", membership.Slug))
+				return newError(ErrNotFound, "segment '%v' doesn't exist", membership.Slug)
+			}
+			membership.Member = membership.AddedAt != nil && membership.RemovedAt == nil
+			res = append(res, membership)
 		}
-		query := `insert into segments (slug) values ($1) returning "id"`
-		if err := conn.QueryRow(ctx, query, segment.Slug).Scan(&id); err != nil {
-			log.Error("failed to insert data or segment already exists", logger.Err(err))
-			return fmt.Errorf("failed to insert data or segment already exists")
+		if err = rows.Err(); err != nil {
+			log.Error("error occurred while reading", logger.Err(err))
+			return fmt.Errorf("error occurred while reading")
 		}
 		return nil
 	})
+	if err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+func (pg *PostgresDB) AddUser(ctx context.Context, user User, log *slog.Logger) (uint64, error) {
+	var id uint64
+	err := pg.inTx(ctx, pgx.ReadCommitted, log, func(ctx context.Context, tx pgx.Tx) error {
+		query := `insert into users (user_id) values ($1) returning "id"`
+		if err := tx.QueryRow(ctx, query, user.UID).Scan(&id); err != nil {
+			if isUniqueViolation(err) {
+				log.Error("user already exists", logger.Err(err))
+				return newError(ErrAlreadyExists, "user '%v' already exists", user.UID)
+			}
+			log.Error("failed to insert data", logger.Err(err))
+			return fmt.Errorf("failed to insert data")
+		}
+		return notifyChange(ctx, tx, Change{Kind: ChangeUser, UserID: user.UID}, log)
+	})
+	if err != nil {
+		return id, err
+	}
+	return id, nil
+}
+
+func (pg *PostgresDB) AddSegment(ctx context.Context, segment Segment, log *slog.Logger) (uint64, error) {
+	var id uint64
+	err := pg.inTx(ctx, pgx.ReadCommitted, log, func(ctx context.Context, tx pgx.Tx) error {
+		query := `insert into segments (slug, owner_team) values ($1, nullif($2, '')) returning "id"`
+		if err := tx.QueryRow(ctx, query, segment.Slug, segment.OwnerTeam).Scan(&id); err != nil {
+			if isUniqueViolation(err) {
+				log.Error("segment already exists", logger.Err(err))
+				return newError(ErrAlreadyExists, "segment '%v' already exists", segment.Slug)
+			}
+			log.Error("failed to insert data", logger.Err(err))
+			return fmt.Errorf("failed to insert data")
+		}
+		return notifyChange(ctx, tx, Change{Kind: ChangeSegment, Slug: segment.Slug}, log)
+	})
 	if err != nil {
 		return id, err
 	}
 	return id, nil
 }
 
+// CascadeDeleteSegment deletes the segment with all its memberships, recording a removal event for each member.
+// If segment.OwnerTeam is set, the segment is only deleted if it's owned by that team.
 func (pg *PostgresDB) CascadeDeleteSegment(ctx context.Context, segment Segment, log *slog.Logger) error {
-	err := pg.DB.AcquireFunc(context.Background(), func(conn *pgxpool.Conn) error {
-		if err := pg.Ping(ctx); err != nil {
-			log.Error("failed to ping db", logger.Err(err))
-			return fmt.Errorf("failed to ping db")
+	err := pg.inTx(ctx, pgx.ReadCommitted, log, func(ctx context.Context, tx pgx.Tx) error {
+		var id uint64
+		// Only the caller's own segment is locked, so a segment of another team is refused without touching it.
+		queryLock := `select id from segments where slug = $1 and ($2::text = '' or owner_team = $2) for update`
+		queryOwner := `select coalesce(owner_team, '') from segments where slug = $1`
+		// The members are read once the segment is locked, so no membership is added until it's deleted.
+		queryMembers := `select u.user_id
+						 from user_segments us
+						 join users u on u.id = us.user_id
+						 where us.segment_id = $1 and us.deleted_at is null
+						 order by u.user_id`
+		queryDelete := `delete from segments where id = $1`
+		if err := tx.QueryRow(ctx, queryLock, segment.Slug, segment.OwnerTeam).Scan(&id); err != nil {
+			if !errors.Is(err, pgx.ErrNoRows) {
+				log.Error("failed to get segment", logger.Err(err))
+				return fmt.Errorf("failed to get segment")
+			}
+			var owner string
+			err = tx.QueryRow(ctx, queryOwner, segment.Slug).Scan(&owner)
+			if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+				log.Error("failed to get segment owner", logger.Err(err))
+				return fmt.Errorf("failed to get segment owner")
+			}
+			return segmentDeleteRefused(segment.Slug, err == nil, owner, segment.OwnerTeam, log)
+		}
+		rows, err := tx.Query(ctx, queryMembers, id)
+		if err != nil {
+			log.Error("failed to get segment members", logger.Err(err))
+			return fmt.Errorf("failed to get segment members")
+		}
+		defer rows.Close()
+		members := make([]uint64, 0)
+		for rows.Next() {
+			var userID uint64
+			if err = rows.Scan(&userID); err != nil {
+				log.Error("failed to read segment members", logger.Err(err))
+				return fmt.Errorf("failed to read segment members")
+			}
+			members = append(members, userID)
+		}
+		if err = rows.Err(); err != nil {
+			log.Error("failed to read segment members", logger.Err(err))
+			return fmt.Errorf("failed to read segment members")
 		}
-		query := `delete from segments where slug = $1`
-		if res, err := conn.Exec(ctx, query, segment.Slug); err != nil {
+		if _, err = tx.Exec(ctx, queryDelete, id); err != nil {
 			log.Error("failed to delete segment", logger.Err(err))
 			return fmt.Errorf("failed to delete segment")
-		} else {
-			n := res.RowsAffected()
-			if n < 1 {
-				log.Error("failed to execute query", logger.Err(fmt.Errorf("segment '%v' is not present in database", segment.Slug)))
-				return fmt.Errorf("segment '%v' is not present in database", segment.Slug)
-			}
 		}
-		return nil
+		if err = recordMemberRemovals(ctx, tx, segment.Slug, members, log); err != nil {
+			return err
+		}
+		if err = recordEvents(ctx, tx, EventSegmentDeleted, 0, []string{segment.Slug}, log); err != nil {
+			return err
+		}
+		return notifyChange(ctx, tx, Change{Kind: ChangeSegment, Slug: segment.Slug}, log)
 	})
 	if err != nil {
 		return err
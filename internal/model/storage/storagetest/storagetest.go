@@ -0,0 +1,873 @@
+// Package storagetest checks that a storage backend behaves like the others. Every backend runs the same suite
+// with Run, so the API works the same whichever of them DB_DRIVER selects.
+package storagetest
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"github.com/vlasashk/user-segmentation/internal/model/storage"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Store is the storage API every backend implements.
+type Store interface {
+	AddUser(context.Context, storage.User, *slog.Logger) (uint64, error)
+	GetUserSegmentsInfo(context.Context, storage.User, *slog.Logger) ([]string, error)
+	GetUsersSegmentsInfo(context.Context, storage.UsersBatch, *slog.Logger) (map[uint64][]string, error)
+	GetMemberships(context.Context, storage.UserSegments, *slog.Logger) ([]storage.Membership, error)
+	AddUserToSegments(context.Context, storage.UserSegments, *slog.Logger) ([]storage.SegmentOutcome, error)
+	DeleteUserFromSegments(context.Context, storage.UserSegments, *slog.Logger) error
+
+	AddSegment(context.Context, storage.Segment, *slog.Logger) (uint64, error)
+	CascadeDeleteSegment(context.Context, storage.Segment, *slog.Logger) error
+	GetSegmentUsersInfo(context.Context, storage.Segment, *slog.Logger) ([]uint64, error)
+
+	CsvHistoryReport(context.Context, storage.CsvReport, *slog.Logger) (string, error)
+
+	ReserveIdempotencyKey(context.Context, storage.IdempotencyKey, time.Duration, time.Duration, *slog.Logger) (storage.IdempotencyRecord, bool, error)
+	SaveIdempotentResponse(context.Context, storage.IdempotencyKey, string, storage.IdempotentResponse, *slog.Logger) error
+	ReleaseIdempotencyKey(context.Context, storage.IdempotencyKey, string, *slog.Logger) error
+	PruneIdempotencyKeys(context.Context, time.Duration, time.Duration, *slog.Logger) (int64, error)
+
+	PublishOutbox(context.Context, int, func(context.Context, []storage.OutboxEvent) error, *slog.Logger) (int, error)
+	PruneOutbox(context.Context, time.Time, bool, *slog.Logger) (int64, error)
+	GetEvents(context.Context, storage.EventFilter, *slog.Logger) ([]storage.OutboxEvent, error)
+	GetLastEventSeq(context.Context, *slog.Logger) (uint64, error)
+
+	AddWebhookSubscription(context.Context, storage.WebhookSubscription, *slog.Logger) (storage.WebhookSubscription, error)
+	DeleteWebhookSubscription(context.Context, uint64, *slog.Logger) error
+	GetWebhookDeadLetters(context.Context, uint64, *slog.Logger) ([]storage.WebhookDeadLetter, error)
+	ClaimWebhookDeliveries(context.Context, int, time.Duration, *slog.Logger) ([]storage.WebhookDelivery, error)
+	RetryWebhookDelivery(context.Context, uint64, time.Time, string, *slog.Logger) error
+	CompleteWebhookDelivery(context.Context, uint64, *slog.Logger) error
+	DeadLetterWebhookDelivery(context.Context, uint64, string, *slog.Logger) error
+}
+
+// Run runs the suite against the stores returned by newStore. Every test gets a store of its own,
+// which has to be empty.
+func Run(t *testing.T, newStore func(t *testing.T) Store) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s Store)
+	}{
+		{"Users", testUsers},
+		{"Segments", testSegments},
+		{"AddOutcomes", testAddOutcomes},
+		{"SoftDelete", testSoftDelete},
+		{"ReAddRemovedMember", testReAddRemovedMember},
+		{"DeleteAtomic", testDeleteAtomic},
+		{"FailedChangeRollback", testFailedChangeRollback},
+		{"CascadeDelete", testCascadeDelete},
+		{"Ownership", testOwnership},
+		{"History", testHistory},
+		{"Events", testEvents},
+		{"Outbox", testOutbox},
+		{"Idempotency", testIdempotency},
+		{"Webhooks", testWebhooks},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newStore(t))
+		})
+	}
+}
+
+var log = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func addUsers(t *testing.T, s Store, uids ...uint64) {
+	t.Helper()
+	for _, uid := range uids {
+		if _, err := s.AddUser(context.Background(), storage.User{UID: uid}, log); err != nil {
+			t.Fatalf("AddUser(%d) failed: %v", uid, err)
+		}
+	}
+}
+
+func addSegments(t *testing.T, s Store, owner string, slugs ...string) {
+	t.Helper()
+	for _, slug := range slugs {
+		if _, err := s.AddSegment(context.Background(), storage.Segment{Slug: slug, OwnerTeam: owner}, log); err != nil {
+			t.Fatalf("AddSegment(%q) failed: %v", slug, err)
+		}
+	}
+}
+
+func add(t *testing.T, s Store, uid uint64, slugs ...string) {
+	t.Helper()
+	if _, err := s.AddUserToSegments(context.Background(), storage.UserSegments{UserID: uid, SegmentSlug: slugs}, log); err != nil {
+		t.Fatalf("AddUserToSegments(%d, %v) failed: %v", uid, slugs, err)
+	}
+}
+
+func remove(t *testing.T, s Store, uid uint64, slugs ...string) {
+	t.Helper()
+	if err := s.DeleteUserFromSegments(context.Background(), storage.UserSegments{UserID: uid, SegmentSlug: slugs}, log); err != nil {
+		t.Fatalf("DeleteUserFromSegments(%d, %v) failed: %v", uid, slugs, err)
+	}
+}
+
+// wantSegments checks the segments the user is a member of, in any order.
+func wantSegments(t *testing.T, s Store, uid uint64, want ...string) {
+	t.Helper()
+	got, err := s.GetUserSegmentsInfo(context.Background(), storage.User{UID: uid}, log)
+	if err != nil {
+		t.Fatalf("GetUserSegmentsInfo(%d) failed: %v", uid, err)
+	}
+	slices.Sort(got)
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		t.Errorf("GetUserSegmentsInfo(%d) = %v, want %v", uid, got, want)
+	}
+}
+
+// wantMembers checks the users that are members of the segment, in any order.
+func wantMembers(t *testing.T, s Store, slug string, want ...uint64) {
+	t.Helper()
+	got, err := s.GetSegmentUsersInfo(context.Background(), storage.Segment{Slug: slug}, log)
+	if err != nil {
+		t.Fatalf("GetSegmentUsersInfo(%q) failed: %v", slug, err)
+	}
+	slices.Sort(got)
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		t.Errorf("GetSegmentUsersInfo(%q) = %v, want %v", slug, got, want)
+	}
+}
+
+func wantKind(t *testing.T, call string, err, kind error) {
+	t.Helper()
+	if !errors.Is(err, kind) {
+		t.Errorf("%s error = %v, want %v", call, err, kind)
+	}
+}
+
+func membership(t *testing.T, s Store, uid uint64, slug string) storage.Membership {
+	t.Helper()
+	got, err := s.GetMemberships(context.Background(), storage.UserSegments{UserID: uid, SegmentSlug: []string{slug}}, log)
+	if err != nil {
+		t.Fatalf("GetMemberships(%d, %q) failed: %v", uid, slug, err)
+	}
+	if len(got) != 1 || got[0].Slug != slug {
+		t.Fatalf("GetMemberships(%d, %q) = %+v, want a single membership", uid, slug, got)
+	}
+	return got[0]
+}
+
+func testUsers(t *testing.T, s Store) {
+	ctx := context.Background()
+	addUsers(t, s, 1, 2)
+	_, err := s.AddUser(ctx, storage.User{UID: 1}, log)
+	wantKind(t, "AddUser() of an existing user", err, storage.ErrAlreadyExists)
+	_, err = s.GetUserSegmentsInfo(ctx, storage.User{UID: 3}, log)
+	wantKind(t, "GetUserSegmentsInfo() of an unknown user", err, storage.ErrNotFound)
+	wantSegments(t, s, 1)
+
+	addSegments(t, s, "", "a")
+	add(t, s, 1, "a")
+	got, err := s.GetUsersSegmentsInfo(ctx, storage.UsersBatch{UserIDs: []uint64{1, 2, 3}}, log)
+	if err != nil {
+		t.Fatalf("GetUsersSegmentsInfo() failed: %v", err)
+	}
+	if len(got) != 2 || !slices.Equal(got[1], []string{"a"}) || len(got[2]) != 0 {
+		t.Errorf("GetUsersSegmentsInfo() = %v, want map[1:[a] 2:[]]", got)
+	}
+	if _, ok := got[3]; ok {
+		t.Errorf("GetUsersSegmentsInfo() returned the unknown user 3")
+	}
+}
+
+func testSegments(t *testing.T, s Store) {
+	ctx := context.Background()
+	addSegments(t, s, "", "promo")
+	_, err := s.AddSegment(ctx, storage.Segment{Slug: "promo"}, log)
+	wantKind(t, "AddSegment() of an existing slug", err, storage.ErrAlreadyExists)
+	_, err = s.AddSegment(ctx, storage.Segment{Slug: "PROMO"}, log)
+	wantKind(t, "AddSegment() of a slug differing only in case", err, storage.ErrAlreadyExists)
+	_, err = s.GetSegmentUsersInfo(ctx, storage.Segment{Slug: "missing"}, log)
+	wantKind(t, "GetSegmentUsersInfo() of an unknown segment", err, storage.ErrNotFound)
+	wantMembers(t, s, "promo")
+}
+
+func testAddOutcomes(t *testing.T, s Store) {
+	addUsers(t, s, 1)
+	addSegments(t, s, "", "a", "b", "c")
+	add(t, s, 1, "b")
+
+	tests := []struct {
+		name     string
+		uid      uint64
+		slugs    []string
+		want     []string
+		wantKind error
+	}{
+		{
+			name:     "not found",
+			uid:      1,
+			slugs:    []string{"a", "missing", "b"},
+			want:     []string{storage.OutcomeAborted, storage.OutcomeNotFound, storage.OutcomeAborted},
+			wantKind: storage.ErrNotFound,
+		},
+		{
+			name:     "already member",
+			uid:      1,
+			slugs:    []string{"a", "b", "c"},
+			want:     []string{storage.OutcomeAborted, storage.OutcomeAlreadyMember, storage.OutcomeAborted},
+			wantKind: storage.ErrAlreadyExists,
+		},
+		{
+			name:  "added",
+			uid:   1,
+			slugs: []string{"c", "a"},
+			want:  []string{storage.OutcomeAdded, storage.OutcomeAdded},
+		},
+		{
+			name:     "unknown user",
+			uid:      2,
+			slugs:    []string{"a"},
+			wantKind: storage.ErrNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outcomes, err := s.AddUserToSegments(context.Background(), storage.UserSegments{UserID: tt.uid, SegmentSlug: tt.slugs}, log)
+			if tt.wantKind == nil && err != nil {
+				t.Fatalf("AddUserToSegments() failed: %v", err)
+			}
+			if tt.wantKind != nil {
+				wantKind(t, "AddUserToSegments()", err, tt.wantKind)
+			}
+			if tt.want == nil {
+				return
+			}
+			if len(outcomes) != len(tt.slugs) {
+				t.Fatalf("AddUserToSegments() = %+v, want an outcome for each of %v", outcomes, tt.slugs)
+			}
+			for i, outcome := range outcomes {
+				if outcome.Slug != tt.slugs[i] || outcome.Outcome != tt.want[i] {
+					t.Errorf("AddUserToSegments() outcome %d = %+v, want {%s %s}", i, outcome, tt.slugs[i], tt.want[i])
+				}
+			}
+		})
+	}
+	wantSegments(t, s, 1, "a", "b", "c")
+}
+
+func testSoftDelete(t *testing.T, s Store) {
+	ctx := context.Background()
+	addUsers(t, s, 1, 2)
+	addSegments(t, s, "", "a", "b")
+	add(t, s, 1, "a", "b")
+	add(t, s, 2, "a")
+	remove(t, s, 1, "a")
+
+	wantSegments(t, s, 1, "b")
+	wantMembers(t, s, "a", 2)
+	got := membership(t, s, 1, "a")
+	if got.Member || got.AddedAt == nil || got.RemovedAt == nil {
+		t.Errorf("GetMemberships() of a removed member = %+v, want added and removed", got)
+	} else if got.RemovedAt.Before(*got.AddedAt) {
+		t.Errorf("GetMemberships() removed at %v, before added at %v", got.RemovedAt, got.AddedAt)
+	}
+	got = membership(t, s, 2, "b")
+	if got.Member || got.AddedAt != nil || got.RemovedAt != nil {
+		t.Errorf("GetMemberships() of a user that was never added = %+v, want no history", got)
+	}
+	err := s.DeleteUserFromSegments(ctx, storage.UserSegments{UserID: 1, SegmentSlug: []string{"a"}}, log)
+	wantKind(t, "DeleteUserFromSegments() of a removed member", err, storage.ErrNotMember)
+	_, err = s.GetMemberships(ctx, storage.UserSegments{UserID: 1, SegmentSlug: []string{"missing"}}, log)
+	wantKind(t, "GetMemberships() of an unknown segment", err, storage.ErrNotFound)
+}
+
+func testReAddRemovedMember(t *testing.T, s Store) {
+	addUsers(t, s, 1)
+	addSegments(t, s, "", "a")
+	add(t, s, 1, "a")
+	first := membership(t, s, 1, "a")
+	remove(t, s, 1, "a")
+
+	outcomes, err := s.AddUserToSegments(context.Background(), storage.UserSegments{UserID: 1, SegmentSlug: []string{"a"}}, log)
+	if err != nil {
+		t.Fatalf("AddUserToSegments() of a removed member failed: %v", err)
+	}
+	if len(outcomes) != 1 || outcomes[0].Outcome != storage.OutcomeAdded {
+		t.Errorf("AddUserToSegments() = %+v, want a single added outcome", outcomes)
+	}
+	wantSegments(t, s, 1, "a")
+	wantMembers(t, s, "a", 1)
+	got := membership(t, s, 1, "a")
+	if !got.Member || got.AddedAt == nil || got.RemovedAt != nil {
+		t.Errorf("GetMemberships() of a member added again = %+v, want a member that wasn't removed", got)
+	} else if got.AddedAt.Before(*first.AddedAt) {
+		t.Errorf("GetMemberships() added at %v, before the first addition at %v", got.AddedAt, first.AddedAt)
+	}
+}
+
+func testDeleteAtomic(t *testing.T, s Store) {
+	ctx := context.Background()
+	addUsers(t, s, 1)
+	addSegments(t, s, "", "a", "b")
+	add(t, s, 1, "a")
+
+	err := s.DeleteUserFromSegments(ctx, storage.UserSegments{UserID: 1, SegmentSlug: []string{"a", "missing"}}, log)
+	wantKind(t, "DeleteUserFromSegments() with an unknown segment", err, storage.ErrNotFound)
+	err = s.DeleteUserFromSegments(ctx, storage.UserSegments{UserID: 1, SegmentSlug: []string{"a", "b"}}, log)
+	wantKind(t, "DeleteUserFromSegments() with a segment the user isn't part of", err, storage.ErrNotMember)
+	err = s.DeleteUserFromSegments(ctx, storage.UserSegments{UserID: 2, SegmentSlug: []string{"a"}}, log)
+	wantKind(t, "DeleteUserFromSegments() of an unknown user", err, storage.ErrNotFound)
+	wantSegments(t, s, 1, "a")
+}
+
+// testFailedChangeRollback checks that a failing multi-slug change leaves no membership, event
+// or webhook delivery behind, even for the slugs that could have been changed on their own.
+func testFailedChangeRollback(t *testing.T, s Store) {
+	ctx := context.Background()
+	if _, err := s.AddWebhookSubscription(ctx, storage.WebhookSubscription{URL: "http://localhost/hook", Secret: "0123456789abcdef"}, log); err != nil {
+		t.Fatalf("AddWebhookSubscription() failed: %v", err)
+	}
+	addUsers(t, s, 1)
+	addSegments(t, s, "", "a", "b", "c")
+	addSegments(t, s, "team-a", "owned")
+	add(t, s, 1, "a")
+	if _, err := s.ClaimWebhookDeliveries(ctx, 100, time.Hour, log); err != nil {
+		t.Fatalf("ClaimWebhookDeliveries() failed: %v", err)
+	}
+	last, err := s.GetLastEventSeq(ctx, log)
+	if err != nil {
+		t.Fatalf("GetLastEventSeq() failed: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		change   func() error
+		wantKind error
+	}{
+		{
+			name: "add with an unknown segment",
+			change: func() error {
+				_, err := s.AddUserToSegments(ctx, storage.UserSegments{UserID: 1, SegmentSlug: []string{"b", "c", "missing"}}, log)
+				return err
+			},
+			wantKind: storage.ErrNotFound,
+		},
+		{
+			name: "add with a segment the user is part of",
+			change: func() error {
+				_, err := s.AddUserToSegments(ctx, storage.UserSegments{UserID: 1, SegmentSlug: []string{"b", "a", "c"}}, log)
+				return err
+			},
+			wantKind: storage.ErrAlreadyExists,
+		},
+		{
+			name: "add with a segment of another team",
+			change: func() error {
+				_, err := s.AddUserToSegments(ctx, storage.UserSegments{UserID: 1, SegmentSlug: []string{"b", "owned"}, OwnerTeam: "team-b"}, log)
+				return err
+			},
+			wantKind: storage.ErrForbidden,
+		},
+		{
+			name: "delete with a segment the user isn't part of",
+			change: func() error {
+				return s.DeleteUserFromSegments(ctx, storage.UserSegments{UserID: 1, SegmentSlug: []string{"a", "b"}}, log)
+			},
+			wantKind: storage.ErrNotMember,
+		},
+		{
+			name: "delete with an unknown segment",
+			change: func() error {
+				return s.DeleteUserFromSegments(ctx, storage.UserSegments{UserID: 1, SegmentSlug: []string{"a", "missing"}}, log)
+			},
+			wantKind: storage.ErrNotFound,
+		},
+		{
+			name: "delete of a segment of another team",
+			change: func() error {
+				return s.CascadeDeleteSegment(ctx, storage.Segment{Slug: "owned", OwnerTeam: "team-b"}, log)
+			},
+			wantKind: storage.ErrForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wantKind(t, "change", tt.change(), tt.wantKind)
+			wantSegments(t, s, 1, "a")
+			wantMembers(t, s, "b")
+			wantMembers(t, s, "c")
+			if got := getEvents(t, s, storage.EventFilter{After: last}); len(got) != 0 {
+				t.Errorf("failed change recorded events %v", eventKeys(got))
+			}
+			claimed, err := s.ClaimWebhookDeliveries(ctx, 100, time.Hour, log)
+			if err != nil {
+				t.Fatalf("ClaimWebhookDeliveries() failed: %v", err)
+			}
+			if len(claimed) != 0 {
+				t.Errorf("failed change queued %d webhook deliveries", len(claimed))
+			}
+		})
+	}
+	if _, err = s.GetSegmentUsersInfo(ctx, storage.Segment{Slug: "owned"}, log); err != nil {
+		t.Errorf("GetSegmentUsersInfo() of a segment whose deletion failed: %v", err)
+	}
+}
+
+func testCascadeDelete(t *testing.T, s Store) {
+	ctx := context.Background()
+	addUsers(t, s, 1, 2)
+	addSegments(t, s, "", "a", "b")
+	add(t, s, 1, "a", "b")
+	add(t, s, 2, "a")
+	remove(t, s, 2, "a")
+
+	if err := s.CascadeDeleteSegment(ctx, storage.Segment{Slug: "a"}, log); err != nil {
+		t.Fatalf("CascadeDeleteSegment() failed: %v", err)
+	}
+	wantSegments(t, s, 1, "b")
+	_, err := s.GetSegmentUsersInfo(ctx, storage.Segment{Slug: "a"}, log)
+	wantKind(t, "GetSegmentUsersInfo() of a deleted segment", err, storage.ErrNotFound)
+	err = s.CascadeDeleteSegment(ctx, storage.Segment{Slug: "a"}, log)
+	wantKind(t, "CascadeDeleteSegment() of a deleted segment", err, storage.ErrNotFound)
+
+	// The slug is free again and the new segment starts without members.
+	addSegments(t, s, "", "a")
+	wantMembers(t, s, "a")
+	if got := membership(t, s, 2, "a"); got.AddedAt != nil {
+		t.Errorf("GetMemberships() of a recreated segment = %+v, want no history", got)
+	}
+}
+
+func testOwnership(t *testing.T, s Store) {
+	ctx := context.Background()
+	addUsers(t, s, 1)
+	addSegments(t, s, "team-a", "owned")
+	addSegments(t, s, "", "shared")
+
+	_, err := s.AddUserToSegments(ctx, storage.UserSegments{UserID: 1, SegmentSlug: []string{"owned"}, OwnerTeam: "team-b"}, log)
+	wantKind(t, "AddUserToSegments() by another team", err, storage.ErrForbidden)
+	_, err = s.AddUserToSegments(ctx, storage.UserSegments{UserID: 1, SegmentSlug: []string{"shared"}, OwnerTeam: "team-a"}, log)
+	wantKind(t, "AddUserToSegments() of a segment without an owner by a team", err, storage.ErrForbidden)
+	wantSegments(t, s, 1)
+
+	if _, err = s.AddUserToSegments(ctx, storage.UserSegments{UserID: 1, SegmentSlug: []string{"owned"}, OwnerTeam: "team-a"}, log); err != nil {
+		t.Fatalf("AddUserToSegments() by the owner failed: %v", err)
+	}
+	add(t, s, 1, "shared")
+	err = s.DeleteUserFromSegments(ctx, storage.UserSegments{UserID: 1, SegmentSlug: []string{"owned", "shared"}, OwnerTeam: "team-a"}, log)
+	wantKind(t, "DeleteUserFromSegments() of a segment without an owner by a team", err, storage.ErrForbidden)
+	wantSegments(t, s, 1, "owned", "shared")
+
+	err = s.CascadeDeleteSegment(ctx, storage.Segment{Slug: "owned", OwnerTeam: "team-b"}, log)
+	wantKind(t, "CascadeDeleteSegment() by another team", err, storage.ErrForbidden)
+	wantMembers(t, s, "owned", 1)
+	err = s.CascadeDeleteSegment(ctx, storage.Segment{Slug: "shared", OwnerTeam: "team-a"}, log)
+	wantKind(t, "CascadeDeleteSegment() of a segment without an owner by a team", err, storage.ErrForbidden)
+	wantMembers(t, s, "shared", 1)
+	err = s.CascadeDeleteSegment(ctx, storage.Segment{Slug: "missing", OwnerTeam: "team-a"}, log)
+	wantKind(t, "CascadeDeleteSegment() of a missing segment by a team", err, storage.ErrNotFound)
+	if err = s.CascadeDeleteSegment(ctx, storage.Segment{Slug: "owned", OwnerTeam: "team-a"}, log); err != nil {
+		t.Fatalf("CascadeDeleteSegment() by the owner failed: %v", err)
+	}
+	wantSegments(t, s, 1, "shared")
+}
+
+func testHistory(t *testing.T, s Store) {
+	t.Setenv("CSV_PATH", t.TempDir())
+	addUsers(t, s, 1, 2)
+	addSegments(t, s, "", "a", "b")
+	add(t, s, 1, "a", "b")
+	add(t, s, 2, "a")
+	remove(t, s, 1, "a")
+
+	want := map[[3]string]bool{
+		{"1", "a", "added"}:   true,
+		{"1", "a", "removed"}: true,
+		{"1", "b", "added"}:   true,
+		{"2", "a", "added"}:   true,
+	}
+	got := make(map[[3]string]bool)
+	// A report's month may be shifted by a day or the time zone of the database,
+	// so the changes made now are looked up in the neighbouring months as well.
+	now := time.Now()
+	for _, month := range []time.Time{now.AddDate(0, 0, -2), now, now.AddDate(0, 0, 2)} {
+		for _, row := range readReport(t, s, storage.CsvReport{Year: uint(month.Year()), Month: month.Month()}) {
+			got[[3]string{row[0], row[1], row[2]}] = true
+		}
+	}
+	for row := range want {
+		if !got[row] {
+			t.Errorf("CsvHistoryReport() is missing %v", row)
+		}
+	}
+	for row := range got {
+		if !want[row] {
+			t.Errorf("CsvHistoryReport() has unexpected %v", row)
+		}
+	}
+}
+
+func readReport(t *testing.T, s Store, month storage.CsvReport) [][]string {
+	t.Helper()
+	id, err := s.CsvHistoryReport(context.Background(), month, log)
+	if err != nil {
+		t.Fatalf("CsvHistoryReport(%+v) failed: %v", month, err)
+	}
+	file, err := os.Open(storage.ReportPath(os.Getenv("CSV_PATH"), id))
+	if err != nil {
+		t.Fatalf("failed to open report: %v", err)
+	}
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+	reader := csv.NewReader(file)
+	reader.Comma = ';'
+	rows, err := reader.ReadAll()
+	if err != nil {
+		t.Fatalf("failed to read report: %v", err)
+	}
+	for _, row := range rows {
+		if len(row) != 4 {
+			t.Fatalf("report row %v, want user id, segment, status and date", row)
+		}
+		if _, err = strconv.ParseUint(row[0], 10, 64); err != nil {
+			t.Errorf("report row %v has user id %q", row, row[0])
+		}
+	}
+	return rows
+}
+
+// getEvents returns every recorded event matching filter.
+func getEvents(t *testing.T, s Store, filter storage.EventFilter) []storage.OutboxEvent {
+	t.Helper()
+	filter.Limit = 1000
+	events, err := s.GetEvents(context.Background(), filter, log)
+	if err != nil {
+		t.Fatalf("GetEvents(%+v) failed: %v", filter, err)
+	}
+	return events
+}
+
+func eventKeys(events []storage.OutboxEvent) []string {
+	res := make([]string, 0, len(events))
+	for _, event := range events {
+		key := event.Type + " " + event.Segment
+		if event.UserID != 0 {
+			key += " " + strconv.FormatUint(event.UserID, 10)
+		}
+		res = append(res, key)
+	}
+	return res
+}
+
+func testEvents(t *testing.T, s Store) {
+	ctx := context.Background()
+	seq, err := s.GetLastEventSeq(ctx, log)
+	if err != nil || seq != 0 {
+		t.Fatalf("GetLastEventSeq() of an empty store = %d, %v, want 0", seq, err)
+	}
+	addUsers(t, s, 1, 2)
+	addSegments(t, s, "", "a", "b")
+	add(t, s, 1, "a", "b")
+	add(t, s, 2, "a")
+	remove(t, s, 1, "b")
+	if err = s.CascadeDeleteSegment(ctx, storage.Segment{Slug: "a"}, log); err != nil {
+		t.Fatalf("CascadeDeleteSegment() failed: %v", err)
+	}
+
+	// Deleting a segment removes each of its members before the segment itself,
+	// so clients following a single user see it losing the segment.
+	events := getEvents(t, s, storage.EventFilter{})
+	want := []string{
+		"membership.added a 1",
+		"membership.added b 1",
+		"membership.added a 2",
+		"membership.removed b 1",
+		"membership.removed a 1",
+		"membership.removed a 2",
+		"segment.deleted a",
+	}
+	if got := eventKeys(events); !slices.Equal(got, want) {
+		t.Fatalf("GetEvents() = %v, want %v", got, want)
+	}
+	ids := make(map[string]bool)
+	for i, event := range events {
+		if i > 0 && event.Seq <= events[i-1].Seq {
+			t.Errorf("GetEvents() seq %d follows %d", event.Seq, events[i-1].Seq)
+		}
+		if event.ID == "" || ids[event.ID] {
+			t.Errorf("GetEvents() event id %q is empty or repeated", event.ID)
+		}
+		ids[event.ID] = true
+	}
+	if seq, err = s.GetLastEventSeq(ctx, log); err != nil || seq != events[len(events)-1].Seq {
+		t.Errorf("GetLastEventSeq() = %d, %v, want %d", seq, err, events[len(events)-1].Seq)
+	}
+
+	if got := eventKeys(getEvents(t, s, storage.EventFilter{UserID: 1})); !slices.Equal(got, []string{want[0], want[1], want[3], want[4]}) {
+		t.Errorf("GetEvents() of user 1 = %v", got)
+	}
+	if got := eventKeys(getEvents(t, s, storage.EventFilter{UserID: 2})); !slices.Equal(got, []string{want[2], want[5]}) {
+		t.Errorf("GetEvents() of user 2 = %v", got)
+	}
+	if got := eventKeys(getEvents(t, s, storage.EventFilter{Segment: "a"})); !slices.Equal(got, []string{want[0], want[2], want[4], want[5], want[6]}) {
+		t.Errorf("GetEvents() of segment a = %v", got)
+	}
+	if got := eventKeys(getEvents(t, s, storage.EventFilter{After: events[2].Seq})); !slices.Equal(got, want[3:]) {
+		t.Errorf("GetEvents() after the third event = %v, want %v", got, want[3:])
+	}
+}
+
+func testOutbox(t *testing.T, s Store) {
+	ctx := context.Background()
+	addUsers(t, s, 1)
+	addSegments(t, s, "", "a", "b", "c")
+	add(t, s, 1, "a", "b", "c")
+
+	var published []storage.OutboxEvent
+	publish := func(_ context.Context, events []storage.OutboxEvent) error {
+		published = append(published, events...)
+		return nil
+	}
+	failing := func(context.Context, []storage.OutboxEvent) error {
+		return errors.New("sink is down")
+	}
+	if _, err := s.PublishOutbox(ctx, 2, failing, log); err == nil {
+		t.Errorf("PublishOutbox() with a failing sink succeeded")
+	}
+	if n, err := s.PublishOutbox(ctx, 2, publish, log); err != nil || n != 2 {
+		t.Fatalf("PublishOutbox() = %d, %v, want 2", n, err)
+	}
+	if n, err := s.PublishOutbox(ctx, 2, publish, log); err != nil || n != 1 {
+		t.Fatalf("PublishOutbox() = %d, %v, want 1", n, err)
+	}
+	if n, err := s.PublishOutbox(ctx, 2, publish, log); err != nil || n != 0 {
+		t.Fatalf("PublishOutbox() of a published outbox = %d, %v, want 0", n, err)
+	}
+	if got, want := eventKeys(published), eventKeys(getEvents(t, s, storage.EventFilter{})); !slices.Equal(got, want) {
+		t.Errorf("PublishOutbox() published %v, want %v", got, want)
+	}
+
+	if pruned, err := s.PruneOutbox(ctx, time.Now().Add(-time.Hour), true, log); err != nil || pruned != 0 {
+		t.Errorf("PruneOutbox() of recent events = %d, %v, want 0", pruned, err)
+	}
+	remove(t, s, 1, "a")
+	// The unpublished removal is kept for the relay.
+	if pruned, err := s.PruneOutbox(ctx, time.Now().Add(24*time.Hour), false, log); err != nil || pruned != 3 {
+		t.Errorf("PruneOutbox() of published events = %d, %v, want 3", pruned, err)
+	}
+	if got := eventKeys(getEvents(t, s, storage.EventFilter{})); !slices.Equal(got, []string{"membership.removed a 1"}) {
+		t.Errorf("GetEvents() after pruning published events = %v, want the unpublished removal", got)
+	}
+	if pruned, err := s.PruneOutbox(ctx, time.Now().Add(24*time.Hour), true, log); err != nil || pruned != 1 {
+		t.Errorf("PruneOutbox() of unpublished events = %d, %v, want 1", pruned, err)
+	}
+	if got := getEvents(t, s, storage.EventFilter{}); len(got) != 0 {
+		t.Errorf("GetEvents() after pruning = %v, want none", eventKeys(got))
+	}
+}
+
+func testIdempotency(t *testing.T, s Store) {
+	ctx := context.Background()
+	key := storage.IdempotencyKey{Caller: "admin", Key: "key-1", RequestHash: "hash-1"}
+	reserve := func(key storage.IdempotencyKey, lease time.Duration) (storage.IdempotencyRecord, bool) {
+		t.Helper()
+		record, reserved, err := s.ReserveIdempotencyKey(ctx, key, time.Hour, lease, log)
+		if err != nil {
+			t.Fatalf("ReserveIdempotencyKey() failed: %v", err)
+		}
+		return record, reserved
+	}
+	save := func(key storage.IdempotencyKey, token string, response storage.IdempotentResponse) {
+		t.Helper()
+		if err := s.SaveIdempotentResponse(ctx, key, token, response, log); err != nil {
+			t.Fatalf("SaveIdempotentResponse() failed: %v", err)
+		}
+	}
+
+	reservation, reserved := reserve(key, time.Hour)
+	if !reserved || reservation.Token == "" {
+		t.Fatalf("ReserveIdempotencyKey() of a new key = %+v, %v, want a reservation token", reservation, reserved)
+	}
+	record, reserved := reserve(key, time.Hour)
+	if reserved || record.RequestHash != key.RequestHash || record.Token != "" || record.Response != nil {
+		t.Fatalf("ReserveIdempotencyKey() of a key in progress = %+v, %v, want the hash without a response", record, reserved)
+	}
+	other := storage.IdempotencyKey{Caller: "team-a", Key: key.Key, RequestHash: "hash-2"}
+	otherReservation, reserved := reserve(other, time.Hour)
+	if !reserved {
+		t.Errorf("ReserveIdempotencyKey() of another caller's key wasn't reserved")
+	}
+
+	response := storage.IdempotentResponse{
+		StatusCode:  201,
+		ContentType: "application/json",
+		Header:      map[string]string{"Deprecation": "true"},
+		Body:        []byte(`{"id":1}`),
+	}
+	// Only the request holding the reservation stores its response.
+	save(key, otherReservation.Token, storage.IdempotentResponse{StatusCode: 500})
+	if record, _ = reserve(key, time.Hour); record.Response != nil {
+		t.Fatalf("SaveIdempotentResponse() with another token stored %+v", record.Response)
+	}
+	save(key, reservation.Token, response)
+	record, reserved = reserve(key, time.Hour)
+	if reserved || record.Response == nil || record.Response.StatusCode != response.StatusCode ||
+		record.Response.ContentType != response.ContentType || record.Response.Header["Deprecation"] != "true" ||
+		string(record.Response.Body) != string(response.Body) {
+		t.Fatalf("ReserveIdempotencyKey() of a completed key = %+v, %v, want the saved response", record, reserved)
+	}
+
+	if err := s.ReleaseIdempotencyKey(ctx, key, otherReservation.Token, log); err != nil {
+		t.Fatalf("ReleaseIdempotencyKey() failed: %v", err)
+	}
+	if _, reserved = reserve(key, time.Hour); reserved {
+		t.Errorf("ReleaseIdempotencyKey() with another token released the key")
+	}
+	if err := s.ReleaseIdempotencyKey(ctx, key, reservation.Token, log); err != nil {
+		t.Fatalf("ReleaseIdempotencyKey() failed: %v", err)
+	}
+	if reservation, reserved = reserve(key, time.Hour); !reserved {
+		t.Errorf("ReserveIdempotencyKey() of a released key wasn't reserved")
+	}
+
+	// A key whose response was never saved is taken over once its lease runs out,
+	// a key with a saved response is kept for the whole ttl.
+	save(key, reservation.Token, response)
+	time.Sleep(20 * time.Millisecond)
+	takeover, reserved := reserve(other, 10*time.Millisecond)
+	if !reserved || takeover.Token == otherReservation.Token {
+		t.Errorf("ReserveIdempotencyKey() of a key past its lease = %+v, %v, want a new reservation", takeover, reserved)
+	}
+	if _, reserved = reserve(key, 10*time.Millisecond); reserved {
+		t.Errorf("ReserveIdempotencyKey() of a completed key past the lease was reserved")
+	}
+	// The request that lost its lease can neither store its response nor release the new reservation.
+	save(other, otherReservation.Token, response)
+	if err := s.ReleaseIdempotencyKey(ctx, other, otherReservation.Token, log); err != nil {
+		t.Fatalf("ReleaseIdempotencyKey() failed: %v", err)
+	}
+	if record, reserved = reserve(other, time.Hour); reserved || record.Response != nil {
+		t.Errorf("ReserveIdempotencyKey() after a stale save and release = %+v, %v, want the new reservation in progress", record, reserved)
+	}
+
+	if pruned, err := s.PruneIdempotencyKeys(ctx, time.Hour, time.Hour, log); err != nil || pruned != 0 {
+		t.Errorf("PruneIdempotencyKeys() of recent keys = %d, %v, want 0", pruned, err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	// Only the key in progress is past the lease.
+	if pruned, err := s.PruneIdempotencyKeys(ctx, time.Hour, 10*time.Millisecond, log); err != nil || pruned != 1 {
+		t.Errorf("PruneIdempotencyKeys() past the lease = %d, %v, want 1", pruned, err)
+	}
+	if pruned, err := s.PruneIdempotencyKeys(ctx, 10*time.Millisecond, time.Hour, log); err != nil || pruned != 1 {
+		t.Errorf("PruneIdempotencyKeys() past the ttl = %d, %v, want 1", pruned, err)
+	}
+	if _, reserved = reserve(key, time.Hour); !reserved {
+		t.Errorf("ReserveIdempotencyKey() of a pruned key wasn't reserved")
+	}
+}
+
+func testWebhooks(t *testing.T, s Store) {
+	ctx := context.Background()
+	subscription, err := s.AddWebhookSubscription(ctx, storage.WebhookSubscription{
+		URL:      "http://localhost/hook",
+		Secret:   "0123456789abcdef",
+		Events:   []string{storage.EventMembershipAdded},
+		Segments: []string{"a"},
+	}, log)
+	if err != nil {
+		t.Fatalf("AddWebhookSubscription() failed: %v", err)
+	}
+	addUsers(t, s, 1)
+	addSegments(t, s, "", "a", "b")
+	add(t, s, 1, "a", "b")
+	remove(t, s, 1, "a")
+
+	claimed, err := s.ClaimWebhookDeliveries(ctx, 10, time.Hour, log)
+	if err != nil {
+		t.Fatalf("ClaimWebhookDeliveries() failed: %v", err)
+	}
+	if len(claimed) != 1 {
+		t.Fatalf("ClaimWebhookDeliveries() = %d deliveries, want only the addition to a", len(claimed))
+	}
+	delivery := claimed[0]
+	if delivery.SubscriptionID != subscription.Id || delivery.URL != subscription.URL ||
+		delivery.Secret != subscription.Secret || delivery.Attempts != 1 || delivery.EventID == "" {
+		t.Errorf("ClaimWebhookDeliveries() = %+v, want the first attempt of a delivery to subscription %d", delivery, subscription.Id)
+	}
+	if claimed, err = s.ClaimWebhookDeliveries(ctx, 10, time.Hour, log); err != nil || len(claimed) != 0 {
+		t.Fatalf("ClaimWebhookDeliveries() of a leased delivery = %d, %v, want none", len(claimed), err)
+	}
+
+	if err = s.RetryWebhookDelivery(ctx, delivery.Id, time.Now().Add(-time.Minute), "status 500", log); err != nil {
+		t.Fatalf("RetryWebhookDelivery() failed: %v", err)
+	}
+	if claimed, err = s.ClaimWebhookDeliveries(ctx, 10, time.Hour, log); err != nil || len(claimed) != 1 || claimed[0].Attempts != 2 {
+		t.Fatalf("ClaimWebhookDeliveries() of a retried delivery = %+v, %v, want its second attempt", claimed, err)
+	}
+	if err = s.DeadLetterWebhookDelivery(ctx, delivery.Id, "status 500", log); err != nil {
+		t.Fatalf("DeadLetterWebhookDelivery() failed: %v", err)
+	}
+	letters, err := s.GetWebhookDeadLetters(ctx, subscription.Id, log)
+	if err != nil {
+		t.Fatalf("GetWebhookDeadLetters() failed: %v", err)
+	}
+	if len(letters) != 1 || letters[0].EventID != delivery.EventID || letters[0].Attempts != 2 || letters[0].LastError != "status 500" {
+		t.Errorf("GetWebhookDeadLetters() = %+v, want the dead lettered delivery", letters)
+	}
+
+	add(t, s, 1, "a")
+	if claimed, err = s.ClaimWebhookDeliveries(ctx, 10, time.Hour, log); err != nil || len(claimed) != 1 {
+		t.Fatalf("ClaimWebhookDeliveries() = %d, %v, want 1", len(claimed), err)
+	}
+	if err = s.CompleteWebhookDelivery(ctx, claimed[0].Id, log); err != nil {
+		t.Fatalf("CompleteWebhookDelivery() failed: %v", err)
+	}
+	if err = s.RetryWebhookDelivery(ctx, claimed[0].Id, time.Now().Add(-time.Minute), "", log); err != nil {
+		t.Fatalf("RetryWebhookDelivery() of a completed delivery failed: %v", err)
+	}
+	if claimed, err = s.ClaimWebhookDeliveries(ctx, 10, time.Hour, log); err != nil || len(claimed) != 0 {
+		t.Errorf("ClaimWebhookDeliveries() after completing = %d, %v, want none", len(claimed), err)
+	}
+
+	// Subscribers of a segment are told about each membership it loses when it is deleted.
+	removals, err := s.AddWebhookSubscription(ctx, storage.WebhookSubscription{
+		URL:      "http://localhost/removals",
+		Secret:   "0123456789abcdef",
+		Events:   []string{storage.EventMembershipRemoved},
+		Segments: []string{"b"},
+	}, log)
+	if err != nil {
+		t.Fatalf("AddWebhookSubscription() failed: %v", err)
+	}
+	addUsers(t, s, 2)
+	add(t, s, 2, "b")
+	if err = s.CascadeDeleteSegment(ctx, storage.Segment{Slug: "b"}, log); err != nil {
+		t.Fatalf("CascadeDeleteSegment() failed: %v", err)
+	}
+	if claimed, err = s.ClaimWebhookDeliveries(ctx, 10, time.Hour, log); err != nil || len(claimed) != 2 {
+		t.Fatalf("ClaimWebhookDeliveries() after deleting a segment = %d, %v, want a removal of each member", len(claimed), err)
+	}
+	for _, delivery := range claimed {
+		var event storage.Event
+		if err = json.Unmarshal(delivery.Payload, &event); err != nil {
+			t.Fatalf("failed to decode delivery payload: %v", err)
+		}
+		if delivery.SubscriptionID != removals.Id || event.Type != storage.EventMembershipRemoved || event.Segment != "b" {
+			t.Errorf("ClaimWebhookDeliveries() = %+v with %+v, want a removal from b", delivery, event)
+		}
+	}
+
+	if err = s.DeleteWebhookSubscription(ctx, subscription.Id, log); err != nil {
+		t.Fatalf("DeleteWebhookSubscription() failed: %v", err)
+	}
+	err = s.DeleteWebhookSubscription(ctx, subscription.Id, log)
+	wantKind(t, "DeleteWebhookSubscription() of a deleted subscription", err, storage.ErrNotFound)
+	_, err = s.GetWebhookDeadLetters(ctx, subscription.Id, log)
+	wantKind(t, "GetWebhookDeadLetters() of a deleted subscription", err, storage.ErrNotFound)
+}
@@ -0,0 +1,288 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/vlasashk/user-segmentation/internal/model/logger"
+	"log/slog"
+	"time"
+)
+
+// WebhookSubscription receives events matching its filters. Empty Events or Segments match everything.
+type WebhookSubscription struct {
+	Id        uint64    `json:"id"`
+	URL       string    `json:"url" validate:"required,http_url,max=2048"`
+	Secret    string    `json:"secret,omitempty" validate:"required,min=16,max=255"`
+	Events    []string  `json:"events" validate:"omitempty,unique,dive,oneof=membership.added membership.removed"`
+	Segments  []string  `json:"segments" validate:"omitempty,max=100,unique,dive,slug"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookDelivery is a pending attempt to post an event to a subscriber.
+type WebhookDelivery struct {
+	Id             uint64
+	SubscriptionID uint64
+	URL            string
+	Secret         string
+	EventID        string
+	Payload        []byte
+	Attempts       int
+}
+
+// WebhookDeadLetter is a delivery given up after running out of attempts.
+type WebhookDeadLetter struct {
+	Id             uint64          `json:"id"`
+	SubscriptionID uint64          `json:"subscription_id"`
+	EventID        string          `json:"event_id"`
+	Payload        json.RawMessage `json:"payload" swaggertype:"object"`
+	Attempts       int             `json:"attempts"`
+	LastError      string          `json:"last_error"`
+	FailedAt       time.Time       `json:"failed_at"`
+}
+
+// enqueueWebhookDeliveries queues deliveries of membership events to every matching subscription.
+// It runs in the transaction making the change, so events are only delivered once the change is committed.
+func enqueueWebhookDeliveries(ctx context.Context, conn execer, eventType string, eventIDs, slugs, payloads []string, log *slog.Logger) error {
+	query := `insert into webhook_deliveries (subscription_id, event_id, payload)
+			  select ws.id, e.event_id, e.payload::jsonb
+			  from unnest($1::text[], $2::text[], $3::text[]) with ordinality as e(event_id, segment, payload, n)
+			  join webhook_subscriptions ws
+				on (cardinality(ws.events) = 0 or $4 = any(ws.events))
+			   and (cardinality(ws.segments) = 0 or e.segment = any(ws.segments))
+			  order by e.n, ws.id`
+	if _, err := conn.Exec(ctx, query, eventIDs, slugs, payloads, eventType); err != nil {
+		log.Error("failed to enqueue webhook deliveries", logger.Err(err))
+		return fmt.Errorf("failed to enqueue webhook deliveries")
+	}
+	return nil
+}
+
+func (pg *PostgresDB) AddWebhookSubscription(ctx context.Context, subscription WebhookSubscription, log *slog.Logger) (WebhookSubscription, error) {
+	err := pg.acquire(ctx, func(ctx context.Context, conn *pgxpool.Conn) error {
+		if err := pg.Ping(ctx); err != nil {
+			log.Error("failed to ping db", logger.Err(err))
+			return newError(ErrUnavailable, "failed to ping db")
+		}
+		query := `insert into webhook_subscriptions (url, secret, events, segments)
+				  values ($1, $2, $3, $4)
+				  returning id, created_at`
+		if subscription.Events == nil {
+			subscription.Events = []string{}
+		}
+		if subscription.Segments == nil {
+			subscription.Segments = []string{}
+		}
+		if err := conn.QueryRow(ctx, query, subscription.URL, subscription.Secret, subscription.Events, subscription.Segments).
+			Scan(&subscription.Id, &subscription.CreatedAt); err != nil {
+			log.Error("failed to insert data", logger.Err(err))
+			return fmt.Errorf("failed to insert data")
+		}
+		return nil
+	})
+	if err != nil {
+		return subscription, err
+	}
+	return subscription, nil
+}
+
+// GetWebhookSubscriptions lists all subscriptions without their secrets.
+func (pg *PostgresDB) GetWebhookSubscriptions(ctx context.Context, log *slog.Logger) ([]WebhookSubscription, error) {
+	res := make([]WebhookSubscription, 0)
+	err := pg.acquire(ctx, func(ctx context.Context, conn *pgxpool.Conn) error {
+		if err := pg.Ping(ctx); err != nil {
+			log.Error("failed to ping db", logger.Err(err))
+			return newError(ErrUnavailable, "failed to ping db")
+		}
+		query := `select id, url, events, segments, created_at from webhook_subscriptions order by id`
+		rows, err := conn.Query(ctx, query)
+		if err != nil {
+			log.Error("failed to get data", logger.Err(err))
+			return fmt.Errorf("failed to get data")
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var subscription WebhookSubscription
+			if err = rows.Scan(&subscription.Id, &subscription.URL, &subscription.Events, &subscription.Segments, &subscription.CreatedAt); err != nil {
+				log.Error("failed to scan subscription", logger.Err(err))
+				return fmt.Errorf("failed to scan subscription")
+			}
+			res = append(res, subscription)
+		}
+		if err = rows.Err(); err != nil {
+			log.Error("error occurred while reading", logger.Err(err))
+			return fmt.Errorf("error occurred while reading")
+		}
+		return nil
+	})
+	if err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+// DeleteWebhookSubscription removes a subscription together with its pending deliveries and dead letters.
+func (pg *PostgresDB) DeleteWebhookSubscription(ctx context.Context, id uint64, log *slog.Logger) error {
+	err := pg.acquire(ctx, func(ctx context.Context, conn *pgxpool.Conn) error {
+		if err := pg.Ping(ctx); err != nil {
+			log.Error("failed to ping db", logger.Err(err))
+			return newError(ErrUnavailable, "failed to ping db")
+		}
+		query := `delete from webhook_subscriptions where id = $1`
+		if res, err := conn.Exec(ctx, query, id); err != nil {
+			log.Error("failed to delete subscription", logger.Err(err))
+			return fmt.Errorf("failed to delete subscription")
+		} else if res.RowsAffected() < 1 {
+			log.Error(fmt.Sprintf("webhook subscription '%d' doesn't exist", id))
+			return newError(ErrNotFound, "webhook subscription '%d' doesn't exist", id)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// GetWebhookDeadLetters lists deliveries to the subscription that were given up, the most recent first.
+func (pg *PostgresDB) GetWebhookDeadLetters(ctx context.Context, subscriptionID uint64, log *slog.Logger) ([]WebhookDeadLetter, error) {
+	res := make([]WebhookDeadLetter, 0)
+	err := pg.acquire(ctx, func(ctx context.Context, conn *pgxpool.Conn) error {
+		if err := pg.Ping(ctx); err != nil {
+			log.Error("failed to ping db", logger.Err(err))
+			return newError(ErrUnavailable, "failed to ping db")
+		}
+		queryCheck := `select id from webhook_subscriptions where id = $1`
+		query := `select id, subscription_id, event_id, payload, attempts, coalesce(last_error, ''), failed_at
+				  from webhook_dead_letters
+				  where subscription_id = $1
+				  order by failed_at desc
+				  limit 1000`
+		if err := conn.QueryRow(ctx, queryCheck, subscriptionID).Scan(&subscriptionID); err != nil {
+			log.Error(fmt.Sprintf("webhook subscription '%d' doesn't exist", subscriptionID), logger.Err(err))
+			return newError(ErrNotFound, "webhook subscription '%d' doesn't exist", subscriptionID)
+		}
+		rows, err := conn.Query(ctx, query, subscriptionID)
+		if err != nil {
+			log.Error("failed to get data", logger.Err(err))
+			return fmt.Errorf("failed to get data")
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var letter WebhookDeadLetter
+			if err = rows.Scan(&letter.Id, &letter.SubscriptionID, &letter.EventID, &letter.Payload, &letter.Attempts, &letter.LastError, &letter.FailedAt); err != nil {
+				log.Error("failed to scan dead letter", logger.Err(err))
+				return fmt.Errorf("failed to scan dead letter")
+			}
+			res = append(res, letter)
+		}
+		if err = rows.Err(); err != nil {
+			log.Error("error occurred while reading", logger.Err(err))
+			return fmt.Errorf("error occurred while reading")
+		}
+		return nil
+	})
+	if err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+// ClaimWebhookDeliveries takes up to limit deliveries that are due and hides them from other workers for lease,
+// so a delivery whose worker died is retried once the lease runs out. Attempts of the returned deliveries
+// already include the attempt being made.
+func (pg *PostgresDB) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration, log *slog.Logger) ([]WebhookDelivery, error) {
+	var res []WebhookDelivery
+	err := pg.acquire(ctx, func(ctx context.Context, conn *pgxpool.Conn) error {
+		query := `with due as (
+					  select id from webhook_deliveries
+					  where next_attempt_at <= NOW()
+					  order by next_attempt_at
+					  limit $1
+					  for update skip locked
+				  )
+				  update webhook_deliveries d
+				  set attempts = d.attempts + 1, next_attempt_at = NOW() + make_interval(secs => $2)
+				  from due, webhook_subscriptions s
+				  where d.id = due.id and s.id = d.subscription_id
+				  returning d.id, d.subscription_id, s.url, s.secret, d.event_id, d.payload, d.attempts`
+		rows, err := conn.Query(ctx, query, limit, lease.Seconds())
+		if err != nil {
+			log.Error("failed to claim webhook deliveries", logger.Err(err))
+			return fmt.Errorf("failed to claim webhook deliveries")
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var delivery WebhookDelivery
+			if err = rows.Scan(&delivery.Id, &delivery.SubscriptionID, &delivery.URL, &delivery.Secret,
+				&delivery.EventID, &delivery.Payload, &delivery.Attempts); err != nil {
+				log.Error("failed to scan webhook delivery", logger.Err(err))
+				return fmt.Errorf("failed to scan webhook delivery")
+			}
+			res = append(res, delivery)
+		}
+		if err = rows.Err(); err != nil {
+			log.Error("error occurred while reading", logger.Err(err))
+			return fmt.Errorf("error occurred while reading")
+		}
+		return nil
+	})
+	if err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+// CompleteWebhookDelivery forgets a delivery accepted by the subscriber.
+func (pg *PostgresDB) CompleteWebhookDelivery(ctx context.Context, id uint64, log *slog.Logger) error {
+	err := pg.acquire(ctx, func(ctx context.Context, conn *pgxpool.Conn) error {
+		query := `delete from webhook_deliveries where id = $1`
+		if _, err := conn.Exec(ctx, query, id); err != nil {
+			log.Error("failed to complete webhook delivery", logger.Err(err))
+			return fmt.Errorf("failed to complete webhook delivery")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// RetryWebhookDelivery schedules the next attempt of a failed delivery.
+func (pg *PostgresDB) RetryWebhookDelivery(ctx context.Context, id uint64, next time.Time, lastError string, log *slog.Logger) error {
+	err := pg.acquire(ctx, func(ctx context.Context, conn *pgxpool.Conn) error {
+		query := `update webhook_deliveries set next_attempt_at = $2, last_error = $3 where id = $1`
+		if _, err := conn.Exec(ctx, query, id, next, lastError); err != nil {
+			log.Error("failed to reschedule webhook delivery", logger.Err(err))
+			return fmt.Errorf("failed to reschedule webhook delivery")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// DeadLetterWebhookDelivery moves a delivery that ran out of attempts to the dead letter table.
+func (pg *PostgresDB) DeadLetterWebhookDelivery(ctx context.Context, id uint64, lastError string, log *slog.Logger) error {
+	err := pg.acquire(ctx, func(ctx context.Context, conn *pgxpool.Conn) error {
+		query := `with failed as (
+					  delete from webhook_deliveries where id = $1
+					  returning subscription_id, event_id, payload, attempts
+				  )
+				  insert into webhook_dead_letters (subscription_id, event_id, payload, attempts, last_error)
+				  select subscription_id, event_id, payload, attempts, $2 from failed`
+		if _, err := conn.Exec(ctx, query, id, lastError); err != nil {
+			log.Error("failed to dead letter webhook delivery", logger.Err(err))
+			return fmt.Errorf("failed to dead letter webhook delivery")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return nil
+}
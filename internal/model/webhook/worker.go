@@ -0,0 +1,202 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/vlasashk/user-segmentation/internal/model/logger"
+	"github.com/vlasashk/user-segmentation/internal/model/storage"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// EventIDHeader carries the event id, receivers should use it to drop duplicate deliveries.
+	EventIDHeader = "X-Webhook-Id"
+	// TimestampHeader carries the unix time the delivery was signed at.
+	TimestampHeader = "X-Webhook-Timestamp"
+	// SignatureHeader carries "sha256=" followed by the hex HMAC-SHA256 of "<timestamp>.<body>"
+	// keyed with the subscription secret.
+	SignatureHeader = "X-Webhook-Signature"
+
+	defaultMaxAttempts  = 8
+	defaultTimeout      = 10 * time.Second
+	defaultPollInterval = time.Second
+	defaultBatchSize    = 50
+	minBackoff          = 10 * time.Second
+	maxBackoff          = time.Hour
+)
+
+// Store is the storage the worker takes deliveries from.
+type Store interface {
+	ClaimWebhookDeliveries(context.Context, int, time.Duration, *slog.Logger) ([]storage.WebhookDelivery, error)
+	CompleteWebhookDelivery(context.Context, uint64, *slog.Logger) error
+	RetryWebhookDelivery(context.Context, uint64, time.Time, string, *slog.Logger) error
+	DeadLetterWebhookDelivery(context.Context, uint64, string, *slog.Logger) error
+}
+
+// Config tunes the delivery worker.
+type Config struct {
+	// MaxAttempts is how many times a delivery is tried before it is dead lettered.
+	MaxAttempts int
+	// Timeout bounds a single delivery attempt.
+	Timeout time.Duration
+	// PollInterval is how often due deliveries are looked up.
+	PollInterval time.Duration
+}
+
+// ConfigFromEnv reads WEBHOOK_MAX_ATTEMPTS, WEBHOOK_TIMEOUT and WEBHOOK_POLL_INTERVAL.
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{
+		MaxAttempts:  defaultMaxAttempts,
+		Timeout:      defaultTimeout,
+		PollInterval: defaultPollInterval,
+	}
+	var err error
+	if v := os.Getenv("WEBHOOK_MAX_ATTEMPTS"); v != "" {
+		if cfg.MaxAttempts, err = strconv.Atoi(v); err != nil || cfg.MaxAttempts <= 0 {
+			return cfg, fmt.Errorf("invalid WEBHOOK_MAX_ATTEMPTS %q", v)
+		}
+	}
+	if v := os.Getenv("WEBHOOK_TIMEOUT"); v != "" {
+		if cfg.Timeout, err = time.ParseDuration(v); err != nil || cfg.Timeout <= 0 {
+			return cfg, fmt.Errorf("invalid WEBHOOK_TIMEOUT %q", v)
+		}
+	}
+	if v := os.Getenv("WEBHOOK_POLL_INTERVAL"); v != "" {
+		if cfg.PollInterval, err = time.ParseDuration(v); err != nil || cfg.PollInterval <= 0 {
+			return cfg, fmt.Errorf("invalid WEBHOOK_POLL_INTERVAL %q", v)
+		}
+	}
+	return cfg, nil
+}
+
+// Worker posts queued events to subscribers. Several workers, in one or many instances,
+// can run against the same storage, each delivery is claimed by one of them at a time.
+type Worker struct {
+	store  Store
+	client *http.Client
+	log    *slog.Logger
+	cfg    Config
+}
+
+func NewWorker(store Store, log *slog.Logger, cfg Config) *Worker {
+	return &Worker{
+		store:  store,
+		client: &http.Client{Timeout: cfg.Timeout},
+		log:    log.With(slog.String("component", "webhook_worker")),
+		cfg:    cfg,
+	}
+}
+
+// Run delivers events until ctx is done.
+func (w *Worker) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.cfg.PollInterval)
+	defer ticker.Stop()
+	for {
+		// Keep going without waiting while there is a backlog.
+		if w.deliverBatch(ctx) == defaultBatchSize && ctx.Err() == nil {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// deliverBatch delivers the deliveries that are due and returns how many were claimed.
+func (w *Worker) deliverBatch(ctx context.Context) int {
+	// The lease outlives the attempt, so the delivery isn't claimed again while it is in flight.
+	// The whole batch shares the lease, so its deliveries are sent concurrently.
+	deliveries, err := w.store.ClaimWebhookDeliveries(ctx, defaultBatchSize, w.cfg.Timeout+minBackoff, w.log)
+	if err != nil {
+		return 0
+	}
+	var wg sync.WaitGroup
+	for _, delivery := range deliveries {
+		wg.Add(1)
+		go func(delivery storage.WebhookDelivery) {
+			defer wg.Done()
+			w.deliver(ctx, delivery)
+		}(delivery)
+	}
+	wg.Wait()
+	return len(deliveries)
+}
+
+func (w *Worker) deliver(ctx context.Context, delivery storage.WebhookDelivery) {
+	log := w.log.With(
+		slog.Uint64("delivery_id", delivery.Id),
+		slog.Uint64("subscription_id", delivery.SubscriptionID),
+		slog.String("event_id", delivery.EventID),
+		slog.Int("attempt", delivery.Attempts),
+	)
+	var storeErr error
+	err := w.post(ctx, delivery)
+	switch {
+	case err == nil:
+		log.Info("webhook delivered")
+		storeErr = w.store.CompleteWebhookDelivery(ctx, delivery.Id, log)
+	case delivery.Attempts >= w.cfg.MaxAttempts:
+		log.Error("webhook delivery failed, giving up", logger.Err(err))
+		storeErr = w.store.DeadLetterWebhookDelivery(ctx, delivery.Id, err.Error(), log)
+	default:
+		next := time.Now().Add(Backoff(delivery.Attempts))
+		log.Warn("webhook delivery failed, retrying", logger.Err(err), slog.Time("next_attempt_at", next))
+		storeErr = w.store.RetryWebhookDelivery(ctx, delivery.Id, next, err.Error(), log)
+	}
+	if storeErr != nil {
+		// The delivery is claimed again once its lease expires.
+		log.Error("failed to record webhook delivery result", logger.Err(storeErr))
+	}
+}
+
+func (w *Worker) post(ctx context.Context, delivery storage.WebhookDelivery) error {
+	timestamp := time.Now().Unix()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventIDHeader, delivery.EventID)
+	req.Header.Set(TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(SignatureHeader, "sha256="+Sign(delivery.Secret, timestamp, delivery.Payload))
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("subscriber responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Sign returns the hex HMAC-SHA256 of "<timestamp>.<body>" keyed with secret.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Backoff returns the delay before the attempt following the given one: 10s doubling up to an hour.
+func Backoff(attempt int) time.Duration {
+	delay := minBackoff
+	for i := 1; i < attempt && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxBackoff)
+}
@@ -0,0 +1,209 @@
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/vlasashk/user-segmentation/internal/model/storage"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+var discardLog = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+const testSecret = "0123456789abcdef"
+
+func TestSign(t *testing.T) {
+	// HMAC-SHA256 of `1693562400.{"id":"1"}` keyed with testSecret.
+	want := "2cf3ba382dc37274d73140c16552de880892f5c2b98176b1dd920d4aa9850f47"
+	if got := Sign(testSecret, 1693562400, []byte(`{"id":"1"}`)); got != want {
+		t.Errorf("Sign() = %s, want %s", got, want)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{4, 80 * time.Second},
+		{9, 2560 * time.Second},
+		{10, time.Hour},
+		{100, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := Backoff(tt.attempt); got != tt.want {
+			t.Errorf("Backoff(%d) = %v, want %v", tt.attempt, got, tt.want)
+		}
+	}
+}
+
+// fakeStore hands out the queued deliveries once and records what happened to them.
+type fakeStore struct {
+	mu         sync.Mutex
+	queued     []storage.WebhookDelivery
+	completed  []uint64
+	retries    map[uint64]time.Time
+	deadLetter map[uint64]string
+}
+
+func newFakeStore(deliveries ...storage.WebhookDelivery) *fakeStore {
+	return &fakeStore{queued: deliveries, retries: make(map[uint64]time.Time), deadLetter: make(map[uint64]string)}
+}
+
+func (s *fakeStore) ClaimWebhookDeliveries(context.Context, int, time.Duration, *slog.Logger) ([]storage.WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	claimed := s.queued
+	s.queued = nil
+	return claimed, nil
+}
+
+func (s *fakeStore) CompleteWebhookDelivery(_ context.Context, id uint64, _ *slog.Logger) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.completed = append(s.completed, id)
+	return nil
+}
+
+func (s *fakeStore) RetryWebhookDelivery(_ context.Context, id uint64, next time.Time, _ string, _ *slog.Logger) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retries[id] = next
+	return nil
+}
+
+func (s *fakeStore) DeadLetterWebhookDelivery(_ context.Context, id uint64, lastError string, _ *slog.Logger) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deadLetter[id] = lastError
+	return nil
+}
+
+// newSubscriber starts a subscriber answering with status and checking the signature of every request.
+func newSubscriber(t *testing.T, status int) (*httptest.Server, *sync.Map) {
+	t.Helper()
+	received := &sync.Map{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		timestamp := r.Header.Get(TimestampHeader)
+		if _, err := strconv.ParseInt(timestamp, 10, 64); err != nil {
+			t.Errorf("%s = %q, want unix time", TimestampHeader, timestamp)
+		}
+		mac := hmac.New(sha256.New, []byte(testSecret))
+		mac.Write([]byte(timestamp + "." + string(body)))
+		want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		if got := r.Header.Get(SignatureHeader); !hmac.Equal([]byte(got), []byte(want)) {
+			t.Errorf("%s = %q, want %q", SignatureHeader, got, want)
+		}
+		received.Store(r.Header.Get(EventIDHeader), string(body))
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, received
+}
+
+func TestWorkerDelivers(t *testing.T) {
+	srv, received := newSubscriber(t, http.StatusNoContent)
+	store := newFakeStore(storage.WebhookDelivery{Id: 1, URL: srv.URL, Secret: testSecret, EventID: "event-1", Payload: []byte(`{"id":"event-1"}`), Attempts: 1})
+	worker := NewWorker(store, discardLog, Config{MaxAttempts: 3, Timeout: time.Second, PollInterval: time.Second})
+	if n := worker.deliverBatch(context.Background()); n != 1 {
+		t.Fatalf("deliverBatch() = %d, want 1", n)
+	}
+	if body, ok := received.Load("event-1"); !ok || body != `{"id":"event-1"}` {
+		t.Errorf("subscriber received %v, want the payload", body)
+	}
+	if len(store.completed) != 1 || store.completed[0] != 1 || len(store.retries) != 0 || len(store.deadLetter) != 0 {
+		t.Errorf("delivery completed %v, retried %v, dead lettered %v, want it completed", store.completed, store.retries, store.deadLetter)
+	}
+}
+
+func TestWorkerRetriesWithBackoff(t *testing.T) {
+	srv, _ := newSubscriber(t, http.StatusInternalServerError)
+	var deliveries []storage.WebhookDelivery
+	for attempt := 1; attempt <= 3; attempt++ {
+		deliveries = append(deliveries, storage.WebhookDelivery{
+			Id: uint64(attempt), URL: srv.URL, Secret: testSecret, EventID: "event-" + strconv.Itoa(attempt), Attempts: attempt,
+		})
+	}
+	store := newFakeStore(deliveries...)
+	worker := NewWorker(store, discardLog, Config{MaxAttempts: 5, Timeout: time.Second, PollInterval: time.Second})
+	start := time.Now()
+	worker.deliverBatch(context.Background())
+	end := time.Now()
+	if len(store.completed) != 0 || len(store.deadLetter) != 0 || len(store.retries) != len(deliveries) {
+		t.Fatalf("deliveries completed %v, retried %v, dead lettered %v, want all retried", store.completed, store.retries, store.deadLetter)
+	}
+	for _, delivery := range deliveries {
+		next := store.retries[delivery.Id]
+		backoff := Backoff(delivery.Attempts)
+		if next.Before(start.Add(backoff)) || next.After(end.Add(backoff)) {
+			t.Errorf("attempt %d retried at %v, want %v after the attempt", delivery.Attempts, next.Sub(start), backoff)
+		}
+	}
+}
+
+func TestWorkerDeadLetters(t *testing.T) {
+	srv, _ := newSubscriber(t, http.StatusBadGateway)
+	store := newFakeStore(storage.WebhookDelivery{Id: 1, URL: srv.URL, Secret: testSecret, EventID: "event-1", Attempts: 3})
+	worker := NewWorker(store, discardLog, Config{MaxAttempts: 3, Timeout: time.Second, PollInterval: time.Second})
+	worker.deliverBatch(context.Background())
+	if lastError, ok := store.deadLetter[1]; !ok || lastError != "subscriber responded with status 502" {
+		t.Errorf("dead letter = %q, %v, want the last error", lastError, ok)
+	}
+	if len(store.retries) != 0 || len(store.completed) != 0 {
+		t.Errorf("delivery retried %v, completed %v, want it dead lettered only", store.retries, store.completed)
+	}
+}
+
+// TestWorkerMemoryStore delivers the events queued by the memory storage, including the removals
+// of the members of a deleted segment.
+func TestWorkerMemoryStore(t *testing.T) {
+	srv, received := newSubscriber(t, http.StatusOK)
+	ctx := context.Background()
+	store := storage.NewMemoryDB()
+	if _, err := store.AddWebhookSubscription(ctx, storage.WebhookSubscription{URL: srv.URL, Secret: testSecret, Segments: []string{"a"}}, discardLog); err != nil {
+		t.Fatalf("AddWebhookSubscription() failed: %v", err)
+	}
+	for _, uid := range []uint64{1, 2} {
+		if _, err := store.AddUser(ctx, storage.User{UID: uid}, discardLog); err != nil {
+			t.Fatalf("AddUser() failed: %v", err)
+		}
+	}
+	if _, err := store.AddSegment(ctx, storage.Segment{Slug: "a"}, discardLog); err != nil {
+		t.Fatalf("AddSegment() failed: %v", err)
+	}
+	for _, uid := range []uint64{1, 2} {
+		if _, err := store.AddUserToSegments(ctx, storage.UserSegments{UserID: uid, SegmentSlug: []string{"a"}}, discardLog); err != nil {
+			t.Fatalf("AddUserToSegments() failed: %v", err)
+		}
+	}
+	if err := store.CascadeDeleteSegment(ctx, storage.Segment{Slug: "a"}, discardLog); err != nil {
+		t.Fatalf("CascadeDeleteSegment() failed: %v", err)
+	}
+	worker := NewWorker(store, discardLog, Config{MaxAttempts: 3, Timeout: time.Second, PollInterval: time.Second})
+	if n := worker.deliverBatch(ctx); n != 4 {
+		t.Fatalf("deliverBatch() = %d, want the two additions and two removals", n)
+	}
+	count := 0
+	received.Range(func(_, _ any) bool {
+		count++
+		return true
+	})
+	if count != 4 {
+		t.Errorf("subscriber received %d events, want 4", count)
+	}
+	if n := worker.deliverBatch(ctx); n != 0 {
+		t.Errorf("deliverBatch() after delivering everything = %d, want 0", n)
+	}
+}
@@ -0,0 +1,9 @@
+// Package initsql embeds the schema migrations of every storage backend.
+package initsql
+
+import "embed"
+
+// Migrations holds the postgres and sqlite migrations, each in the directory named after the backend.
+//
+//go:embed postgres/*.sql sqlite/*.sql
+var Migrations embed.FS
@@ -21,4 +21,4 @@ CREATE TABLE IF NOT EXISTS user_segments
 
 CREATE UNIQUE INDEX IF NOT EXISTS idx_user_segments_not_deleted
     ON user_segments (user_id, segment_id)
-    WHERE deleted_at IS NULL;
\ No newline at end of file
+    WHERE deleted_at IS NULL;
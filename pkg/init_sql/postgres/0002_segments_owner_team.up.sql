@@ -0,0 +1 @@
+ALTER TABLE segments ADD COLUMN owner_team varchar(255);
@@ -0,0 +1,20 @@
+-- Slugs differing only in case have to be renamed or merged by hand before the index can be built.
+DO
+$$
+    DECLARE
+        duplicates TEXT;
+    BEGIN
+        SELECT string_agg(slugs, '; ')
+        INTO duplicates
+        FROM (SELECT string_agg(slug, ', ' ORDER BY slug) AS slugs
+              FROM segments
+              GROUP BY lower(slug)
+              HAVING count(*) > 1) AS d;
+        IF duplicates IS NOT NULL THEN
+            RAISE EXCEPTION 'segment slugs differ only in case, rename or merge them first: %', duplicates;
+        END IF;
+    END
+$$;
+
+CREATE UNIQUE INDEX idx_segments_slug_lower
+    ON segments (lower(slug));
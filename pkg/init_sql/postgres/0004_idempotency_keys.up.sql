@@ -0,0 +1,16 @@
+CREATE TABLE idempotency_keys
+(
+    caller          varchar(255) NOT NULL,
+    key             varchar(255) NOT NULL,
+    request_hash    char(64)     NOT NULL,
+    token           char(32)     NOT NULL,
+    status_code     INT,
+    content_type    varchar(255),
+    response_header JSONB,
+    response_body   BYTEA,
+    created_at      TIMESTAMP    NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (caller, key)
+);
+
+CREATE INDEX idx_idempotency_keys_created_at
+    ON idempotency_keys (created_at);
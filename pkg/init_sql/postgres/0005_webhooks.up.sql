@@ -0,0 +1,38 @@
+CREATE TABLE webhook_subscriptions
+(
+    id         BIGSERIAL PRIMARY KEY,
+    url        TEXT      NOT NULL,
+    secret     TEXT      NOT NULL,
+    events     TEXT[]    NOT NULL DEFAULT '{}',
+    segments   TEXT[]    NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE webhook_deliveries
+(
+    id              BIGSERIAL PRIMARY KEY,
+    subscription_id BIGINT REFERENCES webhook_subscriptions (id) ON DELETE CASCADE NOT NULL,
+    event_id        char(32)  NOT NULL,
+    payload         JSONB     NOT NULL,
+    attempts        INT       NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    last_error      TEXT,
+    created_at      TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_webhook_deliveries_next_attempt_at
+    ON webhook_deliveries (next_attempt_at);
+
+CREATE TABLE webhook_dead_letters
+(
+    id              BIGSERIAL PRIMARY KEY,
+    subscription_id BIGINT REFERENCES webhook_subscriptions (id) ON DELETE CASCADE NOT NULL,
+    event_id        char(32)  NOT NULL,
+    payload         JSONB     NOT NULL,
+    attempts        INT       NOT NULL,
+    last_error      TEXT,
+    failed_at       TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_webhook_dead_letters_subscription_id
+    ON webhook_dead_letters (subscription_id, failed_at);
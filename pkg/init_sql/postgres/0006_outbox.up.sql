@@ -0,0 +1,18 @@
+CREATE TABLE outbox
+(
+    id           BIGSERIAL PRIMARY KEY,
+    event_id     char(32)    NOT NULL,
+    type         varchar(64) NOT NULL,
+    user_id      BIGINT,
+    segment      varchar(255),
+    payload      JSONB       NOT NULL,
+    created_at   TIMESTAMP   NOT NULL DEFAULT NOW(),
+    published_at TIMESTAMP
+);
+
+CREATE INDEX idx_outbox_unpublished
+    ON outbox (id)
+    WHERE published_at IS NULL;
+
+CREATE INDEX idx_outbox_created_at
+    ON outbox (created_at);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_outbox_txid;
+ALTER TABLE outbox DROP COLUMN txid;
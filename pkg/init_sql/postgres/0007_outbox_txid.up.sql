@@ -0,0 +1,4 @@
+ALTER TABLE outbox ADD COLUMN txid xid8 NOT NULL DEFAULT pg_current_xact_id();
+
+CREATE INDEX idx_outbox_txid
+    ON outbox (txid, id);
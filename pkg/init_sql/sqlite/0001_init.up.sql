@@ -0,0 +1,24 @@
+CREATE TABLE IF NOT EXISTS users
+(
+    "id"      INTEGER PRIMARY KEY AUTOINCREMENT,
+    "user_id" INTEGER NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS segments
+(
+    "id"   INTEGER PRIMARY KEY AUTOINCREMENT,
+    "slug" varchar(255) NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS user_segments
+(
+    user_id    INTEGER REFERENCES users (id) ON DELETE CASCADE NOT NULL,
+    segment_id INTEGER REFERENCES segments (id) ON DELETE CASCADE NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    deleted_at TIMESTAMP,
+    PRIMARY KEY (user_id, segment_id)
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_user_segments_not_deleted
+    ON user_segments (user_id, segment_id)
+    WHERE deleted_at IS NULL;
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS idx_segments_slug_lower;
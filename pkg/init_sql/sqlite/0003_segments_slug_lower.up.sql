@@ -0,0 +1,24 @@
+-- Slugs differing only in case have to be renamed or merged by hand before the index can be built.
+-- sqlite raises errors only from triggers, so the check inserts the duplicates into a table aborting on insert.
+CREATE TEMP TABLE segments_slug_duplicates
+(
+    slug TEXT
+);
+
+CREATE TEMP TRIGGER segments_slug_duplicates_abort
+    BEFORE INSERT
+    ON segments_slug_duplicates
+BEGIN
+    SELECT RAISE(ABORT, 'segment slugs differ only in case, rename or merge them first: SELECT lower(slug), group_concat(slug) FROM segments GROUP BY lower(slug) HAVING count(*) > 1');
+END;
+
+INSERT INTO segments_slug_duplicates (slug)
+SELECT lower(slug)
+FROM segments
+GROUP BY lower(slug)
+HAVING count(*) > 1;
+
+DROP TABLE segments_slug_duplicates;
+
+CREATE UNIQUE INDEX idx_segments_slug_lower
+    ON segments (lower(slug));
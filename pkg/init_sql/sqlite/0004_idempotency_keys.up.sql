@@ -0,0 +1,16 @@
+CREATE TABLE idempotency_keys
+(
+    caller          varchar(255) NOT NULL,
+    key             varchar(255) NOT NULL,
+    request_hash    char(64)     NOT NULL,
+    token           char(32)     NOT NULL,
+    status_code     INTEGER,
+    content_type    varchar(255),
+    response_header TEXT,
+    response_body   BLOB,
+    created_at      TIMESTAMP    NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    PRIMARY KEY (caller, key)
+);
+
+CREATE INDEX idx_idempotency_keys_created_at
+    ON idempotency_keys (created_at);
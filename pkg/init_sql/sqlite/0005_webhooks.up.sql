@@ -0,0 +1,39 @@
+-- events and segments are json arrays of strings.
+CREATE TABLE webhook_subscriptions
+(
+    id         INTEGER PRIMARY KEY AUTOINCREMENT,
+    url        TEXT      NOT NULL,
+    secret     TEXT      NOT NULL,
+    events     TEXT      NOT NULL DEFAULT '[]',
+    segments   TEXT      NOT NULL DEFAULT '[]',
+    created_at TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now'))
+);
+
+CREATE TABLE webhook_deliveries
+(
+    id              INTEGER PRIMARY KEY AUTOINCREMENT,
+    subscription_id INTEGER REFERENCES webhook_subscriptions (id) ON DELETE CASCADE NOT NULL,
+    event_id        char(32)  NOT NULL,
+    payload         TEXT      NOT NULL,
+    attempts        INTEGER   NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    last_error      TEXT,
+    created_at      TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now'))
+);
+
+CREATE INDEX idx_webhook_deliveries_next_attempt_at
+    ON webhook_deliveries (next_attempt_at);
+
+CREATE TABLE webhook_dead_letters
+(
+    id              INTEGER PRIMARY KEY AUTOINCREMENT,
+    subscription_id INTEGER REFERENCES webhook_subscriptions (id) ON DELETE CASCADE NOT NULL,
+    event_id        char(32)  NOT NULL,
+    payload         TEXT      NOT NULL,
+    attempts        INTEGER   NOT NULL,
+    last_error      TEXT,
+    failed_at       TIMESTAMP NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now'))
+);
+
+CREATE INDEX idx_webhook_dead_letters_subscription_id
+    ON webhook_dead_letters (subscription_id, failed_at);
@@ -0,0 +1,19 @@
+-- Writes to sqlite are serialized, so ids of committed events only grow.
+CREATE TABLE outbox
+(
+    id           INTEGER PRIMARY KEY AUTOINCREMENT,
+    event_id     char(32)    NOT NULL,
+    type         varchar(64) NOT NULL,
+    user_id      INTEGER,
+    segment      varchar(255),
+    payload      TEXT        NOT NULL,
+    created_at   TIMESTAMP   NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')),
+    published_at TIMESTAMP
+);
+
+CREATE INDEX idx_outbox_unpublished
+    ON outbox (id)
+    WHERE published_at IS NULL;
+
+CREATE INDEX idx_outbox_created_at
+    ON outbox (created_at);
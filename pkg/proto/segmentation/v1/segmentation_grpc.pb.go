@@ -0,0 +1,470 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             v4.24.4
+// source: segmentation/v1/segmentation.proto
+
+package segmentationv1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	SegmentationService_AddUser_FullMethodName                = "/segmentation.v1.SegmentationService/AddUser"
+	SegmentationService_AddSegment_FullMethodName             = "/segmentation.v1.SegmentationService/AddSegment"
+	SegmentationService_DeleteSegment_FullMethodName          = "/segmentation.v1.SegmentationService/DeleteSegment"
+	SegmentationService_AddUserToSegments_FullMethodName      = "/segmentation.v1.SegmentationService/AddUserToSegments"
+	SegmentationService_DeleteUserFromSegments_FullMethodName = "/segmentation.v1.SegmentationService/DeleteUserFromSegments"
+	SegmentationService_GetUserSegments_FullMethodName        = "/segmentation.v1.SegmentationService/GetUserSegments"
+	SegmentationService_GetUsersSegments_FullMethodName       = "/segmentation.v1.SegmentationService/GetUsersSegments"
+	SegmentationService_GetMemberships_FullMethodName         = "/segmentation.v1.SegmentationService/GetMemberships"
+	SegmentationService_GetSegmentUsers_FullMethodName        = "/segmentation.v1.SegmentationService/GetSegmentUsers"
+	SegmentationService_CreateReport_FullMethodName           = "/segmentation.v1.SegmentationService/CreateReport"
+)
+
+// SegmentationServiceClient is the client API for SegmentationService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type SegmentationServiceClient interface {
+	// AddUser adds a new user. Requires manager role.
+	AddUser(ctx context.Context, in *AddUserRequest, opts ...grpc.CallOption) (*AddUserResponse, error)
+	// AddSegment adds a new segment owned by the caller's team. Requires manager role.
+	AddSegment(ctx context.Context, in *AddSegmentRequest, opts ...grpc.CallOption) (*AddSegmentResponse, error)
+	// DeleteSegment permanently deletes a segment and all of its memberships. Requires manager role.
+	DeleteSegment(ctx context.Context, in *DeleteSegmentRequest, opts ...grpc.CallOption) (*DeleteSegmentResponse, error)
+	// AddUserToSegments adds a user to all listed segments, none of them are added if any of them fails.
+	// Requires manager role.
+	AddUserToSegments(ctx context.Context, in *AddUserToSegmentsRequest, opts ...grpc.CallOption) (*AddUserToSegmentsResponse, error)
+	// DeleteUserFromSegments removes a user from all listed segments. Requires manager role.
+	DeleteUserFromSegments(ctx context.Context, in *DeleteUserFromSegmentsRequest, opts ...grpc.CallOption) (*DeleteUserFromSegmentsResponse, error)
+	// GetUserSegments lists segments the user is a member of. Requires reader role.
+	GetUserSegments(ctx context.Context, in *GetUserSegmentsRequest, opts ...grpc.CallOption) (*GetUserSegmentsResponse, error)
+	// GetUsersSegments lists segments of each of the given users, users that don't exist are left out.
+	// Requires reader role.
+	GetUsersSegments(ctx context.Context, in *GetUsersSegmentsRequest, opts ...grpc.CallOption) (*GetUsersSegmentsResponse, error)
+	// GetMemberships tells whether a user is a member of each of the given segments and since when.
+	// Requires reader role.
+	GetMemberships(ctx context.Context, in *GetMembershipsRequest, opts ...grpc.CallOption) (*GetMembershipsResponse, error)
+	// GetSegmentUsers lists members of a segment. Requires reader role.
+	GetSegmentUsers(ctx context.Context, in *GetSegmentUsersRequest, opts ...grpc.CallOption) (*GetSegmentUsersResponse, error)
+	// CreateReport generates the membership history report for a month and returns a signed link
+	// to download it over HTTP. Requires admin role.
+	CreateReport(ctx context.Context, in *CreateReportRequest, opts ...grpc.CallOption) (*CreateReportResponse, error)
+}
+
+type segmentationServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewSegmentationServiceClient(cc grpc.ClientConnInterface) SegmentationServiceClient {
+	return &segmentationServiceClient{cc}
+}
+
+func (c *segmentationServiceClient) AddUser(ctx context.Context, in *AddUserRequest, opts ...grpc.CallOption) (*AddUserResponse, error) {
+	out := new(AddUserResponse)
+	err := c.cc.Invoke(ctx, SegmentationService_AddUser_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *segmentationServiceClient) AddSegment(ctx context.Context, in *AddSegmentRequest, opts ...grpc.CallOption) (*AddSegmentResponse, error) {
+	out := new(AddSegmentResponse)
+	err := c.cc.Invoke(ctx, SegmentationService_AddSegment_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *segmentationServiceClient) DeleteSegment(ctx context.Context, in *DeleteSegmentRequest, opts ...grpc.CallOption) (*DeleteSegmentResponse, error) {
+	out := new(DeleteSegmentResponse)
+	err := c.cc.Invoke(ctx, SegmentationService_DeleteSegment_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *segmentationServiceClient) AddUserToSegments(ctx context.Context, in *AddUserToSegmentsRequest, opts ...grpc.CallOption) (*AddUserToSegmentsResponse, error) {
+	out := new(AddUserToSegmentsResponse)
+	err := c.cc.Invoke(ctx, SegmentationService_AddUserToSegments_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *segmentationServiceClient) DeleteUserFromSegments(ctx context.Context, in *DeleteUserFromSegmentsRequest, opts ...grpc.CallOption) (*DeleteUserFromSegmentsResponse, error) {
+	out := new(DeleteUserFromSegmentsResponse)
+	err := c.cc.Invoke(ctx, SegmentationService_DeleteUserFromSegments_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *segmentationServiceClient) GetUserSegments(ctx context.Context, in *GetUserSegmentsRequest, opts ...grpc.CallOption) (*GetUserSegmentsResponse, error) {
+	out := new(GetUserSegmentsResponse)
+	err := c.cc.Invoke(ctx, SegmentationService_GetUserSegments_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *segmentationServiceClient) GetUsersSegments(ctx context.Context, in *GetUsersSegmentsRequest, opts ...grpc.CallOption) (*GetUsersSegmentsResponse, error) {
+	out := new(GetUsersSegmentsResponse)
+	err := c.cc.Invoke(ctx, SegmentationService_GetUsersSegments_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *segmentationServiceClient) GetMemberships(ctx context.Context, in *GetMembershipsRequest, opts ...grpc.CallOption) (*GetMembershipsResponse, error) {
+	out := new(GetMembershipsResponse)
+	err := c.cc.Invoke(ctx, SegmentationService_GetMemberships_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *segmentationServiceClient) GetSegmentUsers(ctx context.Context, in *GetSegmentUsersRequest, opts ...grpc.CallOption) (*GetSegmentUsersResponse, error) {
+	out := new(GetSegmentUsersResponse)
+	err := c.cc.Invoke(ctx, SegmentationService_GetSegmentUsers_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *segmentationServiceClient) CreateReport(ctx context.Context, in *CreateReportRequest, opts ...grpc.CallOption) (*CreateReportResponse, error) {
+	out := new(CreateReportResponse)
+	err := c.cc.Invoke(ctx, SegmentationService_CreateReport_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// SegmentationServiceServer is the server API for SegmentationService service.
+// All implementations must embed UnimplementedSegmentationServiceServer
+// for forward compatibility
+type SegmentationServiceServer interface {
+	// AddUser adds a new user. Requires manager role.
+	AddUser(context.Context, *AddUserRequest) (*AddUserResponse, error)
+	// AddSegment adds a new segment owned by the caller's team. Requires manager role.
+	AddSegment(context.Context, *AddSegmentRequest) (*AddSegmentResponse, error)
+	// DeleteSegment permanently deletes a segment and all of its memberships. Requires manager role.
+	DeleteSegment(context.Context, *DeleteSegmentRequest) (*DeleteSegmentResponse, error)
+	// AddUserToSegments adds a user to all listed segments, none of them are added if any of them fails.
+	// Requires manager role.
+	AddUserToSegments(context.Context, *AddUserToSegmentsRequest) (*AddUserToSegmentsResponse, error)
+	// DeleteUserFromSegments removes a user from all listed segments. Requires manager role.
+	DeleteUserFromSegments(context.Context, *DeleteUserFromSegmentsRequest) (*DeleteUserFromSegmentsResponse, error)
+	// GetUserSegments lists segments the user is a member of. Requires reader role.
+	GetUserSegments(context.Context, *GetUserSegmentsRequest) (*GetUserSegmentsResponse, error)
+	// GetUsersSegments lists segments of each of the given users, users that don't exist are left out.
+	// Requires reader role.
+	GetUsersSegments(context.Context, *GetUsersSegmentsRequest) (*GetUsersSegmentsResponse, error)
+	// GetMemberships tells whether a user is a member of each of the given segments and since when.
+	// Requires reader role.
+	GetMemberships(context.Context, *GetMembershipsRequest) (*GetMembershipsResponse, error)
+	// GetSegmentUsers lists members of a segment. Requires reader role.
+	GetSegmentUsers(context.Context, *GetSegmentUsersRequest) (*GetSegmentUsersResponse, error)
+	// CreateReport generates the membership history report for a month and returns a signed link
+	// to download it over HTTP. Requires admin role.
+	CreateReport(context.Context, *CreateReportRequest) (*CreateReportResponse, error)
+	mustEmbedUnimplementedSegmentationServiceServer()
+}
+
+// UnimplementedSegmentationServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedSegmentationServiceServer struct {
+}
+
+func (UnimplementedSegmentationServiceServer) AddUser(context.Context, *AddUserRequest) (*AddUserResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddUser not implemented")
+}
+func (UnimplementedSegmentationServiceServer) AddSegment(context.Context, *AddSegmentRequest) (*AddSegmentResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddSegment not implemented")
+}
+func (UnimplementedSegmentationServiceServer) DeleteSegment(context.Context, *DeleteSegmentRequest) (*DeleteSegmentResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteSegment not implemented")
+}
+func (UnimplementedSegmentationServiceServer) AddUserToSegments(context.Context, *AddUserToSegmentsRequest) (*AddUserToSegmentsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddUserToSegments not implemented")
+}
+func (UnimplementedSegmentationServiceServer) DeleteUserFromSegments(context.Context, *DeleteUserFromSegmentsRequest) (*DeleteUserFromSegmentsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteUserFromSegments not implemented")
+}
+func (UnimplementedSegmentationServiceServer) GetUserSegments(context.Context, *GetUserSegmentsRequest) (*GetUserSegmentsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetUserSegments not implemented")
+}
+func (UnimplementedSegmentationServiceServer) GetUsersSegments(context.Context, *GetUsersSegmentsRequest) (*GetUsersSegmentsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetUsersSegments not implemented")
+}
+func (UnimplementedSegmentationServiceServer) GetMemberships(context.Context, *GetMembershipsRequest) (*GetMembershipsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetMemberships not implemented")
+}
+func (UnimplementedSegmentationServiceServer) GetSegmentUsers(context.Context, *GetSegmentUsersRequest) (*GetSegmentUsersResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetSegmentUsers not implemented")
+}
+func (UnimplementedSegmentationServiceServer) CreateReport(context.Context, *CreateReportRequest) (*CreateReportResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateReport not implemented")
+}
+func (UnimplementedSegmentationServiceServer) mustEmbedUnimplementedSegmentationServiceServer() {}
+
+// UnsafeSegmentationServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to SegmentationServiceServer will
+// result in compilation errors.
+type UnsafeSegmentationServiceServer interface {
+	mustEmbedUnimplementedSegmentationServiceServer()
+}
+
+func RegisterSegmentationServiceServer(s grpc.ServiceRegistrar, srv SegmentationServiceServer) {
+	s.RegisterService(&SegmentationService_ServiceDesc, srv)
+}
+
+func _SegmentationService_AddUser_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddUserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SegmentationServiceServer).AddUser(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SegmentationService_AddUser_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SegmentationServiceServer).AddUser(ctx, req.(*AddUserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SegmentationService_AddSegment_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddSegmentRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SegmentationServiceServer).AddSegment(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SegmentationService_AddSegment_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SegmentationServiceServer).AddSegment(ctx, req.(*AddSegmentRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SegmentationService_DeleteSegment_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteSegmentRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SegmentationServiceServer).DeleteSegment(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SegmentationService_DeleteSegment_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SegmentationServiceServer).DeleteSegment(ctx, req.(*DeleteSegmentRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SegmentationService_AddUserToSegments_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddUserToSegmentsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SegmentationServiceServer).AddUserToSegments(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SegmentationService_AddUserToSegments_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SegmentationServiceServer).AddUserToSegments(ctx, req.(*AddUserToSegmentsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SegmentationService_DeleteUserFromSegments_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteUserFromSegmentsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SegmentationServiceServer).DeleteUserFromSegments(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SegmentationService_DeleteUserFromSegments_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SegmentationServiceServer).DeleteUserFromSegments(ctx, req.(*DeleteUserFromSegmentsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SegmentationService_GetUserSegments_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetUserSegmentsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SegmentationServiceServer).GetUserSegments(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SegmentationService_GetUserSegments_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SegmentationServiceServer).GetUserSegments(ctx, req.(*GetUserSegmentsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SegmentationService_GetUsersSegments_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetUsersSegmentsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SegmentationServiceServer).GetUsersSegments(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SegmentationService_GetUsersSegments_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SegmentationServiceServer).GetUsersSegments(ctx, req.(*GetUsersSegmentsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SegmentationService_GetMemberships_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetMembershipsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SegmentationServiceServer).GetMemberships(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SegmentationService_GetMemberships_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SegmentationServiceServer).GetMemberships(ctx, req.(*GetMembershipsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SegmentationService_GetSegmentUsers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetSegmentUsersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SegmentationServiceServer).GetSegmentUsers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SegmentationService_GetSegmentUsers_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SegmentationServiceServer).GetSegmentUsers(ctx, req.(*GetSegmentUsersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SegmentationService_CreateReport_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateReportRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SegmentationServiceServer).CreateReport(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: SegmentationService_CreateReport_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SegmentationServiceServer).CreateReport(ctx, req.(*CreateReportRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// SegmentationService_ServiceDesc is the grpc.ServiceDesc for SegmentationService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var SegmentationService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "segmentation.v1.SegmentationService",
+	HandlerType: (*SegmentationServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "AddUser",
+			Handler:    _SegmentationService_AddUser_Handler,
+		},
+		{
+			MethodName: "AddSegment",
+			Handler:    _SegmentationService_AddSegment_Handler,
+		},
+		{
+			MethodName: "DeleteSegment",
+			Handler:    _SegmentationService_DeleteSegment_Handler,
+		},
+		{
+			MethodName: "AddUserToSegments",
+			Handler:    _SegmentationService_AddUserToSegments_Handler,
+		},
+		{
+			MethodName: "DeleteUserFromSegments",
+			Handler:    _SegmentationService_DeleteUserFromSegments_Handler,
+		},
+		{
+			MethodName: "GetUserSegments",
+			Handler:    _SegmentationService_GetUserSegments_Handler,
+		},
+		{
+			MethodName: "GetUsersSegments",
+			Handler:    _SegmentationService_GetUsersSegments_Handler,
+		},
+		{
+			MethodName: "GetMemberships",
+			Handler:    _SegmentationService_GetMemberships_Handler,
+		},
+		{
+			MethodName: "GetSegmentUsers",
+			Handler:    _SegmentationService_GetSegmentUsers_Handler,
+		},
+		{
+			MethodName: "CreateReport",
+			Handler:    _SegmentationService_CreateReport_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "segmentation/v1/segmentation.proto",
+}